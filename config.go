@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mahdiz/daga/config"
+	"os"
+)
+
+// daga config check
+func configCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: daga config check [flags]")
+	}
+	switch args[0] {
+	case "check":
+		return configCheck(args[1:])
+	}
+	return errors.New("Unknown config command '" + args[0] + "'")
+}
+
+// Checks node config folders and reports every problem found in them.
+// Without -node or -dir, every profile under the config root is checked.
+func configCheck(args []string) error {
+
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	node := fs.String("node", "", "Name of the node profile to check")
+	dir := fs.String("dir", "", "Config folder to check, instead of a profile")
+	passphraseFile := fs.String("passphrase-file", "", "File containing the passphrase of the private keys (default: $"+config.PASSPHRASE_ENV+")")
+	fs.Parse(args)
+
+	passphrase, err := config.ReadPassphrase(*passphraseFile)
+	if err != nil {
+		return errors.New("Cannot read passphrase. " + err.Error())
+	}
+
+	// Collect the folders to check
+	var dirs []string
+	switch {
+	case *dir != "":
+		dirs = []string{*dir}
+	case *node != "":
+		d, err := config.ConfigDir(*node)
+		if err != nil {
+			return err
+		}
+		dirs = []string{d}
+	default:
+		root := config.ConfigRoot()
+		if root == "" {
+			return errors.New("Give -node or -dir, or a config root (-config-root or $" + config.CONFIG_ROOT_ENV + ") to check every profile")
+		}
+		profiles, err := config.ListProfiles(root)
+		if err != nil {
+			return err
+		}
+		if len(profiles) == 0 {
+			return errors.New("No profile found under " + root)
+		}
+		for _, profile := range profiles {
+			d, err := config.ConfigDir(profile)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, d)
+		}
+	}
+
+	problems := 0
+	for _, d := range dirs {
+		errs := config.CheckDir(d, passphrase)
+		if len(errs) == 0 {
+			fmt.Println(d + ": OK")
+			continue
+		}
+		fmt.Println(d + ":")
+		for _, err := range errs {
+			fmt.Println("  [" + err.Kind.String() + "] " + err.Error())
+		}
+		problems += len(errs)
+	}
+
+	if problems > 0 {
+		fmt.Fprintln(os.Stderr, problems, "problem(s) found")
+		return errors.New("Config check failed")
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+// Where the relay and trustees of a generated deployment listen.
+// Trustee i is advertised on TrusteeHosts[i % len(TrusteeHosts)] at port TrusteeBasePort+i,
+// so several trustees can share a host. Hosts may be IPv4 or IPv6 addresses, or host names.
+type AddressPlan struct {
+	ListenHost      string   // Host the relay and trustees bind to, e.g. "0.0.0.0" or "::" (default: their advertised host)
+	RelayHost       string   // Advertised host of the relay
+	RelayPort       int      // Port of the relay
+	TrusteeHosts    []string // Advertised hosts of the trustees
+	TrusteeBasePort int      // Port of the first trustee
+}
+
+// Returns the listen and advertise addresses of the relay
+func (plan *AddressPlan) RelayAddrs() (listen []string, advertise []string) {
+	return plan.addrs(plan.RelayHost, plan.RelayPort)
+}
+
+// Returns the listen and advertise addresses of the i-th trustee
+func (plan *AddressPlan) TrusteeAddrs(i int) (listen []string, advertise []string) {
+	if len(plan.TrusteeHosts) == 0 {
+		return nil, nil
+	}
+	return plan.addrs(plan.TrusteeHosts[i%len(plan.TrusteeHosts)], plan.TrusteeBasePort+i)
+}
+
+func (plan *AddressPlan) addrs(host string, port int) ([]string, []string) {
+	listenHost := plan.ListenHost
+	if listenHost == "" {
+		listenHost = host
+	}
+	p := strconv.Itoa(port)
+	return []string{net.JoinHostPort(listenHost, p)}, []string{net.JoinHostPort(host, p)}
+}
+
+// Checks that every address is a valid host:port pair.
+// IPv6 hosts must be enclosed in brackets, as in "[::1]:9000".
+func CheckAddrs(addrs []string) error {
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return errors.New("Invalid address '" + addr + "'. " + err.Error())
+		}
+		if host == "" && port == "" {
+			return errors.New("Invalid address '" + addr + "'")
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			return errors.New("Invalid port in address '" + addr + "'")
+		}
+	}
+	return nil
+}
+
+// Returns the public information of the other nodes of a given type
+func (c *NodeConfig) Peers(nodeType string) []NodeInfo {
+	var peers []NodeInfo
+	for _, info := range c.NodesInfo {
+		if info.Type == nodeType && info.Id != c.Id {
+			peers = append(peers, info)
+		}
+	}
+	return peers
+}
+
+// Returns the first advertised address of each of the given nodes, skipping nodes without one
+func AdvertisedAddrs(nodesInfo []NodeInfo) []string {
+	var addrs []string
+	for _, info := range nodesInfo {
+		if len(info.AdvertiseAddrs) > 0 {
+			addrs = append(addrs, info.AdvertiseAddrs[0])
+		}
+	}
+	return addrs
+}
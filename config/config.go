@@ -1,24 +1,49 @@
 package config
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"github.com/BurntSushi/toml"
 	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/base64"
 	"github.com/dedis/crypto/cipher"
-	"github.com/dedis/crypto/random"
 	"github.com/dedis/crypto/suites"
-	"github.com/dedis/crypto/util"
 	"io/ioutil"
 	"os"
 	"os/user"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 )
 
+// Config root set by SetConfigRoot, overriding CONFIG_ROOT_ENV
+var configRoot string
+
+// Sets the folder holding the nodes' config folders (profiles).
+// An empty root falls back to CONFIG_ROOT_ENV, then to the user's home folder.
+func SetConfigRoot(root string) {
+	configRoot = root
+}
+
+// Returns the config root set by SetConfigRoot or CONFIG_ROOT_ENV, or "" if there is none
+func ConfigRoot() string {
+	if configRoot != "" {
+		return configRoot
+	}
+	return os.Getenv(CONFIG_ROOT_ENV)
+}
+
+// Returns the config folder of a node profile.
+// With a config root, the folder is <root>/<name>; otherwise it is $HOME/.<name>.
 func ConfigDir(name string) (string, error) {
 
+	if root := ConfigRoot(); root != "" {
+		return filepath.Join(root, name), nil
+	}
+
 	var homedir string
 	if runtime.GOOS == "windows" {
 		usr, err := user.Current()
@@ -33,215 +58,418 @@ func ConfigDir(name string) (string, error) {
 	return confDir, nil
 }
 
-// Loads a node's config data from a folder.
-// The folder must contain a TOML-format .config file and a .sec file containing the node's private key.
-func (c *NodeConfig) Load(name string) error {
+// Returns the names of the profiles found under a config root:
+// the folders that contain a config file
+func ListProfiles(root string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(root, "*", "config.tml"))
+	if err != nil {
+		return nil, err
+	}
+	profiles := make([]string, len(matches))
+	for i, match := range matches {
+		profiles[i] = filepath.Base(filepath.Dir(match))
+	}
+	sort.Strings(profiles)
+	return profiles, nil
+}
 
+// Loads a node profile's config data from its config folder (see ConfigDir)
+func (c *NodeConfig) Load(name string) error {
 	dir, err := ConfigDir(name)
 	if err != nil {
 		return err
 	}
+	return c.LoadDir(dir)
+}
 
-	// Read the config file if it exists
-	filename := dir + "/config.tml"
-	_, err = toml.DecodeFile(filename, &c.nodePubConfig)
-	if err != nil && !os.IsNotExist(err) {
-		return err
+// Loads a node's config data from a folder.
+// The folder must contain a TOML-format config.tml file and a .sec file containing the node's private key.
+// An encrypted .sec file is decrypted with the passphrase given by SetPassphrase.
+// On failure, the returned error is a ConfigErrors listing every problem found.
+func (c *NodeConfig) LoadDir(dir string) error {
+	if errs := c.loadDir(dir); len(errs) > 0 {
+		return errs
 	}
+	return nil
+}
+
+func (c *NodeConfig) loadDir(dir string) ConfigErrors {
+
+	var errs ConfigErrors
+
+	// Read the config file and check its fields
+	filename := filepath.Join(dir, "config.tml")
+	if _, err := toml.DecodeFile(filename, &c.nodePubConfig); err != nil {
+		if os.IsNotExist(err) {
+			errs.add(CONFIG_ERROR_MISSING_FILE, filename, "", err)
+		} else {
+			errs.add(CONFIG_ERROR_SYNTAX, filename, "", err)
+		}
+		return errs
+	}
+	c.checkPubConfig(filename, &errs)
 
 	// Lookup the appropriate cipher suite for this public key.
+	// Nothing else can be checked without it.
 	suite := suites.All()[c.Suite]
 	if suite == nil {
-		return errors.New("Unsupported ciphersuite '" + c.Suite + "'")
+		return errs
 	}
 
-	// Read the private key file
-	secFilename := dir + "/" + c.PubId + ".sec"
-	secFile, err := os.Open(secFilename)
-	if err != nil {
-		return err
+	// Read the private key file, decrypting it if needed, and verify the public key.
+	// A node whose key is held by a signer process only has its public key file.
+	if c.PubId != "" {
+		keyFilename := filepath.Join(dir, c.PubId+".sec")
+		var err error
+		if c.KeySocket != "" {
+			keyFilename = filepath.Join(dir, c.PubId+".pub")
+			err = c.loadPublicKey(suite, keyFilename)
+		} else {
+			err = c.loadPrivateKey(suite, keyFilename)
+		}
+		if err != nil {
+			kind := CONFIG_ERROR_KEY
+			if os.IsNotExist(err) {
+				kind = CONFIG_ERROR_MISSING_FILE
+			}
+			errs.add(kind, keyFilename, "", err)
+		}
 	}
-	defer secFile.Close()
 
-	if err := suite.Read(secFile, &c.PrivateKey); err != nil {
-		return err
+	// Decode the administrator's public key
+	if c.AdminKey != "" {
+		var err error
+		if c.AdminPublicKey, err = DecodePoint(suite, c.AdminKey); err != nil {
+			errs.add(CONFIG_ERROR_INVALID_FIELD, filename, "AdminKey", errors.New("Cannot decode administrator key. "+err.Error()))
+		}
 	}
 
-	// Reconstruct and verify the public key
-	c.PublicKey = suite.Point().Mul(nil, c.PrivateKey)
-	if getPublicStringIdentifier(suite, c.PublicKey) != c.PubId {
-		return errors.New("Secret does not yield public key " + c.PubId)
+	// Load public key roster if it exists, check the administrator's signature and its consistency
+	rosterFilename := filepath.Join(dir, "roster")
+	rosterBytes, err := ioutil.ReadFile(rosterFilename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			errs.add(CONFIG_ERROR_ROSTER, rosterFilename, "", err)
+		}
+		return errs
+	}
+	if c.Roster, err = UnmarshalRoster(suite, rosterBytes); err != nil {
+		errs.add(CONFIG_ERROR_ROSTER, rosterFilename, "", errors.New("Cannot unmarshal node's public key roster. "+err.Error()))
+		return errs
 	}
+	if c.AdminPublicKey != nil {
+		if err := c.Roster.Verify(suite, c.AdminPublicKey); err != nil {
+			errs.add(CONFIG_ERROR_ROSTER, rosterFilename, "", err)
+		}
+	}
+	c.checkRoster(suite, rosterFilename, &errs)
+
+	return errs
+}
 
-	// Load public key roster if it exists
-	rosterFilename := dir + "/roster"
-	if _, err := os.Stat(rosterFilename); err == nil {
+// Reads the private key file, decrypting it if needed, and checks it against PubId
+func (c *NodeConfig) loadPrivateKey(suite abstract.Suite, filename string) error {
 
-		var rosterBytes []byte
-		if rosterBytes, err = ioutil.ReadFile(rosterFilename); err != nil {
+	secBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	c.keyEncrypted = IsEncryptedKeyFile(secBytes)
+	if c.keyEncrypted {
+		if secBytes, err = DecryptKeyFile(secBytes, c.passphrase); err != nil {
 			return err
 		}
-		if c.PublicKeyRoster, err = UnmarshalPointsMap(suite, rosterBytes); err != nil {
-			return errors.New("Cannot unmarshal node's public key roster. " + err.Error())
-		}
 	}
 
+	if err := suite.Read(bytes.NewReader(secBytes), &c.PrivateKey); err != nil {
+		return errors.New("Cannot read private key. " + err.Error())
+	}
+
+	// Reconstruct and verify the public key
+	c.PublicKey = suite.Point().Mul(nil, c.PrivateKey)
+	if PublicKeyId(suite, c.PublicKey) != c.PubId {
+		return errors.New("Secret does not yield public key " + c.PubId)
+	}
 	return nil
 }
 
-// Saves a node's config data into a folder
-// The folder will contain a TOML-format .config file and a .sec file containing the node's private key.
-func (c *NodeConfig) Save(appName string) error {
+// Reads the public key file written by SaveDir and checks it against PubId
+func (c *NodeConfig) loadPublicKey(suite abstract.Suite, filename string) error {
 
-	dir, err := ConfigDir(appName)
+	pubBytes, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return err
 	}
-
-	// Delete the config directory if it already exists
-	if err := os.RemoveAll(dir); err != nil {
+	entry, err := DecodePublicKeyPEM(pubBytes)
+	if err != nil {
 		return err
 	}
-
-	// Create the config directory
-	if err := os.MkdirAll(dir, 0700); err != nil {
+	if c.PublicKey, err = DecodePoint(suite, entry.Point); err != nil {
 		return err
 	}
-
-	// Delete the file if it exists
-	filename := dir + "/config.tml"
-	if _, err := os.Stat(filename); err == nil {
-		os.Remove(filename)
+	if PublicKeyId(suite, c.PublicKey) != c.PubId {
+		return errors.New("Public key file does not match PubId " + c.PubId)
 	}
+	return nil
+}
 
-	// Create a new config file
-	file, err := os.Create(filename)
+// Saves a node profile's config data into its config folder (see ConfigDir).
+// Previous versions of the config and roster are backed up, but not of the private key.
+func (c *NodeConfig) Save(name string) error {
+	dir, err := ConfigDir(name)
 	if err != nil {
 		return err
 	}
+	return c.SaveDir(dir)
+}
 
-	// Save the config file
-	enc := toml.NewEncoder(file)
-	if err := enc.Encode(c.nodePubConfig); err != nil {
+// Saves a node's config data into a folder
+// The folder will contain a TOML-format .config file, a .sec file containing the node's private key,
+// a PEM .pub file containing its public key and, if the node has one, the signed roster.
+// Other files in the folder are left untouched. Every file is replaced atomically, and the
+// previous versions of the config and roster are kept as numbered backups.
+// The private key has no backups: a backup would keep the key in plaintext after it is encrypted,
+// or readable with the old passphrase after it is changed. A key replaced by a rotation is
+// kept by ArchiveKey instead.
+// The config file is written last, so a crash midway leaves it pointing to a complete key file.
+func (c *NodeConfig) SaveDir(dir string) error {
+
+	// Create the config directory if needed
+	if err := os.MkdirAll(dir, 0700); err != nil {
 		return err
 	}
-	defer file.Close()
 
-	// Save the private key into a sec file
-	secFilename := dir + "/" + c.PubId + ".sec"
-	r := util.Replacer{}
-	if err := r.Open(secFilename); err != nil {
-		return err
+	// Save the private key into a sec file, encrypted if the node has a passphrase.
+	// Nodes whose key is held by a signer process have no private key to save.
+	if c.PrivateKey != nil {
+		suite := suites.All()[c.Suite]
+		var secBuf bytes.Buffer
+		if err := suite.Write(&secBuf, &c.PrivateKey); err != nil {
+			return err
+		}
+		secBytes := secBuf.Bytes()
+		var err error
+		if len(c.passphrase) > 0 {
+			if secBytes, err = EncryptKeyFile(secBytes, c.passphrase); err != nil {
+				return err
+			}
+		}
+		// Older versions kept backups of the key, wipe them
+		if err := saveFile(dir+"/"+c.PubId+".sec", secBytes, 0600, false); err != nil {
+			return err
+		}
+		if err := wipeBackups(dir + "/" + c.PubId + ".sec"); err != nil {
+			return errors.New("Cannot wipe the backups of the private key. " + err.Error())
+		}
+		c.keyEncrypted = len(c.passphrase) > 0
 	}
-	defer r.Abort()
 
-	// Write the secret key
-	suite := suites.All()[c.Suite]
-	if err := suite.Write(r.File, &c.PrivateKey); err != nil {
+	// Save the public key into a PEM file, to build rosters from
+	pubBytes, err := EncodePublicKeyPEM(c.NodeInfo, c.PublicKey)
+	if err != nil {
 		return err
 	}
+	if err := saveFile(dir+"/"+c.PubId+".pub", pubBytes, 0644, false); err != nil {
+		return err
+	}
+
+	// Save the signed roster
+	if c.Roster != nil {
+		rosterBytes, err := c.Roster.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err := saveFile(dir+"/roster", rosterBytes, 0600, true); err != nil {
+			return err
+		}
+	}
 
-	if err := r.Commit(); err != nil {
+	// Save the config file
+	var configBuf bytes.Buffer
+	if err := toml.NewEncoder(&configBuf).Encode(c.nodePubConfig); err != nil {
 		return err
 	}
-	return nil
+	return saveFile(dir+"/config.tml", configBuf.Bytes(), 0600, true)
 }
 
-// Generates a public/private key pair
-func (c *NodeConfig) GenKeyPair(suite abstract.Suite, random cipher.Stream) {
+// Atomically replaces a file's content. If backup is set and the file exists with a
+// different content, its previous versions are rotated into filename.1 ... filename.N,
+// where N is CONFIG_BACKUPS.
+func saveFile(filename string, data []byte, perm os.FileMode, backup bool) error {
 
-	c.Suite = suite.String()
-	c.PrivateKey = suite.Scalar().Pick(random)
-	c.PublicKey = suite.Point().Mul(nil, c.PrivateKey)
-	c.PubId = getPublicStringIdentifier(suite, c.PublicKey)
+	if backup {
+		old, err := ioutil.ReadFile(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && !bytes.Equal(old, data) {
+			if err := rotateBackups(filename, old, perm); err != nil {
+				return errors.New("Cannot back up " + filename + ". " + err.Error())
+			}
+		}
+	}
+	return writeFileAtomic(filename, data, perm)
 }
 
-func getPublicStringIdentifier(suite abstract.Suite, publicKey abstract.Point) string {
-	buf, _ := publicKey.MarshalBinary()
-	hash := abstract.Sum(suite, buf)
-	return base64.RawURLEncoding.EncodeToString(hash)
-}
+// Shifts filename.1 ... filename.N-1 one step up, dropping filename.N,
+// and saves the current content as filename.1
+func rotateBackups(filename string, current []byte, perm os.FileMode) error {
 
-// Generates a config folder for each node: clients, servers, and a relay
-// For clients and servers, the folder will contain a TOML-formatted config file
-// and a binary secret key file. For the relay, the folder will also contain a binary file
-// that contains a dictionary of (pubId, public key)'s for all nodes.
-func GenerateConfig(nClients int, nTrustees int, authMethod int, suite abstract.Suite) error {
-
-	nodesConfig := make([]NodeConfig, nClients+nTrustees)
-
-	// Create trustees' config files
-	id := int(1)
-	for i := 0; id < nTrustees+1; id++ {
-
-		nodeConfig := NodeConfig{}
-		nodeConfig.Id = id
-		nodeConfig.Name = "prifi-trustee-" + strconv.Itoa(i)
-		nodeConfig.Type = NODE_TYPE_TRUSTEE
-		nodeConfig.AuthMethod = authMethod
-		nodeConfig.GenKeyPair(suite, random.Stream)
-		if err := nodeConfig.Save(nodeConfig.Name); err != nil {
+	for i := CONFIG_BACKUPS - 1; i >= 1; i-- {
+		from := filename + "." + strconv.Itoa(i)
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		if err := os.Rename(from, filename+"."+strconv.Itoa(i+1)); err != nil {
 			return err
 		}
-		nodesConfig[i] = nodeConfig
-		i++
 	}
+	return writeFileAtomic(filename+".1", current, perm)
+}
 
-	// Create clients' config files
-	for i := 0; id < nClients+nTrustees+1; id++ {
+// Overwrites the numbered backups of a file with zeros, then deletes them
+func wipeBackups(filename string) error {
 
-		nodeConfig := NodeConfig{}
-		nodeConfig.Id = id
-		nodeConfig.Name = "prifi-client-" + strconv.Itoa(i)
-		nodeConfig.Type = NODE_TYPE_CLIENT
-		nodeConfig.AuthMethod = authMethod
-		nodeConfig.GenKeyPair(suite, random.Stream)
-		if err := nodeConfig.Save(nodeConfig.Name); err != nil {
+	backups, err := filepath.Glob(filename + ".[0-9]*")
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups {
+		if _, err := strconv.Atoi(strings.TrimPrefix(backup, filename+".")); err != nil {
+			continue
+		}
+		info, err := os.Stat(backup)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(backup, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(make([]byte, info.Size()))
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(backup); err != nil {
 			return err
 		}
-		nodesConfig[nTrustees+i] = nodeConfig
-		i++
 	}
+	return nil
+}
 
-	// Create relay's config file
-	relayConfig := NodeConfig{}
-	relayConfig.GenKeyPair(suite, random.Stream)
-	relayConfig.Id = 0 // Relay's id is always 0
-	relayConfig.Name = "prifi-relay"
-	relayConfig.Type = NODE_TYPE_RELAY
-	relayConfig.AuthMethod = authMethod
-	relayConfig.NodesInfo = make([]NodeInfo, len(nodesConfig))
+// Writes a file into a temporary file of the same folder, syncs it and renames it over the
+// destination, so that readers see either the old or the new content
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
 
-	for i := 0; i < len(nodesConfig); i++ {
-		relayConfig.NodesInfo[i] = nodesConfig[i].NodeInfo
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
 	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
 
-	if err := relayConfig.Save(relayConfig.Name); err != nil {
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
 		return err
 	}
-
-	// Create the public roster which is a map of (node ID, public key)'s for all nodes
-	dir, err := ConfigDir(relayConfig.Name)
-	if err != nil {
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
 		return err
 	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
 
-	pubs := make(map[int]abstract.Point)
-	for _, nodeConfig := range nodesConfig {
-		pubs[nodeConfig.Id] = nodeConfig.PublicKey
+// Sets the passphrase used to decrypt the private key on Load and to encrypt it on Save.
+// A nil passphrase saves the private key in plaintext.
+func (c *NodeConfig) SetPassphrase(passphrase []byte) {
+	c.passphrase = passphrase
+}
+
+// Returns whether the private key was loaded from, or saved to, an encrypted file
+func (c *NodeConfig) KeyEncrypted() bool {
+	return c.keyEncrypted
+}
+
+// Generates a public/private key pair
+func (c *NodeConfig) GenKeyPair(suite abstract.Suite, random cipher.Stream) {
+
+	c.Suite = suite.String()
+	c.PrivateKey = suite.Scalar().Pick(random)
+	c.PublicKey = suite.Point().Mul(nil, c.PrivateKey)
+	c.PubId = PublicKeyId(suite, c.PublicKey)
+}
+
+// Encodes a point into a base64 string, as stored in TOML config files
+func EncodePoint(p abstract.Point) (string, error) {
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		return "", err
 	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
 
-	rosterFile, err := os.Create(dir + "/roster")
+// Decodes a point encoded by EncodePoint
+func DecodePoint(suite abstract.Suite, s string) (abstract.Point, error) {
+	buf, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	p := suite.Point()
+	if err := p.UnmarshalBinary(buf); err != nil {
+		return nil, err
 	}
-	defer rosterFile.Close()
+	return p, nil
+}
 
-	rosterBytes, _ := MarshalPointsMap(pubs)
-	if _, err := rosterFile.Write(rosterBytes); err != nil {
-		return err
+// Returns the identifier of a public key, used to name key files and to pin roster members
+func PublicKeyId(suite abstract.Suite, publicKey abstract.Point) string {
+	buf, _ := publicKey.MarshalBinary()
+	hash := abstract.Sum(suite, buf)
+	return base64.RawURLEncoding.EncodeToString(hash)
+}
+
+// Generates a config folder for each node: clients, servers, a relay and an administrator,
+// named "prifi-trustee-N", "prifi-client-N", "prifi-relay" and "prifi-admin".
+// See GenerateDeployment for the content of the folders.
+// If plan is not nil, the relay and trustees get listen and advertise addresses from it, and every
+// node's config lists the relay and trustees, so that nodes can find each other from config alone.
+func GenerateConfig(outDir string, nClients int, nTrustees int, authMethod int, suite abstract.Suite,
+	plan *AddressPlan, passphrase []byte) error {
+
+	spec := &DeploymentSpec{
+		Suite:      suite.String(),
+		AuthMethod: authMethod,
+		Admin:      DEFAULT_ADMIN_NAME,
 	}
-	return nil
+
+	for i := 0; i < nTrustees; i++ {
+		node := NodeSpec{Name: "prifi-trustee-" + strconv.Itoa(i), Role: NODE_TYPE_TRUSTEE}
+		if plan != nil {
+			node.Listen, node.Addrs = plan.TrusteeAddrs(i)
+		}
+		spec.Nodes = append(spec.Nodes, node)
+	}
+	spec.Groups = []GroupSpec{{Name: "prifi-client", Role: NODE_TYPE_CLIENT, Count: nClients}}
+
+	relay := NodeSpec{Name: "prifi-relay", Role: NODE_TYPE_RELAY}
+	if plan != nil {
+		relay.Listen, relay.Addrs = plan.RelayAddrs()
+	}
+	spec.Nodes = append(spec.Nodes, relay)
+
+	return GenerateDeployment(spec, outDir, passphrase)
 }
 
 // Marshals a map of (nodeId, Point) into a byte arrays
@@ -254,8 +482,15 @@ func MarshalPointsMap(pointsMap map[int]abstract.Point) ([]byte, error) {
 	binary.BigEndian.PutUint32(numEntries, uint32(len(pointsMap)))
 	arr = append(arr, numEntries...)
 
-	// Marshal each entry
-	for k, v := range pointsMap {
+	// Marshal each entry in increasing key order, so that equal maps marshal identically
+	keys := make([]int, 0, len(pointsMap))
+	for k := range pointsMap {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	for _, k := range keys {
+		v := pointsMap[k]
 
 		keyBytes := make([]byte, 4)
 		binary.BigEndian.PutUint32(keyBytes, uint32(k))
@@ -274,25 +509,46 @@ func MarshalPointsMap(pointsMap map[int]abstract.Point) ([]byte, error) {
 	return arr, nil
 }
 
+// Unmarshals a map produced by MarshalPointsMap.
+// Fails instead of panicking on truncated or oversized input.
 func UnmarshalPointsMap(suite abstract.Suite, arr []byte) (map[int]abstract.Point, error) {
 
-	pointsMap := make(map[int]abstract.Point)
-	numEntries := int(binary.BigEndian.Uint32(arr[0:4]))
+	if len(arr) < 4 {
+		return nil, errors.New("Points map is too short")
+	}
+	numEntries64 := int64(binary.BigEndian.Uint32(arr[0:4]))
+	if numEntries64 > int64((len(arr)-4)/6) {
+		return nil, errors.New("Points map has more entries than bytes")
+	}
+	numEntries := int(numEntries64)
 
+	pointsMap := make(map[int]abstract.Point, numEntries)
 	i := 4
 	for j := 0; j < numEntries; j++ {
 
+		if len(arr) < i+6 {
+			return nil, errors.New("Points map is too short")
+		}
 		key := int(binary.BigEndian.Uint32(arr[i : i+4]))
 
 		valBytesLen := int(binary.BigEndian.Uint16(arr[i+4 : i+6]))
+		if len(arr) < i+6+valBytesLen {
+			return nil, errors.New("Points map is too short")
+		}
 		valBytes := arr[i+6 : i+6+valBytesLen]
 
+		if _, exists := pointsMap[key]; exists {
+			return nil, errors.New("Duplicate key " + strconv.Itoa(key) + " in points map")
+		}
 		point := suite.Point()
 		if err := point.UnmarshalBinary(valBytes); err != nil {
-			return map[int]abstract.Point{}, err
+			return nil, err
 		}
 		pointsMap[key] = point
 		i += 6 + valBytesLen
 	}
+	if i != len(arr) {
+		return nil, errors.New("Points map has trailing bytes")
+	}
 	return pointsMap, nil
 }
@@ -0,0 +1,352 @@
+package config
+
+import (
+	"errors"
+	"github.com/BurntSushi/toml"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/random"
+	"github.com/dedis/crypto/suites"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+)
+
+// Name of the signed roster written at the top of a deployment's output folder
+const DEPLOYMENT_ROSTER_FILE = "roster"
+
+// Declarative description of a deployment, read from a TOML file.
+// Example:
+//
+//	Suite = "P256"
+//	Admin = "staging-admin"
+//	ListenHost = "0.0.0.0"
+//	AnnounceAddr = "239.1.2.3:9200"
+//
+//	[[Nodes]]
+//	Name = "relay"
+//	Role = "Relay"
+//	Addrs = ["relay.example.org:9000"]
+//
+//	[[Nodes]]
+//	Name = "trustee-eu"
+//	Role = "Trustee"
+//	Addrs = ["[2001:db8::1]:9100"]
+//
+//	[[Groups]]
+//	Name = "staff"
+//	Count = 50
+type DeploymentSpec struct {
+	Suite        string      // Default cipher suite of the nodes
+	AuthMethod   int         // Authentication method
+	Admin        string      // Name of the administrator's config folder (default: DEFAULT_ADMIN_NAME)
+	ListenHost   string      // Host nodes bind to when they do not list their own listen addresses
+	AnnounceAddr string      // UDP broadcast or multicast address the relay announces to clients on (optional)
+	Nodes        []NodeSpec  // Individually named nodes
+	Groups       []GroupSpec // Groups of similar nodes
+}
+
+// A named node of a deployment
+type NodeSpec struct {
+	Name   string   // Node name, also the name of its config folder
+	Id     int      // Node id (default: assigned in order). The relay's id is always 0.
+	Role   string   // Relay, Trustee or Client
+	Suite  string   // Cipher suite (default: the deployment's)
+	Addrs  []string // Advertised addresses
+	Listen []string // Listen addresses (default: the advertised ports on ListenHost, or the advertised addresses)
+	Group  string   // Group the node was generated from, if any
+}
+
+// A group of nodes named <Name>-0 ... <Name>-<Count-1>
+type GroupSpec struct {
+	Name  string // Prefix of the nodes' names
+	Role  string // Role of the nodes (default: Client)
+	Count int    // Number of nodes
+	Suite string // Cipher suite (default: the deployment's)
+}
+
+// Reads a deployment spec from a TOML file and checks it
+func LoadDeploymentSpec(filename string) (*DeploymentSpec, error) {
+	spec := &DeploymentSpec{}
+	if _, err := toml.DecodeFile(filename, spec); err != nil {
+		return nil, err
+	}
+	if err := spec.Check(); err != nil {
+		return nil, errors.New(filename + ": " + err.Error())
+	}
+	return spec, nil
+}
+
+// Returns every node of the deployment, with groups expanded and ids assigned.
+// Trustees come first, then clients, then the relay, so that ids follow that order.
+func (spec *DeploymentSpec) ExpandNodes() []NodeSpec {
+
+	var all []NodeSpec
+	all = append(all, spec.Nodes...)
+	for _, group := range spec.Groups {
+		role := group.Role
+		if role == "" {
+			role = NODE_TYPE_CLIENT
+		}
+		for i := 0; i < group.Count; i++ {
+			all = append(all, NodeSpec{
+				Name:  group.Name + "-" + strconv.Itoa(i),
+				Role:  role,
+				Suite: group.Suite,
+				Group: group.Name,
+			})
+		}
+	}
+
+	// Nodes without an id get the next free one, trustees before clients
+	used := make(map[int]bool)
+	for _, node := range all {
+		if node.Id != 0 {
+			used[node.Id] = true
+		}
+	}
+	nextId := 1
+	var nodes []NodeSpec
+	for _, role := range []string{NODE_TYPE_TRUSTEE, NODE_TYPE_CLIENT, NODE_TYPE_RELAY} {
+		for _, node := range all {
+			if node.Role != role {
+				continue
+			}
+			if node.Suite == "" {
+				node.Suite = spec.suite()
+			}
+			if node.Role == NODE_TYPE_RELAY {
+				node.Id = 0
+			} else if node.Id == 0 {
+				for used[nextId] {
+					nextId++
+				}
+				node.Id = nextId
+				used[nextId] = true
+			}
+			if len(node.Listen) == 0 {
+				node.Listen = spec.listenAddrs(node.Addrs)
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// Checks the spec: known roles and suites, unique names and ids, valid addresses,
+// exactly one relay, at least one trustee, and a single suite among trustees and clients.
+// The spec is left as it is; defaults are only filled in by ExpandNodes and GenerateDeployment.
+func (spec *DeploymentSpec) Check() error {
+
+	if spec.AnnounceAddr != "" {
+		if err := CheckAddrs([]string{spec.AnnounceAddr}); err != nil {
+			return errors.New("AnnounceAddr: " + err.Error())
+		}
+	}
+	for _, group := range spec.Groups {
+		if group.Name == "" || group.Count < 0 {
+			return errors.New("Groups need a name and a non-negative count")
+		}
+	}
+
+	names := map[string]bool{spec.admin(): true, DEPLOYMENT_ROSTER_FILE: true}
+	ids := make(map[int]string)
+	relays, trustees := 0, 0
+	rosterSuite, relaySuite := "", ""
+
+	for _, node := range spec.ExpandNodes() {
+		if node.Name == "" {
+			return errors.New("Every node needs a name")
+		}
+		if names[node.Name] {
+			return errors.New("Duplicate node name '" + node.Name + "'")
+		}
+		names[node.Name] = true
+
+		if suites.All()[node.Suite] == nil {
+			return errors.New("Node " + node.Name + ": unsupported ciphersuite '" + node.Suite + "'")
+		}
+		if err := CheckAddrs(node.Addrs); err != nil {
+			return errors.New("Node " + node.Name + ": " + err.Error())
+		}
+		if err := CheckAddrs(node.Listen); err != nil {
+			return errors.New("Node " + node.Name + ": " + err.Error())
+		}
+
+		switch node.Role {
+		case NODE_TYPE_RELAY:
+			relays++
+			relaySuite = node.Suite
+			continue
+		case NODE_TYPE_TRUSTEE:
+			trustees++
+		case NODE_TYPE_CLIENT:
+		default:
+			return errors.New("Node " + node.Name + ": unknown role '" + node.Role + "'")
+		}
+
+		if node.Id < 0 {
+			return errors.New("Node " + node.Name + ": id " + strconv.Itoa(node.Id) + " is negative")
+		}
+		if other, exists := ids[node.Id]; exists {
+			return errors.New("Node " + node.Name + ": id " + strconv.Itoa(node.Id) + " is already used by " + other)
+		}
+		ids[node.Id] = node.Name
+		if rosterSuite == "" {
+			rosterSuite = node.Suite
+		} else if node.Suite != rosterSuite {
+			return errors.New("Node " + node.Name + ": trustees and clients must all use the same suite")
+		}
+	}
+
+	if relays != 1 {
+		return errors.New("A deployment needs exactly one relay, found " + strconv.Itoa(relays))
+	}
+	if trustees < 1 {
+		return errors.New("A deployment needs at least one trustee")
+	}
+	if relaySuite != rosterSuite {
+		return errors.New("The relay must use the same suite as trustees and clients")
+	}
+	return nil
+}
+
+// Generates a config folder for each node of a deployment under outDir, plus the
+// administrator's folder. Each folder contains a TOML-formatted config file, a secret key file
+// and the roster of all clients' and trustees' public keys, signed by the administrator.
+// The signed roster is also written to outDir/DEPLOYMENT_ROSTER_FILE.
+// If outDir is empty, each node's folder is given by ConfigDir and no extra roster is written.
+// If passphrase is not nil, every private key is saved encrypted with it.
+func GenerateDeployment(spec *DeploymentSpec, outDir string, passphrase []byte) error {
+
+	if err := spec.Check(); err != nil {
+		return err
+	}
+	// Trustees come first, and all trustees and clients share the roster's suite
+	nodes := spec.ExpandNodes()
+	suite := suites.All()[nodes[0].Suite]
+
+	// Create the administrator's key pair
+	adminConfig := NodeConfig{}
+	adminConfig.GenKeyPair(suite, random.Stream)
+	adminConfig.Name = spec.admin()
+	adminConfig.Type = NODE_TYPE_ADMIN
+	adminKey, err := EncodePoint(adminConfig.PublicKey)
+	if err != nil {
+		return err
+	}
+	adminConfig.AdminKey = adminKey
+
+	roster := &Roster{
+		Version:  1,
+		Clients:  make(map[int]abstract.Point),
+		Trustees: make(map[int]abstract.Point),
+	}
+
+	// Create every node's config
+	var nodesConfig []NodeConfig
+	var rosterInfo, directory []NodeInfo
+	for _, node := range nodes {
+
+		nodeSuite := suites.All()[node.Suite]
+		nodeConfig := NodeConfig{}
+		nodeConfig.Id = node.Id
+		nodeConfig.Name = node.Name
+		nodeConfig.Type = node.Role
+		nodeConfig.AuthMethod = spec.AuthMethod
+		nodeConfig.AdminKey = adminKey
+		nodeConfig.ListenAddrs = node.Listen
+		nodeConfig.AdvertiseAddrs = node.Addrs
+		if node.Role == NODE_TYPE_RELAY || node.Role == NODE_TYPE_CLIENT {
+			nodeConfig.AnnounceAddr = spec.AnnounceAddr
+		}
+		nodeConfig.GenKeyPair(nodeSuite, random.Stream)
+		nodesConfig = append(nodesConfig, nodeConfig)
+
+		switch node.Role {
+		case NODE_TYPE_TRUSTEE:
+			roster.Trustees[node.Id] = nodeConfig.PublicKey
+			rosterInfo = append(rosterInfo, nodeConfig.NodeInfo)
+			directory = append(directory, nodeConfig.NodeInfo)
+		case NODE_TYPE_CLIENT:
+			roster.Clients[node.Id] = nodeConfig.PublicKey
+			rosterInfo = append(rosterInfo, nodeConfig.NodeInfo)
+		case NODE_TYPE_RELAY:
+			directory = append([]NodeInfo{nodeConfig.NodeInfo}, directory...)
+		}
+	}
+
+	// The relay and the administrator know every roster member, while trustees and clients
+	// know the relay and the trustees
+	for i := range nodesConfig {
+		if nodesConfig[i].Type == NODE_TYPE_RELAY {
+			nodesConfig[i].NodesInfo = rosterInfo
+		} else {
+			nodesConfig[i].NodesInfo = directory
+		}
+	}
+	adminConfig.NodesInfo = rosterInfo
+
+	// Sign the roster and save it along with every node's config
+	if err := roster.Sign(suite, random.Stream, adminConfig.PrivateKey); err != nil {
+		return err
+	}
+
+	nodesConfig = append(nodesConfig, adminConfig)
+	for _, nodeConfig := range nodesConfig {
+		nodeConfig.Roster = roster
+		nodeConfig.SetPassphrase(passphrase)
+
+		var err error
+		if outDir != "" {
+			err = nodeConfig.SaveDir(filepath.Join(outDir, nodeConfig.Name))
+		} else {
+			err = nodeConfig.Save(nodeConfig.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if outDir != "" {
+		rosterBytes, err := roster.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(outDir, DEPLOYMENT_ROSTER_FILE), rosterBytes, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the deployment's suite, CryptoSuite's if none is set
+func (spec *DeploymentSpec) suite() string {
+	if spec.Suite == "" {
+		return CryptoSuite.String()
+	}
+	return spec.Suite
+}
+
+// Returns the name of the administrator's config folder
+func (spec *DeploymentSpec) admin() string {
+	if spec.Admin == "" {
+		return DEFAULT_ADMIN_NAME
+	}
+	return spec.Admin
+}
+
+// Returns the listen addresses matching advertised addresses: the same ports on
+// ListenHost if it is set, otherwise the advertised addresses themselves
+func (spec *DeploymentSpec) listenAddrs(addrs []string) []string {
+	if spec.ListenHost == "" {
+		return addrs
+	}
+	var listen []string
+	for _, addr := range addrs {
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			listen = append(listen, net.JoinHostPort(spec.ListenHost, port))
+		}
+	}
+	return listen
+}
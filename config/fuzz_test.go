@@ -0,0 +1,64 @@
+package config
+
+import (
+	"testing"
+)
+
+// Fuzz targets feeding untrusted input to the parsers, which must return an error instead
+// of panicking. Run one with e.g.
+//
+//	go test -fuzz FuzzUnmarshalRoster ./config
+
+func fuzzRosterSeeds(f *testing.F) ([]byte, []byte) {
+	roster, _ := newTestRoster(f, 3, 2)
+	rosterBytes, err := roster.MarshalBinary()
+	if err != nil {
+		f.Fatal(err)
+	}
+	header, err := roster.Header(CryptoSuite)
+	if err != nil {
+		f.Fatal(err)
+	}
+	headerBytes, err := header.MarshalBinary()
+	if err != nil {
+		f.Fatal(err)
+	}
+	return rosterBytes, headerBytes
+}
+
+func FuzzUnmarshalPointsMap(f *testing.F) {
+	roster, _ := newTestRoster(f, 3, 0)
+	data, err := MarshalPointsMap(roster.Clients)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		UnmarshalPointsMap(CryptoSuite, data)
+	})
+}
+
+func FuzzUnmarshalRoster(f *testing.F) {
+	rosterBytes, _ := fuzzRosterSeeds(f)
+	f.Add(rosterBytes)
+	f.Add([]byte{0, 0, 0, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		roster, err := UnmarshalRoster(CryptoSuite, data)
+		if err != nil {
+			return
+		}
+		if _, err := roster.MarshalBinary(); err != nil {
+			t.Fatal("Unmarshaled roster does not marshal:", err)
+		}
+	})
+}
+
+func FuzzUnmarshalRosterHeader(f *testing.F) {
+	_, headerBytes := fuzzRosterSeeds(f)
+	f.Add(headerBytes)
+	f.Add(make([]byte, 10))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		UnmarshalRosterHeader(CryptoSuite, data)
+	})
+}
@@ -0,0 +1,314 @@
+package config
+
+import (
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/cipher"
+	"github.com/dedis/crypto/suites"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// PEM block type of a key handover statement
+const KEY_HANDOVER_PEM_TYPE = "DAGA KEY HANDOVER"
+
+// Label prefixed to the handover's fields when they are signed, so that a handover signature
+// cannot be taken for a signature of another message made with the node's key
+const KEY_HANDOVER_SIGN_LABEL = "DAGA-KEY-HANDOVER-1"
+
+// Extension of the copy of a handover statement kept in the node's config folder,
+// named after the new key's identifier
+const KEY_HANDOVER_EXT = ".handover"
+
+// Folder, inside a node's config folder, where rotated-out private keys are kept
+const KEY_ARCHIVE_DIR = "archive"
+
+// Statement by which a node hands its identity over from its old key to a new one.
+// It is signed with the old key, so that only the current key holder can rotate it, and with
+// the new key, to prove possession of it. The administrator applies it to the roster,
+// which keeps the node's id.
+type KeyHandover struct {
+	Id           int            // Node id, unchanged by the rotation
+	Type         string         // Node type
+	Suite        string         // Cipher suite name
+	OldPubId     string         // Identifier of the old public key
+	NewPublicKey abstract.Point // New public key
+	OldSignature []byte         // Signature with the old key
+	NewSignature []byte         // Signature with the new key
+}
+
+// Replaces the node's key pair with a fresh one and returns the signed handover statement.
+// The config must then be saved, and the old key archived with ArchiveKey.
+// Only clients and trustees can rotate their key, since the handover is applied to the roster:
+// the relay's and the administrator's keys are listed in every node's config instead.
+func (c *NodeConfig) RotateKey(random cipher.Stream) (*KeyHandover, error) {
+
+	if c.Type != NODE_TYPE_CLIENT && c.Type != NODE_TYPE_TRUSTEE {
+		return nil, errors.New("The key of a " + c.Type + " cannot be rotated, only the keys of clients and trustees")
+	}
+	suite := suites.All()[c.Suite]
+	if suite == nil {
+		return nil, errors.New("Unsupported ciphersuite '" + c.Suite + "'")
+	}
+	if c.PrivateKey == nil {
+		return nil, errors.New("The node's private key is not loaded")
+	}
+
+	oldKey := c.PrivateKey
+	h := &KeyHandover{
+		Id:       c.Id,
+		Type:     c.Type,
+		Suite:    c.Suite,
+		OldPubId: c.PubId,
+	}
+	c.GenKeyPair(suite, random)
+	h.NewPublicKey = c.PublicKey
+
+	msg, err := h.signedMessage()
+	if err != nil {
+		return nil, err
+	}
+	if h.OldSignature, err = SchnorrSign(suite, random, msg, oldKey); err != nil {
+		return nil, err
+	}
+	if h.NewSignature, err = SchnorrSign(suite, random, msg, c.PrivateKey); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Verifies both signatures of the handover, given the node's old public key
+func (h *KeyHandover) Verify(oldPublicKey abstract.Point) error {
+
+	suite := suites.All()[h.Suite]
+	if suite == nil {
+		return errors.New("Unsupported ciphersuite '" + h.Suite + "'")
+	}
+	if PublicKeyId(suite, oldPublicKey) != h.OldPubId {
+		return errors.New("Handover was not made for key " + PublicKeyId(suite, oldPublicKey))
+	}
+	msg, err := h.signedMessage()
+	if err != nil {
+		return err
+	}
+	if err := SchnorrVerify(suite, msg, oldPublicKey, h.OldSignature); err != nil {
+		return errors.New("Invalid handover signature of the old key. " + err.Error())
+	}
+	if err := SchnorrVerify(suite, msg, h.NewPublicKey, h.NewSignature); err != nil {
+		return errors.New("Invalid handover signature of the new key. " + err.Error())
+	}
+	return nil
+}
+
+// Returns the identifier of the new public key
+func (h *KeyHandover) NewPubId() string {
+	return PublicKeyId(suites.All()[h.Suite], h.NewPublicKey)
+}
+
+// Returns the next version of the roster, unsigned, where the node of the handover
+// has its new key. The handover is verified against the node's key in the roster.
+func (r *Roster) ApplyHandover(h *KeyHandover) (*Roster, error) {
+
+	var keys map[int]abstract.Point
+	switch h.Type {
+	case NODE_TYPE_CLIENT:
+		keys = r.Clients
+	case NODE_TYPE_TRUSTEE:
+		keys = r.Trustees
+	default:
+		return nil, errors.New("Node type '" + h.Type + "' is not in the roster")
+	}
+	oldKey, exists := keys[h.Id]
+	if !exists {
+		return nil, errors.New(h.Type + " " + strconv.Itoa(h.Id) + " is not in the roster")
+	}
+	if err := h.Verify(oldKey); err != nil {
+		return nil, err
+	}
+
+	next := r.Clone()
+	next.Version = r.Version + 1
+	if h.Type == NODE_TYPE_CLIENT {
+		next.Clients[h.Id] = h.NewPublicKey
+	} else {
+		next.Trustees[h.Id] = h.NewPublicKey
+	}
+	return next, nil
+}
+
+// Replaces the node's roster with a newer one signed by the administrator, such as the one
+// a handover leads to. The clients and trustees the node knows take their key identifiers from
+// the new roster, and those no longer in it are forgotten. The node's own key must match
+// its entry. The config must then be saved.
+func (c *NodeConfig) ApplyRoster(roster *Roster) error {
+
+	suite := suites.All()[c.Suite]
+	if suite == nil {
+		return errors.New("Unsupported ciphersuite '" + c.Suite + "'")
+	}
+	if err := roster.Verify(suite, c.AdminPublicKey); err != nil {
+		return err
+	}
+	if c.Roster != nil && roster.Version <= c.Roster.Version {
+		return errors.New("Roster version must be greater than the current version " + strconv.Itoa(c.Roster.Version))
+	}
+
+	keyOf := func(info NodeInfo) (abstract.Point, bool) {
+		switch info.Type {
+		case NODE_TYPE_CLIENT:
+			pub, exists := roster.Clients[info.Id]
+			return pub, exists
+		case NODE_TYPE_TRUSTEE:
+			pub, exists := roster.Trustees[info.Id]
+			return pub, exists
+		}
+		return nil, false
+	}
+	if c.Type == NODE_TYPE_CLIENT || c.Type == NODE_TYPE_TRUSTEE {
+		if pub, exists := keyOf(c.NodeInfo); !exists || PublicKeyId(suite, pub) != c.PubId {
+			return errors.New("The roster does not list the node's key " + c.PubId)
+		}
+	}
+
+	var nodesInfo []NodeInfo
+	for _, info := range c.NodesInfo {
+		if info.Type == NODE_TYPE_CLIENT || info.Type == NODE_TYPE_TRUSTEE {
+			pub, exists := keyOf(info)
+			if !exists {
+				continue
+			}
+			info.PubId = PublicKeyId(suite, pub)
+		}
+		nodesInfo = append(nodesInfo, info)
+	}
+	c.NodesInfo = nodesInfo
+	c.Roster = roster
+	return nil
+}
+
+// Encodes the handover into a PEM block
+func (h *KeyHandover) MarshalPEM() ([]byte, error) {
+
+	msg, err := h.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	for _, sig := range [][]byte{h.OldSignature, h.NewSignature} {
+		sigLength := make([]byte, 2)
+		binary.BigEndian.PutUint16(sigLength, uint16(len(sig)))
+		msg = append(msg, sigLength...)
+		msg = append(msg, sig...)
+	}
+
+	block := &pem.Block{
+		Type: KEY_HANDOVER_PEM_TYPE,
+		Headers: map[string]string{
+			"Id":       strconv.Itoa(h.Id),
+			"Type":     h.Type,
+			"Suite":    h.Suite,
+			"OldPubId": h.OldPubId,
+			"NewPubId": h.NewPubId(),
+		},
+		Bytes: msg,
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// Decodes a handover encoded by MarshalPEM. The signatures are not verified.
+func UnmarshalKeyHandoverPEM(data []byte) (*KeyHandover, error) {
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != KEY_HANDOVER_PEM_TYPE {
+		return nil, errors.New("No " + KEY_HANDOVER_PEM_TYPE + " block found")
+	}
+
+	// The block holds the signed fields followed by both signatures.
+	// The PEM headers repeat some of them and are only informative.
+	arr := block.Bytes
+	fields := make([][]byte, 7)
+	i := 0
+	for j := range fields {
+		if len(arr) < i+2 {
+			return nil, errors.New("Key handover is too short")
+		}
+		n := int(binary.BigEndian.Uint16(arr[i : i+2]))
+		if len(arr) < i+2+n {
+			return nil, errors.New("Key handover is too short")
+		}
+		fields[j] = arr[i+2 : i+2+n]
+		i += 2 + n
+	}
+	if i != len(arr) || len(fields[0]) != 4 {
+		return nil, errors.New("Malformed key handover")
+	}
+
+	h := &KeyHandover{
+		Id:           int(binary.BigEndian.Uint32(fields[0])),
+		Type:         string(fields[1]),
+		Suite:        string(fields[2]),
+		OldPubId:     string(fields[3]),
+		OldSignature: append([]byte{}, fields[5]...),
+		NewSignature: append([]byte{}, fields[6]...),
+	}
+	suite := suites.All()[h.Suite]
+	if suite == nil {
+		return nil, errors.New("Unsupported ciphersuite '" + h.Suite + "'")
+	}
+	h.NewPublicKey = suite.Point()
+	if err := h.NewPublicKey.UnmarshalBinary(fields[4]); err != nil {
+		return nil, errors.New("Cannot decode new public key. " + err.Error())
+	}
+	return h, nil
+}
+
+// Marshals the part of the handover covered by its signatures (see signedMessage): id, type,
+// suite, old key identifier and new key, each prefixed by its 2-byte length
+func (h *KeyHandover) signedBytes() ([]byte, error) {
+
+	pkBytes, err := h.NewPublicKey.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 4)
+	binary.BigEndian.PutUint32(id, uint32(h.Id))
+
+	var arr []byte
+	for _, field := range [][]byte{id, []byte(h.Type), []byte(h.Suite), []byte(h.OldPubId), pkBytes} {
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(field)))
+		arr = append(arr, length...)
+		arr = append(arr, field...)
+	}
+	return arr, nil
+}
+
+// Returns the message both keys sign: KEY_HANDOVER_SIGN_LABEL followed by signedBytes
+func (h *KeyHandover) signedMessage() ([]byte, error) {
+	arr, err := h.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(KEY_HANDOVER_SIGN_LABEL), arr...), nil
+}
+
+// Moves a rotated-out key's .sec and .pub files from a node's config folder into its archive folder
+func ArchiveKey(dir string, pubId string) error {
+
+	archiveDir := filepath.Join(dir, KEY_ARCHIVE_DIR)
+	if err := os.MkdirAll(archiveDir, 0700); err != nil {
+		return err
+	}
+	for _, ext := range []string{".sec", ".pub"} {
+		filename := filepath.Join(dir, pubId+ext)
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(filename, filepath.Join(archiveDir, pubId+ext)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"github.com/dedis/crypto/random"
+	"testing"
+)
+
+// A handover survives its PEM encoding, and only verifies under its label and the old key
+func TestKeyHandover(t *testing.T) {
+	c := &NodeConfig{}
+	c.GenKeyPair(CryptoSuite, random.Stream)
+	c.Id, c.Type = 3, NODE_TYPE_CLIENT
+	oldKey, oldPrivateKey := c.PublicKey, c.PrivateKey
+
+	h, err := c.RotateKey(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := h.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalKeyHandoverPEM(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.Verify(oldKey); err != nil {
+		t.Fatal("Decoded handover does not verify:", err)
+	}
+	if err := decoded.Verify(c.PublicKey); err == nil {
+		t.Fatal("Handover verified against the new key as the old one")
+	}
+
+	// Signatures of the bare fields, as the key would make for another kind of message
+	msg, err := h.signedBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlabelled := *h
+	if unlabelled.OldSignature, err = SchnorrSign(CryptoSuite, random.Stream, msg, oldPrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	if unlabelled.NewSignature, err = SchnorrSign(CryptoSuite, random.Stream, msg, c.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := unlabelled.Verify(oldKey); err == nil {
+		t.Fatal("Accepted a handover signed without its label")
+	}
+}
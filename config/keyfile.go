@@ -0,0 +1,145 @@
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/scrypt"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// Encrypted private key files start with this magic string, followed by a version byte.
+// Files without it are legacy plaintext keys.
+const KEY_FILE_MAGIC = "DAGASEC"
+const KEY_FILE_VERSION = 1
+
+// Environment variables a daemon can use to provide the passphrase of its private key
+const (
+	PASSPHRASE_ENV      = "DAGA_PASSPHRASE"
+	PASSPHRASE_FILE_ENV = "DAGA_PASSPHRASE_FILE"
+)
+
+// scrypt parameters used for new key files
+const (
+	KEY_FILE_SCRYPT_LOG_N = 15
+	KEY_FILE_SCRYPT_R     = 8
+	KEY_FILE_SCRYPT_P     = 1
+)
+
+const (
+	keyFileSaltSize   = 16
+	keyFileNonceSize  = 12
+	keyFileHeaderSize = len(KEY_FILE_MAGIC) + 1 + 1 + 4 + 4 + keyFileSaltSize + keyFileNonceSize
+)
+
+var ErrPassphraseRequired = errors.New("Private key is encrypted and no passphrase was given")
+var ErrWrongPassphrase = errors.New("Cannot decrypt private key: wrong passphrase or corrupted file")
+
+// Returns whether a private key file is encrypted
+func IsEncryptedKeyFile(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(KEY_FILE_MAGIC))
+}
+
+// Encrypts a private key with a key derived from a passphrase by scrypt, using AES-256-GCM.
+// The file is laid out as: magic, version, log2(N), r, p, salt, nonce, ciphertext.
+// The header is authenticated along with the ciphertext.
+func EncryptKeyFile(plaintext []byte, passphrase []byte) ([]byte, error) {
+
+	header := make([]byte, keyFileHeaderSize)
+	i := copy(header, KEY_FILE_MAGIC)
+	header[i] = KEY_FILE_VERSION
+	header[i+1] = KEY_FILE_SCRYPT_LOG_N
+	binary.BigEndian.PutUint32(header[i+2:i+6], KEY_FILE_SCRYPT_R)
+	binary.BigEndian.PutUint32(header[i+6:i+10], KEY_FILE_SCRYPT_P)
+	if _, err := rand.Read(header[i+10:]); err != nil { // Salt and nonce
+		return nil, err
+	}
+
+	aead, err := keyFileCipher(header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	nonce := header[keyFileHeaderSize-keyFileNonceSize:]
+	return aead.Seal(header, nonce, plaintext, header), nil
+}
+
+// Decrypts a private key file produced by EncryptKeyFile
+func DecryptKeyFile(data []byte, passphrase []byte) ([]byte, error) {
+
+	if !IsEncryptedKeyFile(data) {
+		return nil, errors.New("Not an encrypted key file")
+	}
+	if len(data) < keyFileHeaderSize {
+		return nil, errors.New("Encrypted key file is too short")
+	}
+	if version := data[len(KEY_FILE_MAGIC)]; version != KEY_FILE_VERSION {
+		return nil, errors.New("Unsupported key file version " + strconv.Itoa(int(version)))
+	}
+	if len(passphrase) == 0 {
+		return nil, ErrPassphraseRequired
+	}
+
+	header := data[:keyFileHeaderSize]
+	aead, err := keyFileCipher(header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	nonce := header[keyFileHeaderSize-keyFileNonceSize:]
+	plaintext, err := aead.Open(nil, nonce, data[keyFileHeaderSize:], header)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+// Reads a passphrase from a file, or from the environment if no file is given.
+// Returns nil if no passphrase is available. A single trailing newline is removed.
+func ReadPassphrase(passphraseFile string) ([]byte, error) {
+
+	if passphraseFile == "" {
+		passphraseFile = os.Getenv(PASSPHRASE_FILE_ENV)
+	}
+	if passphraseFile == "" {
+		if passphrase := os.Getenv(PASSPHRASE_ENV); passphrase != "" {
+			return []byte(passphrase), nil
+		}
+		return nil, nil
+	}
+
+	passphrase, err := ioutil.ReadFile(passphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	passphrase = bytes.TrimSuffix(passphrase, []byte("\n"))
+	passphrase = bytes.TrimSuffix(passphrase, []byte("\r"))
+	return passphrase, nil
+}
+
+// Derives the file's AES-256-GCM cipher from the passphrase and the header's scrypt parameters
+func keyFileCipher(header []byte, passphrase []byte) (cipher.AEAD, error) {
+
+	i := len(KEY_FILE_MAGIC) + 1
+	logN := uint(header[i])
+	r := int(binary.BigEndian.Uint32(header[i+1 : i+5]))
+	p := int(binary.BigEndian.Uint32(header[i+5 : i+9]))
+	salt := header[i+9 : i+9+keyFileSaltSize]
+
+	if logN < 10 || logN > 22 || r < 1 || r > 32 || p < 1 || p > 16 {
+		return nil, errors.New("Invalid key file parameters")
+	}
+
+	key, err := scrypt.Key(passphrase, salt, 1<<logN, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
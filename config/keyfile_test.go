@@ -0,0 +1,74 @@
+package config
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyFileRoundTrip(t *testing.T) {
+	plaintext := []byte("private key bytes")
+	passphrase := []byte("correct horse")
+
+	data, err := EncryptKeyFile(plaintext, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncryptedKeyFile(data) {
+		t.Fatal("Encrypted key file is not recognized")
+	}
+	if bytes.Contains(data, plaintext) {
+		t.Fatal("Encrypted key file contains the plaintext")
+	}
+	decrypted, err := DecryptKeyFile(data, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatal("Decrypted key differs from the original")
+	}
+
+	again, err := EncryptKeyFile(plaintext, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again, data) {
+		t.Fatal("Two encryptions use the same salt and nonce")
+	}
+}
+
+func TestKeyFileRejectsTampering(t *testing.T) {
+	passphrase := []byte("correct horse")
+	data, err := EncryptKeyFile([]byte("private key bytes"), passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := DecryptKeyFile(data, []byte("wrong horse")); err != ErrWrongPassphrase {
+		t.Fatal("Wrong passphrase gives", err)
+	}
+	if _, err := DecryptKeyFile(data, nil); err != ErrPassphraseRequired {
+		t.Fatal("Missing passphrase gives", err)
+	}
+	if _, err := DecryptKeyFile([]byte("plaintext key"), passphrase); err == nil {
+		t.Fatal("Plaintext key file decrypts")
+	}
+	if _, err := DecryptKeyFile(data[:keyFileHeaderSize-1], passphrase); err == nil {
+		t.Fatal("Truncated header decrypts")
+	}
+	if _, err := DecryptKeyFile(data[:len(data)-1], passphrase); err == nil {
+		t.Fatal("Truncated key file decrypts")
+	}
+
+	// The version, salt, nonce and ciphertext are all authenticated. Each try runs scrypt,
+	// so only the first and last bytes of each field are flipped.
+	version := len(KEY_FILE_MAGIC)
+	salt := keyFileHeaderSize - keyFileNonceSize - keyFileSaltSize
+	nonce := keyFileHeaderSize - keyFileNonceSize
+	for _, i := range []int{version, salt, nonce - 1, nonce, keyFileHeaderSize - 1, keyFileHeaderSize, len(data) - 1} {
+		tampered := append([]byte{}, data...)
+		tampered[i] ^= 0x01
+		if _, err := DecryptKeyFile(tampered, passphrase); err == nil {
+			t.Fatal("Key file with byte", i, "flipped decrypts")
+		}
+	}
+}
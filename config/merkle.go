@@ -0,0 +1,143 @@
+package config
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/dedis/crypto/abstract"
+)
+
+// Merkle tree over the roster's members, following the layout of RFC 6962:
+// leaves are hashed with a 0x00 prefix and inner nodes with a 0x01 prefix,
+// and a tree of n leaves is split at the largest power of two smaller than n.
+
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// Hashes a member's id and public key into a Merkle leaf
+func MerkleLeaf(suite abstract.Suite, id int, publicKey abstract.Point) ([]byte, error) {
+	pkBytes, err := publicKey.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 5, 5+len(pkBytes))
+	buf[0] = merkleLeafPrefix
+	binary.BigEndian.PutUint32(buf[1:5], uint32(id))
+	return abstract.Sum(suite, append(buf, pkBytes...)), nil
+}
+
+// Merkle tree kept in memory, so that proofs are computed in logarithmic time
+type MerkleTree struct {
+	hash  []byte
+	size  int
+	left  *MerkleTree
+	right *MerkleTree
+}
+
+// Builds the Merkle tree over the given leaves
+func NewMerkleTree(suite abstract.Suite, leaves [][]byte) *MerkleTree {
+	switch len(leaves) {
+	case 0:
+		return &MerkleTree{hash: abstract.Sum(suite, []byte{})}
+	case 1:
+		return &MerkleTree{hash: leaves[0], size: 1}
+	}
+	k := merkleSplit(len(leaves))
+	left := NewMerkleTree(suite, leaves[:k])
+	right := NewMerkleTree(suite, leaves[k:])
+	return &MerkleTree{
+		hash:  merkleNode(suite, left.hash, right.hash),
+		size:  len(leaves),
+		left:  left,
+		right: right,
+	}
+}
+
+// Returns the root of the tree
+func (t *MerkleTree) Root() []byte {
+	return t.hash
+}
+
+// Returns the number of leaves in the tree
+func (t *MerkleTree) Size() int {
+	return t.size
+}
+
+// Computes the audit path proving that the leaf at the given index is in the tree.
+// The path starts with the leaf's sibling and ends with a child of the root.
+func (t *MerkleTree) Proof(index int) ([][]byte, error) {
+	if index < 0 || index >= t.size {
+		return nil, errors.New("Merkle leaf index out of range")
+	}
+
+	var path [][]byte
+	for node := t; node.size > 1; {
+		k := merkleSplit(node.size)
+		if index < k {
+			path = append(path, node.right.hash)
+			node = node.left
+		} else {
+			path = append(path, node.left.hash)
+			node = node.right
+			index -= k
+		}
+	}
+
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, nil
+}
+
+// Verifies that a leaf is at the given index of a tree of size leaves with the given root
+func VerifyMerkleProof(suite abstract.Suite, root []byte, leaf []byte, index int, size int, proof [][]byte) error {
+
+	if index < 0 || index >= size {
+		return errors.New("Merkle leaf index out of range")
+	}
+
+	fn, sn := index, size-1
+	r := leaf
+	for _, p := range proof {
+		if sn == 0 {
+			return errors.New("Merkle proof is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNode(suite, p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNode(suite, r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return errors.New("Merkle proof is too short")
+	}
+	if !bytes.Equal(r, root) {
+		return errors.New("Merkle proof does not match the root")
+	}
+	return nil
+}
+
+func merkleNode(suite abstract.Suite, left []byte, right []byte) []byte {
+	buf := make([]byte, 1, 1+len(left)+len(right))
+	buf[0] = merkleNodePrefix
+	buf = append(buf, left...)
+	return abstract.Sum(suite, append(buf, right...))
+}
+
+// Returns the largest power of two smaller than n, for n > 1
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"strconv"
+	"testing"
+)
+
+func testMerkleLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = []byte("leaf " + strconv.Itoa(i))
+	}
+	return leaves
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		leaves := testMerkleLeaves(n)
+		tree := NewMerkleTree(CryptoSuite, leaves)
+		if tree.Size() != n {
+			t.Fatal("Tree of", n, "leaves has size", tree.Size())
+		}
+		for i, leaf := range leaves {
+			proof, err := tree.Proof(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyMerkleProof(CryptoSuite, tree.Root(), leaf, i, n, proof); err != nil {
+				t.Fatal("Leaf", i, "of", n, ":", err)
+			}
+		}
+	}
+}
+
+func TestMerkleProofsRejectMismatches(t *testing.T) {
+	leaves := testMerkleLeaves(7)
+	tree := NewMerkleTree(CryptoSuite, leaves)
+	proof, err := tree.Proof(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := tree.Root()
+
+	if err := VerifyMerkleProof(CryptoSuite, root, leaves[4], 3, 7, proof); err == nil {
+		t.Fatal("Proof verifies another leaf")
+	}
+	if err := VerifyMerkleProof(CryptoSuite, root, leaves[3], 2, 7, proof); err == nil {
+		t.Fatal("Proof verifies at another index")
+	}
+	if err := VerifyMerkleProof(CryptoSuite, root, leaves[3], 3, 8, proof); err == nil {
+		t.Fatal("Proof verifies for another tree size")
+	}
+	if err := VerifyMerkleProof(CryptoSuite, root, leaves[3], 3, 7, proof[1:]); err == nil {
+		t.Fatal("Truncated proof verifies")
+	}
+	if err := VerifyMerkleProof(CryptoSuite, root, leaves[3], 3, 7, append(proof, root)); err == nil {
+		t.Fatal("Extended proof verifies")
+	}
+	if err := VerifyMerkleProof(CryptoSuite, root, leaves[3], 7, 7, proof); err == nil {
+		t.Fatal("Proof verifies out of range")
+	}
+	if _, err := tree.Proof(7); err == nil {
+		t.Fatal("Proof computed out of range")
+	}
+}
+
+// The member tree commits to every member's id and key
+func TestRosterMemberTree(t *testing.T) {
+	roster, _ := newTestRoster(t, 6, 1)
+	tree, err := roster.MemberTree(CryptoSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range roster.MemberIds() {
+		leaf, err := MerkleLeaf(CryptoSuite, id, roster.Clients[id])
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := tree.Proof(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyMerkleProof(CryptoSuite, tree.Root(), leaf, i, tree.Size(), proof); err != nil {
+			t.Fatal("Member", id, ":", err)
+		}
+		other, err := MerkleLeaf(CryptoSuite, id+100, roster.Clients[id])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyMerkleProof(CryptoSuite, tree.Root(), other, i, tree.Size(), proof); err == nil {
+			t.Fatal("Member", id, "verifies under another id")
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package config
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/cipher"
+	"sort"
+)
+
+// Public key roster of a deployment, signed by the administrator.
+// Relay, trustees and clients only accept rosters that carry a valid administrator signature,
+// so the relay can neither swap in its own trustees nor shrink the set of members.
+type Roster struct {
+	Version   int                    // Incremented by the administrator on every change
+	Clients   map[int]abstract.Point // Members' public keys
+	Trustees  map[int]abstract.Point // Trustees' public keys
+	Signature []byte                 // Administrator's signature over the roster's header
+}
+
+// Part of the roster covered by the administrator's signature.
+// Members are committed to by the root of a Merkle tree over their ids and keys in increasing
+// id order, so that the header can be sent and checked without the full member list.
+type RosterHeader struct {
+	Version     int
+	MemberCount int
+	MemberRoot  []byte
+	Trustees    map[int]abstract.Point
+	Signature   []byte
+}
+
+// Returns a copy of the roster without its signature
+func (r *Roster) Clone() *Roster {
+	clone := &Roster{
+		Version:  r.Version,
+		Clients:  make(map[int]abstract.Point, len(r.Clients)),
+		Trustees: make(map[int]abstract.Point, len(r.Trustees)),
+	}
+	for id, pub := range r.Clients {
+		clone.Clients[id] = pub
+	}
+	for id, pub := range r.Trustees {
+		clone.Trustees[id] = pub
+	}
+	return clone
+}
+
+// Returns the members' ids in increasing order, which is the order of the Merkle tree's leaves
+func (r *Roster) MemberIds() []int {
+	ids := make([]int, 0, len(r.Clients))
+	for id := range r.Clients {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Computes the Merkle leaves of the roster's members
+func (r *Roster) MemberLeaves(suite abstract.Suite) ([][]byte, error) {
+	ids := r.MemberIds()
+	leaves := make([][]byte, len(ids))
+	for i, id := range ids {
+		leaf, err := MerkleLeaf(suite, id, r.Clients[id])
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = leaf
+	}
+	return leaves, nil
+}
+
+// Builds the Merkle tree over the roster's members
+func (r *Roster) MemberTree(suite abstract.Suite) (*MerkleTree, error) {
+	leaves, err := r.MemberLeaves(suite)
+	if err != nil {
+		return nil, err
+	}
+	return NewMerkleTree(suite, leaves), nil
+}
+
+// Computes the roster's header, carrying the roster's signature
+func (r *Roster) Header(suite abstract.Suite) (*RosterHeader, error) {
+	tree, err := r.MemberTree(suite)
+	if err != nil {
+		return nil, err
+	}
+	return r.HeaderWithTree(tree), nil
+}
+
+// Returns the roster's header for an already built member tree
+func (r *Roster) HeaderWithTree(tree *MerkleTree) *RosterHeader {
+	return &RosterHeader{
+		Version:     r.Version,
+		MemberCount: tree.Size(),
+		MemberRoot:  tree.Root(),
+		Trustees:    r.Trustees,
+		Signature:   r.Signature,
+	}
+}
+
+// Signs the roster's header with the administrator's private key
+func (r *Roster) Sign(suite abstract.Suite, random cipher.Stream, adminKey abstract.Scalar) error {
+	header, err := r.Header(suite)
+	if err != nil {
+		return err
+	}
+	msg, err := header.signedBytes()
+	if err != nil {
+		return err
+	}
+	if r.Signature, err = SchnorrSign(suite, random, msg, adminKey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Verifies the administrator's signature on the roster
+func (r *Roster) Verify(suite abstract.Suite, adminPublicKey abstract.Point) error {
+	header, err := r.Header(suite)
+	if err != nil {
+		return err
+	}
+	return header.Verify(suite, adminPublicKey)
+}
+
+// Returns the digest of the roster's header
+func (r *Roster) Digest(suite abstract.Suite) ([]byte, error) {
+	header, err := r.Header(suite)
+	if err != nil {
+		return nil, err
+	}
+	return header.Digest(suite)
+}
+
+// Marshals the roster together with its signature
+func (r *Roster) MarshalBinary() ([]byte, error) {
+
+	arr := make([]byte, 4)
+	binary.BigEndian.PutUint32(arr, uint32(r.Version))
+
+	for _, pointsMap := range []map[int]abstract.Point{r.Clients, r.Trustees} {
+		mapBytes, err := MarshalPointsMap(pointsMap)
+		if err != nil {
+			return nil, err
+		}
+		mapLength := make([]byte, 4)
+		binary.BigEndian.PutUint32(mapLength, uint32(len(mapBytes)))
+		arr = append(arr, mapLength...)
+		arr = append(arr, mapBytes...)
+	}
+
+	sigLength := make([]byte, 2)
+	binary.BigEndian.PutUint16(sigLength, uint16(len(r.Signature)))
+	arr = append(arr, sigLength...)
+	arr = append(arr, r.Signature...)
+	return arr, nil
+}
+
+// Unmarshals a roster produced by MarshalBinary. The signature is not verified.
+func UnmarshalRoster(suite abstract.Suite, arr []byte) (*Roster, error) {
+
+	if len(arr) < 4 {
+		return nil, errors.New("Roster is too short")
+	}
+	r := &Roster{}
+	r.Version = int(binary.BigEndian.Uint32(arr[0:4]))
+
+	var err error
+	i := 4
+	for _, pointsMap := range []*map[int]abstract.Point{&r.Clients, &r.Trustees} {
+		if *pointsMap, i, err = unmarshalPointsMapAt(suite, arr, i); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.Signature, err = unmarshalSignatureAt(arr, i); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Verifies the administrator's signature on the header
+func (h *RosterHeader) Verify(suite abstract.Suite, adminPublicKey abstract.Point) error {
+	if adminPublicKey == nil {
+		return errors.New("No administrator key to verify the roster with")
+	}
+	if len(h.Signature) == 0 {
+		return errors.New("Roster is not signed")
+	}
+	msg, err := h.signedBytes()
+	if err != nil {
+		return err
+	}
+	if err := SchnorrVerify(suite, msg, adminPublicKey, h.Signature); err != nil {
+		return errors.New("Invalid roster signature. " + err.Error())
+	}
+	return nil
+}
+
+// Returns a digest of the signed part of the header.
+// Trustees send it with their authentication context so that clients can check
+// the context was built from the roster they verified.
+func (h *RosterHeader) Digest(suite abstract.Suite) ([]byte, error) {
+	msg, err := h.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	return abstract.Sum(suite, msg), nil
+}
+
+// Marshals the header together with its signature
+func (h *RosterHeader) MarshalBinary() ([]byte, error) {
+	arr, err := h.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	sigLength := make([]byte, 2)
+	binary.BigEndian.PutUint16(sigLength, uint16(len(h.Signature)))
+	arr = append(arr, sigLength...)
+	arr = append(arr, h.Signature...)
+	return arr, nil
+}
+
+// Unmarshals a header produced by MarshalBinary. The signature is not verified.
+func UnmarshalRosterHeader(suite abstract.Suite, arr []byte) (*RosterHeader, error) {
+
+	if len(arr) < 10 {
+		return nil, errors.New("Roster header is too short")
+	}
+	h := &RosterHeader{}
+	h.Version = int(binary.BigEndian.Uint32(arr[0:4]))
+	h.MemberCount = int(binary.BigEndian.Uint32(arr[4:8]))
+
+	rootLen := int(binary.BigEndian.Uint16(arr[8:10]))
+	if len(arr) < 10+rootLen {
+		return nil, errors.New("Roster header is too short")
+	}
+	h.MemberRoot = append([]byte{}, arr[10:10+rootLen]...)
+
+	var err error
+	i := 10 + rootLen
+	if h.Trustees, i, err = unmarshalPointsMapAt(suite, arr, i); err != nil {
+		return nil, err
+	}
+	if h.Signature, err = unmarshalSignatureAt(arr, i); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Marshals the part of the header covered by the administrator's signature:
+// version, member count, member root and the length-prefixed trustees map.
+func (h *RosterHeader) signedBytes() ([]byte, error) {
+
+	arr := make([]byte, 10, 10+len(h.MemberRoot))
+	binary.BigEndian.PutUint32(arr[0:4], uint32(h.Version))
+	binary.BigEndian.PutUint32(arr[4:8], uint32(h.MemberCount))
+	binary.BigEndian.PutUint16(arr[8:10], uint16(len(h.MemberRoot)))
+	arr = append(arr, h.MemberRoot...)
+
+	mapBytes, err := MarshalPointsMap(h.Trustees)
+	if err != nil {
+		return nil, err
+	}
+	mapLength := make([]byte, 4)
+	binary.BigEndian.PutUint32(mapLength, uint32(len(mapBytes)))
+	arr = append(arr, mapLength...)
+	arr = append(arr, mapBytes...)
+	return arr, nil
+}
+
+// Unmarshals a length-prefixed points map at offset i, and returns the offset following it
+func unmarshalPointsMapAt(suite abstract.Suite, arr []byte, i int) (map[int]abstract.Point, int, error) {
+	if len(arr) < i+4 {
+		return nil, 0, errors.New("Roster is too short")
+	}
+	mapLen64 := int64(binary.BigEndian.Uint32(arr[i : i+4]))
+	if mapLen64 > int64(len(arr)-i-4) {
+		return nil, 0, errors.New("Roster is too short")
+	}
+	mapLen := int(mapLen64)
+	pointsMap, err := UnmarshalPointsMap(suite, arr[i+4:i+4+mapLen])
+	if err != nil {
+		return nil, 0, err
+	}
+	return pointsMap, i + 4 + mapLen, nil
+}
+
+// Unmarshals a length-prefixed signature that must end the array at offset i
+func unmarshalSignatureAt(arr []byte, i int) ([]byte, error) {
+	if len(arr) < i+2 {
+		return nil, errors.New("Roster is too short")
+	}
+	sigLen := int(binary.BigEndian.Uint16(arr[i : i+2]))
+	if len(arr) != i+2+sigLen {
+		return nil, errors.New("Roster has an invalid signature length")
+	}
+	return append([]byte{}, arr[i+2:]...), nil
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/random"
+	"testing"
+)
+
+// Returns a roster of the given numbers of clients and trustees, with fresh keys, signed with
+// a fresh administrator key, along with the administrator's public key. Clients get the ids
+// 1..nClients and trustees the following ones.
+func newTestRoster(tb testing.TB, nClients int, nTrustees int) (*Roster, abstract.Point) {
+	tb.Helper()
+
+	suite := CryptoSuite
+	roster := &Roster{
+		Version:  1,
+		Clients:  make(map[int]abstract.Point),
+		Trustees: make(map[int]abstract.Point),
+	}
+	for i := 1; i <= nClients+nTrustees; i++ {
+		pub := suite.Point().Mul(nil, suite.Scalar().Pick(random.Stream))
+		if i <= nClients {
+			roster.Clients[i] = pub
+		} else {
+			roster.Trustees[i] = pub
+		}
+	}
+	adminKey := suite.Scalar().Pick(random.Stream)
+	if err := roster.Sign(suite, random.Stream, adminKey); err != nil {
+		tb.Fatal(err)
+	}
+	return roster, suite.Point().Mul(nil, adminKey)
+}
+
+func TestRosterRoundTrip(t *testing.T) {
+	roster, adminPublicKey := newTestRoster(t, 5, 2)
+
+	data, err := roster.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalRoster(CryptoSuite, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.Verify(CryptoSuite, adminPublicKey); err != nil {
+		t.Fatal("Decoded roster does not verify:", err)
+	}
+	if decoded.Version != roster.Version || len(decoded.Clients) != 5 || len(decoded.Trustees) != 2 {
+		t.Fatal("Decoded roster differs from the original")
+	}
+	for id, pub := range roster.Clients {
+		if !decoded.Clients[id].Equal(pub) {
+			t.Fatal("Client", id, "has another key once decoded")
+		}
+	}
+}
+
+func TestRosterVerifyRejectsChanges(t *testing.T) {
+	roster, adminPublicKey := newTestRoster(t, 3, 1)
+
+	changed := roster.Clone()
+	changed.Signature = roster.Signature
+	changed.Version++
+	if err := changed.Verify(CryptoSuite, adminPublicKey); err == nil {
+		t.Fatal("Roster with another version verifies")
+	}
+
+	changed = roster.Clone()
+	changed.Signature = roster.Signature
+	delete(changed.Clients, 1)
+	if err := changed.Verify(CryptoSuite, adminPublicKey); err == nil {
+		t.Fatal("Roster without a member verifies")
+	}
+
+	otherAdmin := CryptoSuite.Point().Mul(nil, CryptoSuite.Scalar().Pick(random.Stream))
+	if err := roster.Verify(CryptoSuite, otherAdmin); err == nil {
+		t.Fatal("Roster verifies with another administrator's key")
+	}
+}
+
+func TestUnmarshalRosterMalformed(t *testing.T) {
+	roster, _ := newTestRoster(t, 3, 1)
+	data, err := roster.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 0; n < len(data); n++ {
+		if _, err := UnmarshalRoster(CryptoSuite, data[:n]); err == nil {
+			t.Fatal("Roster truncated to", n, "bytes unmarshals")
+		}
+	}
+	if _, err := UnmarshalRoster(CryptoSuite, append(data, 0)); err == nil {
+		t.Fatal("Roster with trailing data unmarshals")
+	}
+}
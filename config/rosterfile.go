@@ -0,0 +1,296 @@
+package config
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/BurntSushi/toml"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/base64"
+	"github.com/dedis/crypto/suites"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const (
+	ROSTER_FORMAT_TOML = "toml"
+	ROSTER_FORMAT_JSON = "json"
+)
+
+// PEM block type of a node's public key file
+const PUBLIC_KEY_PEM_TYPE = "DAGA PUBLIC KEY"
+
+// Human-readable roster entry
+type RosterEntry struct {
+	Id    int    // Node id
+	Name  string // Node name
+	Type  string // Node type (Client or Trustee)
+	Suite string // Cipher suite name
+	Point string // Public key (base64)
+	PubId string // Public key identifier, checked against Point on import
+}
+
+// Human-readable roster, for administrators to review and edit membership by hand
+type RosterFile struct {
+	Version   int           // Roster version. Must be increased whenever membership changes.
+	Signature string        // Administrator's signature (base64), informative only
+	Members   []RosterEntry // Clients
+	Trustees  []RosterEntry // Trustees
+}
+
+// Converts a roster into its human-readable form.
+// Node names are looked up in nodesInfo; nodes missing from it are left unnamed.
+func ExportRoster(suite abstract.Suite, roster *Roster, nodesInfo []NodeInfo) (*RosterFile, error) {
+
+	names := make(map[int]string, len(nodesInfo))
+	for _, info := range nodesInfo {
+		names[info.Id] = info.Name
+	}
+
+	f := &RosterFile{
+		Version:   roster.Version,
+		Signature: base64.StdEncoding.EncodeToString(roster.Signature),
+	}
+
+	var err error
+	if f.Members, err = exportEntries(suite, roster.Clients, names, NODE_TYPE_CLIENT); err != nil {
+		return nil, err
+	}
+	if f.Trustees, err = exportEntries(suite, roster.Trustees, names, NODE_TYPE_TRUSTEE); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Converts a human-readable roster back into an unsigned roster.
+// Fails on unknown suites, entries on another suite than the first one, keys that do not
+// match their PubId, and duplicate ids or keys.
+func (f *RosterFile) Roster() (*Roster, error) {
+
+	if _, err := f.Suite(); err != nil {
+		return nil, err
+	}
+
+	roster := &Roster{
+		Version:  f.Version,
+		Clients:  make(map[int]abstract.Point),
+		Trustees: make(map[int]abstract.Point),
+	}
+	pubIds := make(map[string]bool)
+
+	for _, group := range []struct {
+		entries  []RosterEntry
+		nodeType string
+		points   map[int]abstract.Point
+	}{
+		{f.Members, NODE_TYPE_CLIENT, roster.Clients},
+		{f.Trustees, NODE_TYPE_TRUSTEE, roster.Trustees},
+	} {
+		for _, entry := range group.entries {
+			if entry.Type != "" && entry.Type != group.nodeType {
+				return nil, errors.New("Entry " + strconv.Itoa(entry.Id) + " has type " + entry.Type + ", expected " + group.nodeType)
+			}
+			if _, exists := roster.Clients[entry.Id]; exists {
+				return nil, errors.New("Duplicate roster id " + strconv.Itoa(entry.Id))
+			}
+			if _, exists := roster.Trustees[entry.Id]; exists {
+				return nil, errors.New("Duplicate roster id " + strconv.Itoa(entry.Id))
+			}
+
+			point, err := entry.PublicKey()
+			if err != nil {
+				return nil, err
+			}
+			pubId := PublicKeyId(suites.All()[entry.Suite], point)
+			if pubIds[pubId] {
+				return nil, errors.New("Duplicate public key " + pubId)
+			}
+			pubIds[pubId] = true
+			group.points[entry.Id] = point
+		}
+	}
+	return roster, nil
+}
+
+// Decodes an entry's public key and checks it against the entry's PubId
+func (e *RosterEntry) PublicKey() (abstract.Point, error) {
+
+	suite := suites.All()[e.Suite]
+	if suite == nil {
+		return nil, errors.New("Unsupported ciphersuite '" + e.Suite + "' for entry " + strconv.Itoa(e.Id))
+	}
+	point, err := DecodePoint(suite, e.Point)
+	if err != nil {
+		return nil, errors.New("Cannot decode public key of entry " + strconv.Itoa(e.Id) + ". " + err.Error())
+	}
+	if e.PubId != "" && PublicKeyId(suite, point) != e.PubId {
+		return nil, errors.New("Public key of entry " + strconv.Itoa(e.Id) + " does not match PubId " + e.PubId)
+	}
+	return point, nil
+}
+
+// Returns the suite of the roster's entries, which must all use the same one
+func (f *RosterFile) Suite() (string, error) {
+	suite := ""
+	for _, entries := range [][]RosterEntry{f.Trustees, f.Members} {
+		for _, entry := range entries {
+			if suite == "" {
+				suite = entry.Suite
+			} else if entry.Suite != suite {
+				return "", errors.New("Entry " + strconv.Itoa(entry.Id) + " uses suite " + entry.Suite + ", expected " + suite)
+			}
+		}
+	}
+	return suite, nil
+}
+
+// Writes a human-readable roster in the given format
+func WriteRosterFile(w io.Writer, f *RosterFile, format string) error {
+	switch format {
+	case ROSTER_FORMAT_TOML:
+		return toml.NewEncoder(w).Encode(f)
+	case ROSTER_FORMAT_JSON:
+		buf, err := json.MarshalIndent(f, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(buf, '\n'))
+		return err
+	}
+	return errors.New("Unknown roster format '" + format + "'")
+}
+
+// Reads a human-readable roster in the given format
+func ReadRosterFile(r io.Reader, format string) (*RosterFile, error) {
+	f := &RosterFile{}
+	switch format {
+	case ROSTER_FORMAT_TOML:
+		if _, err := toml.DecodeReader(r, f); err != nil {
+			return nil, err
+		}
+	case ROSTER_FORMAT_JSON:
+		if err := json.NewDecoder(r).Decode(f); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Unknown roster format '" + format + "'")
+	}
+	return f, nil
+}
+
+// Returns the roster format matching a file name's extension, TOML by default
+func RosterFormatFromFilename(filename string) string {
+	if filepath.Ext(filename) == ".json" {
+		return ROSTER_FORMAT_JSON
+	}
+	return ROSTER_FORMAT_TOML
+}
+
+// Encodes a node's public key into a PEM block whose headers carry the node's information
+func EncodePublicKeyPEM(info NodeInfo, publicKey abstract.Point) ([]byte, error) {
+	buf, err := publicKey.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	block := &pem.Block{
+		Type: PUBLIC_KEY_PEM_TYPE,
+		Headers: map[string]string{
+			"Id":    strconv.Itoa(info.Id),
+			"Name":  info.Name,
+			"Type":  info.Type,
+			"Suite": info.Suite,
+			"PubId": info.PubId,
+		},
+		Bytes: buf,
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// Decodes a public key file written by EncodePublicKeyPEM into a roster entry
+func DecodePublicKeyPEM(data []byte) (*RosterEntry, error) {
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != PUBLIC_KEY_PEM_TYPE {
+		return nil, errors.New("No " + PUBLIC_KEY_PEM_TYPE + " block found")
+	}
+	id, err := strconv.Atoi(block.Headers["Id"])
+	if err != nil {
+		return nil, errors.New("Invalid Id header. " + err.Error())
+	}
+
+	entry := &RosterEntry{
+		Id:    id,
+		Name:  block.Headers["Name"],
+		Type:  block.Headers["Type"],
+		Suite: block.Headers["Suite"],
+		Point: base64.StdEncoding.EncodeToString(block.Bytes),
+		PubId: block.Headers["PubId"],
+	}
+	if _, err := entry.PublicKey(); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Builds a human-readable roster from a folder of per-node public key files (*.pub).
+// Clients and trustees are told apart by the Type header of each file.
+func RosterFromKeyDir(dir string) (*RosterFile, error) {
+
+	filenames, err := filepath.Glob(filepath.Join(dir, "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(filenames)
+
+	f := &RosterFile{Version: 1}
+	for _, filename := range filenames {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := DecodePublicKeyPEM(data)
+		if err != nil {
+			return nil, errors.New(filename + ": " + err.Error())
+		}
+
+		switch entry.Type {
+		case NODE_TYPE_CLIENT:
+			f.Members = append(f.Members, *entry)
+		case NODE_TYPE_TRUSTEE:
+			f.Trustees = append(f.Trustees, *entry)
+		default:
+			return nil, errors.New(filename + ": node type '" + entry.Type + "' cannot be in a roster")
+		}
+	}
+	return f, nil
+}
+
+// Converts a points map into roster entries sorted by id
+func exportEntries(suite abstract.Suite, points map[int]abstract.Point, names map[int]string, nodeType string) ([]RosterEntry, error) {
+
+	ids := make([]int, 0, len(points))
+	for id := range points {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	entries := make([]RosterEntry, len(ids))
+	for i, id := range ids {
+		point, err := EncodePoint(points[id])
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = RosterEntry{
+			Id:    id,
+			Name:  names[id],
+			Type:  nodeType,
+			Suite: suite.String(),
+			Point: point,
+			PubId: PublicKeyId(suite, points[id]),
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"errors"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/cipher"
+)
+
+// Signs a message with a Schnorr signature.
+// The signature is the challenge c followed by the response r, where
+// c = H(g^k || message) and r = k - c*x for a random k and the private key x.
+func SchnorrSign(suite abstract.Suite, random cipher.Stream, message []byte, privateKey abstract.Scalar) ([]byte, error) {
+
+	k := suite.Scalar().Pick(random)
+	R := suite.Point().Mul(nil, k)
+
+	c, err := schnorrChallenge(suite, R, message)
+	if err != nil {
+		return nil, err
+	}
+	r := suite.Scalar().Sub(k, suite.Scalar().Mul(c, privateKey))
+
+	cBytes, err := c.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	rBytes, err := r.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(cBytes, rBytes...), nil
+}
+
+// Verifies a Schnorr signature produced by SchnorrSign
+func SchnorrVerify(suite abstract.Suite, message []byte, publicKey abstract.Point, signature []byte) error {
+
+	scalarLen := suite.ScalarLen()
+	if len(signature) != 2*scalarLen {
+		return errors.New("Invalid Schnorr signature length")
+	}
+
+	c := suite.Scalar()
+	if err := c.UnmarshalBinary(signature[:scalarLen]); err != nil {
+		return err
+	}
+	r := suite.Scalar()
+	if err := r.UnmarshalBinary(signature[scalarLen:]); err != nil {
+		return err
+	}
+
+	// Reconstruct the commitment g^k = g^r * Y^c and recompute the challenge
+	R := suite.Point().Add(suite.Point().Mul(nil, r), suite.Point().Mul(publicKey, c))
+	c2, err := schnorrChallenge(suite, R, message)
+	if err != nil {
+		return err
+	}
+	if !c.Equal(c2) {
+		return errors.New("Invalid Schnorr signature")
+	}
+	return nil
+}
+
+// Hashes the signer's commitment and the message into a challenge scalar
+func schnorrChallenge(suite abstract.Suite, R abstract.Point, message []byte) (abstract.Scalar, error) {
+	Rb, err := R.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	c := suite.Cipher(append(Rb, message...))
+	return suite.Scalar().Pick(c), nil
+}
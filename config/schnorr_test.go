@@ -0,0 +1,53 @@
+package config
+
+import (
+	"github.com/dedis/crypto/random"
+	"testing"
+)
+
+func TestSchnorrRoundTrip(t *testing.T) {
+	suite := CryptoSuite
+	key := suite.Scalar().Pick(random.Stream)
+	pub := suite.Point().Mul(nil, key)
+	msg := []byte("roster update")
+
+	sig, err := SchnorrSign(suite, random.Stream, msg, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SchnorrVerify(suite, msg, pub, sig); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SchnorrVerify(suite, []byte("roster updatE"), pub, sig); err == nil {
+		t.Fatal("Signature verifies another message")
+	}
+	other := suite.Point().Mul(nil, suite.Scalar().Pick(random.Stream))
+	if err := SchnorrVerify(suite, msg, other, sig); err == nil {
+		t.Fatal("Signature verifies under another key")
+	}
+}
+
+func TestSchnorrMalformed(t *testing.T) {
+	suite := CryptoSuite
+	key := suite.Scalar().Pick(random.Stream)
+	pub := suite.Point().Mul(nil, key)
+	msg := []byte("announcement")
+
+	sig, err := SchnorrSign(suite, random.Stream, msg, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range [][]byte{nil, sig[:len(sig)-1], append(append([]byte{}, sig...), 0)} {
+		if err := SchnorrVerify(suite, msg, pub, bad); err == nil {
+			t.Fatal("Signature of", len(bad), "bytes verifies")
+		}
+	}
+	for i := range sig {
+		flipped := append([]byte{}, sig...)
+		flipped[i] ^= 0x01
+		if err := SchnorrVerify(suite, msg, pub, flipped); err == nil {
+			t.Fatal("Signature with byte", i, "flipped verifies")
+		}
+	}
+}
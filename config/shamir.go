@@ -0,0 +1,198 @@
+package config
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/cipher"
+	"github.com/dedis/crypto/suites"
+	"strconv"
+)
+
+// PEM block type of a private key share
+const KEY_SHARE_PEM_TYPE = "DAGA KEY SHARE"
+
+// Share of a private key split with Shamir's secret sharing: any Threshold of the
+// Total shares recover the key, while fewer reveal nothing about it
+type KeyShare struct {
+	Suite     string          // Cipher suite name
+	PubId     string          // Identifier of the public key, to check the recovered key against
+	Threshold int             // Number of shares needed to recover the key
+	Total     int             // Number of shares the key was split into
+	Index     int             // Share index, in 1..Total
+	Value     abstract.Scalar // Value of the sharing polynomial at Index
+}
+
+// Splits the node's private key into n shares, any k of which recover it
+func (c *NodeConfig) SplitPrivateKey(k int, n int, random cipher.Stream) ([]*KeyShare, error) {
+
+	suite := suites.All()[c.Suite]
+	if suite == nil {
+		return nil, errors.New("Unsupported ciphersuite '" + c.Suite + "'")
+	}
+	if c.PrivateKey == nil {
+		return nil, errors.New("The node's private key is not loaded")
+	}
+	if k < 1 || n < k || n > 255 {
+		return nil, errors.New("Invalid sharing: need 1 <= k <= n <= 255, got k=" + strconv.Itoa(k) + ", n=" + strconv.Itoa(n))
+	}
+
+	// Random polynomial f of degree k-1 with f(0) = private key
+	coeffs := make([]abstract.Scalar, k)
+	coeffs[0] = c.PrivateKey
+	for i := 1; i < k; i++ {
+		coeffs[i] = suite.Scalar().Pick(random)
+	}
+
+	shares := make([]*KeyShare, n)
+	for i := 1; i <= n; i++ {
+		x := suite.Scalar().SetInt64(int64(i))
+		y := suite.Scalar().Zero()
+		for j := k - 1; j >= 0; j-- { // Horner's rule
+			y = suite.Scalar().Mul(y, x)
+			y = suite.Scalar().Add(y, coeffs[j])
+		}
+		shares[i-1] = &KeyShare{
+			Suite:     c.Suite,
+			PubId:     c.PubId,
+			Threshold: k,
+			Total:     n,
+			Index:     i,
+			Value:     y,
+		}
+	}
+	return shares, nil
+}
+
+// Recovers a private key from at least Threshold shares of the same key, and checks
+// the result against the shares' PubId
+func RecoverPrivateKey(shares []*KeyShare) (abstract.Scalar, error) {
+
+	if len(shares) == 0 {
+		return nil, errors.New("No key share given")
+	}
+	first := shares[0]
+	suite := suites.All()[first.Suite]
+	if suite == nil {
+		return nil, errors.New("Unsupported ciphersuite '" + first.Suite + "'")
+	}
+
+	indices := make(map[int]bool)
+	for _, share := range shares {
+		if share.Suite != first.Suite || share.PubId != first.PubId || share.Threshold != first.Threshold {
+			return nil, errors.New("Key shares belong to different keys or sharings")
+		}
+		if share.Index < 1 || share.Index > share.Total || indices[share.Index] {
+			return nil, errors.New("Invalid or duplicate key share index " + strconv.Itoa(share.Index))
+		}
+		indices[share.Index] = true
+	}
+	if len(shares) < first.Threshold {
+		return nil, errors.New("Need " + strconv.Itoa(first.Threshold) + " key shares, got " + strconv.Itoa(len(shares)))
+	}
+	shares = shares[:first.Threshold]
+
+	// Lagrange interpolation of the polynomial at 0
+	secret := suite.Scalar().Zero()
+	for i, si := range shares {
+		num := suite.Scalar().One()
+		den := suite.Scalar().One()
+		xi := suite.Scalar().SetInt64(int64(si.Index))
+		for j, sj := range shares {
+			if i == j {
+				continue
+			}
+			xj := suite.Scalar().SetInt64(int64(sj.Index))
+			num = suite.Scalar().Mul(num, xj)
+			den = suite.Scalar().Mul(den, suite.Scalar().Sub(xj, xi))
+		}
+		term := suite.Scalar().Mul(si.Value, suite.Scalar().Div(num, den))
+		secret = suite.Scalar().Add(secret, term)
+	}
+
+	if PublicKeyId(suite, suite.Point().Mul(nil, secret)) != first.PubId {
+		return nil, errors.New("Recovered key does not match public key " + first.PubId + "; a share is corrupted")
+	}
+	return secret, nil
+}
+
+// Sets a recovered private key, which must match the node's PubId
+func (c *NodeConfig) SetPrivateKey(privateKey abstract.Scalar) error {
+	suite := suites.All()[c.Suite]
+	if suite == nil {
+		return errors.New("Unsupported ciphersuite '" + c.Suite + "'")
+	}
+	publicKey := suite.Point().Mul(nil, privateKey)
+	if PublicKeyId(suite, publicKey) != c.PubId {
+		return errors.New("Private key does not yield public key " + c.PubId)
+	}
+	c.PrivateKey = privateKey
+	c.PublicKey = publicKey
+	return nil
+}
+
+// Encodes a share into a printable PEM block
+func (s *KeyShare) MarshalPEM() ([]byte, error) {
+	buf, err := s.Value.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	block := &pem.Block{
+		Type: KEY_SHARE_PEM_TYPE,
+		Headers: map[string]string{
+			"Suite":     s.Suite,
+			"PubId":     s.PubId,
+			"Threshold": strconv.Itoa(s.Threshold),
+			"Total":     strconv.Itoa(s.Total),
+			"Index":     strconv.Itoa(s.Index),
+		},
+		Bytes: buf,
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// Decodes every share found in PEM-encoded data
+func UnmarshalKeySharesPEM(data []byte) ([]*KeyShare, error) {
+
+	var shares []*KeyShare
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != KEY_SHARE_PEM_TYPE {
+			continue
+		}
+
+		share := &KeyShare{Suite: block.Headers["Suite"], PubId: block.Headers["PubId"]}
+		suite := suites.All()[share.Suite]
+		if suite == nil {
+			return nil, errors.New("Unsupported ciphersuite '" + share.Suite + "'")
+		}
+		for _, field := range []struct {
+			name  string
+			value *int
+		}{
+			{"Threshold", &share.Threshold},
+			{"Total", &share.Total},
+			{"Index", &share.Index},
+		} {
+			var err error
+			if *field.value, err = strconv.Atoi(block.Headers[field.name]); err != nil {
+				return nil, errors.New("Invalid " + field.name + " header in key share. " + err.Error())
+			}
+		}
+		share.Value = suite.Scalar()
+		if err := share.Value.UnmarshalBinary(block.Bytes); err != nil {
+			return nil, errors.New("Cannot decode key share " + strconv.Itoa(share.Index) + ". " + err.Error())
+		}
+		shares = append(shares, share)
+	}
+
+	if len(bytes.TrimSpace(data)) != 0 {
+		return nil, errors.New("Unexpected data after the key shares")
+	}
+	return shares, nil
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"github.com/dedis/crypto/random"
+	"testing"
+)
+
+func newTestNode(t *testing.T) *NodeConfig {
+	c := &NodeConfig{}
+	c.Suite = CryptoSuite.String()
+	c.GenKeyPair(CryptoSuite, random.Stream)
+	return c
+}
+
+func TestSplitRecoverPrivateKey(t *testing.T) {
+	c := newTestNode(t)
+	shares, err := c.SplitPrivateKey(3, 5, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Any 3 shares recover the key, in any order
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var picked []*KeyShare
+		for _, i := range subset {
+			picked = append(picked, shares[i])
+		}
+		key, err := RecoverPrivateKey(picked)
+		if err != nil {
+			t.Fatal("Shares", subset, ":", err)
+		}
+		if !key.Equal(c.PrivateKey) {
+			t.Fatal("Shares", subset, "recover another key")
+		}
+	}
+
+	if _, err := RecoverPrivateKey(shares[:2]); err == nil {
+		t.Fatal("Two shares of a 3-of-5 sharing recover a key")
+	}
+	if _, err := RecoverPrivateKey([]*KeyShare{shares[0], shares[0], shares[1]}); err == nil {
+		t.Fatal("Duplicate shares recover a key")
+	}
+}
+
+func TestRecoverPrivateKeyRejectsBadShares(t *testing.T) {
+	c := newTestNode(t)
+	shares, err := c.SplitPrivateKey(2, 3, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupted := *shares[1]
+	corrupted.Value = CryptoSuite.Scalar().Add(corrupted.Value, CryptoSuite.Scalar().One())
+	if _, err := RecoverPrivateKey([]*KeyShare{shares[0], &corrupted}); err == nil {
+		t.Fatal("Corrupted share recovers a key")
+	}
+
+	other, err := newTestNode(t).SplitPrivateKey(2, 3, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RecoverPrivateKey([]*KeyShare{shares[0], other[1]}); err == nil {
+		t.Fatal("Shares of different keys recover a key")
+	}
+
+	for _, kn := range [][2]int{{0, 3}, {4, 3}, {2, 256}} {
+		if _, err := c.SplitPrivateKey(kn[0], kn[1], random.Stream); err == nil {
+			t.Fatal("Split with k =", kn[0], "and n =", kn[1], "succeeds")
+		}
+	}
+}
+
+func TestKeySharesPEM(t *testing.T) {
+	c := newTestNode(t)
+	shares, err := c.SplitPrivateKey(2, 3, random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for _, share := range shares {
+		block, err := share.MarshalPEM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, block...)
+	}
+
+	decoded, err := UnmarshalKeySharesPEM(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(shares) {
+		t.Fatal("Decoded", len(decoded), "shares out of", len(shares))
+	}
+	key, err := RecoverPrivateKey(decoded[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(c.PrivateKey) {
+		t.Fatal("Decoded shares recover another key")
+	}
+
+	if _, err := UnmarshalKeySharesPEM(append(data, "garbage"...)); err == nil {
+		t.Fatal("Shares followed by garbage decode")
+	}
+}
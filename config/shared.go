@@ -1,14 +1,53 @@
 package config
 
 import (
+	"errors"
 	"github.com/dedis/crypto/nist"
+	"github.com/dedis/crypto/suites"
 )
 
 // Used to make sure everybody has the same version of the software. must be updated manually
 const LLD_PROTOCOL_VERSION = 3
 
+// Oldest protocol version still spoken. Nodes agree on the highest version in
+// [MIN_PROTOCOL_VERSION, LLD_PROTOCOL_VERSION] they both speak, so that they can be upgraded one at a time.
+const MIN_PROTOCOL_VERSION = 3
+
+// Largest message frame accepted from peers when a node's config does not set one.
+// Larger messages are sent in chunks (see net.WriteStream).
+const DEFAULT_MAX_FRAME_SIZE = 1 << 20
+
+// Smallest maximum frame size a node may set, which still fits the handshakes
+const MIN_FRAME_SIZE = 4096
+
+// Largest message reassembled from chunks when a node's config does not set one
+const DEFAULT_MAX_MESSAGE_SIZE = 64 << 20
+
 // Number of times to retry connecting to a node
 const NUM_RETRY_CONNECT = 3
 
+// Environment variable setting the folder that holds the nodes' config folders
+const CONFIG_ROOT_ENV = "DAGA_CONFIG_ROOT"
+
+// Number of previous versions of a node's config and roster kept by NodeConfig.Save.
+// The private key is not backed up (see NodeConfig.SaveDir).
+const CONFIG_BACKUPS = 3
+
+// Name of the administrator's config folder when a deployment does not name it
+const DEFAULT_ADMIN_NAME = "prifi-admin"
+
+// Smallest anonymity set a client accepts when its config does not set one
+const DEFAULT_MIN_ANONYMITY_SET = 2
+
 // Sets the crypto suite used
 var CryptoSuite = nist.NewAES128SHA256P256()
+
+// Makes the protocols use the cipher suite of the given name, e.g. the suite of a node's config
+func UseCryptoSuite(name string) error {
+	suite := suites.All()[name]
+	if suite == nil {
+		return errors.New("Unsupported ciphersuite '" + name + "'")
+	}
+	CryptoSuite = suite
+	return nil
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha512"
+	"errors"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/suites"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Name of the cipher suite Ed25519 keys are imported on
+const ED25519_SUITE = "Ed25519"
+
+// Order of the Ed25519 base point
+var ed25519Order, _ = new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+
+// Returns the Ed25519 suite, failing if it is not built in
+func Ed25519Suite() (abstract.Suite, error) {
+	suite := suites.All()[ED25519_SUITE]
+	if suite == nil {
+		return nil, errors.New("Ciphersuite " + ED25519_SUITE + " is not supported")
+	}
+	return suite, nil
+}
+
+// Converts a 32-byte Ed25519 public key into a point of the Ed25519 suite
+func ImportEd25519PublicKey(suite abstract.Suite, publicKey []byte) (abstract.Point, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("Ed25519 public keys are " + strconv.Itoa(ed25519.PublicKeySize) + " bytes long")
+	}
+	point := suite.Point()
+	if err := point.UnmarshalBinary(publicKey); err != nil {
+		return nil, errors.New("Invalid Ed25519 public key. " + err.Error())
+	}
+	return point, nil
+}
+
+// Converts an Ed25519 private key into a scalar of the Ed25519 suite, as specified by RFC 8032:
+// the clamped first half of the SHA-512 hash of the seed, reduced modulo the group order.
+// The result is checked against the key's public half.
+func ImportEd25519PrivateKey(suite abstract.Suite, privateKey ed25519.PrivateKey) (abstract.Scalar, error) {
+
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return nil, errors.New("Ed25519 private keys are " + strconv.Itoa(ed25519.PrivateKeySize) + " bytes long")
+	}
+	h := sha512.Sum512(privateKey.Seed())
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+
+	// The hash is little-endian, as are the suite's marshaled scalars
+	be := make([]byte, 32)
+	for i := range be {
+		be[i] = h[31-i]
+	}
+	n := new(big.Int).SetBytes(be)
+	n.Mod(n, ed25519Order)
+
+	le := make([]byte, 32)
+	nb := n.Bytes()
+	for i := range nb {
+		le[i] = nb[len(nb)-1-i]
+	}
+	scalar := suite.Scalar()
+	if err := scalar.UnmarshalBinary(le); err != nil {
+		return nil, err
+	}
+
+	pub, err := ImportEd25519PublicKey(suite, privateKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	if !suite.Point().Mul(nil, scalar).Equal(pub) {
+		return nil, errors.New("Imported private key does not match its public key")
+	}
+	return scalar, nil
+}
+
+// Parses an OpenSSH public key line ("ssh-ed25519 AAAA... comment") into an Ed25519 public key
+// and the line's comment
+func ParseSSHPublicKey(line []byte) (ed25519.PublicKey, string, error) {
+
+	sshKey, comment, _, _, err := ssh.ParseAuthorizedKey(line)
+	if err != nil {
+		return nil, "", err
+	}
+	cryptoKey, ok := sshKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, "", errors.New("Unsupported SSH key")
+	}
+	publicKey, ok := cryptoKey.CryptoPublicKey().(ed25519.PublicKey)
+	if !ok {
+		return nil, "", errors.New("Only ssh-ed25519 keys can be imported, got " + sshKey.Type())
+	}
+	return publicKey, comment, nil
+}
+
+// Parses an OpenSSH private key file holding an Ed25519 key.
+// The passphrase is only needed for encrypted key files.
+func ParseSSHPrivateKey(data []byte, passphrase []byte) (ed25519.PrivateKey, error) {
+
+	var key interface{}
+	var err error
+	if len(passphrase) > 0 {
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+	} else {
+		key, err = ssh.ParseRawPrivateKey(data)
+	}
+	if err != nil {
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			return nil, errors.New("SSH private key is encrypted and no passphrase was given")
+		}
+		return nil, err
+	}
+
+	switch k := key.(type) {
+	case *ed25519.PrivateKey:
+		return *k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+	return nil, errors.New("Only Ed25519 SSH private keys can be imported")
+}
+
+// Builds roster entries from OpenSSH public key lines, as found in authorized_keys files.
+// Entries are given increasing ids from firstId, and are named after the lines' comments.
+// Empty lines and comment lines are skipped.
+func RosterEntriesFromSSH(data []byte, firstId int, nodeType string) ([]RosterEntry, error) {
+
+	suite, err := Ed25519Suite()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []RosterEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		publicKey, comment, err := ParseSSHPublicKey([]byte(line))
+		if err != nil {
+			return nil, errors.New("Line " + strconv.Itoa(lineNum) + ": " + err.Error())
+		}
+		point, err := ImportEd25519PublicKey(suite, publicKey)
+		if err != nil {
+			return nil, errors.New("Line " + strconv.Itoa(lineNum) + ": " + err.Error())
+		}
+		encoded, err := EncodePoint(point)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, RosterEntry{
+			Id:    firstId + len(entries),
+			Name:  comment,
+			Type:  nodeType,
+			Suite: suite.String(),
+			Point: encoded,
+			PubId: PublicKeyId(suite, point),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Replaces the node's key pair with an Ed25519 key imported from an OpenSSH private key file.
+// The node must already be on the Ed25519 suite, as its roster and peers are: a node cannot
+// change suites on its own. Its PubId changes to the imported key's.
+func (c *NodeConfig) ImportSSHPrivateKey(data []byte, passphrase []byte) error {
+
+	if c.Suite != ED25519_SUITE {
+		return errors.New("SSH keys can only be imported into nodes of the " + ED25519_SUITE + " suite, not " + c.Suite)
+	}
+	suite, err := Ed25519Suite()
+	if err != nil {
+		return err
+	}
+	privateKey, err := ParseSSHPrivateKey(data, passphrase)
+	if err != nil {
+		return err
+	}
+	scalar, err := ImportEd25519PrivateKey(suite, privateKey)
+	if err != nil {
+		return err
+	}
+
+	c.PrivateKey = scalar
+	c.PublicKey = suite.Point().Mul(nil, scalar)
+	c.PubId = PublicKeyId(suite, c.PublicKey)
+	return nil
+}
@@ -6,6 +6,7 @@ const (
 	NODE_TYPE_RELAY   = "Relay"
 	NODE_TYPE_TRUSTEE = "Trustee"
 	NODE_TYPE_CLIENT  = "Client"
+	NODE_TYPE_ADMIN   = "Admin"
 )
 
 // Node's personal information
@@ -15,6 +16,9 @@ type NodeInfo struct {
 	Type  string // Node type
 	Suite string // Cipher suite name
 	PubId string // My public key identifier. Used to validate the secret key file
+
+	ListenAddrs    []string // Addresses (host:port) the node listens on
+	AdvertiseAddrs []string // Addresses (host:port) other nodes reach the node at, in order of preference
 }
 
 // Node's public configuration information
@@ -23,6 +27,16 @@ type nodePubConfig struct {
 	NodeInfo              // My public info
 	NodesInfo  []NodeInfo // Other nodes' public info
 	AuthMethod int        // Authentication method
+	AdminKey   string     // Administrator's public key (base64), used to verify the roster
+	KeySocket  string     // Unix socket of a signer process holding the private key, instead of the .sec file
+
+	MaxFrameSize   int // Largest message frame accepted from peers, in bytes (0 means DEFAULT_MAX_FRAME_SIZE)
+	MaxMessageSize int // Largest message accepted in chunks, in bytes (0 means DEFAULT_MAX_MESSAGE_SIZE)
+
+	AnnounceAddr string // UDP broadcast or multicast address (host:port) the relay announces to clients on (empty: over TCP only)
+
+	MinAnonymitySet int      // Clients refuse to authenticate among fewer members (0 means DEFAULT_MIN_ANONYMITY_SET)
+	RequiredMembers []string // PubIds of members a client requires in its anonymity set
 }
 
 // Node's configuration
@@ -30,8 +44,12 @@ type nodePubConfig struct {
 type NodeConfig struct {
 	nodePubConfig // Node's information
 
-	PublicKey  abstract.Point
-	PrivateKey abstract.Scalar
+	PublicKey      abstract.Point
+	PrivateKey     abstract.Scalar
+	AdminPublicKey abstract.Point // Decoded from AdminKey
+
+	Roster *Roster // Signed public key roster of all clients and trustees
 
-	PublicKeyRoster map[int]abstract.Point // Other nodes' public keys
+	passphrase   []byte // Protects the private key file
+	keyEncrypted bool   // Whether the private key file is encrypted
 }
@@ -0,0 +1,227 @@
+package config
+
+import (
+	"errors"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/suites"
+	"strconv"
+	"strings"
+)
+
+// Kind of problem found in a node's config folder
+type ConfigErrorKind int
+
+const (
+	CONFIG_ERROR_MISSING_FILE      ConfigErrorKind = iota // A required file does not exist
+	CONFIG_ERROR_SYNTAX                                   // A file cannot be parsed
+	CONFIG_ERROR_MISSING_FIELD                            // A required field is empty
+	CONFIG_ERROR_INVALID_FIELD                            // A field has an invalid value
+	CONFIG_ERROR_UNSUPPORTED_SUITE                        // A cipher suite is unknown
+	CONFIG_ERROR_KEY                                      // The private key cannot be read or does not match PubId
+	CONFIG_ERROR_ROSTER                                   // The roster is corrupted, unsigned or inconsistent
+)
+
+var configErrorKindNames = map[ConfigErrorKind]string{
+	CONFIG_ERROR_MISSING_FILE:      "missing file",
+	CONFIG_ERROR_SYNTAX:            "syntax error",
+	CONFIG_ERROR_MISSING_FIELD:     "missing field",
+	CONFIG_ERROR_INVALID_FIELD:     "invalid field",
+	CONFIG_ERROR_UNSUPPORTED_SUITE: "unsupported suite",
+	CONFIG_ERROR_KEY:               "key error",
+	CONFIG_ERROR_ROSTER:            "roster error",
+}
+
+func (k ConfigErrorKind) String() string {
+	return configErrorKindNames[k]
+}
+
+// A problem found while loading a node's config folder
+type ConfigError struct {
+	Kind  ConfigErrorKind
+	File  string // File the problem was found in
+	Field string // Offending field, if any
+	Err   error  // Underlying error, e.g. ErrPassphraseRequired
+}
+
+func (e *ConfigError) Error() string {
+	s := e.File + ": "
+	if e.Field != "" {
+		s += e.Field + ": "
+	}
+	return s + e.Err.Error()
+}
+
+// Every problem found while loading a node's config folder
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Returns whether one of the problems is of the given kind
+func (errs ConfigErrors) Has(kind ConfigErrorKind) bool {
+	for _, err := range errs {
+		if err.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (errs *ConfigErrors) add(kind ConfigErrorKind, file string, field string, err error) {
+	*errs = append(*errs, &ConfigError{Kind: kind, File: file, Field: field, Err: err})
+}
+
+func (errs *ConfigErrors) addf(kind ConfigErrorKind, file string, field string, msg string) {
+	errs.add(kind, file, field, errors.New(msg))
+}
+
+// Loads a node's config folder and returns every problem found, or nil if there is none.
+// An encrypted private key is decrypted with passphrase.
+func CheckDir(dir string, passphrase []byte) ConfigErrors {
+	c := &NodeConfig{}
+	c.SetPassphrase(passphrase)
+	return c.loadDir(dir)
+}
+
+// Checks the fields of the node's public config
+func (c *NodeConfig) checkPubConfig(filename string, errs *ConfigErrors) {
+
+	checkNodeInfo(&c.NodeInfo, filename, "", errs)
+	if c.Type == NODE_TYPE_RELAY && c.Id != 0 {
+		errs.addf(CONFIG_ERROR_INVALID_FIELD, filename, "Id", "The relay's id must be 0")
+	}
+	if c.AdminKey == "" {
+		errs.addf(CONFIG_ERROR_MISSING_FIELD, filename, "AdminKey", "Required to verify the roster")
+	}
+	if c.AuthMethod < 0 {
+		errs.addf(CONFIG_ERROR_INVALID_FIELD, filename, "AuthMethod", "Must not be negative")
+	}
+	if c.MinAnonymitySet < 0 {
+		errs.addf(CONFIG_ERROR_INVALID_FIELD, filename, "MinAnonymitySet", "Must not be negative")
+	}
+	if c.MaxFrameSize != 0 && c.MaxFrameSize < MIN_FRAME_SIZE {
+		errs.addf(CONFIG_ERROR_INVALID_FIELD, filename, "MaxFrameSize", "Must be 0 or at least "+strconv.Itoa(MIN_FRAME_SIZE))
+	}
+	if c.MaxMessageSize < 0 {
+		errs.addf(CONFIG_ERROR_INVALID_FIELD, filename, "MaxMessageSize", "Must not be negative")
+	}
+	if c.AnnounceAddr != "" {
+		if err := CheckAddrs([]string{c.AnnounceAddr}); err != nil {
+			errs.add(CONFIG_ERROR_INVALID_FIELD, filename, "AnnounceAddr", err)
+		}
+	}
+
+	ids := map[int]bool{c.Id: true}
+	pubIds := map[string]bool{c.PubId: true}
+	for i := range c.NodesInfo {
+		info := &c.NodesInfo[i]
+		field := "NodesInfo[" + strconv.Itoa(i) + "]."
+		checkNodeInfo(info, filename, field, errs)
+		if ids[info.Id] {
+			errs.addf(CONFIG_ERROR_INVALID_FIELD, filename, field+"Id", "Duplicate node id "+strconv.Itoa(info.Id))
+		}
+		if info.PubId != "" && pubIds[info.PubId] {
+			errs.addf(CONFIG_ERROR_INVALID_FIELD, filename, field+"PubId", "Duplicate public key "+info.PubId)
+		}
+		ids[info.Id] = true
+		pubIds[info.PubId] = true
+	}
+}
+
+// Checks the required fields, type, suite and addresses of a node's information
+func checkNodeInfo(info *NodeInfo, filename string, field string, errs *ConfigErrors) {
+
+	if info.Name == "" {
+		errs.addf(CONFIG_ERROR_MISSING_FIELD, filename, field+"Name", "Required")
+	}
+	switch info.Type {
+	case NODE_TYPE_RELAY, NODE_TYPE_TRUSTEE, NODE_TYPE_CLIENT, NODE_TYPE_ADMIN:
+	case "":
+		errs.addf(CONFIG_ERROR_MISSING_FIELD, filename, field+"Type", "Required")
+	default:
+		errs.addf(CONFIG_ERROR_INVALID_FIELD, filename, field+"Type", "Unknown node type '"+info.Type+"'")
+	}
+	if info.Id < 0 {
+		errs.addf(CONFIG_ERROR_INVALID_FIELD, filename, field+"Id", "Must not be negative")
+	}
+	if info.Suite == "" {
+		errs.addf(CONFIG_ERROR_MISSING_FIELD, filename, field+"Suite", "Required")
+	} else if suites.All()[info.Suite] == nil {
+		errs.addf(CONFIG_ERROR_UNSUPPORTED_SUITE, filename, field+"Suite", "Unsupported ciphersuite '"+info.Suite+"'")
+	}
+	if info.PubId == "" {
+		errs.addf(CONFIG_ERROR_MISSING_FIELD, filename, field+"PubId", "Required")
+	}
+	if err := CheckAddrs(info.ListenAddrs); err != nil {
+		errs.add(CONFIG_ERROR_INVALID_FIELD, filename, field+"ListenAddrs", err)
+	}
+	if err := CheckAddrs(info.AdvertiseAddrs); err != nil {
+		errs.add(CONFIG_ERROR_INVALID_FIELD, filename, field+"AdvertiseAddrs", err)
+	}
+}
+
+// Checks the roster's consistency: positive ids that are either a client's or a trustee's,
+// no key used twice, and agreement with the node's own key and with the nodes it knows
+func (c *NodeConfig) checkRoster(suite abstract.Suite, filename string, errs *ConfigErrors) {
+
+	r := c.Roster
+	if len(r.Trustees) == 0 {
+		errs.addf(CONFIG_ERROR_ROSTER, filename, "", "Roster has no trustee")
+	}
+
+	pubIds := make(map[string]int)
+	for _, group := range []map[int]abstract.Point{r.Clients, r.Trustees} {
+		for id, pub := range group {
+			if id <= 0 {
+				errs.addf(CONFIG_ERROR_ROSTER, filename, "", "Invalid roster id "+strconv.Itoa(id))
+			}
+			pubId := PublicKeyId(suite, pub)
+			if other, exists := pubIds[pubId]; exists {
+				errs.addf(CONFIG_ERROR_ROSTER, filename, "", "Ids "+strconv.Itoa(other)+" and "+strconv.Itoa(id)+" share public key "+pubId)
+			}
+			pubIds[pubId] = id
+		}
+	}
+	for id := range r.Clients {
+		if _, exists := r.Trustees[id]; exists {
+			errs.addf(CONFIG_ERROR_ROSTER, filename, "", "Id "+strconv.Itoa(id)+" is both a client and a trustee")
+		}
+	}
+
+	// The node itself, then every node it knows, must appear in the roster with its type and key
+	if c.Type == NODE_TYPE_CLIENT || c.Type == NODE_TYPE_TRUSTEE {
+		c.checkRosterEntry(suite, c.NodeInfo, filename, "", errs)
+	}
+	for i, info := range c.NodesInfo {
+		if info.Type == NODE_TYPE_CLIENT || info.Type == NODE_TYPE_TRUSTEE {
+			c.checkRosterEntry(suite, info, filename, "NodesInfo["+strconv.Itoa(i)+"]", errs)
+		}
+	}
+}
+
+func (c *NodeConfig) checkRosterEntry(suite abstract.Suite, info NodeInfo, filename string, field string, errs *ConfigErrors) {
+
+	expected, other := c.Roster.Clients, c.Roster.Trustees
+	if info.Type == NODE_TYPE_TRUSTEE {
+		expected, other = other, expected
+	}
+	name := info.Name + " (id " + strconv.Itoa(info.Id) + ")"
+
+	if _, exists := other[info.Id]; exists {
+		errs.addf(CONFIG_ERROR_ROSTER, filename, field, name+" is a "+info.Type+" but the roster lists another type")
+		return
+	}
+	pub, exists := expected[info.Id]
+	if !exists {
+		errs.addf(CONFIG_ERROR_ROSTER, filename, field, name+" is not in the roster")
+		return
+	}
+	if PublicKeyId(suite, pub) != info.PubId {
+		errs.addf(CONFIG_ERROR_ROSTER, filename, field, "Roster key of "+name+" does not match PubId "+info.PubId)
+	}
+}
@@ -0,0 +1,474 @@
+package daga
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dedis/crypto/abstract"
+	"github.com/mahdiz/daga/config"
+	daganet "github.com/mahdiz/daga/net"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Relay announcements reach every client with one write: they are sent over UDP broadcast or
+// multicast to the config's AnnounceAddr (see daganet.DialBroadcast). Clients without broadcast
+// subscribe over their TCP connection to the relay instead, and clients that lost broadcast
+// announcements fetch them again over TCP. Every announcement is signed by the relay and
+// numbered, so forged or replayed datagrams are dropped by clients. Subscribers are written to
+// by their own goroutine from a bounded queue, so that a slow client is dropped rather than
+// holding up the others.
+// Announcements are numbered like the broadcast messages carrying them, so that clients place
+// themselves in the broadcast stream from the announcements they fetch over TCP, rather than
+// from unauthenticated datagrams (see daganet.DatagramConn.Sync).
+
+// Signs the relay's announcements and sends them to all clients
+type Announcer struct {
+	keys        KeyStore
+	conn        *daganet.DatagramConn // Broadcast connection, nil if clients are only reached over TCP
+	lock        sync.Mutex
+	next        uint64
+	history     []RelayAnnouncement // Last ANNOUNCE_HISTORY announcements, oldest first
+	subscribers []*subscriber       // Clients reached over TCP
+}
+
+// Client subscribed to announcements over TCP
+type subscriber struct {
+	conn   net.Conn
+	queue  chan queuedMessage
+	failed chan struct{} // Closed when a write failed
+}
+
+type queuedMessage struct {
+	contextId int
+	msg       interface{}
+}
+
+// Creates the relay's announcer, broadcasting to the config's AnnounceAddr if it is set.
+// Sequence numbers start from the current time, so that they keep increasing when the relay restarts.
+func NewAnnouncer(c *config.NodeConfig, keys KeyStore) (*Announcer, error) {
+	a := &Announcer{keys: keys, next: uint64(time.Now().UnixNano())}
+	if c.AnnounceAddr != "" {
+		conn, err := daganet.DialBroadcast(c.AnnounceAddr, &daganet.DatagramConfig{FirstSequence: a.next})
+		if err != nil {
+			return nil, err
+		}
+		a.conn = conn
+	}
+	return a, nil
+}
+
+// Signs an announcement and sends it to all clients. Subscribers that failed or fell
+// ANNOUNCE_QUEUE_SIZE messages behind are dropped.
+// An announcement that cannot be broadcast is not kept for clients catching up.
+func (a *Announcer) Announce(ctx context.Context, kind int, rosterVersion int, payload []byte) error {
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	msg := &RelayAnnouncement{Announcement: AnnouncementBody{
+		Sequence:      a.next,
+		Kind:          uint8(kind),
+		RosterVersion: rosterVersion,
+		Payload:       payload,
+	}}
+	body, err := signedBody(SIGN_LABEL_ANNOUNCEMENT, &msg.Announcement)
+	if err != nil {
+		return errors.New("Cannot marshal announcement. " + err.Error())
+	}
+	msg.Signature, err = a.keys.Sign(body)
+	if err != nil {
+		return errors.New("Cannot sign announcement. " + err.Error())
+	}
+
+	if a.conn != nil {
+		data, err := daganet.Encode(&daganet.Envelope{ContextId: uint32(rosterVersion), Message: msg})
+		if err != nil {
+			return err
+		}
+		if err := a.conn.Send(data); err != nil {
+			// Stay numbered like the broadcast messages, whether this one took a number or not
+			a.next = a.conn.NextSequence()
+			return errors.New("Cannot broadcast announcement. " + err.Error())
+		}
+	}
+	a.next++
+
+	a.history = append(a.history, *msg)
+	if len(a.history) > ANNOUNCE_HISTORY {
+		a.history = a.history[len(a.history)-ANNOUNCE_HISTORY:]
+	}
+
+	subscribers := a.subscribers[:0]
+	for _, s := range a.subscribers {
+		if !s.push(queuedMessage{contextId: rosterVersion, msg: msg}) {
+			close(s.queue)
+			s.conn.Close()
+			continue
+		}
+		subscribers = append(subscribers, s)
+	}
+	a.subscribers = subscribers
+	return nil
+}
+
+// Sends a client the announcements it missed, and subscribes it if it asked to
+func (a *Announcer) serveRequest(ctx context.Context, conn net.Conn, req *AnnouncementsReq) error {
+
+	a.lock.Lock()
+	reply := &Announcements{Oldest: a.next}
+	if len(a.history) > 0 {
+		reply.Oldest = a.history[0].Announcement.Sequence
+	}
+	for _, msg := range a.history {
+		if msg.Announcement.Sequence > req.After {
+			reply.Announcements = append(reply.Announcements, msg)
+		}
+	}
+
+	// A subscriber's reply is queued ahead of the announcements that follow it
+	if req.Subscribe {
+		s := &subscriber{conn: conn, queue: make(chan queuedMessage, ANNOUNCE_QUEUE_SIZE), failed: make(chan struct{})}
+		s.push(queuedMessage{msg: reply})
+		a.subscribers = append(a.subscribers, s)
+		a.lock.Unlock()
+		go s.run()
+		return nil
+	}
+	a.lock.Unlock()
+
+	if err := writeMessage(ctx, conn, 0, 0, reply); err != nil {
+		return errors.New("Cannot write to the client. " + err.Error())
+	}
+	return nil
+}
+
+// Stops broadcasting and writing to subscribers, once their queued messages are written.
+// Subscribers' connections are left open.
+func (a *Announcer) Close() error {
+	a.lock.Lock()
+	for _, s := range a.subscribers {
+		close(s.queue)
+	}
+	a.subscribers = nil
+	a.lock.Unlock()
+
+	if a.conn != nil {
+		return a.conn.Close()
+	}
+	return nil
+}
+
+// Queues a message for the subscriber, unless a write failed or the queue is full
+func (s *subscriber) push(m queuedMessage) bool {
+	select {
+	case <-s.failed:
+		return false
+	default:
+	}
+	select {
+	case s.queue <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+// Writes the queued messages until the queue is closed. A failed write closes the connection,
+// and the messages queued until the subscriber is dropped are discarded.
+func (s *subscriber) run() {
+	for m := range s.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), ANNOUNCE_WRITE_TIMEOUT)
+		err := writeMessage(ctx, s.conn, 0, m.contextId, m.msg)
+		cancel()
+		if err != nil {
+			s.conn.Close()
+			close(s.failed)
+			for range s.queue {
+			}
+			return
+		}
+	}
+}
+
+// Fetches an authentication context from a trustee and announces it to all clients
+func (p *RelayProtocol) AnnounceAuthContext(ctx context.Context) error {
+	p.trusteeLock.Lock()
+	defer p.trusteeLock.Unlock()
+
+	p.rosterLock.RLock()
+	roster := p.Roster
+	p.rosterLock.RUnlock()
+	if roster == nil {
+		return errors.New("The relay has no roster")
+	}
+	return p.announceAuthContext(ctx, roster)
+}
+
+// Announces the authentication context of a roster the relay just committed. The roster
+// already took effect, so a failed announcement is reported rather than returned: clients
+// fetch the context from the trustees when they authenticate. trusteeLock must be held.
+func (p *RelayProtocol) announceCommitted(ctx context.Context, roster *config.Roster) {
+	if p.Announcer == nil {
+		return
+	}
+	if err := p.announceAuthContext(ctx, roster); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot announce the authentication context of roster version "+
+			strconv.Itoa(roster.Version)+". "+err.Error())
+	}
+}
+
+// Announces a downstream cell to all clients
+func (p *RelayProtocol) AnnounceDownstream(ctx context.Context, cell []byte) error {
+	if p.Announcer == nil {
+		return errors.New("The relay has no announcer")
+	}
+	p.rosterLock.RLock()
+	version := p.Roster.Version
+	p.rosterLock.RUnlock()
+	return p.Announcer.Announce(ctx, ANNOUNCE_DOWNSTREAM, version, cell)
+}
+
+// Fetches an authentication context built from the given roster from one of the trustees,
+// and announces it. The trustee's signature is checked so that clients are not sent bad contexts.
+// trusteeLock must be held, so that the request and reply do not interleave with a setup or update.
+func (p *RelayProtocol) announceAuthContext(ctx context.Context, roster *config.Roster) error {
+
+	if p.Announcer == nil {
+		return errors.New("The relay has no announcer")
+	}
+	version := roster.Version
+	digest, err := roster.Digest(config.CryptoSuite)
+	if err != nil {
+		return errors.New("Cannot compute roster digest. " + err.Error())
+	}
+	p.rosterLock.RLock()
+	if len(p.Trustees) == 0 {
+		p.rosterLock.RUnlock()
+		return errors.New("No trustee to fetch an authentication context from")
+	}
+	trustee := p.Trustees[0]
+	p.rosterLock.RUnlock()
+	if trustee.Conn == nil {
+		return errors.New("Trustee " + strconv.Itoa(trustee.Id) + " is not connected")
+	}
+
+	if err := writeMessage(ctx, trustee.Conn, 0, version, &ClientContextReq{}); err != nil {
+		return errors.New("Cannot write to trustee " + strconv.Itoa(trustee.Id) + ". " + err.Error())
+	}
+	env, err := expectMessage(ctx, trustee.Conn, TRUSTEE_AUTH_CONTEXT)
+	if err != nil {
+		return errors.New("Cannot read the authentication context of trustee " + strconv.Itoa(trustee.Id) + ". " + err.Error())
+	}
+	authContext := env.Message.(*AuthContext)
+	if err := checkAuthContext(authContext, trustee.Id, trustee.PublicKey, digest); err != nil {
+		return err
+	}
+
+	payload, err := daganet.EncodeBody(authContext)
+	if err != nil {
+		return err
+	}
+	return p.Announcer.Announce(ctx, ANNOUNCE_AUTH_CONTEXT, version, payload)
+}
+
+// Answers a client's request for missed announcements
+func (p *RelayProtocol) relayAnnouncementsReq(ctx context.Context, req *AnnouncementsReq, clientConn net.Conn) error {
+	if p.Announcer == nil {
+		return errors.New("The relay has no announcer")
+	}
+	return p.Announcer.serveRequest(ctx, clientConn, req)
+}
+
+// Checks that an authentication context was signed by the given trustee, and built from
+// the roster with the given digest
+func checkAuthContext(authContext *AuthContext, trusteeId int, trusteeKey abstract.Point, digest []byte) error {
+	if authContext.TrusteeId != trusteeId {
+		return errors.New("Authentication context was sent by " + strconv.Itoa(authContext.TrusteeId) +
+			" instead of trustee " + strconv.Itoa(trusteeId))
+	}
+	if !bytes.Equal(authContext.Context.RosterDigest, digest) {
+		return errors.New("Authentication context was not built from the current roster")
+	}
+	body, err := signedBody(SIGN_LABEL_AUTH_CONTEXT, &authContext.Context)
+	if err != nil {
+		return err
+	}
+	if err := config.SchnorrVerify(config.CryptoSuite, body, trusteeKey, authContext.Signature); err != nil {
+		return errors.New("Invalid authentication context signature. " + err.Error())
+	}
+	return nil
+}
+
+// Receives the relay's announcements: over broadcast if the client's config has an AnnounceAddr,
+// and over its TCP connection to the relay otherwise. Announcements lost in broadcast are
+// fetched from the relay over TCP. The listener reads from the relay connection, which must
+// not be read elsewhere meanwhile, except through RelayConn.
+type AnnouncementListener struct {
+	conn      *daganet.DatagramConn // nil when announcements come over TCP
+	relayConn *subscribedConn
+	relayKey  abstract.Point
+	last      uint64 // Sequence number of the last announcement delivered
+	pending   []AnnouncementBody
+}
+
+// Starts receiving the relay's announcements. The relay connection must be secured with
+// SecureOutgoing, so that the announcements' signatures are checked against the relay's key.
+// Clients listening on the broadcast address first fetch the relay's recent announcements over
+// TCP, which tell them where the broadcast stream is. Clients that cannot listen subscribe over TCP.
+func ListenAnnouncements(ctx context.Context, c *config.NodeConfig, relayConn net.Conn) (*AnnouncementListener, error) {
+
+	relayKey, err := relayPublicKey(c, relayConn)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &AnnouncementListener{relayKey: relayKey}
+	l.relayConn = &subscribedConn{SecureConn: secureRelayConn(relayConn), listener: l}
+	if c.AnnounceAddr != "" {
+		if conn, err := daganet.ListenBroadcast(c.AnnounceAddr, nil); err == nil {
+			l.conn = conn
+			if err := l.catchUp(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return l, nil
+		}
+	}
+
+	if err := writeMessage(ctx, l.relayConn, daganet.SENDER_ANONYMOUS, 0, &AnnouncementsReq{Subscribe: true}); err != nil {
+		return nil, errors.New("Cannot subscribe to announcements. " + err.Error())
+	}
+	return l, nil
+}
+
+// Returns the next announcement. Fails if announcements were lost for good, in which case
+// the following call returns the next announcement received.
+func (l *AnnouncementListener) Next(ctx context.Context) (*AnnouncementBody, error) {
+	for len(l.pending) == 0 {
+		if err := l.receive(ctx); err != nil {
+			return nil, err
+		}
+	}
+	a := l.pending[0]
+	l.pending = l.pending[1:]
+	return &a, nil
+}
+
+// Returns the relay connection, to be used instead of the one the listener was started with for
+// other exchanges with the relay, e.g. ClientAuthentication. The announcements the relay pushes
+// meanwhile to subscribers are kept for Next. It must not be used concurrently with Next.
+func (l *AnnouncementListener) RelayConn() net.Conn {
+	return l.relayConn
+}
+
+// Stops listening for broadcasts. The relay connection is left open.
+func (l *AnnouncementListener) Close() error {
+	if l.conn != nil {
+		return l.conn.Close()
+	}
+	return nil
+}
+
+// Receives announcements into the pending list
+func (l *AnnouncementListener) receive(ctx context.Context) error {
+
+	if l.conn == nil {
+		env, err := readMessage(ctx, l.relayConn)
+		if err != nil {
+			return err
+		}
+		return l.accept(env)
+	}
+
+	data, err := l.conn.Receive(ctx)
+	if _, lost := err.(*daganet.DatagramLossError); lost {
+		return l.catchUp(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Anyone may send to the broadcast address, so invalid announcements are dropped
+	env, err := daganet.Decode(config.CryptoSuite, data)
+	if err == nil {
+		l.accept(env)
+	}
+	return nil
+}
+
+// Fetches the announcements after the last one delivered from the relay, and resumes the
+// broadcast stream after them
+func (l *AnnouncementListener) catchUp(ctx context.Context) error {
+	if err := writeMessage(ctx, l.relayConn, daganet.SENDER_ANONYMOUS, 0, &AnnouncementsReq{After: l.last}); err != nil {
+		return errors.New("Cannot request missed announcements. " + err.Error())
+	}
+	env, err := expectMessage(ctx, l.relayConn, ANNOUNCEMENTS)
+	if err != nil {
+		return errors.New("Cannot read missed announcements. " + err.Error())
+	}
+	err = l.accept(env)
+
+	// The relay's next announcement follows the ones it holds, or is the oldest it would hold
+	next := env.Message.(*Announcements).Oldest
+	if l.last >= next {
+		next = l.last + 1
+	}
+	l.conn.Sync(next)
+	return err
+}
+
+func (l *AnnouncementListener) accept(env *daganet.Envelope) error {
+
+	switch msg := env.Message.(type) {
+	case *RelayAnnouncement:
+		return l.add(msg)
+
+	case *Announcements:
+		gap := l.last != 0 && msg.Oldest > l.last+1
+		for i := range msg.Announcements {
+			if err := l.add(&msg.Announcements[i]); err != nil {
+				return err
+			}
+		}
+		if gap {
+			return errors.New("Missed announcements the relay no longer holds")
+		}
+		return nil
+	}
+	return errors.New("Unexpected message type " + strconv.Itoa(int(env.Type)) + " among announcements")
+}
+
+// Checks an announcement's signature, and queues it unless it was already delivered
+func (l *AnnouncementListener) add(msg *RelayAnnouncement) error {
+	body, err := signedBody(SIGN_LABEL_ANNOUNCEMENT, &msg.Announcement)
+	if err != nil {
+		return err
+	}
+	if err := config.SchnorrVerify(config.CryptoSuite, body, l.relayKey, msg.Signature); err != nil {
+		return errors.New("Invalid announcement signature. " + err.Error())
+	}
+	if msg.Announcement.Sequence <= l.last {
+		return nil
+	}
+	l.last = msg.Announcement.Sequence
+	l.pending = append(l.pending, msg.Announcement)
+	return nil
+}
+
+// Returns the authentication context of an ANNOUNCE_AUTH_CONTEXT announcement.
+// Its signature must still be checked against the trustee's key in the roster.
+func (a *AnnouncementBody) AuthContext() (*AuthContext, error) {
+	if a.Kind != ANNOUNCE_AUTH_CONTEXT {
+		return nil, errors.New("Announcement does not hold an authentication context")
+	}
+	authContext := &AuthContext{}
+	if err := daganet.DecodeBody(config.CryptoSuite, a.Payload, authContext); err != nil {
+		return nil, errors.New("Cannot unmarshal authentication context. " + err.Error())
+	}
+	return authContext, nil
+}
@@ -0,0 +1,61 @@
+package daga
+
+import (
+	"context"
+	"github.com/mahdiz/daga/config"
+	"testing"
+)
+
+// A client subscribed over TCP receives the relay's announcements, and refuses those not signed by the relay
+func TestAnnouncementSubscriber(t *testing.T) {
+	for _, forged := range []bool{false, true} {
+		relay, relayKeys := newTestNode(t, config.NODE_TYPE_RELAY, 0)
+		client, clientKeys := newTestNode(t, config.NODE_TYPE_CLIENT, 1)
+		client.NodesInfo = []config.NodeInfo{relay.NodeInfo}
+
+		signer := relayKeys
+		if forged {
+			_, signer = newTestNode(t, config.NODE_TYPE_RELAY, 0)
+		}
+		announcer, err := NewAnnouncer(relay, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &RelayProtocol{Announcer: announcer}
+
+		ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+		clientEnd, relayEnd := securePipe(t, client, clientKeys, relay, relayKeys)
+		go func() {
+			conn := &clientConn{SecureConn: relayEnd}
+			env, err := readMessage(ctx, conn)
+			if err == nil {
+				err = p.HandleMessage(ctx, env, conn)
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+
+		l, err := ListenAnnouncements(ctx, client, clientEnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := announcer.Announce(ctx, ANNOUNCE_DOWNSTREAM, 3, []byte("cell")); err != nil {
+			t.Fatal(err)
+		}
+		a, err := l.Next(ctx)
+		if forged {
+			if err == nil {
+				t.Fatal("Accepted an announcement not signed by the relay")
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		} else if a.Kind != ANNOUNCE_DOWNSTREAM || a.RosterVersion != 3 || string(a.Payload) != "cell" {
+			t.Fatalf("Received %+v", a)
+		}
+
+		cancel()
+		announcer.Close()
+		clientEnd.Close()
+	}
+}
@@ -1,69 +1,155 @@
 package daga
 
 import (
-	"encoding/binary"
+	"bytes"
+	"context"
 	"errors"
 	"github.com/dedis/crypto/abstract"
 	"github.com/mahdiz/daga/config"
 	daganet "github.com/mahdiz/daga/net"
 	"net"
+	"sort"
 	"strconv"
 )
 
-// Client participates in authentication process
-func ClientAuthentication(relayConn net.Conn, clientId int, privateKey abstract.Scalar) error {
+// Client participates in authentication process.
+// The relay connection must be secured with SecureOutgoing, and lead to the relay of the
+// client's config; the trustee connection is secured here against the trustees' keys in
+// the signed roster. Clients subscribed to announcements over TCP pass the listener's RelayConn.
+// The client's config provides its id, its private key, the administrator's public key
+// used to check the roster sent by the relay, and the anonymity set policy.
+// Every read and write, and the connection to the trustee, give up when ctx is done.
+// On success, the result describes the anonymity set the client authenticated among.
+func ClientAuthentication(ctx context.Context, relayConn net.Conn, c *config.NodeConfig) (*AuthResult, error) {
 
-	// Receive a welcome message from the relay
-	welcomeMsg, err := daganet.ReadMessage(relayConn)
-	if err != nil {
-		return errors.New("Relay disconnected. " + err.Error())
+	clientId := c.Id
+	if _, err := relayPublicKey(c, relayConn); err != nil {
+		return nil, err
 	}
 
-	// Extract a trustee host address from the message
-	addrSize := int(welcomeMsg[0])
-	trusteeAddr := string(welcomeMsg[1 : addrSize+1])
+	// Receive a welcome message from the relay, holding a trustee host address and the roster header
+	env, err := expectMessage(ctx, relayConn, RELAY_WELCOME)
+	if err != nil {
+		return nil, errors.New("Cannot read the relay's welcome message. " + err.Error())
+	}
+	welcome := env.Message.(*RelayWelcome)
+	trusteeAddr := welcome.TrusteeAddr
 
-	// Extract trustee public keys from the message
-	pkSize := int(binary.BigEndian.Uint16(welcomeMsg[1+addrSize : 3+addrSize]))
-	serverPublicKeys, err := config.UnmarshalPointsMap(config.CryptoSuite, welcomeMsg[3+addrSize:3+addrSize+pkSize])
+	// Check the administrator's signature of the roster header,
+	// so that the relay cannot substitute its own trustees
+	header, err := config.UnmarshalRosterHeader(config.CryptoSuite, welcome.RosterHeader)
+	if err != nil {
+		return nil, errors.New("Cannot unmarshal roster header. " + err.Error())
+	}
+	if err := header.Verify(config.CryptoSuite, c.AdminPublicKey); err != nil {
+		return nil, err
+	}
+	serverPublicKeys := header.Trustees
+	rosterDigest, err := header.Digest(config.CryptoSuite)
 	if err != nil {
-		return errors.New("Cannot unmarshal trustee public keys." + err.Error())
+		return nil, err
+	}
+
+	// Use our own copy of the roster if it is the one the header commits to,
+	// otherwise fetch the members from the relay
+	roster := c.Roster
+	if roster != nil {
+		if localDigest, err := roster.Digest(config.CryptoSuite); err != nil || !bytes.Equal(localDigest, rosterDigest) {
+			roster = nil
+		}
+	}
+	if roster == nil {
+		members, err := fetchRosterMembers(ctx, relayConn, header)
+		if err != nil {
+			return nil, err
+		}
+		roster = &config.Roster{Version: header.Version, Clients: members, Trustees: header.Trustees, Signature: header.Signature}
+	}
+
+	// Refuse to authenticate among a set of members we do not accept
+	if err := checkAnonymitySet(c, roster); err != nil {
+		return nil, err
+	}
+
+	// Tell the relay we are done with the roster
+	if err := writeMessage(ctx, relayConn, daganet.SENDER_ANONYMOUS, roster.Version, &ClientJoining{}); err != nil {
+		return nil, errors.New("Client cannot write to the relay. " + err.Error())
 	}
 
-	// Connect to the trustee
-	trusteeConn, err := net.Dial("tcp", trusteeAddr)
+	// Connect to the trustee over a secure channel, authenticating it against the
+	// trustees of the signed roster while staying anonymous
+	rawTrusteeConn, err := daganet.DialWithRetry(ctx, "tcp", trusteeAddr)
+	if err != nil {
+		return nil, errors.New("Client cannot connect to the trustee. " + err.Error())
+	}
+	trusteeKeys := make([]abstract.Point, 0, len(serverPublicKeys))
+	for _, pub := range serverPublicKeys {
+		trusteeKeys = append(trusteeKeys, pub)
+	}
+	var trusteeConn *daganet.SecureConn
+	err = daganet.RunWithContext(ctx, rawTrusteeConn, func() error {
+		negotiatedConn, err := daganet.NegotiateClient(rawTrusteeConn, nodeFeatures(c))
+		if err != nil {
+			return errors.New("Cannot negotiate with the trustee. " + err.Error())
+		}
+		trusteeConn, err = daganet.SecureClient(negotiatedConn, &daganet.SecureConfig{
+			Suite:      config.CryptoSuite,
+			VerifyPeer: daganet.AcceptKeys(trusteeKeys...),
+		})
+		if err != nil {
+			return errors.New("Cannot secure the connection to the trustee. " + err.Error())
+		}
+		return nil
+	})
 	if err != nil {
-		return errors.New("Client cannot connect to the trustee. " + err.Error())
+		rawTrusteeConn.Close()
+		return nil, err
 	}
+	defer trusteeConn.Close()
 
 	// Request authentication context from the trustee
-	reqMsg := make([]byte, 1)
-	reqMsg[0] = CLIENT_CONTEXT_REQ
-	if err := writeMessage(trusteeConn, reqMsg); err != nil {
-		return errors.New("Client cannot write to the trustee. " + err.Error())
+	if err := writeMessage(ctx, trusteeConn, daganet.SENDER_ANONYMOUS, roster.Version, &ClientContextReq{}); err != nil {
+		return nil, errors.New("Client cannot write to the trustee. " + err.Error())
 	}
 
-	// Receive trustee commitments from the trustee
-	commitBytes, err := daganet.ReadMessage(relayConn)
+	// Receive the authentication context from the trustee, and check it was built from the roster we verified
+	env, err = expectMessage(ctx, trusteeConn, TRUSTEE_AUTH_CONTEXT)
 	if err != nil {
-		return errors.New("Trustee disconnected. " + err.Error())
+		return nil, errors.New("Cannot read the authentication context. " + err.Error())
+	}
+	authContext := env.Message.(*AuthContext)
+	if !bytes.Equal(authContext.Context.RosterDigest, rosterDigest) {
+		return nil, errors.New("Authentication context was not built from the roster signed by the administrator")
+	}
+	trusteeKey, ok := serverPublicKeys[authContext.TrusteeId]
+	if !ok {
+		return nil, errors.New("Authentication context was sent by " + strconv.Itoa(authContext.TrusteeId) + ", which is not a trustee")
 	}
-	trusteeCommits, err := config.UnmarshalPointsMap(config.CryptoSuite, commitBytes)
+	contextBody, err := signedBody(SIGN_LABEL_AUTH_CONTEXT, &authContext.Context)
 	if err != nil {
-		return errors.New("Cannot unmarshal trustee commitments. " + err.Error())
+		return nil, err
+	}
+	if err := config.SchnorrVerify(config.CryptoSuite, contextBody, trusteeKey, authContext.Signature); err != nil {
+		return nil, errors.New("Invalid authentication context signature. " + err.Error())
+	}
+	trusteeCommits := authContext.Context.Commitments
+	for id, commit := range trusteeCommits {
+		if commit == nil {
+			return nil, errors.New("Trustee " + strconv.Itoa(id) + " has an empty commitment in the authentication context")
+		}
 	}
 
 	// Calculate my per-round generator h_i
 	h, err := computeClientGroupGenerator(config.CryptoSuite, clientId, trusteeCommits)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Generate an ephemeral key pair (z, Z)
 	rand := config.CryptoSuite.Cipher(nil)
 	base := config.CryptoSuite.Point().Base()
-	z := config.CryptoSuite.Scalar().Pick(rand) // Ephemeral private key
-	//Z := config.CryptoSuite.Point().Mul(base, z) // Ephemeral public key
+	z := config.CryptoSuite.Scalar().Pick(rand)  // Ephemeral private key
+	Z := config.CryptoSuite.Point().Mul(base, z) // Ephemeral public key
 
 	// Compute the initial linkage tag and client's commitments (one commitment for each trustee)
 	sProduct := config.CryptoSuite.Scalar().One()
@@ -79,12 +165,8 @@ func ClientAuthentication(relayConn net.Conn, clientId int, privateKey abstract.
 	initialTag := config.CryptoSuite.Point().Mul(h, sProduct) // T_0 = h_i^{s_1 * ... * s_m}
 
 	// Send the linkage tag to the first trustee
-	initTagBytes, err := initialTag.MarshalBinary()
-	if err != nil {
-		return errors.New("Client " + strconv.Itoa(clientId) + " cannot marshal initial tag. " + err.Error())
-	}
-	if err := writeMessage(trusteeConn, initTagBytes); err != nil {
-		return errors.New("Cannot write to the client. " + err.Error())
+	if err := writeMessage(ctx, trusteeConn, daganet.SENDER_ANONYMOUS, roster.Version, &InitialTag{Tag: initialTag, Ephemeral: Z}); err != nil {
+		return nil, errors.New("Client " + strconv.Itoa(clientId) + " cannot write to the trustee. " + err.Error())
 	}
 
 	// TODO: Run the interactive ZKP protocol of Camenisch and Stadler with the trustee to prove that:
@@ -93,12 +175,102 @@ func ClientAuthentication(relayConn net.Conn, clientId int, privateKey abstract.
 	// TODO: See Section 1.3.7 of DAGA chapter
 
 	// Receive the final linkage tag from the trustee
-	finalTagBytes, err := daganet.ReadMessage(trusteeConn)
+	env, err = expectMessage(ctx, trusteeConn, TRUSTEE_FINAL_TAG)
 	if err != nil {
-		return errors.New("Trustee disconnected. " + err.Error())
+		return nil, errors.New("Cannot read the final linkage tag. " + err.Error())
+	}
+	finalTag := env.Message.(*FinalTag).Tag
+	if finalTag == nil {
+		return nil, errors.New("Trustee sent an empty final linkage tag")
 	}
-	finalTag := config.CryptoSuite.Point()
-	finalTag.UnmarshalBinary(finalTagBytes)
 
+	anonymitySet := make([]int, 0, len(roster.Clients))
+	for id := range roster.Clients {
+		anonymitySet = append(anonymitySet, id)
+	}
+	sort.Ints(anonymitySet)
+
+	return &AuthResult{AnonymitySet: anonymitySet, RosterVersion: roster.Version, Tag: finalTag}, nil
+}
+
+// Fetches the members committed to by a roster header from the relay, one page at a time.
+// Every member comes with a Merkle proof against the signed root, so a misbehaving relay is
+// detected on the first bad page. All pages are fetched, so the relay does not learn which
+// part of the roster the client is interested in.
+func fetchRosterMembers(ctx context.Context, relayConn net.Conn, header *config.RosterHeader) (map[int]abstract.Point, error) {
+
+	members := make(map[int]abstract.Point, header.MemberCount)
+	lastId := -1
+
+	for offset := 0; offset < header.MemberCount; offset += ROSTER_PAGE_SIZE {
+
+		req := &RosterMembersReq{Offset: offset, Count: ROSTER_PAGE_SIZE}
+		if err := writeMessage(ctx, relayConn, daganet.SENDER_ANONYMOUS, header.Version, req); err != nil {
+			return nil, errors.New("Client cannot write to the relay. " + err.Error())
+		}
+
+		env, err := expectMessage(ctx, relayConn, ROSTER_MEMBERS_PAGE)
+		if err != nil {
+			return nil, errors.New("Cannot read roster members. " + err.Error())
+		}
+		page := env.Message.(*RosterMembersPage)
+		if len(page.Members) == 0 {
+			return nil, errors.New("Relay sent an empty roster page")
+		}
+
+		for i, member := range page.Members {
+			if member.Index != offset+i || member.Id <= lastId {
+				return nil, errors.New("Roster entries are out of order")
+			}
+			if member.PublicKey == nil {
+				return nil, errors.New("Roster member " + strconv.Itoa(member.Id) + " has no public key")
+			}
+
+			leaf, err := config.MerkleLeaf(config.CryptoSuite, member.Id, member.PublicKey)
+			if err != nil {
+				return nil, err
+			}
+			if err := config.VerifyMerkleProof(config.CryptoSuite, header.MemberRoot, leaf, member.Index, header.MemberCount, member.Proof); err != nil {
+				return nil, errors.New("Invalid proof for member " + strconv.Itoa(member.Id) + ". " + err.Error())
+			}
+
+			members[member.Id] = member.PublicKey
+			lastId = member.Id
+		}
+	}
+
+	if len(members) != header.MemberCount {
+		return nil, errors.New("Relay did not send all roster members")
+	}
+	return members, nil
+}
+
+// Checks that the roster's members form an anonymity set the client accepts:
+// the client must be a member, the set must have at least the configured minimum size,
+// and every member pinned in the client's config must be present.
+func checkAnonymitySet(c *config.NodeConfig, roster *config.Roster) error {
+
+	if pub, ok := roster.Clients[c.Id]; !ok || !pub.Equal(c.PublicKey) {
+		return errors.New("Client " + strconv.Itoa(c.Id) + " is not a member of the roster.")
+	}
+
+	minSize := c.MinAnonymitySet
+	if minSize == 0 {
+		minSize = config.DEFAULT_MIN_ANONYMITY_SET
+	}
+	if len(roster.Clients) < minSize {
+		return errors.New("Anonymity set has " + strconv.Itoa(len(roster.Clients)) +
+			" members, fewer than the required " + strconv.Itoa(minSize) + ".")
+	}
+
+	members := make(map[string]bool, len(roster.Clients))
+	for _, pub := range roster.Clients {
+		members[config.PublicKeyId(config.CryptoSuite, pub)] = true
+	}
+	for _, pubId := range c.RequiredMembers {
+		if !members[pubId] {
+			return errors.New("Required member " + pubId + " is not in the anonymity set.")
+		}
+	}
 	return nil
 }
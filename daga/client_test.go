@@ -0,0 +1,95 @@
+package daga
+
+import (
+	"context"
+	"github.com/mahdiz/daga/config"
+	"net"
+	"testing"
+)
+
+// A client refuses rosters it is not in, that are too small, or that miss a required member
+func TestCheckAnonymitySet(t *testing.T) {
+	d := newTestDeployment(t, 3)
+	roster := d.relay.Roster
+	c, other := d.clients[0], d.clients[1]
+
+	if err := checkAnonymitySet(c, roster); err != nil {
+		t.Fatal(err)
+	}
+
+	c.MinAnonymitySet = 4
+	if checkAnonymitySet(c, roster) == nil {
+		t.Error("Accepted an anonymity set smaller than the minimum")
+	}
+	c.MinAnonymitySet = 0
+
+	c.RequiredMembers = []string{other.PubId, "missing"}
+	if checkAnonymitySet(c, roster) == nil {
+		t.Error("Accepted an anonymity set without a required member")
+	}
+	c.RequiredMembers = []string{other.PubId}
+	if err := checkAnonymitySet(c, roster); err != nil {
+		t.Error(err)
+	}
+
+	stranger, _ := newTestNode(t, config.NODE_TYPE_CLIENT, c.Id)
+	if checkAnonymitySet(stranger, roster) == nil {
+		t.Error("Accepted a roster listing another key for the client")
+	}
+}
+
+// A client refuses roster pages whose members do not match the signed root
+func TestFetchRosterMembersBadProof(t *testing.T) {
+	d := newTestDeployment(t, 5)
+	roster, header, tree, memberIds, err := d.relay.rosterSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tamperings := map[string]func(page *RosterMembersPage){
+		"none": func(page *RosterMembersPage) {},
+		"key": func(page *RosterMembersPage) {
+			page.Members[1].PublicKey = roster.Clients[page.Members[0].Id]
+		},
+		"proof": func(page *RosterMembersPage) {
+			page.Members[0].Proof[0] = append([]byte{}, page.Members[0].Proof[0]...)
+			page.Members[0].Proof[0][0] ^= 1
+		},
+		"index": func(page *RosterMembersPage) {
+			page.Members[0], page.Members[1] = page.Members[1], page.Members[0]
+		},
+	}
+	for name, tamper := range tamperings {
+		ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+		clientEnd, relayEnd := net.Pipe()
+		go func() {
+			defer relayEnd.Close()
+			for {
+				env, err := readMessage(ctx, relayEnd)
+				if err != nil {
+					return
+				}
+				page, err := rosterMembersPage(roster, tree, memberIds, env.Message.(*RosterMembersReq))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				tamper(page)
+				if err := writeMessage(ctx, relayEnd, 0, header.Version, page); err != nil {
+					return
+				}
+			}
+		}()
+
+		members, err := fetchRosterMembers(ctx, clientEnd, header)
+		if name == "none" {
+			if err != nil || len(members) != len(roster.Clients) {
+				t.Errorf("Fetched %d members: %v", len(members), err)
+			}
+		} else if err == nil {
+			t.Errorf("Accepted a roster page with a tampered %s", name)
+		}
+		clientEnd.Close()
+		cancel()
+	}
+}
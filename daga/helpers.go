@@ -1,23 +1,90 @@
 package daga
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"github.com/dedis/crypto/abstract"
 	"github.com/mahdiz/daga/config"
+	daganet "github.com/mahdiz/daga/net"
 	"net"
+	"sort"
+	"strconv"
+	"sync"
 )
 
-func writeMessage(conn net.Conn, msg []byte) error {
+// Writes a DAGA message. The sender is the node's id, or daganet.SENDER_ANONYMOUS for clients,
+// and the context is the version of the roster the message refers to.
+// The write gives up when ctx is done.
+func writeMessage(ctx context.Context, conn net.Conn, sender int, contextId int, msg interface{}) error {
+	if c, ok := conn.(*clientConn); ok {
+		c.writeLock.Lock()
+		defer c.writeLock.Unlock()
+	}
+	return daganet.WriteEnvelopeContext(ctx, conn, &daganet.Envelope{
+		ContextId: uint32(contextId),
+		Sender:    int32(sender),
+		Message:   msg,
+	})
+}
+
+// Reads a message written by writeMessage, which must belong to DAGA.
+// The read gives up when ctx is done.
+func readMessage(ctx context.Context, conn net.Conn) (*daganet.Envelope, error) {
+	env, err := daganet.ReadEnvelopeContext(ctx, conn, config.CryptoSuite)
+	if err != nil {
+		return nil, err
+	}
+	if env.Protocol != PROTOCOL_TYPE_DAGA {
+		return nil, errors.New("Received a message that does not belong to DAGA")
+	}
+	return env, nil
+}
 
-	// Add protocol type to the message
-	authMsg := make([]byte, len(msg)+1)
-	authMsg[0] = PROTOCOL_TYPE_DAGA
-	copy(authMsg[1:], msg)
+// Reads a DAGA message of the given type. On the relay connection of a client subscribed to
+// announcements (see AnnouncementListener.RelayConn), the announcements read first are handed
+// to the listener.
+func expectMessage(ctx context.Context, conn net.Conn, msgType uint16) (*daganet.Envelope, error) {
+	for {
+		env, err := readMessage(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := conn.(*subscribedConn); ok && env.Type == RELAY_ANNOUNCEMENT && msgType != RELAY_ANNOUNCEMENT {
+			if err := s.listener.accept(env); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if env.Type != msgType {
+			return nil, errors.New("Expected DAGA message type " + strconv.Itoa(int(msgType)) + ", got " + strconv.Itoa(int(env.Type)))
+		}
+		return env, nil
+	}
+}
 
-	if err := writeMessage(conn, authMsg); err != nil {
-		return err
+// Returns the bytes a node signs for a message: a label naming the kind of message, and the
+// message's encoding
+func signedBody(label string, msg interface{}) ([]byte, error) {
+	body, err := daganet.EncodeBody(msg)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return daganet.MarshalByteArrays([]byte(label), body), nil
+}
+
+// Client connection served by the relay. Replies and announcements are written to it by
+// different goroutines, so writeMessage writes each message whole under the write lock.
+type clientConn struct {
+	*daganet.SecureConn
+	writeLock sync.Mutex
+}
+
+// Relay connection of a client subscribed to announcements over TCP, on which the relay
+// pushes announcements between its other messages
+type subscribedConn struct {
+	*daganet.SecureConn
+	listener *AnnouncementListener
 }
 
 // Hashes a point by converting it from the point (base) group to a secret (exponent) group
@@ -27,14 +94,21 @@ func hashPoint(suite abstract.Suite, p abstract.Point) abstract.Scalar {
 	return suite.Scalar().Pick(c)
 }
 
-// Computes a client's per-round generator (h_i)
+// Computes a client's per-round generator (h_i). The commitments are hashed by increasing
+// trustee id, so that every trustee and the client compute the same generator.
 func computeClientGroupGenerator(suite abstract.Suite, clientId int,
 	serverCommits map[int]abstract.Point) (abstract.Point, error) {
 
+	trusteeIds := make([]int, 0, len(serverCommits))
+	for id := range serverCommits {
+		trusteeIds = append(trusteeIds, id)
+	}
+	sort.Ints(trusteeIds)
+
 	// Embed clientId and commitments into a byte array to be hashed
 	hashInput := make([]byte, 0)
-	for _, commit := range serverCommits {
-		cb, err := commit.MarshalBinary()
+	for _, id := range trusteeIds {
+		cb, err := serverCommits[id].MarshalBinary()
 		if err != nil {
 			return config.CryptoSuite.Point(), err
 		}
@@ -63,3 +137,46 @@ func hashBytes(suite abstract.Suite, input []byte, seed []byte) abstract.Point {
 	}
 	return p
 }
+
+// Computes the single change between two versions of the roster: a client added or removed,
+// or the key of a client or trustee rotated under the same id.
+// Other trustee changes, or more than one change, cannot be sent as a roster update
+// and require a new setup.
+func rosterDiff(oldRoster *config.Roster, newRoster *config.Roster) (updateType int, nodeId int, publicKey abstract.Point, err error) {
+
+	changes := 0
+	if len(oldRoster.Trustees) != len(newRoster.Trustees) {
+		return 0, 0, nil, errors.New("Trustees changed, a new setup is required")
+	}
+	for id, pub := range oldRoster.Trustees {
+		newPub, ok := newRoster.Trustees[id]
+		if !ok {
+			return 0, 0, nil, errors.New("Trustees changed, a new setup is required")
+		}
+		if !newPub.Equal(pub) {
+			updateType, nodeId, publicKey = ROSTER_ROTATE_KEY, id, newPub
+			changes++
+		}
+	}
+
+	for id, pub := range newRoster.Clients {
+		oldPub, ok := oldRoster.Clients[id]
+		if !ok {
+			updateType, nodeId, publicKey = ROSTER_ADD_MEMBER, id, pub
+			changes++
+		} else if !oldPub.Equal(pub) {
+			updateType, nodeId, publicKey = ROSTER_ROTATE_KEY, id, pub
+			changes++
+		}
+	}
+	for id := range oldRoster.Clients {
+		if _, ok := newRoster.Clients[id]; !ok {
+			updateType, nodeId, publicKey = ROSTER_REMOVE_MEMBER, id, nil
+			changes++
+		}
+	}
+	if changes != 1 {
+		return 0, 0, nil, errors.New("A roster update must make exactly one change, found " + strconv.Itoa(changes) + " changes")
+	}
+	return updateType, nodeId, publicKey, nil
+}
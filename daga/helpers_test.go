@@ -0,0 +1,117 @@
+package daga
+
+import (
+	"context"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/random"
+	"github.com/mahdiz/daga/config"
+	daganet "github.com/mahdiz/daga/net"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Time a test exchange has to complete
+const TEST_TIMEOUT = 5 * time.Second
+
+// Creates the config and key store of a node with a fresh key pair
+func newTestNode(t *testing.T, nodeType string, id int) (*config.NodeConfig, KeyStore) {
+	c := &config.NodeConfig{}
+	c.GenKeyPair(config.CryptoSuite, random.Stream)
+	c.Id = id
+	c.Name = nodeType + "-" + strconv.Itoa(id)
+	c.Type = nodeType
+	keys, err := NewFileKeyStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, keys
+}
+
+// Secures both ends of a pipe, as a node of config c dialing the relay or trustee of config server
+func securePipe(t *testing.T, c *config.NodeConfig, keys KeyStore, server *config.NodeConfig, serverKeys KeyStore) (*daganet.SecureConn, *daganet.SecureConn) {
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+
+	a, b := net.Pipe()
+	done := make(chan *daganet.SecureConn, 1)
+	go func() {
+		sconn, err := SecureIncoming(ctx, b, server, serverKeys, false)
+		if err != nil {
+			t.Error(err)
+			b.Close()
+		}
+		done <- sconn
+	}()
+	sconn, err := SecureOutgoing(ctx, a, c, keys)
+	if err != nil {
+		a.Close()
+		t.Fatal(err)
+	}
+	serverConn := <-done
+	if serverConn == nil {
+		t.FailNow()
+	}
+	return sconn, serverConn
+}
+
+// Relay and trustee connected over a pipe, and the clients of their roster
+type testDeployment struct {
+	adminKey abstract.Scalar
+	relay    *RelayProtocol
+	trustee  *TrusteeProtocol
+	clients  []*config.NodeConfig
+}
+
+// Creates a relay, a trustee serving it and a roster of nClients clients, signed by the
+// administrator. The trustee is not set up.
+func newTestDeployment(t *testing.T, nClients int) *testDeployment {
+	suite := config.CryptoSuite
+	d := &testDeployment{adminKey: suite.Scalar().Pick(random.Stream)}
+	adminPublicKey := suite.Point().Mul(nil, d.adminKey)
+
+	relayConfig, relayKeys := newTestNode(t, config.NODE_TYPE_RELAY, 0)
+	trusteeConfig, trusteeKeys := newTestNode(t, config.NODE_TYPE_TRUSTEE, 1)
+	roster := &config.Roster{
+		Version:  1,
+		Clients:  make(map[int]abstract.Point),
+		Trustees: map[int]abstract.Point{trusteeConfig.Id: trusteeConfig.PublicKey},
+	}
+	for i := 0; i < nClients; i++ {
+		c, _ := newTestNode(t, config.NODE_TYPE_CLIENT, 2+i)
+		c.AdminPublicKey = adminPublicKey
+		roster.Clients[c.Id] = c.PublicKey
+		d.clients = append(d.clients, c)
+	}
+	d.sign(t, roster)
+
+	relayEnd, trusteeEnd := net.Pipe()
+	t.Cleanup(func() { relayEnd.Close() })
+	d.relay = &RelayProtocol{
+		Roster:         roster,
+		AdminPublicKey: adminPublicKey,
+		Keys:           relayKeys,
+		Trustees:       []daganet.NodeRepresentation{{Id: trusteeConfig.Id, Conn: relayEnd, Connected: true, PublicKey: trusteeConfig.PublicKey}},
+	}
+	d.trustee = NewTrusteeProtocol(trusteeConfig.Id, daganet.NodeRepresentation{Id: relayConfig.Id, Conn: trusteeEnd, PublicKey: relayConfig.PublicKey},
+		nil, adminPublicKey, trusteeKeys)
+	go d.trustee.serveMessages(context.Background(), trusteeEnd, true)
+	return d
+}
+
+// Signs a roster with the administrator's key
+func (d *testDeployment) sign(t *testing.T, roster *config.Roster) {
+	if err := roster.Sign(config.CryptoSuite, random.Stream, d.adminKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Runs the setup of the relay with the trustee
+func (d *testDeployment) setup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+	if err := d.relay.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,270 @@
+package daga
+
+import (
+	"errors"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/random"
+	"github.com/dedis/crypto/suites"
+	"github.com/mahdiz/daga/config"
+	daganet "github.com/mahdiz/daga/net"
+	"net"
+	"sync"
+	"time"
+)
+
+// Private key operations of a node. Protocols only reach a node's private key through
+// this interface, so the key can be kept in a separate process (see RemoteKeyStore).
+type KeyStore interface {
+	PublicKey() abstract.Point
+
+	// Schnorr signature of a message (see config.SchnorrSign)
+	Sign(message []byte) ([]byte, error)
+
+	// Multiplies a point by the private key, for Diffie-Hellman secrets and linkage tags
+	Mul(point abstract.Point) (abstract.Point, error)
+}
+
+// Operations of the remote key store protocol
+const (
+	KEYSTORE_OP_PUBLIC_KEY = iota
+	KEYSTORE_OP_SIGN
+	KEYSTORE_OP_MUL
+)
+
+// Time a signer process has to answer a request
+const KEYSTORE_TIMEOUT = 10 * time.Second
+
+// Status of a remote key store response
+const (
+	KEYSTORE_STATUS_OK = iota
+	KEYSTORE_STATUS_ERROR
+)
+
+// Key store holding a private key in process memory, as read from a node's .sec file
+type FileKeyStore struct {
+	suite      abstract.Suite
+	privateKey abstract.Scalar
+	publicKey  abstract.Point
+}
+
+// Creates a key store from a node's loaded config
+func NewFileKeyStore(c *config.NodeConfig) (*FileKeyStore, error) {
+	suite := suites.All()[c.Suite]
+	if suite == nil {
+		return nil, errors.New("Unsupported ciphersuite '" + c.Suite + "'")
+	}
+	if c.PrivateKey == nil {
+		return nil, errors.New("Node " + c.Name + " has no private key file")
+	}
+	return &FileKeyStore{suite: suite, privateKey: c.PrivateKey, publicKey: c.PublicKey}, nil
+}
+
+func (k *FileKeyStore) PublicKey() abstract.Point {
+	return k.publicKey
+}
+
+func (k *FileKeyStore) Sign(message []byte) ([]byte, error) {
+	return config.SchnorrSign(k.suite, random.Stream, message, k.privateKey)
+}
+
+func (k *FileKeyStore) Mul(point abstract.Point) (abstract.Point, error) {
+	return k.suite.Point().Mul(point, k.privateKey), nil
+}
+
+// Key store forwarding every operation to a signer process (see ServeKeyStore)
+// over a Unix socket. Requests are sent one at a time, and each must be answered within
+// KEYSTORE_TIMEOUT. A request that fails on the connection closes it for good.
+type RemoteKeyStore struct {
+	suite     abstract.Suite
+	conn      net.Conn
+	publicKey abstract.Point
+	lock      sync.Mutex
+	err       error // Error that closed the connection
+}
+
+// Connects to a signer process listening on a Unix socket, and fetches its public key
+func DialKeyStore(suite abstract.Suite, socketPath string) (*RemoteKeyStore, error) {
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, errors.New("Cannot connect to the key store. " + err.Error())
+	}
+	k := &RemoteKeyStore{suite: suite, conn: conn}
+
+	res, err := k.call(&KeyStoreRequest{Op: KEYSTORE_OP_PUBLIC_KEY})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.Point == nil {
+		conn.Close()
+		return nil, errors.New("Key store did not send its public key")
+	}
+	k.publicKey = res.Point
+	return k, nil
+}
+
+func (k *RemoteKeyStore) PublicKey() abstract.Point {
+	return k.publicKey
+}
+
+func (k *RemoteKeyStore) Sign(message []byte) ([]byte, error) {
+	res, err := k.call(&KeyStoreRequest{Op: KEYSTORE_OP_SIGN, Message: message})
+	if err != nil {
+		return nil, err
+	}
+	return res.Signature, nil
+}
+
+func (k *RemoteKeyStore) Mul(point abstract.Point) (abstract.Point, error) {
+	res, err := k.call(&KeyStoreRequest{Op: KEYSTORE_OP_MUL, Point: point})
+	if err != nil {
+		return nil, err
+	}
+	if res.Point == nil {
+		return nil, errors.New("Key store returned no point")
+	}
+	return res.Point, nil
+}
+
+// Closes the connection to the signer process
+func (k *RemoteKeyStore) Close() error {
+	return k.conn.Close()
+}
+
+// Sends a request and reads its response, failing if the key store reports an error
+func (k *RemoteKeyStore) call(req *KeyStoreRequest) (*KeyStoreResponse, error) {
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.err != nil {
+		return nil, k.err
+	}
+	// A late answer would be taken for the next request's, so the connection is not reused
+	fail := func(err error) (*KeyStoreResponse, error) {
+		k.err = err
+		k.conn.Close()
+		return nil, err
+	}
+
+	if err := k.conn.SetDeadline(time.Now().Add(KEYSTORE_TIMEOUT)); err != nil {
+		return fail(errors.New("Cannot set the key store deadline. " + err.Error()))
+	}
+	if err := daganet.WriteEnvelope(k.conn, &daganet.Envelope{Sender: daganet.SENDER_ANONYMOUS, Message: req}); err != nil {
+		return fail(errors.New("Cannot write to the key store. " + err.Error()))
+	}
+
+	env, err := daganet.ExpectEnvelope(k.conn, k.suite, KEYSTORE_RESPONSE)
+	if err != nil {
+		return fail(errors.New("Key store disconnected. " + err.Error()))
+	}
+	res := env.Message.(*KeyStoreResponse)
+	if res.Status != KEYSTORE_STATUS_OK {
+		return nil, errors.New("Key store error: " + res.Error)
+	}
+	return res, nil
+}
+
+// Opens the key store of a node: the signer process at the config's KeySocket if it is set,
+// otherwise the private key loaded from the node's .sec file.
+// A signer whose public key does not match the config's PubId is rejected.
+func OpenKeyStore(c *config.NodeConfig) (KeyStore, error) {
+
+	if c.KeySocket == "" {
+		return NewFileKeyStore(c)
+	}
+
+	suite := suites.All()[c.Suite]
+	if suite == nil {
+		return nil, errors.New("Unsupported ciphersuite '" + c.Suite + "'")
+	}
+	k, err := DialKeyStore(suite, c.KeySocket)
+	if err != nil {
+		return nil, err
+	}
+	if config.PublicKeyId(suite, k.PublicKey()) != c.PubId {
+		k.Close()
+		return nil, errors.New("Key store at " + c.KeySocket + " does not hold key " + c.PubId)
+	}
+	return k, nil
+}
+
+// Serves a key store's operations on a listener, typically a Unix socket only readable by the
+// node's user. Each connection is served in its own goroutine until it is closed.
+// Only the messages a node signs are signed (see checkSignedMessage), so that a process
+// reaching the socket cannot have the key sign anything else.
+func ServeKeyStore(listener net.Listener, suite abstract.Suite, keys KeyStore) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go serveKeyStoreConn(conn, suite, keys)
+	}
+}
+
+func serveKeyStoreConn(conn net.Conn, suite abstract.Suite, keys KeyStore) {
+
+	defer conn.Close()
+	for {
+		env, err := daganet.ExpectEnvelope(conn, suite, KEYSTORE_REQUEST)
+		if err != nil {
+			return
+		}
+
+		res, err := handleKeyStoreRequest(keys, env.Message.(*KeyStoreRequest))
+		if err != nil {
+			res = &KeyStoreResponse{Status: KEYSTORE_STATUS_ERROR, Error: err.Error()}
+		}
+		if err := daganet.WriteEnvelope(conn, &daganet.Envelope{Sender: daganet.SENDER_ANONYMOUS, Message: res}); err != nil {
+			return
+		}
+	}
+}
+
+func handleKeyStoreRequest(keys KeyStore, req *KeyStoreRequest) (*KeyStoreResponse, error) {
+
+	switch req.Op {
+	case KEYSTORE_OP_PUBLIC_KEY:
+		return &KeyStoreResponse{Status: KEYSTORE_STATUS_OK, Point: keys.PublicKey()}, nil
+
+	case KEYSTORE_OP_SIGN:
+		if err := checkSignedMessage(req.Message); err != nil {
+			return nil, err
+		}
+		sig, err := keys.Sign(req.Message)
+		if err != nil {
+			return nil, err
+		}
+		return &KeyStoreResponse{Status: KEYSTORE_STATUS_OK, Signature: sig}, nil
+
+	case KEYSTORE_OP_MUL:
+		if req.Point == nil {
+			return nil, errors.New("Missing point")
+		}
+		point, err := keys.Mul(req.Point)
+		if err != nil {
+			return nil, err
+		}
+		return &KeyStoreResponse{Status: KEYSTORE_STATUS_OK, Point: point}, nil
+	}
+	return nil, errors.New("Unknown operation")
+}
+
+// Checks that a message is one a node signs: a secure channel handshake transcript, or a
+// message labelled by signedBody with one of the SIGN_LABEL_* labels
+func checkSignedMessage(message []byte) error {
+	if daganet.CheckHandshakeSignedBytes(message) == nil {
+		return nil
+	}
+	arrs, err := daganet.UnmarshalByteArrays(message)
+	if err != nil || len(arrs) != 2 {
+		return errors.New("Refusing to sign an unlabelled message")
+	}
+	switch string(arrs[0]) {
+	case SIGN_LABEL_ROSTER_UPDATE, SIGN_LABEL_ANNOUNCEMENT, SIGN_LABEL_AUTH_CONTEXT:
+		return nil
+	}
+	return errors.New("Refusing to sign a message labelled '" + string(arrs[0]) + "'")
+}
@@ -0,0 +1,89 @@
+package daga
+
+import (
+	"bytes"
+	"github.com/mahdiz/daga/config"
+	daganet "github.com/mahdiz/daga/net"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The signer only signs handshake transcripts and labelled messages
+func TestCheckSignedMessage(t *testing.T) {
+	hash := bytes.Repeat([]byte{1}, 32)
+	accepted := [][]byte{
+		append([]byte(daganet.SECURE_RESPONDER_PREFIX), hash...),
+		append(append([]byte(daganet.SECURE_INITIATOR_PREFIX), hash...), "key"...),
+		daganet.MarshalByteArrays([]byte(SIGN_LABEL_ANNOUNCEMENT), []byte("body")),
+		daganet.MarshalByteArrays([]byte(SIGN_LABEL_AUTH_CONTEXT), nil),
+	}
+	refused := [][]byte{
+		nil,
+		[]byte("anything"),
+		append([]byte(daganet.SECURE_RESPONDER_PREFIX), hash[:31]...),
+		[]byte(daganet.SECURE_INITIATOR_PREFIX),
+		daganet.MarshalByteArrays([]byte("DAGA-OTHER-1"), []byte("body")),
+		daganet.MarshalByteArrays([]byte(SIGN_LABEL_ANNOUNCEMENT), []byte("body"), []byte("extra")),
+	}
+	for _, msg := range accepted {
+		if err := checkSignedMessage(msg); err != nil {
+			t.Errorf("Refused %q: %v", msg, err)
+		}
+	}
+	for _, msg := range refused {
+		if checkSignedMessage(msg) == nil {
+			t.Errorf("Accepted %q", msg)
+		}
+	}
+}
+
+// A signer process answers like the key it holds, and refuses to sign unlabelled messages
+func TestRemoteKeyStore(t *testing.T) {
+	c, keys := newTestNode(t, config.NODE_TYPE_TRUSTEE, 1)
+
+	dir, err := ioutil.TempDir("", "daga-keyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener, err := net.Listen("unix", filepath.Join(dir, "keyd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go ServeKeyStore(listener, config.CryptoSuite, keys)
+
+	remote, err := DialKeyStore(config.CryptoSuite, filepath.Join(dir, "keyd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	if !remote.PublicKey().Equal(c.PublicKey) {
+		t.Fatal("Signer answered with another key")
+	}
+
+	point := config.CryptoSuite.Point().Base()
+	got, err := remote.Mul(point)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := keys.Mul(point)
+	if !got.Equal(want) {
+		t.Fatal("Signer multiplied by another key")
+	}
+
+	msg := daganet.MarshalByteArrays([]byte(SIGN_LABEL_AUTH_CONTEXT), []byte("context"))
+	sig, err := remote.Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.SchnorrVerify(config.CryptoSuite, msg, c.PublicKey, sig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Sign([]byte("anything")); err == nil {
+		t.Fatal("Signer signed an unlabelled message")
+	}
+}
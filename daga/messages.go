@@ -0,0 +1,154 @@
+package daga
+
+import (
+	"github.com/dedis/crypto/abstract"
+	daganet "github.com/mahdiz/daga/net"
+)
+
+// Signed roster sent by the relay to start a setup
+type TrusteeSetup struct {
+	Roster []byte // Roster marshaled with config.Roster.MarshalBinary
+}
+
+type TrusteeFinishedSetup struct{}
+
+type ClientJoining struct{}
+
+type ClientContextReq struct{}
+
+// Change of one member of the roster, signed by the relay.
+// PublicKey is nil for removals.
+type RosterUpdateBody struct {
+	Version   int // Version of the roster after the update
+	Kind      uint8
+	NodeId    int
+	PublicKey abstract.Point
+}
+
+// Roster update along with the administrator's signature of the roster it leads to
+type RosterUpdate struct {
+	Update         RosterUpdateBody
+	RelaySignature []byte // Relay's signature of the encoded Update (see signedBody)
+	AdminSignature []byte
+}
+
+// Trustee's answer to a roster update. Error is empty if the update was applied.
+type RosterUpdateAck struct {
+	Version int
+	Error   string
+}
+
+type RosterMembersReq struct {
+	Offset int
+	Count  int
+}
+
+// Roster member along with its leaf index and Merkle proof against the signed root
+type RosterMember struct {
+	Id        int
+	Index     int
+	PublicKey abstract.Point
+	Proof     [][]byte
+}
+
+type RosterMembersPage struct {
+	Members []RosterMember
+}
+
+// Trustee address for the client to connect to, and the roster header signed by the administrator
+type RelayWelcome struct {
+	TrusteeAddr  string
+	RosterHeader []byte // Header marshaled with config.RosterHeader.MarshalBinary
+}
+
+// Trustee's commitment R_j = g^r_j
+type TrusteeCommitment struct {
+	Commitment abstract.Point
+}
+
+// Digest of the roster an authentication context was built from, and the trustees' commitments
+type AuthContextBody struct {
+	RosterDigest []byte
+	Commitments  map[int]abstract.Point
+}
+
+// Authentication context signed by the trustee that sent it
+type AuthContext struct {
+	Context   AuthContextBody
+	TrusteeId int
+	Signature []byte // Trustee's signature of the encoded Context (see signedBody)
+}
+
+type InitialTag struct {
+	Tag       abstract.Point
+	Ephemeral abstract.Point // Client's ephemeral public key Z, from which trustees derive their shared secrets
+}
+
+type FinalTag struct {
+	Tag abstract.Point
+}
+
+// Key store operation (see RemoteKeyStore). Message is set for signatures,
+// and Point for multiplications by the private key.
+type KeyStoreRequest struct {
+	Op      uint8
+	Message []byte
+	Point   abstract.Point
+}
+
+// Result of a key store operation: a signature for signatures, a point for public keys and
+// multiplications. Error is set, and the results empty, when the status is KEYSTORE_STATUS_ERROR.
+type KeyStoreResponse struct {
+	Status    uint8
+	Error     string
+	Signature []byte
+	Point     abstract.Point
+}
+
+// Announcement made by the relay to all clients at once
+type AnnouncementBody struct {
+	Sequence      uint64 // Increases with every announcement, so that replays are rejected
+	Kind          uint8
+	RosterVersion int
+	Payload       []byte // Encoded AuthContext, or downstream cell
+}
+
+// Announcement signed by the relay
+type RelayAnnouncement struct {
+	Announcement AnnouncementBody
+	Signature    []byte // Relay's signature of the encoded Announcement (see signedBody)
+}
+
+// Client's request for the announcements after a sequence number. Subscribed clients
+// are sent the following announcements over the same connection.
+type AnnouncementsReq struct {
+	After     uint64
+	Subscribe bool
+}
+
+// Announcements a client missed, along with the oldest one the relay still holds
+type Announcements struct {
+	Announcements []RelayAnnouncement
+	Oldest        uint64
+}
+
+func init() {
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, TRUSTEE_SETUP, (*TrusteeSetup)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, TRUSTEE_FINISHED_SETUP, (*TrusteeFinishedSetup)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, CLIENT_JOINING, (*ClientJoining)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, CLIENT_CONTEXT_REQ, (*ClientContextReq)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, ROSTER_UPDATE, (*RosterUpdate)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, ROSTER_MEMBERS_REQ, (*RosterMembersReq)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, ROSTER_MEMBERS_PAGE, (*RosterMembersPage)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, RELAY_WELCOME, (*RelayWelcome)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, TRUSTEE_COMMITMENT, (*TrusteeCommitment)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, TRUSTEE_AUTH_CONTEXT, (*AuthContext)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, CLIENT_INITIAL_TAG, (*InitialTag)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, TRUSTEE_FINAL_TAG, (*FinalTag)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, KEYSTORE_REQUEST, (*KeyStoreRequest)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, KEYSTORE_RESPONSE, (*KeyStoreResponse)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, RELAY_ANNOUNCEMENT, (*RelayAnnouncement)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, ANNOUNCEMENTS_REQ, (*AnnouncementsReq)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, ANNOUNCEMENTS, (*Announcements)(nil))
+	daganet.RegisterMessage(PROTOCOL_TYPE_DAGA, TRUSTEE_ROSTER_UPDATED, (*RosterUpdateAck)(nil))
+}
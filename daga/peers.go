@@ -0,0 +1,303 @@
+package daga
+
+import (
+	"context"
+	"errors"
+	"github.com/mahdiz/daga/config"
+	daganet "github.com/mahdiz/daga/net"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Returns a dialer for a connection manager, connecting to the nodes listed in the node's config.
+// Each node is dialed at its advertised addresses in order of preference, until one of them
+// answers and the secure channel authenticates it with the key listed for it.
+func PeerDialer(c *config.NodeConfig, keys KeyStore) daganet.PeerDialer {
+	return func(ctx context.Context, node daganet.NodeRepresentation) (net.Conn, error) {
+
+		var info *config.NodeInfo
+		for i := range c.NodesInfo {
+			if c.NodesInfo[i].Id == node.Id {
+				info = &c.NodesInfo[i]
+			}
+		}
+		if info == nil || len(info.AdvertiseAddrs) == 0 {
+			return nil, errors.New("No address known for node " + strconv.Itoa(node.Id))
+		}
+
+		dialer := net.Dialer{KeepAlive: 30 * time.Second}
+		var err error
+		for _, addr := range info.AdvertiseAddrs {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				continue
+			}
+			var sconn *daganet.SecureConn
+			sconn, err = SecureOutgoing(ctx, conn, c, keys)
+			if err == nil && config.PublicKeyId(config.CryptoSuite, sconn.PeerPublicKey()) != info.PubId {
+				err = errors.New(addr + " answered with another node's key")
+			}
+			if err != nil {
+				conn.Close()
+				err = errors.New("Cannot secure the connection to " + addr + ". " + err.Error())
+				continue
+			}
+			return sconn, nil
+		}
+		return nil, errors.New("Cannot connect to node " + strconv.Itoa(node.Id) + ". " + err.Error())
+	}
+}
+
+// Connects to the trustees listed in the relay's config, and keeps Trustees in sync with their
+// connections. A trustee that reconnects has lost the setup, so the relay is no longer
+// initialized until relaySetup runs again. The connections are multiplexed (see openPeerStream),
+// so they must be used through Trustees rather than TrusteeConns.
+func (p *RelayProtocol) ConnectTrustees(c *config.NodeConfig, keys KeyStore, mc *daganet.ManagerConfig) {
+
+	cfg := daganet.ManagerConfig{}
+	if mc != nil {
+		cfg = *mc
+	}
+	onUp, onDown := cfg.OnUp, cfg.OnDown
+	cfg.OnUp = func(node daganet.NodeRepresentation) {
+		node, err := openPeerStream(node)
+		if err != nil {
+			return // The mux failed, which has the connection reconnected
+		}
+		p.trusteeUp(node)
+		if onUp != nil {
+			onUp(node)
+		}
+	}
+	cfg.OnDown = func(node daganet.NodeRepresentation, err error) {
+		p.trusteeDown(node)
+		if onDown != nil {
+			onDown(node, err)
+		}
+	}
+
+	p.TrusteeConns = daganet.NewConnManager(PeerDialer(c, keys), &cfg)
+	for _, info := range c.Peers(config.NODE_TYPE_TRUSTEE) {
+		p.TrusteeConns.Add(daganet.NodeRepresentation{Id: info.Id})
+	}
+}
+
+func (p *RelayProtocol) trusteeUp(node daganet.NodeRepresentation) {
+	p.rosterLock.Lock()
+	defer p.rosterLock.Unlock()
+
+	for i := range p.Trustees {
+		if p.Trustees[i].Id == node.Id {
+			p.Trustees[i].Conn, p.Trustees[i].Connected = node.Conn, true
+			return
+		}
+	}
+	if p.Roster != nil {
+		node.PublicKey = p.Roster.Trustees[node.Id]
+	}
+	p.Trustees = append(p.Trustees, node)
+}
+
+// Forgets a trustee's lost connection, unless the trustee reconnected meanwhile
+func (p *RelayProtocol) trusteeDown(node daganet.NodeRepresentation) {
+	p.rosterLock.Lock()
+	defer p.rosterLock.Unlock()
+
+	for i := range p.Trustees {
+		if p.Trustees[i].Id == node.Id && peerConn(p.Trustees[i].Conn) == node.Conn {
+			p.Trustees[i].Conn, p.Trustees[i].Connected = nil, false
+		}
+	}
+	p.Initialized = false
+}
+
+// Serves a client connection the relay accepted (see ServeSecure): authenticates the client,
+// then answers its announcement requests until the connection fails
+func (p *RelayProtocol) ServeConn(ctx context.Context, conn *daganet.SecureConn) error {
+
+	defer conn.Close()
+	if conn.PeerPublicKey() != nil {
+		return errors.New("Only clients connect to the relay")
+	}
+	client := &clientConn{SecureConn: conn}
+	if _, err := p.AuthenticateClient(ctx, client); err != nil {
+		return err
+	}
+	for {
+		env, err := readMessage(ctx, client)
+		if err != nil {
+			return err
+		}
+		if err := p.HandleMessage(ctx, env, client); err != nil {
+			return err
+		}
+	}
+}
+
+// Connects to the other trustees listed in the trustee's config that have a greater id, and keeps
+// the trustee's connections in sync with them. Trustees with a smaller id connect to this one
+// (see ServeConn). The returned manager keeps the connections open until it is closed.
+func (p *TrusteeProtocol) ConnectTrustees(c *config.NodeConfig, keys KeyStore, mc *daganet.ManagerConfig) *daganet.ConnManager {
+
+	cfg := daganet.ManagerConfig{}
+	if mc != nil {
+		cfg = *mc
+	}
+	onUp, onDown := cfg.OnUp, cfg.OnDown
+	cfg.OnUp = func(node daganet.NodeRepresentation) {
+		node, err := openPeerStream(node)
+		if err != nil {
+			return // The mux failed, which has the connection reconnected
+		}
+		p.trusteeUp(node)
+		if onUp != nil {
+			onUp(node)
+		}
+	}
+	cfg.OnDown = func(node daganet.NodeRepresentation, err error) {
+		p.trusteeDown(node)
+		if onDown != nil {
+			onDown(node, err)
+		}
+	}
+
+	m := daganet.NewConnManager(PeerDialer(c, keys), &cfg)
+	for _, info := range c.Peers(config.NODE_TYPE_TRUSTEE) {
+		if info.Id > c.Id {
+			m.Add(daganet.NodeRepresentation{Id: info.Id})
+		}
+	}
+	return m
+}
+
+// Serves a connection the trustee accepted (see ServeSecure).
+// The relay's connection carries setups and roster updates on its first stream, which replaces
+// the previous one, and clients' requests on the others. A trustee's connection is kept for the
+// setups. Anonymous connections carry clients' requests.
+// Returns when the connection fails, or once the stream is accepted for trustees.
+func (p *TrusteeProtocol) ServeConn(ctx context.Context, conn *daganet.SecureConn, c *config.NodeConfig) error {
+
+	if pub := conn.PeerPublicKey(); pub != nil {
+		pubId := config.PublicKeyId(config.CryptoSuite, pub)
+		var info *config.NodeInfo
+		for i := range c.NodesInfo {
+			if c.NodesInfo[i].PubId == pubId {
+				info = &c.NodesInfo[i]
+			}
+		}
+		switch {
+		case info != nil && info.Type == config.NODE_TYPE_TRUSTEE && info.Id < c.Id:
+			stream, err := acceptPeerStream(conn)
+			if err != nil {
+				return err
+			}
+			p.trusteeUp(daganet.NodeRepresentation{Id: info.Id, Conn: stream, Connected: true})
+			return nil
+		case info != nil && info.Type == config.NODE_TYPE_RELAY:
+			stream, err := acceptPeerStream(conn)
+			if err != nil {
+				return err
+			}
+			defer stream.Mux().Close()
+			p.lock.Lock()
+			p.relay.PublicKey, p.relayConn = pub, stream
+			p.lock.Unlock()
+
+			go func() {
+				for {
+					clientStream, err := stream.Mux().Accept()
+					if err != nil {
+						return
+					}
+					go p.serveMessages(ctx, clientStream, false)
+				}
+			}()
+			return p.serveMessages(ctx, stream, true)
+		default:
+			conn.Close()
+			return errors.New("Node " + pubId + " is not expected to connect to trustee " + strconv.Itoa(c.Id))
+		}
+	}
+	return p.serveMessages(ctx, conn, false)
+}
+
+// Handles the messages read from a connection until it fails, or one of them fails unless
+// failures are kept for the relay: failed updates are acknowledged with their error, and
+// failed setups time out on the relay
+func (p *TrusteeProtocol) serveMessages(ctx context.Context, conn net.Conn, fromRelay bool) error {
+	defer conn.Close()
+	for {
+		env, err := readMessage(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := p.HandleMessage(ctx, env, conn); err != nil && !fromRelay {
+			return err
+		}
+	}
+}
+
+func (p *TrusteeProtocol) trusteeUp(node daganet.NodeRepresentation) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for i := range p.trustees {
+		if p.trustees[i].Id == node.Id {
+			p.trustees[i].Conn, p.trustees[i].Connected = node.Conn, true
+			return
+		}
+	}
+	p.trustees = append(p.trustees, node)
+}
+
+// Forgets a trustee's lost connection, unless the trustee reconnected meanwhile
+func (p *TrusteeProtocol) trusteeDown(node daganet.NodeRepresentation) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for i := range p.trustees {
+		if p.trustees[i].Id == node.Id && peerConn(p.trustees[i].Conn) == node.Conn {
+			p.trustees[i].Conn, p.trustees[i].Connected = nil, false
+		}
+	}
+}
+
+// Opens the stream carrying the DAGA messages of a managed connection to another node. The
+// connection is multiplexed (see daganet.Mux), so that other streams, e.g. of client sessions,
+// can share it.
+func openPeerStream(node daganet.NodeRepresentation) (daganet.NodeRepresentation, error) {
+	stream, err := daganet.NewMuxClient(node.Conn, nil).OpenStream()
+	if err != nil {
+		return node, err
+	}
+	node.Conn = stream
+	return node, nil
+}
+
+// Accepts the stream opened by openPeerStream on a connection from a node that manages it,
+// and keeps the connection alive from this end. Gives up after HANDSHAKE_TIMEOUT.
+func acceptPeerStream(conn net.Conn) (*daganet.Stream, error) {
+	mux := daganet.NewMuxServer(daganet.KeepAlive(conn, daganet.DEFAULT_KEEPALIVE_INTERVAL), nil)
+	timer := time.AfterFunc(HANDSHAKE_TIMEOUT, func() {
+		mux.Close()
+	})
+	stream, err := mux.Accept()
+	if !timer.Stop() && err == nil {
+		err = errors.New("Mux is closed")
+	}
+	if err != nil {
+		mux.Close()
+		return nil, errors.New("Peer opened no stream. " + err.Error())
+	}
+	return stream.(*daganet.Stream), nil
+}
+
+// Returns the connection a node's stream is multiplexed over, or the connection itself
+func peerConn(conn net.Conn) net.Conn {
+	if s, ok := conn.(*daganet.Stream); ok {
+		return s.Mux().Conn()
+	}
+	return conn
+}
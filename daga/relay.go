@@ -1,8 +1,9 @@
 package daga
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
+	"github.com/dedis/crypto/abstract"
 	"github.com/mahdiz/daga/config"
 	daganet "github.com/mahdiz/daga/net"
 	"math/rand"
@@ -10,46 +11,80 @@ import (
 	"strconv"
 )
 
-func (p *RelayProtocol) Start() error {
-	p.relaySetup()
-	return nil
+// Creates a relay protocol instance from the relay's config and key store (see OpenKeyStore).
+// Trustee addresses are taken from the trustees' advertised addresses in the config.
+func NewRelayProtocol(c *config.NodeConfig, keys KeyStore) *RelayProtocol {
+	return &RelayProtocol{
+		TrusteeHosts:   config.AdvertisedAddrs(c.Peers(config.NODE_TYPE_TRUSTEE)),
+		Roster:         c.Roster,
+		AdminPublicKey: c.AdminPublicKey,
+		Keys:           keys,
+	}
+}
+
+func (p *RelayProtocol) Start(ctx context.Context) error {
+	return p.relaySetup(ctx)
 }
 
-func (p *RelayProtocol) HandleMessage(msg []byte, senderConn net.Conn) error {
+func (p *RelayProtocol) HandleMessage(ctx context.Context, env *daganet.Envelope, senderConn net.Conn) error {
+
+	switch msg := env.Message.(type) {
+	case *AnnouncementsReq:
+		err := p.relayAnnouncementsReq(ctx, msg, senderConn)
+		return err
+	}
 	return nil
 }
 
 // Relay requests trustees to run DAGA setup collectively
-func (p *RelayProtocol) relaySetup() error {
+func (p *RelayProtocol) relaySetup(ctx context.Context) error {
+
+	p.trusteeLock.Lock()
+	defer p.trusteeLock.Unlock()
 
-	// Send the client public key roster to all trustees
-	// TODO: Send the roster once to the trustees when they join. Send them new public keys when clients join.
-	rosterBytes, err := config.MarshalPointsMap(p.ClientPublicKeys)
+	// Send the signed roster to all trustees: the roster of a failed update if there is one,
+	// since some trustees may already have applied it.
+	// Later membership changes are sent as roster updates (see UpdateRoster).
+	p.rosterLock.RLock()
+	roster := p.Roster
+	if p.pendingRoster != nil {
+		roster = p.pendingRoster
+	}
+	trustees := append([]daganet.NodeRepresentation(nil), p.Trustees...)
+	p.rosterLock.RUnlock()
+
+	if roster == nil {
+		return errors.New("The relay has no roster")
+	}
+	rosterBytes, err := roster.MarshalBinary()
 	if err != nil {
 		return errors.New("Cannot marshal public key roster. " + err.Error())
 	}
+	for _, trustee := range trustees {
+		if trustee.Conn == nil {
+			return errors.New("Trustee " + strconv.Itoa(trustee.Id) + " is not connected")
+		}
+	}
 
-	msg := make([]byte, 1+len(rosterBytes))
-	msg[0] = TRUSTEE_SETUP
-	copy(msg[1:], rosterBytes)
-
-	for _, trustee := range p.Trustees {
-		if err := writeMessage(trustee.Conn, msg); err != nil {
+	for _, trustee := range trustees {
+		if err := writeMessage(ctx, trustee.Conn, 0, roster.Version, &TrusteeSetup{Roster: rosterBytes}); err != nil {
 			return errors.New("Cannot write to trustee " + strconv.Itoa(trustee.Id) + ". " + err.Error())
 		}
 	}
 
 	// Wait until a message is received from all trustees showing the end of the setup phase
-	for _, trustee := range p.Trustees {
-		trusteeMsg, err := daganet.ReadMessage(trustee.Conn)
-		if err != nil {
-			return errors.New("Trustee " + strconv.Itoa(trustee.Id) + " disconnected. " + err.Error())
-		}
-		if int(trusteeMsg[0]) != TRUSTEE_FINISHED_SETUP {
-			return errors.New("Unexpected message received from trustee " + strconv.Itoa(trustee.Id) + ".")
+	for _, trustee := range trustees {
+		if _, err := expectMessage(ctx, trustee.Conn, TRUSTEE_FINISHED_SETUP); err != nil {
+			return errors.New("Trustee " + strconv.Itoa(trustee.Id) + " did not finish the setup. " + err.Error())
 		}
 	}
+	p.rosterLock.Lock()
+	p.commitRoster(roster)
 	p.Initialized = true
+	p.rosterLock.Unlock()
+
+	// Tell clients about the new authentication context
+	p.announceCommitted(ctx, roster)
 	//trusteesFinished := 0
 	//for trusteesFinished < len(trustees) {
 	//	select {
@@ -62,30 +97,216 @@ func (p *RelayProtocol) relaySetup() error {
 	return nil
 }
 
-func (p *RelayProtocol) AuthenticateClient(clientConn net.Conn) (daganet.NodeRepresentation, error) {
+// Replaces the roster with a new version signed by the administrator.
+// The new version must add or remove exactly one client, or rotate the key of one client or
+// trustee (see config.KeyHandover). The change is sent to all trustees as a roster update
+// carrying the administrator's signature of the new roster. Trustees only compute the
+// generator of an added client, so existing members keep authenticating while the update
+// is applied.
+// The relay keeps serving the current roster until every trustee acknowledged the update.
+// If a trustee did not, the relay is no longer initialized, and the next setup sends the new roster.
+func (p *RelayProtocol) UpdateRoster(ctx context.Context, newRoster *config.Roster) error {
+
+	if err := newRoster.Verify(config.CryptoSuite, p.AdminPublicKey); err != nil {
+		return err
+	}
+
+	p.trusteeLock.Lock()
+	defer p.trusteeLock.Unlock()
+
+	p.rosterLock.RLock()
+	oldRoster, pending := p.Roster, p.pendingRoster != nil
+	trustees := append([]daganet.NodeRepresentation(nil), p.Trustees...)
+	p.rosterLock.RUnlock()
+
+	if oldRoster == nil {
+		return errors.New("Cannot update the roster before setup")
+	}
+	if pending {
+		return errors.New("A previous roster update failed, the trustees must be set up again first")
+	}
+	if newRoster.Version != oldRoster.Version+1 {
+		return errors.New("Expected roster version " + strconv.Itoa(oldRoster.Version+1) + ", got " + strconv.Itoa(newRoster.Version) + ".")
+	}
+
+	updateType, nodeId, publicKey, err := rosterDiff(oldRoster, newRoster)
+	if err != nil {
+		return err
+	}
+
+	msg, err := p.rosterUpdateMessage(newRoster, updateType, nodeId, publicKey)
+	if err != nil {
+		return err
+	}
+
+	if err := sendRosterUpdate(ctx, trustees, msg); err != nil {
+		p.rosterLock.Lock()
+		p.pendingRoster = newRoster
+		p.Initialized = false
+		p.rosterLock.Unlock()
+		return errors.New(err.Error() + " The trustees must be set up again.")
+	}
+
+	p.rosterLock.Lock()
+	p.commitRoster(newRoster)
+
+	// A trustee's rotated key replaces the one the relay knows it by
+	if updateType == ROSTER_ROTATE_KEY {
+		for i := range p.Trustees {
+			if p.Trustees[i].Id == nodeId {
+				p.Trustees[i].PublicKey = publicKey
+			}
+		}
+	}
+	p.rosterLock.Unlock()
+
+	// Tell clients about the authentication context of the new roster
+	p.announceCommitted(ctx, newRoster)
+	return nil
+}
+
+// Makes a roster the current one, once every trustee has it. rosterLock must be held for writing.
+func (p *RelayProtocol) commitRoster(roster *config.Roster) {
+	if roster != p.Roster {
+		p.Roster = roster
+		p.rosterHeader, p.memberTree, p.memberIds = nil, nil, nil
+	}
+	p.pendingRoster = nil
+}
+
+// Returns the roster along with its header, member tree and member ids.
+// The header and tree are built on first use and kept until the roster changes.
+func (p *RelayProtocol) rosterSnapshot() (*config.Roster, *config.RosterHeader, *config.MerkleTree, []int, error) {
+
+	p.rosterLock.RLock()
+	roster, header, tree, memberIds := p.Roster, p.rosterHeader, p.memberTree, p.memberIds
+	p.rosterLock.RUnlock()
+	if header != nil {
+		return roster, header, tree, memberIds, nil
+	}
+
+	p.rosterLock.Lock()
+	defer p.rosterLock.Unlock()
+
+	// Another request may have built the cache, or replaced the roster, meanwhile
+	if p.rosterHeader == nil {
+		if p.Roster == nil {
+			return nil, nil, nil, nil, errors.New("The relay has no roster")
+		}
+		tree, err := p.Roster.MemberTree(config.CryptoSuite)
+		if err != nil {
+			return nil, nil, nil, nil, errors.New("Cannot build roster member tree. " + err.Error())
+		}
+		p.memberTree = tree
+		p.rosterHeader = p.Roster.HeaderWithTree(tree)
+		p.memberIds = p.Roster.MemberIds()
+	}
+	return p.Roster, p.rosterHeader, p.memberTree, p.memberIds, nil
+}
+
+// Builds a roster update message signed with the relay's key.
+// The administrator's signature of the new roster is attached so that trustees can check the result.
+// The update kind is signed so that an addition cannot be replayed as a removal.
+func (p *RelayProtocol) rosterUpdateMessage(newRoster *config.Roster, updateType int, nodeId int, publicKey abstract.Point) (*RosterUpdate, error) {
+
+	msg := &RosterUpdate{
+		Update: RosterUpdateBody{
+			Version:   newRoster.Version,
+			Kind:      uint8(updateType),
+			NodeId:    nodeId,
+			PublicKey: publicKey,
+		},
+		AdminSignature: newRoster.Signature,
+	}
+	body, err := signedBody(SIGN_LABEL_ROSTER_UPDATE, &msg.Update)
+	if err != nil {
+		return nil, errors.New("Cannot marshal roster update. " + err.Error())
+	}
+
+	msg.RelaySignature, err = p.Keys.Sign(body)
+	if err != nil {
+		return nil, errors.New("Cannot sign roster update. " + err.Error())
+	}
+	return msg, nil
+}
+
+// Sends a roster update to all trustees, and waits until each of them applied it.
+// A trustee that misses an update rejects the following ones and must be set up again.
+func sendRosterUpdate(ctx context.Context, trustees []daganet.NodeRepresentation, msg *RosterUpdate) error {
+	for _, trustee := range trustees {
+		if trustee.Conn == nil {
+			return errors.New("Cannot send roster update to trustee " + strconv.Itoa(trustee.Id) + ", which is not connected.")
+		}
+		if err := writeMessage(ctx, trustee.Conn, 0, msg.Update.Version, msg); err != nil {
+			return errors.New("Cannot send roster update to trustee " + strconv.Itoa(trustee.Id) + ". " + err.Error())
+		}
+	}
+	for _, trustee := range trustees {
+		env, err := expectMessage(ctx, trustee.Conn, TRUSTEE_ROSTER_UPDATED)
+		if err != nil {
+			return errors.New("Trustee " + strconv.Itoa(trustee.Id) + " did not acknowledge the roster update. " + err.Error())
+		}
+		ack := env.Message.(*RosterUpdateAck)
+		if ack.Error != "" {
+			return errors.New("Trustee " + strconv.Itoa(trustee.Id) + " rejected the roster update: " + ack.Error + ".")
+		}
+		if ack.Version != msg.Update.Version {
+			return errors.New("Trustee " + strconv.Itoa(trustee.Id) + " acknowledged roster version " + strconv.Itoa(ack.Version) + ".")
+		}
+	}
+	return nil
+}
+
+func (p *RelayProtocol) AuthenticateClient(ctx context.Context, clientConn net.Conn) (daganet.NodeRepresentation, error) {
 
 	// Send a welcome message to the client consisting of:
 	// (1) one of the trustees' IP/port addresses;
-	// (2) all trustee public keys.
+	// (2) the roster header signed by the administrator, which holds all trustee public keys
+	//     and a Merkle root committing to the members.
 
-	addrBytes := []byte(p.TrusteeHosts[rand.Intn(len(p.TrusteeHosts))])
-	addrSize := len(addrBytes)
-	pkBytes, err := config.MarshalPointsMap(p.TrusteePublicKeys)
+	if len(p.TrusteeHosts) == 0 {
+		return daganet.NodeRepresentation{}, errors.New("No trustee advertises an address for clients")
+	}
+	roster, header, tree, memberIds, err := p.rosterSnapshot()
 	if err != nil {
-		return daganet.NodeRepresentation{}, errors.New("Cannot marshal server public keys. " + err.Error())
+		return daganet.NodeRepresentation{}, err
 	}
-	pkSize := len(pkBytes)
-
-	welcomeMsg := make([]byte, 1+addrSize+2+pkSize)
-	welcomeMsg[0] = byte(addrSize)
-	copy(welcomeMsg[1:addrSize+1], addrBytes)
-	binary.BigEndian.PutUint16(welcomeMsg[1+addrSize:3+addrSize], uint16(pkSize))
-	copy(welcomeMsg[3+addrSize:], pkBytes)
 
-	if err := writeMessage(clientConn, welcomeMsg); err != nil {
+	headerBytes, err := header.MarshalBinary()
+	if err != nil {
+		return daganet.NodeRepresentation{}, errors.New("Cannot marshal roster header. " + err.Error())
+	}
+	welcome := &RelayWelcome{
+		TrusteeAddr:  p.TrusteeHosts[rand.Intn(len(p.TrusteeHosts))],
+		RosterHeader: headerBytes,
+	}
+	if err := writeMessage(ctx, clientConn, 0, header.Version, welcome); err != nil {
 		return daganet.NodeRepresentation{}, errors.New("Cannot write to the relay. " + err.Error())
 	}
 
+	// Serve the client's requests for roster members until it goes on to the trustee
+	for {
+		env, err := readMessage(ctx, clientConn)
+		if err != nil {
+			return daganet.NodeRepresentation{}, errors.New("Client disconnected. " + err.Error())
+		}
+		if env.Type == CLIENT_JOINING {
+			break
+		}
+		req, ok := env.Message.(*RosterMembersReq)
+		if !ok {
+			return daganet.NodeRepresentation{}, errors.New("Unexpected message received from the client.")
+		}
+
+		page, err := rosterMembersPage(roster, tree, memberIds, req)
+		if err != nil {
+			return daganet.NodeRepresentation{}, err
+		}
+		if err := writeMessage(ctx, clientConn, 0, header.Version, page); err != nil {
+			return daganet.NodeRepresentation{}, errors.New("Cannot write to the client. " + err.Error())
+		}
+	}
+
 	// Wait until the client's authentication is finished
 	//clientMsg, err := prifinet.ReadMessage(clientConn)
 	//if err != nil {
@@ -96,3 +317,35 @@ func (p *RelayProtocol) AuthenticateClient(clientConn net.Conn) (daganet.NodeRep
 
 	return daganet.NodeRepresentation{}, nil
 }
+
+// Builds a page of roster members in answer to a client's request.
+// Each member is sent with its leaf index and the Merkle proof against the signed root.
+func rosterMembersPage(roster *config.Roster, tree *config.MerkleTree, memberIds []int, req *RosterMembersReq) (*RosterMembersPage, error) {
+
+	offset, count := req.Offset, req.Count
+	if offset < 0 || count < 0 {
+		return nil, errors.New("Malformed roster members request")
+	}
+	if count > ROSTER_PAGE_SIZE {
+		count = ROSTER_PAGE_SIZE
+	}
+	if offset > len(memberIds) {
+		offset = len(memberIds)
+	}
+	if offset+count > len(memberIds) {
+		count = len(memberIds) - offset
+	}
+
+	page := &RosterMembersPage{Members: make([]RosterMember, count)}
+	for i := 0; i < count; i++ {
+		index := offset + i
+		id := memberIds[index]
+
+		proof, err := tree.Proof(index)
+		if err != nil {
+			return nil, err
+		}
+		page.Members[i] = RosterMember{Id: id, Index: index, PublicKey: roster.Clients[id], Proof: proof}
+	}
+	return page, nil
+}
@@ -0,0 +1,112 @@
+package daga
+
+import (
+	"context"
+	"github.com/dedis/crypto/random"
+	"github.com/mahdiz/daga/config"
+	"testing"
+)
+
+// Roster updates are refused before setup and out of order, by the relay and by the trustee
+func TestRosterUpdateOrdering(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+
+	d := newTestDeployment(t, 2)
+	current := d.relay.Roster
+	added, _ := newTestNode(t, config.NODE_TYPE_CLIENT, 10)
+	next := current.Clone()
+	next.Version = current.Version + 1
+	next.Clients[added.Id] = added.PublicKey
+	d.sign(t, next)
+
+	d.relay.Roster = nil
+	if d.relay.UpdateRoster(ctx, next) == nil {
+		t.Fatal("Relay updated the roster before setup")
+	}
+	d.relay.Roster = current
+	d.setup(t)
+
+	skipped := next.Clone()
+	skipped.Version = current.Version + 2
+	d.sign(t, skipped)
+	if d.relay.UpdateRoster(ctx, skipped) == nil {
+		t.Fatal("Relay skipped a roster version")
+	}
+
+	// The trustee refuses an update that skips a version, even when the relay signed it
+	msg, err := d.relay.rosterUpdateMessage(skipped, ROSTER_ADD_MEMBER, added.Id, added.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.trustee.trusteeRosterUpdate(msg) == nil {
+		t.Fatal("Trustee skipped a roster version")
+	}
+
+	if err := d.relay.UpdateRoster(ctx, next); err != nil {
+		t.Fatal(err)
+	}
+	if d.relay.Roster.Version != next.Version || d.trustee.roster.Version != next.Version {
+		t.Fatal("Roster update was not applied")
+	}
+
+	// Replaying the applied update is refused
+	msg, err = d.relay.rosterUpdateMessage(next, ROSTER_ADD_MEMBER, added.Id, added.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.trustee.trusteeRosterUpdate(msg) == nil {
+		t.Fatal("Trustee applied a roster update twice")
+	}
+	if d.relay.UpdateRoster(ctx, next) == nil {
+		t.Fatal("Relay applied a roster update twice")
+	}
+}
+
+// A client's key handover becomes a roster update, and only the old key can hand over
+func TestRosterUpdateHandover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+
+	d := newTestDeployment(t, 2)
+	d.setup(t)
+	current := d.relay.Roster
+	c := d.clients[0]
+
+	// A handover made by another key than the client's is refused
+	impostor, _ := newTestNode(t, config.NODE_TYPE_CLIENT, c.Id)
+	impostor.PubId = c.PubId
+	forged, err := impostor.RotateKey(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := current.ApplyHandover(forged); err == nil {
+		t.Fatal("Applied a handover not signed by the client's key")
+	}
+
+	handover, err := c.RotateKey(random.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := current.ApplyHandover(handover)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotation must be the only change of the update
+	extra := next.Clone()
+	added, _ := newTestNode(t, config.NODE_TYPE_CLIENT, 10)
+	extra.Clients[added.Id] = added.PublicKey
+	d.sign(t, extra)
+	if d.relay.UpdateRoster(ctx, extra) == nil {
+		t.Fatal("Relay sent a key rotation along with another change")
+	}
+
+	d.sign(t, next)
+	if err := d.relay.UpdateRoster(ctx, next); err != nil {
+		t.Fatal(err)
+	}
+	if !d.trustee.roster.Clients[c.Id].Equal(c.PublicKey) {
+		t.Fatal("Trustee does not know the client's new key")
+	}
+}
@@ -0,0 +1,126 @@
+package daga
+
+import (
+	"context"
+	"errors"
+	"github.com/dedis/crypto/abstract"
+	"github.com/mahdiz/daga/config"
+	daganet "github.com/mahdiz/daga/net"
+	"net"
+	"time"
+)
+
+// Time a peer has to negotiate and finish the secure channel handshake after connecting
+const HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// Negotiates the protocol version and features of a connection the node dialed, then runs
+// the secure channel handshake over it.
+// Relay and trustees authenticate with their long-term key, while clients stay anonymous.
+// The peer must be the relay or one of the trustees listed in the node's config.
+// The handshake gives up when ctx is done.
+func SecureOutgoing(ctx context.Context, conn net.Conn, c *config.NodeConfig, keys KeyStore) (*daganet.SecureConn, error) {
+	var sconn *daganet.SecureConn
+	err := daganet.RunWithContext(ctx, conn, func() error {
+		nconn, err := daganet.NegotiateClient(conn, nodeFeatures(c))
+		if err != nil {
+			return err
+		}
+		cfg := &daganet.SecureConfig{
+			Suite:      config.CryptoSuite,
+			VerifyPeer: daganet.AcceptPubIds(config.CryptoSuite, serverPubIds(c)...),
+		}
+		if c.Type != config.NODE_TYPE_CLIENT {
+			cfg.Signer = keys
+		}
+		sconn, err = daganet.SecureClient(nconn, cfg)
+		return err
+	})
+	return sconn, err
+}
+
+// Negotiates the protocol version and features of a connection the relay or a trustee accepted,
+// then runs the secure channel handshake over it.
+// Peers that authenticate must be the relay or one of the trustees listed in the node's config.
+// Anonymous peers (clients) are refused if requirePeerAuth is set.
+// The handshake gives up when ctx is done.
+func SecureIncoming(ctx context.Context, conn net.Conn, c *config.NodeConfig, keys KeyStore, requirePeerAuth bool) (*daganet.SecureConn, error) {
+	var sconn *daganet.SecureConn
+	err := daganet.RunWithContext(ctx, conn, func() error {
+		nconn, err := daganet.NegotiateServer(conn, nodeFeatures(c))
+		if err != nil {
+			return err
+		}
+		sconn, err = daganet.SecureServer(nconn, &daganet.SecureConfig{
+			Suite:           config.CryptoSuite,
+			Signer:          keys,
+			VerifyPeer:      daganet.AcceptPubIds(config.CryptoSuite, serverPubIds(c)...),
+			RequirePeerAuth: requirePeerAuth,
+		})
+		return err
+	})
+	return sconn, err
+}
+
+// Accepts connections on a listener of the relay or a trustee, secures each one with
+// SecureIncoming and serves it in its own goroutine. Connections whose handshake fails,
+// or takes longer than HANDSHAKE_TIMEOUT, are closed.
+func ServeSecure(listener net.Listener, c *config.NodeConfig, keys KeyStore, serve func(conn *daganet.SecureConn)) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), HANDSHAKE_TIMEOUT)
+			sconn, err := SecureIncoming(ctx, conn, c, keys, false)
+			cancel()
+			if err != nil {
+				conn.Close()
+				return
+			}
+			serve(sconn)
+		}()
+	}
+}
+
+// Returns the relay's public key, as authenticated by a connection secured with SecureOutgoing.
+// Fails if the connection is not secured, or leads to another node than the config's relay.
+func relayPublicKey(c *config.NodeConfig, relayConn net.Conn) (abstract.Point, error) {
+	sconn := secureRelayConn(relayConn)
+	if sconn == nil || sconn.PeerPublicKey() == nil {
+		return nil, errors.New("The relay connection must be secured with SecureOutgoing")
+	}
+	relayKey := sconn.PeerPublicKey()
+	relays := c.Peers(config.NODE_TYPE_RELAY)
+	if len(relays) == 0 || relays[0].PubId != config.PublicKeyId(config.CryptoSuite, relayKey) {
+		return nil, errors.New("The relay connection is not connected to the relay")
+	}
+	return relayKey, nil
+}
+
+// Returns the secure connection under a client's relay connection, or nil if it is not secured
+func secureRelayConn(relayConn net.Conn) *daganet.SecureConn {
+	switch conn := relayConn.(type) {
+	case *daganet.SecureConn:
+		return conn
+	case *subscribedConn:
+		return conn.SecureConn
+	}
+	return nil
+}
+
+// Returns the features a node offers when negotiating a connection: its suite and auth method
+func nodeFeatures(c *config.NodeConfig) *daganet.Features {
+	return daganet.DefaultFeatures(c.Suite, c.AuthMethod)
+}
+
+// Returns the key identifiers of the relay and trustees listed in a node's config
+func serverPubIds(c *config.NodeConfig) []string {
+	var pubIds []string
+	for _, info := range c.NodesInfo {
+		if info.Type == config.NODE_TYPE_RELAY || info.Type == config.NODE_TYPE_TRUSTEE {
+			pubIds = append(pubIds, info.PubId)
+		}
+	}
+	return pubIds
+}
@@ -1,6 +1,7 @@
 package daga
 
 import (
+	"context"
 	"errors"
 	"github.com/dedis/crypto/abstract"
 	"github.com/mahdiz/daga/config"
@@ -9,80 +10,314 @@ import (
 	"strconv"
 )
 
-func (p *TrusteeProtocol) HandleMessage(msg []byte, senderConn net.Conn) error {
+// Creates a trustee protocol instance.
+// The relay's public key is used to verify roster updates, and the administrator's
+// public key to verify the rosters they lead to. The trustee's own key is only reached
+// through its key store, which may be a separate signer process (see OpenKeyStore).
+func NewTrusteeProtocol(trusteeId int, relay daganet.NodeRepresentation, trustees []daganet.NodeRepresentation,
+	adminPublicKey abstract.Point, keys KeyStore) *TrusteeProtocol {
+	return &TrusteeProtocol{
+		trusteeId:      trusteeId,
+		relay:          relay,
+		relayConn:      relay.Conn,
+		trustees:       trustees,
+		adminPublicKey: adminPublicKey,
+		keys:           keys,
+	}
+}
+
+func (p *TrusteeProtocol) HandleMessage(ctx context.Context, env *daganet.Envelope, senderConn net.Conn) error {
 
-	switch msg[0] {
-	case TRUSTEE_SETUP:
-		err := p.trusteeSetup(msg[1:])
+	switch msg := env.Message.(type) {
+	case *TrusteeSetup:
+		err := p.trusteeSetup(ctx, msg)
 		return err
 
-	case CLIENT_CONTEXT_REQ:
-		err := p.trusteeNewClient(senderConn)
+	case *ClientContextReq:
+		err := p.trusteeNewClient(ctx, senderConn)
+		return err
+
+	case *InitialTag:
+		err := p.trusteeClientTag(ctx, env, msg, senderConn)
+		return err
+
+	case *RosterUpdate:
+		err := p.trusteeRosterUpdate(msg)
+		ack := &RosterUpdateAck{Version: msg.Update.Version}
+		if err != nil {
+			ack.Error = err.Error()
+		}
+		relayConn, _ := p.peerConns()
+		if werr := writeMessage(ctx, relayConn, p.trusteeId, msg.Update.Version, ack); werr != nil && err == nil {
+			err = errors.New("Cannot write to the relay. " + werr.Error())
+		}
 		return err
 	}
 	return nil
 }
 
 // Trustee runs DAGA setup collectively with other trustees
-func (p *TrusteeProtocol) trusteeSetup(msg []byte) error {
+func (p *TrusteeProtocol) trusteeSetup(ctx context.Context, msg *TrusteeSetup) error {
 
-	// Extract public key roster from the message
-	publicKeyRoster, err := config.UnmarshalPointsMap(config.CryptoSuite, msg[1:])
+	// Extract the signed roster from the message and check the administrator's signature
+	roster, err := config.UnmarshalRoster(config.CryptoSuite, msg.Roster)
 	if err != nil {
 		return errors.New("Cannot unmarshall public key roster. " + err.Error())
 	}
-	p.publicKeyRoster = publicKeyRoster
+	if err := roster.Verify(config.CryptoSuite, p.adminPublicKey); err != nil {
+		return err
+	}
+	if _, ok := roster.Trustees[p.trusteeId]; !ok {
+		return errors.New("Trustee " + strconv.Itoa(p.trusteeId) + " is not in the roster.")
+	}
+
+	// Refuse to go back to an older roster, which may still list removed members or keys
+	p.lock.RLock()
+	accepted := p.acceptedVersion
+	p.lock.RUnlock()
+	if roster.Version < accepted {
+		return errors.New("Roster version " + strconv.Itoa(roster.Version) +
+			" is older than the accepted version " + strconv.Itoa(accepted) + ".")
+	}
+
+	relayConn, trustees := p.peerConns()
+	for _, trustee := range trustees {
+		if trustee.Conn == nil {
+			return errors.New("Trustee " + strconv.Itoa(trustee.Id) + " is not connected")
+		}
+	}
 
 	// Generate a secret r_j and the commitment R_j = g^r_j
-	commits := make(map[int]abstract.Point, len(p.trustees)) // Trustees' commitments
+	commits := make(map[int]abstract.Point, len(trustees)) // Trustees' commitments
 	rand := config.CryptoSuite.Cipher(nil)
 	g := config.CryptoSuite.Point().Base()
 	r := config.CryptoSuite.Scalar().Pick(rand) // Random secret
 	commits[p.trusteeId] = config.CryptoSuite.Point().Mul(g, r)
 
 	// Broadcast the commitment to other trustees
-	Rb, _ := commits[p.trusteeId].MarshalBinary()
-	daganet.NUnicastMessageToNodes(p.trustees, Rb)
+	for _, trustee := range trustees {
+		if err := writeMessage(ctx, trustee.Conn, p.trusteeId, roster.Version, &TrusteeCommitment{Commitment: commits[p.trusteeId]}); err != nil {
+			return errors.New("Cannot send the commitment to trustee " + strconv.Itoa(trustee.Id) + ". " + err.Error())
+		}
+	}
 
 	// Receive and collect commitments of other trustees
-	for _, trustee := range p.trustees {
+	for _, trustee := range trustees {
 
 		// TODO: Reading from multiple trustees can be done in parallel using a goroutine.
-		commitBinary, err := daganet.ReadMessage(trustee.Conn)
-		if err == nil {
+		env, err := expectMessage(ctx, trustee.Conn, TRUSTEE_COMMITMENT)
+		if err != nil {
 			// TODO: If a trustee disconnects, we should rerun the setup.
-			return errors.New("Cannot read from the trustee " + strconv.Itoa(trustee.Id) + ". " + err.Error())
+			return errors.New("Cannot read the commitment of trustee " + strconv.Itoa(trustee.Id) + ". " + err.Error())
 		}
-
-		commitment := config.CryptoSuite.Point()
-		err = commitment.UnmarshalBinary(commitBinary)
-		if err == nil {
-			return errors.New("Cannot unmarshal trustee " + strconv.Itoa(trustee.Id) + " commitment. " + err.Error())
+		commitment := env.Message.(*TrusteeCommitment).Commitment
+		if commitment == nil {
+			return errors.New("Trustee " + strconv.Itoa(trustee.Id) + " sent an empty commitment.")
 		}
 		commits[trustee.Id] = commitment
 	}
-	p.trusteeCommitments = commits
+
+	digest, err := roster.Digest(config.CryptoSuite)
+	if err != nil {
+		return errors.New("Cannot compute roster digest. " + err.Error())
+	}
 
 	// Generate a group generator h_i = H(i, commits) for each client i
-	p.clientGenerators = make(map[int]abstract.Point, len(p.publicKeyRoster))
-	for clientId, _ := range p.publicKeyRoster {
-		p.clientGenerators[clientId], err = computeClientGroupGenerator(config.CryptoSuite, clientId, commits)
+	clientGenerators := make(map[int]abstract.Point, len(roster.Clients))
+	for clientId, _ := range roster.Clients {
+		clientGenerators[clientId], err = computeClientGroupGenerator(config.CryptoSuite, clientId, commits)
 		if err != nil {
 			return errors.New("Cannot compute client generator. " + err.Error())
 		}
 	}
+
+	p.lock.Lock()
+	if roster.Version < p.acceptedVersion {
+		p.lock.Unlock()
+		return errors.New("Roster version " + strconv.Itoa(roster.Version) +
+			" is older than the accepted version " + strconv.Itoa(p.acceptedVersion) + ".")
+	}
+	p.roster = roster
+	p.rosterDigest = digest
+	p.acceptedVersion = roster.Version
+	p.trusteeCommitments = commits
+	p.clientGenerators = clientGenerators
+	p.roundSecret = r
+	p.lock.Unlock()
+
+	// Tell the relay the setup is over
+	if err := writeMessage(ctx, relayConn, p.trusteeId, roster.Version, &TrusteeFinishedSetup{}); err != nil {
+		return errors.New("Cannot write to the relay. " + err.Error())
+	}
 	return nil
 }
 
-// Trustee sends an authentication context (trustee commitments) to the client
-func (p *TrusteeProtocol) trusteeNewClient(clientConn net.Conn) error {
+// Trustee applies a signed roster update from the relay.
+// The update is applied to a copy of the roster, which must then carry the administrator's
+// signature. Only the generator of the added or removed client is recomputed; a rotated key
+// keeps the node's id, and so its generator. The relay is told whether the update was applied.
+func (p *TrusteeProtocol) trusteeRosterUpdate(msg *RosterUpdate) error {
+
+	p.lock.RLock()
+	relayKey := p.relay.PublicKey
+	p.lock.RUnlock()
+	if relayKey == nil {
+		return errors.New("The relay's public key is not known")
+	}
+
+	body, err := signedBody(SIGN_LABEL_ROSTER_UPDATE, &msg.Update)
+	if err != nil {
+		return errors.New("Cannot marshal roster update. " + err.Error())
+	}
+	if err := config.SchnorrVerify(config.CryptoSuite, body, relayKey, msg.RelaySignature); err != nil {
+		return errors.New("Invalid roster update signature. " + err.Error())
+	}
+
+	version, updateType, nodeId, publicKey := msg.Update.Version, int(msg.Update.Kind), msg.Update.NodeId, msg.Update.PublicKey
+	if publicKey == nil && updateType != ROSTER_REMOVE_MEMBER {
+		return errors.New("Roster update is missing the member's public key")
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.roster == nil {
+		return errors.New("Cannot apply a roster update before setup")
+	}
+	if version != p.roster.Version+1 {
+		return errors.New("Out of order roster update: got version " + strconv.Itoa(version) +
+			", expected " + strconv.Itoa(p.roster.Version+1) + ".")
+	}
+
+	roster := p.roster.Clone()
+	roster.Version = version
+	roster.Signature = msg.AdminSignature
+
+	var h abstract.Point
+	switch updateType {
+	case ROSTER_ADD_MEMBER:
+		if _, exists := roster.Clients[nodeId]; exists {
+			return errors.New("Client " + strconv.Itoa(nodeId) + " is already in the roster.")
+		}
+		roster.Clients[nodeId] = publicKey
+		if h, err = computeClientGroupGenerator(config.CryptoSuite, nodeId, p.trusteeCommitments); err != nil {
+			return errors.New("Cannot compute client generator. " + err.Error())
+		}
+
+	case ROSTER_REMOVE_MEMBER:
+		if _, exists := roster.Clients[nodeId]; !exists {
+			return errors.New("Client " + strconv.Itoa(nodeId) + " is not in the roster.")
+		}
+		delete(roster.Clients, nodeId)
+
+	case ROSTER_ROTATE_KEY:
+		if _, exists := roster.Clients[nodeId]; exists {
+			roster.Clients[nodeId] = publicKey
+		} else if _, exists := roster.Trustees[nodeId]; exists {
+			roster.Trustees[nodeId] = publicKey
+		} else {
+			return errors.New("Node " + strconv.Itoa(nodeId) + " is not in the roster.")
+		}
+
+	default:
+		return errors.New("Unknown roster update kind " + strconv.Itoa(updateType))
+	}
+
+	if err := roster.Verify(config.CryptoSuite, p.adminPublicKey); err != nil {
+		return err
+	}
+	digest, err := roster.Digest(config.CryptoSuite)
+	if err != nil {
+		return errors.New("Cannot compute roster digest. " + err.Error())
+	}
+
+	p.roster = roster
+	p.rosterDigest = digest
+	p.acceptedVersion = version
+	switch updateType {
+	case ROSTER_ADD_MEMBER:
+		p.clientGenerators[nodeId] = h
+	case ROSTER_REMOVE_MEMBER:
+		delete(p.clientGenerators, nodeId)
+	case ROSTER_ROTATE_KEY:
+		for i := range p.trustees {
+			if p.trustees[i].Id == nodeId {
+				p.trustees[i].PublicKey = publicKey
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the relay's connection and a copy of the other trustees, with their connections
+func (p *TrusteeProtocol) peerConns() (net.Conn, []daganet.NodeRepresentation) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.relayConn, append([]daganet.NodeRepresentation(nil), p.trustees...)
+}
+
+// Trustee sends an authentication context to the client: the digest of the roster
+// the context was built from, the trustee commitments, and the trustee's id and signature
+// over both, which the client checks against the trustee's key in the roster
+func (p *TrusteeProtocol) trusteeNewClient(ctx context.Context, clientConn net.Conn) error {
+
+	p.lock.RLock()
+	if p.roster == nil {
+		p.lock.RUnlock()
+		return errors.New("Cannot send an authentication context before setup")
+	}
+	version := p.roster.Version
+	msg := &AuthContext{
+		Context:   AuthContextBody{RosterDigest: p.rosterDigest, Commitments: p.trusteeCommitments},
+		TrusteeId: p.trusteeId,
+	}
+	body, err := signedBody(SIGN_LABEL_AUTH_CONTEXT, &msg.Context)
+	p.lock.RUnlock()
+	if err != nil {
+		return errors.New("Cannot marshal authentication context. " + err.Error())
+	}
+
+	msg.Signature, err = p.keys.Sign(body)
+	if err != nil {
+		return errors.New("Cannot sign authentication context. " + err.Error())
+	}
+
+	if err := writeMessage(ctx, clientConn, p.trusteeId, version, msg); err != nil {
+		return errors.New("Cannot write to the client. " + err.Error())
+	}
+	return nil
+}
+
+// Trustee applies its step to a client's linkage tag: it removes the secret it shares with
+// the client, s_j = H(Z^y_j), and applies its round secret, T_j = T_{j-1}^{r_j / s_j}.
+// The exponentiation by the trustee's private key y_j is done by its key store.
+func (p *TrusteeProtocol) trusteeClientTag(ctx context.Context, env *daganet.Envelope, msg *InitialTag, clientConn net.Conn) error {
+
+	if msg.Tag == nil || msg.Ephemeral == nil {
+		return errors.New("Client sent an incomplete linkage tag")
+	}
+	p.lock.RLock()
+	r, roster := p.roundSecret, p.roster
+	p.lock.RUnlock()
+	if r == nil || roster == nil {
+		return errors.New("Cannot process a linkage tag before setup")
+	}
+	if int(env.ContextId) != roster.Version {
+		return errors.New("Linkage tag was computed for roster version " + strconv.Itoa(int(env.ContextId)) +
+			" instead of " + strconv.Itoa(roster.Version))
+	}
 
-	commitBytes, err := config.MarshalPointsMap(p.trusteeCommitments)
+	shared, err := p.keys.Mul(msg.Ephemeral)
 	if err != nil {
-		return errors.New("Cannot marshal trustee commitments. " + err.Error())
+		return errors.New("Cannot compute the secret shared with the client. " + err.Error())
 	}
+	s := hashPoint(config.CryptoSuite, shared)
+	exp := config.CryptoSuite.Scalar().Mul(r, config.CryptoSuite.Scalar().Inv(s))
+	tag := config.CryptoSuite.Point().Mul(msg.Tag, exp)
 
-	if err := writeMessage(clientConn, commitBytes); err != nil {
+	// TODO: With several trustees, pass the tag on to the others, each applying its own step,
+	// TODO: and check the client's proof that the initial tag is well formed (see ClientAuthentication).
+	if err := writeMessage(ctx, clientConn, p.trusteeId, roster.Version, &FinalTag{Tag: tag}); err != nil {
 		return errors.New("Cannot write to the client. " + err.Error())
 	}
 	return nil
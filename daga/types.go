@@ -1,9 +1,13 @@
 package daga
 
 import (
+	"context"
 	"github.com/dedis/crypto/abstract"
+	"github.com/mahdiz/daga/config"
 	daganet "github.com/mahdiz/daga/net"
 	"net"
+	"sync"
+	"time"
 )
 
 const (
@@ -11,25 +15,89 @@ const (
 )
 
 type Protocol interface {
-	Start() error
-	HandleMessage(msg []byte, senderConn net.Conn) error
+	Start(ctx context.Context) error
+	HandleMessage(ctx context.Context, env *daganet.Envelope, senderConn net.Conn) error
 }
 
 /////////////////
 
+// Type codes of DAGA messages (see messages.go), distinct from the net package's codes
 const (
-	TRUSTEE_SETUP          = iota // Relay requesting DAGA setup (fresh authentication context)
-	TRUSTEE_FINISHED_SETUP        // Trustee finished DAGA setup
-	CLIENT_JOINING                // Client requests authentication from the relay
-	CLIENT_CONTEXT_REQ            // Client requesting authentication context from the first trustee
+	TRUSTEE_SETUP          = 0x0200 + iota // Relay requesting DAGA setup (fresh authentication context)
+	TRUSTEE_FINISHED_SETUP                 // Trustee finished DAGA setup
+	CLIENT_JOINING                         // Client requests authentication from the relay
+	CLIENT_CONTEXT_REQ                     // Client requesting authentication context from the first trustee
+	ROSTER_UPDATE                          // Relay adding, removing or replacing a member in the trustees' roster
+	ROSTER_MEMBERS_REQ                     // Client requesting a page of roster members from the relay
+	ROSTER_MEMBERS_PAGE                    // Relay sending a page of roster members
+	RELAY_WELCOME                          // Relay sending a trustee address and the roster header to a client
+	TRUSTEE_COMMITMENT                     // Trustee sending its setup commitment to the other trustees
+	TRUSTEE_AUTH_CONTEXT                   // Trustee sending a signed authentication context to a client
+	CLIENT_INITIAL_TAG                     // Client sending its initial linkage tag to the trustee
+	TRUSTEE_FINAL_TAG                      // Trustee sending the final linkage tag to the client
+	KEYSTORE_REQUEST                       // Node requesting a private key operation from its signer process
+	KEYSTORE_RESPONSE                      // Signer process answering a key store request
+	RELAY_ANNOUNCEMENT                     // Relay announcing a context or downstream cell to all clients
+	ANNOUNCEMENTS_REQ                      // Client requesting the announcements it missed from the relay
+	ANNOUNCEMENTS                          // Relay sending missed announcements to a client
+	TRUSTEE_ROSTER_UPDATED                 // Trustee acknowledging a roster update
+)
+
+// Kinds of roster updates
+const (
+	ROSTER_ADD_MEMBER    = iota // Client added to the roster
+	ROSTER_REMOVE_MEMBER        // Client removed from the roster
+	ROSTER_ROTATE_KEY           // Key of a client or trustee replaced under the same id
+)
+
+// Number of roster members sent by the relay per page
+const ROSTER_PAGE_SIZE = 64
+
+// Kinds of relay announcements
+const (
+	ANNOUNCE_AUTH_CONTEXT = iota // Authentication context signed by a trustee
+	ANNOUNCE_DOWNSTREAM          // Downstream cell
+)
+
+// Number of announcements the relay keeps for clients that missed them
+const ANNOUNCE_HISTORY = 256
+
+// Number of messages queued for a client subscribed over TCP before it is dropped as too slow
+const ANNOUNCE_QUEUE_SIZE = 64
+
+// Time a client subscribed over TCP is given to take each message
+const ANNOUNCE_WRITE_TIMEOUT = 10 * time.Second
+
+// Labels prefixed to the messages the relay and trustees sign with their long-term keys
+// (see signedBody), so that the signature of one kind of message is not accepted for another
+const (
+	SIGN_LABEL_ROSTER_UPDATE = "DAGA-ROSTER-UPDATE-1"
+	SIGN_LABEL_ANNOUNCEMENT  = "DAGA-ANNOUNCEMENT-1"
+	SIGN_LABEL_AUTH_CONTEXT  = "DAGA-AUTH-CONTEXT-1"
 )
 
 type RelayProtocol struct {
-	Initialized       bool
-	TrusteeHosts      []string
-	Trustees          []daganet.NodeRepresentation
-	ClientPublicKeys  map[int]abstract.Point
-	TrusteePublicKeys map[int]abstract.Point
+	Initialized    bool
+	TrusteeHosts   []string
+	Trustees       []daganet.NodeRepresentation
+	Roster         *config.Roster       // Client and trustee public keys, signed by the administrator
+	AdminPublicKey abstract.Point       // Administrator's public key, used to check new rosters
+	Keys           KeyStore             // Relay's long-term key, used to sign roster updates
+	Announcer      *Announcer           // Announces contexts and downstream cells to clients, if set
+	TrusteeConns   *daganet.ConnManager // Keeps the trustee connections open, if set (see ConnectTrustees)
+	trusteeLock    sync.Mutex           // Serializes setups and roster updates, which talk to the trustees
+	rosterLock     sync.RWMutex
+	pendingRoster  *config.Roster       // Roster some trustees may have applied, to set up again with
+	rosterHeader   *config.RosterHeader // Cached header of Roster
+	memberTree     *config.MerkleTree   // Cached Merkle tree over Roster's members
+	memberIds      []int                // Roster's member ids, in leaf order
+}
+
+// Outcome of a client's authentication
+type AuthResult struct {
+	AnonymitySet  []int          // Ids of the members the client authenticated among
+	RosterVersion int            // Version of the roster the authentication context was built from
+	Tag           abstract.Point // Final linkage tag
 }
 
 type TrusteeProtocol struct {
@@ -37,8 +105,13 @@ type TrusteeProtocol struct {
 	trustees           []daganet.NodeRepresentation
 	relay              daganet.NodeRepresentation
 	relayConn          net.Conn
-	publicKeyRoster    map[int]abstract.Point
-	rand               int                    // r_j
+	adminPublicKey     abstract.Point
+	keys               KeyStore               // Trustee's long-term key
+	roster             *config.Roster         // Roster the context was built from
+	rosterDigest       []byte                 // Digest of roster, sent with every authentication context
+	acceptedVersion    int                    // Highest roster version accepted, kept across setups
+	roundSecret        abstract.Scalar        // r_j
 	clientGenerators   map[int]abstract.Point // Clients' group generators (h_i's)
 	trusteeCommitments map[int]abstract.Point
+	lock               sync.RWMutex
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mahdiz/daga/config"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Generates the config folders of a whole deployment
+func genConfigCommand(args []string) error {
+
+	fs := flag.NewFlagSet("genconfig", flag.ExitOnError)
+	out := fs.String("out", "", "Folder to write the deployment into (default: the config root)")
+	specFile := fs.String("spec", "", "TOML deployment spec listing the nodes; replaces the count and address flags")
+	nClients := fs.Int("clients", 1, "Number of clients")
+	nTrustees := fs.Int("trustees", 1, "Number of trustees")
+	authMethod := fs.Int("auth", 0, "Authentication method")
+	passphraseFile := fs.String("passphrase-file", "", "File containing the passphrase that protects the private keys (default: $"+config.PASSPHRASE_ENV+")")
+	relayAddr := fs.String("relay-addr", "", "Advertised host:port of the relay; enables address generation")
+	trusteeHosts := fs.String("trustee-hosts", "", "Comma-separated advertised hosts of the trustees (default: the relay's host)")
+	trusteePort := fs.Int("trustee-port", 9100, "Port of the first trustee; the others use the following ports")
+	listenHost := fs.String("listen-host", "", "Host the relay and trustees bind to, e.g. 0.0.0.0 or :: (default: their advertised host)")
+	fs.Parse(args)
+
+	passphrase, err := config.ReadPassphrase(*passphraseFile)
+	if err != nil {
+		return err
+	}
+	if len(passphrase) == 0 {
+		fmt.Fprintln(os.Stderr, "Warning: no passphrase given, private keys are saved unencrypted.")
+	}
+
+	if *specFile != "" {
+		spec, err := config.LoadDeploymentSpec(*specFile)
+		if err != nil {
+			return err
+		}
+		if err := config.GenerateDeployment(spec, *out, passphrase); err != nil {
+			return err
+		}
+		fmt.Println("Generated", len(spec.ExpandNodes()), "nodes from", *specFile)
+		return nil
+	}
+
+	if *nClients < 0 || *nTrustees < 1 {
+		return errors.New("A deployment needs at least one trustee")
+	}
+
+	var plan *config.AddressPlan
+	if *relayAddr != "" {
+		host, port, err := net.SplitHostPort(*relayAddr)
+		if err != nil {
+			return errors.New("Invalid -relay-addr. " + err.Error())
+		}
+		relayPort, err := strconv.Atoi(port)
+		if err != nil {
+			return errors.New("Invalid -relay-addr port. " + err.Error())
+		}
+		plan = &config.AddressPlan{
+			ListenHost:      *listenHost,
+			RelayHost:       host,
+			RelayPort:       relayPort,
+			TrusteeHosts:    []string{host},
+			TrusteeBasePort: *trusteePort,
+		}
+		if *trusteeHosts != "" {
+			plan.TrusteeHosts = strings.Split(*trusteeHosts, ",")
+		}
+	}
+
+	if err := config.GenerateConfig(*out, *nClients, *nTrustees, *authMethod, config.CryptoSuite, plan, passphrase); err != nil {
+		return err
+	}
+	fmt.Println("Generated a relay,", *nTrustees, "trustees and", *nClients, "clients")
+	return nil
+}
+
+// Lists the node profiles found under the config root
+func profilesCommand(args []string) error {
+
+	fs := flag.NewFlagSet("profiles", flag.ExitOnError)
+	fs.Parse(args)
+
+	root := config.ConfigRoot()
+	if root == "" {
+		return errors.New("Profiles can only be listed under a config root (-config-root or $" + config.CONFIG_ROOT_ENV + ")")
+	}
+
+	profiles, err := config.ListProfiles(root)
+	if err != nil {
+		return err
+	}
+	for _, profile := range profiles {
+		fmt.Println(profile)
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dedis/crypto/random"
+	"github.com/mahdiz/daga/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// daga key encrypt|rotate|split|recover|import-ssh
+func keyCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: daga key encrypt|rotate|split|recover|import-ssh [flags]")
+	}
+	switch args[0] {
+	case "encrypt":
+		return keyEncrypt(args[1:])
+	case "rotate":
+		return keyRotate(args[1:])
+	case "split":
+		return keySplit(args[1:])
+	case "recover":
+		return keyRecover(args[1:])
+	case "import-ssh":
+		return keyImportSSH(args[1:])
+	}
+	return errors.New("Unknown key command '" + args[0] + "'")
+}
+
+// Encrypts a node's private key file with a passphrase.
+// This is the migration path for plaintext keys, and also changes the passphrase of encrypted keys.
+func keyEncrypt(args []string) error {
+
+	fs := flag.NewFlagSet("key encrypt", flag.ExitOnError)
+	node := fs.String("node", "", "Name of the node whose key is encrypted")
+	passphraseFile := fs.String("passphrase-file", "", "File containing the current passphrase, if the key is already encrypted")
+	newPassphraseFile := fs.String("new-passphrase-file", "", "File containing the new passphrase (default: $"+config.PASSPHRASE_ENV+")")
+	fs.Parse(args)
+
+	if *node == "" {
+		return errors.New("Missing -node")
+	}
+
+	passphrase, err := config.ReadPassphrase(*passphraseFile)
+	if err != nil {
+		return err
+	}
+	c := config.NodeConfig{}
+	c.SetPassphrase(passphrase)
+	if err := c.Load(*node); err != nil {
+		return err
+	}
+
+	newPassphrase, err := config.ReadPassphrase(*newPassphraseFile)
+	if err != nil {
+		return err
+	}
+	if len(newPassphrase) == 0 {
+		return errors.New("No new passphrase given")
+	}
+	c.SetPassphrase(newPassphrase)
+	if err := c.Save(*node); err != nil {
+		return err
+	}
+
+	fmt.Println("Encrypted the private key of", *node)
+	return nil
+}
+
+// Replaces a node's key pair with a fresh one under the same node id.
+// The old private key is archived, and a handover statement signed with both keys is written
+// for the administrator to apply to the roster (see daga roster apply-handover). A copy of the
+// handover is kept in the node's folder, as <new key id>.handover.
+func keyRotate(args []string) error {
+
+	fs := flag.NewFlagSet("key rotate", flag.ExitOnError)
+	node := fs.String("node", "", "Name of the node whose key is rotated")
+	out := fs.String("out", "", "File to write the handover statement to (default: standard output)")
+	passphraseFile := fs.String("passphrase-file", "", "File containing the key passphrase, also used for the new key (default: $"+config.PASSPHRASE_ENV+")")
+	fs.Parse(args)
+
+	if *node == "" {
+		return errors.New("Missing -node")
+	}
+	dir, err := config.ConfigDir(*node)
+	if err != nil {
+		return err
+	}
+	c, err := loadNodeConfig(*node, *passphraseFile)
+	if err != nil {
+		return err
+	}
+
+	oldPubId := c.PubId
+	handover, err := c.RotateKey(random.Stream)
+	if err != nil {
+		return err
+	}
+	handoverBytes, err := handover.MarshalPEM()
+	if err != nil {
+		return err
+	}
+
+	// Write the handover out before the new key replaces the old one, so that a rotated key
+	// always has a handover. A copy is kept in the node's folder in case the output is lost.
+	handoverFile := filepath.Join(dir, c.PubId+config.KEY_HANDOVER_EXT)
+	if err := ioutil.WriteFile(handoverFile, handoverBytes, 0644); err != nil {
+		return errors.New("Cannot keep a copy of the handover. " + err.Error())
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(handoverBytes)
+	} else {
+		err = ioutil.WriteFile(*out, handoverBytes, 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Save the new key before archiving the old one, so that a failure leaves a usable config
+	if err := c.SaveDir(dir); err != nil {
+		return err
+	}
+	if err := config.ArchiveKey(dir, oldPubId); err != nil {
+		return errors.New("Cannot archive the old key. " + err.Error())
+	}
+	fmt.Fprintln(os.Stderr, "Rotated the key of", *node, "from", oldPubId, "to", c.PubId)
+	return nil
+}
+
+// Splits a node's private key into k-of-n printable shares, to be kept by different people
+func keySplit(args []string) error {
+
+	fs := flag.NewFlagSet("key split", flag.ExitOnError)
+	node := fs.String("node", "", "Name of the node whose key is split")
+	k := fs.Int("k", 2, "Number of shares needed to recover the key")
+	n := fs.Int("n", 3, "Number of shares")
+	outDir := fs.String("out-dir", "", "Folder to write one share file per share into (default: all shares to standard output)")
+	passphraseFile := fs.String("passphrase-file", "", "File containing the key passphrase (default: $"+config.PASSPHRASE_ENV+")")
+	fs.Parse(args)
+
+	if *node == "" {
+		return errors.New("Missing -node")
+	}
+	c, err := loadNodeConfig(*node, *passphraseFile)
+	if err != nil {
+		return err
+	}
+	shares, err := c.SplitPrivateKey(*k, *n, random.Stream)
+	if err != nil {
+		return err
+	}
+
+	if *outDir != "" {
+		if err := os.MkdirAll(*outDir, 0700); err != nil {
+			return err
+		}
+	}
+	for _, share := range shares {
+		shareBytes, err := share.MarshalPEM()
+		if err != nil {
+			return err
+		}
+		if *outDir == "" {
+			if _, err := os.Stdout.Write(shareBytes); err != nil {
+				return err
+			}
+			continue
+		}
+		filename := filepath.Join(*outDir, *node+"-share-"+strconv.Itoa(share.Index)+".pem")
+		if err := ioutil.WriteFile(filename, shareBytes, 0600); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Split the key of", *node, "into", *n, "shares, any", *k, "of which recover it")
+	return nil
+}
+
+// Recovers a node's private key from share files and saves it into the node's config folder.
+// The recovered key must match the PubId of the node's config.
+func keyRecover(args []string) error {
+
+	fs := flag.NewFlagSet("key recover", flag.ExitOnError)
+	node := fs.String("node", "", "Name of the node whose key is recovered")
+	passphraseFile := fs.String("passphrase-file", "", "File containing the passphrase to encrypt the recovered key with (default: $"+config.PASSPHRASE_ENV+")")
+	fs.Parse(args)
+
+	if *node == "" || fs.NArg() == 0 {
+		return errors.New("Usage: daga key recover -node <name> <share file>...")
+	}
+
+	var shares []*config.KeyShare
+	for _, filename := range fs.Args() {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		fileShares, err := config.UnmarshalKeySharesPEM(data)
+		if err != nil {
+			return errors.New(filename + ": " + err.Error())
+		}
+		shares = append(shares, fileShares...)
+	}
+	privateKey, err := config.RecoverPrivateKey(shares)
+	if err != nil {
+		return err
+	}
+
+	// Load the node's config, whose private key file is expected to be missing or unreadable
+	dir, err := config.ConfigDir(*node)
+	if err != nil {
+		return err
+	}
+	c := &config.NodeConfig{}
+	if err := c.LoadDir(dir); err != nil {
+		errs, ok := err.(config.ConfigErrors)
+		if !ok {
+			return err
+		}
+		for _, e := range errs {
+			if !strings.HasSuffix(e.File, ".sec") {
+				return err
+			}
+		}
+	}
+	if shares[0].PubId != c.PubId {
+		return errors.New("Key shares are for key " + shares[0].PubId + ", but " + *node + " uses key " + c.PubId)
+	}
+	if err := c.SetPrivateKey(privateKey); err != nil {
+		return err
+	}
+
+	passphrase, err := config.ReadPassphrase(*passphraseFile)
+	if err != nil {
+		return err
+	}
+	if len(passphrase) == 0 {
+		fmt.Fprintln(os.Stderr, "Warning: no passphrase given, the recovered key is saved unencrypted.")
+	}
+	c.SetPassphrase(passphrase)
+	if err := c.SaveDir(dir); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Recovered the key", c.PubId, "of", *node)
+	return nil
+}
+
+// Replaces a node's key with an existing OpenSSH Ed25519 private key, so that a member
+// authenticates with a key they already manage. The node's previous key is archived.
+// The member's public key must be added to the roster, e.g. with daga roster from-ssh.
+func keyImportSSH(args []string) error {
+
+	fs := flag.NewFlagSet("key import-ssh", flag.ExitOnError)
+	node := fs.String("node", "", "Name of the node the key is imported into")
+	keyFile := fs.String("key", "", "OpenSSH private key file, e.g. ~/.ssh/id_ed25519")
+	sshPassphraseFile := fs.String("ssh-passphrase-file", "", "File containing the passphrase of the SSH key, if it is encrypted")
+	passphraseFile := fs.String("passphrase-file", "", "File containing the node's key passphrase, also used for the imported key (default: $"+config.PASSPHRASE_ENV+")")
+	fs.Parse(args)
+
+	if *node == "" || *keyFile == "" {
+		return errors.New("Usage: daga key import-ssh -node <name> -key <file>")
+	}
+	dir, err := config.ConfigDir(*node)
+	if err != nil {
+		return err
+	}
+	c, err := loadNodeConfig(*node, *passphraseFile)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	var sshPassphrase []byte
+	if *sshPassphraseFile != "" {
+		if sshPassphrase, err = config.ReadPassphrase(*sshPassphraseFile); err != nil {
+			return err
+		}
+	}
+
+	oldPubId := c.PubId
+	if err := c.ImportSSHPrivateKey(data, sshPassphrase); err != nil {
+		return errors.New("Cannot import " + *keyFile + ". " + err.Error())
+	}
+	if err := c.SaveDir(dir); err != nil {
+		return err
+	}
+	if c.PubId != oldPubId {
+		if err := config.ArchiveKey(dir, oldPubId); err != nil {
+			return errors.New("Cannot archive the previous key. " + err.Error())
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Imported", *keyFile, "into", *node, "as key", c.PubId, "on the", c.Suite, "suite")
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dedis/crypto/suites"
+	"github.com/mahdiz/daga/config"
+	"github.com/mahdiz/daga/daga"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Runs a signer process holding a node's private key and serving its operations on a Unix socket.
+// The signer loads its own copy of the node's profile, with the .sec file, while the node's
+// profile sets KeySocket to the socket and keeps only the .pub file. The signer only signs the
+// kinds of messages nodes sign (see daga.ServeKeyStore).
+func keydCommand(args []string) error {
+
+	fs := flag.NewFlagSet("keyd", flag.ExitOnError)
+	node := fs.String("node", "", "Name of the profile holding the private key")
+	socket := fs.String("socket", "", "Path of the Unix socket to listen on")
+	passphraseFile := fs.String("passphrase-file", "", "File containing the key passphrase (default: $"+config.PASSPHRASE_ENV+")")
+	fs.Parse(args)
+
+	if *node == "" || *socket == "" {
+		return errors.New("Usage: daga keyd -node <name> -socket <path>")
+	}
+	c, err := loadNodeConfig(*node, *passphraseFile)
+	if err != nil {
+		return err
+	}
+	if c.KeySocket != "" {
+		return errors.New("Profile " + *node + " delegates its key to " + c.KeySocket + "; the signer needs a profile with the .sec file")
+	}
+	keys, err := daga.NewFileKeyStore(c)
+	if err != nil {
+		return err
+	}
+
+	// Replace a socket left over by a previous run, and only let the owner connect
+	if err := os.Remove(*socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// The socket is created without access for others, rather than restricted once it exists
+	umask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", *socket)
+	syscall.Umask(umask)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(*socket, 0600); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Serving key", c.PubId, "of", *node, "on", *socket)
+	return daga.ServeKeyStore(listener, suites.All()[c.Suite], keys)
+}
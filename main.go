@@ -1,11 +1,81 @@
 package main
 
 import (
-	"github.com/mahdiz/daga/daga"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mahdiz/daga/config"
+	daganet "github.com/mahdiz/daga/net"
+	"os"
 )
 
 func main() {
-	var relay daga.RelayProtocol
 
-	relay.Start()
+	configRoot := flag.String("config-root", "", "Folder holding the node profiles (default: $"+config.CONFIG_ROOT_ENV+", or the home folder)")
+	profile := flag.String("profile", "", "Profile of the relay or trustee to start")
+	passphraseFile := flag.String("passphrase-file", "", "File containing the node's key passphrase (default: $"+config.PASSPHRASE_ENV+")")
+	flag.Parse()
+	config.SetConfigRoot(*configRoot)
+
+	// Run a subcommand if one is given, otherwise start the node of the profile
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Arg(0), flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *profile == "" {
+		fmt.Fprintln(os.Stderr, "Usage: daga -profile <name> [-passphrase-file <file>], or daga <command>")
+		os.Exit(2)
+	}
+	if err := runNode(*profile, *passphraseFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func runCommand(name string, args []string) error {
+	switch name {
+	case "genconfig":
+		return genConfigCommand(args)
+	case "profiles":
+		return profilesCommand(args)
+	case "roster":
+		return rosterCommand(args)
+	case "key":
+		return keyCommand(args)
+	case "config":
+		return configCommand(args)
+	case "keyd":
+		return keydCommand(args)
+	}
+	return errors.New("Unknown command '" + name + "'")
+}
+
+// Loads a node's config, decrypting its private key with the passphrase read from
+// passphraseFile or from the environment
+func loadNodeConfig(name string, passphraseFile string) (*config.NodeConfig, error) {
+
+	passphrase, err := config.ReadPassphrase(passphraseFile)
+	if err != nil {
+		return nil, errors.New("Cannot read passphrase. " + err.Error())
+	}
+
+	c := &config.NodeConfig{}
+	c.SetPassphrase(passphrase)
+	if err := c.Load(name); err != nil {
+		return nil, err
+	}
+	if err := config.UseCryptoSuite(c.Suite); err != nil {
+		return nil, err
+	}
+	if err := daganet.SetFrameLimits(c.MaxFrameSize, c.MaxMessageSize); err != nil {
+		return nil, err
+	}
+	if !c.KeyEncrypted() && c.KeySocket == "" {
+		fmt.Fprintln(os.Stderr, "Warning: the private key of "+name+" is not encrypted. Run 'daga key encrypt -node "+name+"' to protect it.")
+	}
+	return c, nil
 }
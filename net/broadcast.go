@@ -0,0 +1,45 @@
+package net
+
+import (
+	"errors"
+	"net"
+)
+
+// Opens a broadcast datagram connection to a UDP broadcast or multicast address (host:port),
+// e.g. IPV4_BROADCAST_ADDR:9100 or 239.1.2.3:9100. The connection only sends.
+func DialBroadcast(addr string, c *DatagramConfig) (*DatagramConn, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, errors.New("Cannot open broadcast address " + addr + ". " + err.Error())
+	}
+	return NewDatagramConn(conn, broadcastConfig(c)), nil
+}
+
+// Receives from a UDP broadcast or multicast address (host:port), joining the group of multicast
+// addresses on the default interface. The connection only receives.
+func ListenBroadcast(addr string, c *DatagramConfig) (*DatagramConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, errors.New("Invalid broadcast address " + addr + ". " + err.Error())
+	}
+
+	var conn *net.UDPConn
+	if udpAddr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", nil, udpAddr)
+	} else {
+		conn, err = net.ListenUDP("udp", &net.UDPAddr{Port: udpAddr.Port})
+	}
+	if err != nil {
+		return nil, errors.New("Cannot listen on broadcast address " + addr + ". " + err.Error())
+	}
+	return NewDatagramConn(conn, broadcastConfig(c)), nil
+}
+
+func broadcastConfig(c *DatagramConfig) *DatagramConfig {
+	bc := DatagramConfig{}
+	if c != nil {
+		bc = *c
+	}
+	bc.Broadcast = true
+	return &bc
+}
@@ -0,0 +1,642 @@
+package net
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/dedis/crypto/abstract"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Typed messages and their wire encoding.
+//
+// Every message is a Go struct registered under a protocol and a type code (see RegisterMessage).
+// Type codes are unique across protocols: each protocol takes its codes from its own range,
+// 0x01xx for the net package and 0x02xx for DAGA. A message travels in an envelope:
+//
+//	protocol (1 byte) | type (2 bytes) | context id (4 bytes) | sender (4 bytes) | body
+//
+// The body holds the struct's fields in order, encoded as follows (integers are big-endian):
+//
+//	bool, uint8                      1 byte
+//	uint16                           2 bytes
+//	uint32, int32                    4 bytes
+//	uint64, int64, int               8 bytes
+//	string, []byte                   4-byte length, then the bytes
+//	abstract.Point, abstract.Scalar  2-byte length, then the marshaled value (empty for nil)
+//	slices                           4-byte count, then the elements
+//	maps with integer keys           4-byte count, then the entries by increasing key
+//	structs                          their fields
+//
+// Decoding checks every length and count against the remaining input, and rejects
+// unknown types and trailing bytes.
+
+// Size of an encoded envelope header
+const ENVELOPE_HEADER_SIZE = 11
+
+// Sender of messages from anonymous nodes (clients) or from unknown senders
+const SENDER_ANONYMOUS = -1
+
+// A typed message along with its routing information
+type Envelope struct {
+	Protocol  uint8       // Protocol the message belongs to, set from the registry when encoding
+	Type      uint16      // Message type code, set from the registry when encoding
+	ContextId uint32      // Authentication context (roster version) the message refers to, 0 if none
+	Sender    int32       // Id of the sending node, or SENDER_ANONYMOUS
+	Message   interface{} // Pointer to a registered message struct
+}
+
+type messageInfo struct {
+	protocol uint8
+	msgType  uint16
+	goType   reflect.Type
+}
+
+var registry = struct {
+	sync.RWMutex
+	byCode   map[uint16]*messageInfo
+	byGoType map[reflect.Type]*messageInfo
+}{
+	byCode:   make(map[uint16]*messageInfo),
+	byGoType: make(map[reflect.Type]*messageInfo),
+}
+
+var (
+	pointType  = reflect.TypeOf((*abstract.Point)(nil)).Elem()
+	scalarType = reflect.TypeOf((*abstract.Scalar)(nil)).Elem()
+	bytesType  = reflect.TypeOf([]byte(nil))
+)
+
+// Registers a message struct under a protocol and a type code.
+// The prototype is a pointer to the struct, e.g. (*PublicKeys)(nil).
+// Registering a type code or struct twice, or a struct with a field that cannot be encoded, panics:
+// registrations are made from init functions, so these are programming errors.
+func RegisterMessage(protocol uint8, msgType uint16, prototype interface{}) {
+
+	t := reflect.TypeOf(prototype)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic("RegisterMessage: prototype of message type " + strconv.Itoa(int(msgType)) + " is not a pointer to a struct")
+	}
+	t = t.Elem()
+	if err := checkEncodable(t); err != nil {
+		panic("RegisterMessage: " + t.String() + ": " + err.Error())
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+	if other, ok := registry.byCode[msgType]; ok {
+		panic("RegisterMessage: type code " + strconv.Itoa(int(msgType)) + " of " + t.String() + " is taken by " + other.goType.String())
+	}
+	if _, ok := registry.byGoType[t]; ok {
+		panic("RegisterMessage: " + t.String() + " is already registered")
+	}
+	info := &messageInfo{protocol: protocol, msgType: msgType, goType: t}
+	registry.byCode[msgType] = info
+	registry.byGoType[t] = info
+}
+
+// Returns the type code a message struct is registered under
+func MessageType(msg interface{}) (uint16, error) {
+	info, err := lookupGoType(msg)
+	if err != nil {
+		return 0, err
+	}
+	return info.msgType, nil
+}
+
+func lookupGoType(msg interface{}) (*messageInfo, error) {
+	t := reflect.TypeOf(msg)
+	if t == nil || t.Kind() != reflect.Ptr {
+		return nil, errors.New("Message must be a pointer to a registered struct")
+	}
+	registry.RLock()
+	info := registry.byGoType[t.Elem()]
+	registry.RUnlock()
+	if info == nil {
+		return nil, errors.New("Message " + t.Elem().String() + " is not registered")
+	}
+	return info, nil
+}
+
+// Encodes an envelope and its message. The envelope's protocol and type are set from
+// the registry entry of the message.
+func Encode(env *Envelope) ([]byte, error) {
+
+	info, err := lookupGoType(env.Message)
+	if err != nil {
+		return nil, err
+	}
+	env.Protocol = info.protocol
+	env.Type = info.msgType
+
+	buf := make([]byte, ENVELOPE_HEADER_SIZE)
+	buf[0] = env.Protocol
+	binary.BigEndian.PutUint16(buf[1:3], env.Type)
+	binary.BigEndian.PutUint32(buf[3:7], env.ContextId)
+	binary.BigEndian.PutUint32(buf[7:11], uint32(env.Sender))
+
+	e := &encoder{buf: buf}
+	if err := e.encode(reflect.ValueOf(env.Message).Elem()); err != nil {
+		return nil, errors.New("Cannot encode " + info.goType.String() + ". " + err.Error())
+	}
+	return e.buf, nil
+}
+
+// Decodes an envelope and its message, whose points and scalars belong to the given suite.
+// The message must be registered under the envelope's type code and protocol.
+func Decode(suite abstract.Suite, data []byte) (*Envelope, error) {
+
+	if len(data) < ENVELOPE_HEADER_SIZE {
+		return nil, errors.New("Message is too short for an envelope")
+	}
+	env := &Envelope{
+		Protocol:  data[0],
+		Type:      binary.BigEndian.Uint16(data[1:3]),
+		ContextId: binary.BigEndian.Uint32(data[3:7]),
+		Sender:    int32(binary.BigEndian.Uint32(data[7:11])),
+	}
+
+	registry.RLock()
+	info := registry.byCode[env.Type]
+	registry.RUnlock()
+	if info == nil {
+		return nil, errors.New("Unknown message type " + strconv.Itoa(int(env.Type)))
+	}
+	if info.protocol != env.Protocol {
+		return nil, errors.New("Message type " + strconv.Itoa(int(env.Type)) + " does not belong to protocol " + strconv.Itoa(int(env.Protocol)))
+	}
+
+	msg := reflect.New(info.goType)
+	if err := decodeInto(suite, data[ENVELOPE_HEADER_SIZE:], msg.Elem()); err != nil {
+		return nil, errors.New("Cannot decode " + info.goType.String() + ". " + err.Error())
+	}
+	env.Message = msg.Interface()
+	return env, nil
+}
+
+// Encodes a message struct without an envelope, e.g. to sign it
+func EncodeBody(msg interface{}) ([]byte, error) {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, errors.New("Message must be a pointer to a struct")
+	}
+	if err := checkEncodable(v.Elem().Type()); err != nil {
+		return nil, err
+	}
+	e := &encoder{}
+	if err := e.encode(v.Elem()); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+// Decodes a message struct encoded by EncodeBody into msg, a pointer to the struct
+func DecodeBody(suite abstract.Suite, data []byte, msg interface{}) error {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return errors.New("Message must be a pointer to a struct")
+	}
+	if err := checkEncodable(v.Elem().Type()); err != nil {
+		return err
+	}
+	return decodeInto(suite, data, v.Elem())
+}
+
+// Writes an envelope as one message (see WriteMessage)
+func WriteEnvelope(conn net.Conn, env *Envelope) error {
+	data, err := Encode(env)
+	if err != nil {
+		return err
+	}
+	return WriteMessage(conn, data)
+}
+
+// Reads one message (see ReadMessage) and decodes its envelope
+func ReadEnvelope(conn net.Conn, suite abstract.Suite) (*Envelope, error) {
+	data, err := ReadMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(suite, data)
+}
+
+// Writes an envelope, giving up when the context is done (see WriteMessageContext)
+func WriteEnvelopeContext(ctx context.Context, conn net.Conn, env *Envelope) error {
+	data, err := Encode(env)
+	if err != nil {
+		return err
+	}
+	return WriteMessageContext(ctx, conn, data)
+}
+
+// Reads an envelope, giving up when the context is done (see ReadMessageContext)
+func ReadEnvelopeContext(ctx context.Context, conn net.Conn, suite abstract.Suite) (*Envelope, error) {
+	data, err := ReadMessageContext(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(suite, data)
+}
+
+// Reads an envelope, which must hold a message of the given type
+func ExpectEnvelope(conn net.Conn, suite abstract.Suite, msgType uint16) (*Envelope, error) {
+	env, err := ReadEnvelope(conn, suite)
+	if err != nil {
+		return nil, err
+	}
+	if env.Type != msgType {
+		return nil, errors.New("Expected message type " + strconv.Itoa(int(msgType)) + ", got " + strconv.Itoa(int(env.Type)))
+	}
+	return env, nil
+}
+
+// Writes a message with no context from an anonymous sender
+func writeTyped(conn net.Conn, msg interface{}) error {
+	return WriteEnvelope(conn, &Envelope{Sender: SENDER_ANONYMOUS, Message: msg})
+}
+
+// Checks that values of a type can be encoded, and that their decoding cannot allocate
+// more than the input's size
+func checkEncodable(t reflect.Type) error {
+
+	switch t {
+	case pointType, scalarType, bytesType:
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Int32,
+		reflect.Uint64, reflect.Int64, reflect.Int, reflect.String:
+		return nil
+
+	case reflect.Slice:
+		if minEncodedSize(t.Elem()) == 0 {
+			return errors.New("slices of " + t.Elem().String() + " have empty elements")
+		}
+		return checkEncodable(t.Elem())
+
+	case reflect.Map:
+		switch t.Key().Kind() {
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Int32, reflect.Uint64, reflect.Int64, reflect.Int:
+		default:
+			return errors.New("map keys must be integers, not " + t.Key().String())
+		}
+		return checkEncodable(t.Elem())
+
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				return errors.New("field " + f.Name + " is not exported")
+			}
+			if err := checkEncodable(f.Type); err != nil {
+				return errors.New("field " + f.Name + ": " + err.Error())
+			}
+		}
+		return nil
+	}
+	return errors.New("unsupported type " + t.String())
+}
+
+// Returns the smallest encoded size of a value of a type
+func minEncodedSize(t reflect.Type) int {
+
+	switch t {
+	case pointType, scalarType:
+		return 2
+	case bytesType:
+		return 4
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.Uint8:
+		return 1
+	case reflect.Uint16:
+		return 2
+	case reflect.Uint32, reflect.Int32, reflect.String, reflect.Slice, reflect.Map:
+		return 4
+	case reflect.Uint64, reflect.Int64, reflect.Int:
+		return 8
+	case reflect.Struct:
+		size := 0
+		for i := 0; i < t.NumField(); i++ {
+			size += minEncodedSize(t.Field(i).Type)
+		}
+		return size
+	}
+	return 0
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) putUint(x uint64, size int) {
+	for i := size - 1; i >= 0; i-- {
+		e.buf = append(e.buf, byte(x>>(8*uint(i))))
+	}
+}
+
+func (e *encoder) putBytes(b []byte) error {
+	if uint64(len(b)) > 0xffffffff {
+		return errors.New("byte array is too long")
+	}
+	e.putUint(uint64(len(b)), 4)
+	e.buf = append(e.buf, b...)
+	return nil
+}
+
+func (e *encoder) putMarshaled(v reflect.Value) error {
+	if v.IsNil() {
+		e.putUint(0, 2)
+		return nil
+	}
+	b, err := v.Interface().(interface {
+		MarshalBinary() ([]byte, error)
+	}).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 || len(b) > 0xffff {
+		return errors.New("marshaled " + v.Type().String() + " has an invalid length " + strconv.Itoa(len(b)))
+	}
+	e.putUint(uint64(len(b)), 2)
+	e.buf = append(e.buf, b...)
+	return nil
+}
+
+func (e *encoder) encode(v reflect.Value) error {
+
+	switch v.Type() {
+	case pointType, scalarType:
+		return e.putMarshaled(v)
+	case bytesType:
+		return e.putBytes(v.Bytes())
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.putUint(1, 1)
+		} else {
+			e.putUint(0, 1)
+		}
+	case reflect.Uint8:
+		e.putUint(v.Uint(), 1)
+	case reflect.Uint16:
+		e.putUint(v.Uint(), 2)
+	case reflect.Uint32:
+		e.putUint(v.Uint(), 4)
+	case reflect.Int32:
+		e.putUint(uint64(uint32(v.Int())), 4)
+	case reflect.Uint64:
+		e.putUint(v.Uint(), 8)
+	case reflect.Int64, reflect.Int:
+		e.putUint(uint64(v.Int()), 8)
+	case reflect.String:
+		return e.putBytes([]byte(v.String()))
+
+	case reflect.Slice:
+		if uint64(v.Len()) > 0xffffffff {
+			return errors.New("slice is too long")
+		}
+		e.putUint(uint64(v.Len()), 4)
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return lessInt(keys[i], keys[j]) })
+		e.putUint(uint64(len(keys)), 4)
+		for _, key := range keys {
+			if err := e.encode(key); err != nil {
+				return err
+			}
+			if err := e.encode(v.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if err := e.encode(v.Field(i)); err != nil {
+				return errors.New(v.Type().Field(i).Name + ": " + err.Error())
+			}
+		}
+
+	default:
+		return errors.New("unsupported type " + v.Type().String())
+	}
+	return nil
+}
+
+func lessInt(a reflect.Value, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	}
+	return a.Uint() < b.Uint()
+}
+
+type decoder struct {
+	suite abstract.Suite
+	data  []byte
+}
+
+func decodeInto(suite abstract.Suite, data []byte, v reflect.Value) error {
+	d := &decoder{suite: suite, data: data}
+	if err := d.decode(v); err != nil {
+		return err
+	}
+	if len(d.data) != 0 {
+		return errors.New(strconv.Itoa(len(d.data)) + " unexpected bytes after the message")
+	}
+	return nil
+}
+
+func (d *decoder) take(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data) {
+		return nil, errors.New("message is truncated")
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+func (d *decoder) readUint(size int) (uint64, error) {
+	b, err := d.take(size)
+	if err != nil {
+		return 0, err
+	}
+	var x uint64
+	for _, c := range b {
+		x = x<<8 | uint64(c)
+	}
+	return x, nil
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	n, err := d.readUint(4)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.data)) {
+		return nil, errors.New("byte array length exceeds the message")
+	}
+	b, _ := d.take(int(n))
+	return append([]byte(nil), b...), nil
+}
+
+// Reads a count of elements, each taking at least minSize bytes
+func (d *decoder) count(minSize int) (int, error) {
+	n, err := d.readUint(4)
+	if err != nil {
+		return 0, err
+	}
+	if n*uint64(minSize) > uint64(len(d.data)) {
+		return 0, errors.New("element count exceeds the message")
+	}
+	return int(n), nil
+}
+
+func (d *decoder) unmarshaled(v reflect.Value) error {
+	n, err := d.readUint(2)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	b, err := d.take(int(n))
+	if err != nil {
+		return err
+	}
+	if d.suite == nil {
+		return errors.New("no ciphersuite to decode " + v.Type().String())
+	}
+	var value interface {
+		UnmarshalBinary([]byte) error
+	}
+	if v.Type() == pointType {
+		p := d.suite.Point()
+		v.Set(reflect.ValueOf(p))
+		value = p
+	} else {
+		s := d.suite.Scalar()
+		v.Set(reflect.ValueOf(s))
+		value = s
+	}
+	if err := value.UnmarshalBinary(b); err != nil {
+		return errors.New("invalid " + v.Type().String() + ". " + err.Error())
+	}
+	return nil
+}
+
+func (d *decoder) decode(v reflect.Value) error {
+
+	switch v.Type() {
+	case pointType, scalarType:
+		return d.unmarshaled(v)
+	case bytesType:
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		v.SetBytes(b)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		x, err := d.readUint(1)
+		if err != nil {
+			return err
+		}
+		if x > 1 {
+			return errors.New("invalid boolean")
+		}
+		v.SetBool(x == 1)
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x, err := d.readUint(int(v.Type().Size()))
+		if err != nil {
+			return err
+		}
+		v.SetUint(x)
+	case reflect.Int32:
+		x, err := d.readUint(4)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(int32(uint32(x))))
+	case reflect.Int64, reflect.Int:
+		x, err := d.readUint(8)
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(int64(x)) {
+			return errors.New("integer overflows " + v.Type().String())
+		}
+		v.SetInt(int64(x))
+	case reflect.String:
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+
+	case reflect.Slice:
+		n, err := d.count(minEncodedSize(v.Type().Elem()))
+		if err != nil {
+			return err
+		}
+		s := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			if err := d.decode(s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+
+	case reflect.Map:
+		t := v.Type()
+		n, err := d.count(minEncodedSize(t.Key()) + minEncodedSize(t.Elem()))
+		if err != nil {
+			return err
+		}
+		m := reflect.MakeMapWithSize(t, n)
+		var last reflect.Value
+		for i := 0; i < n; i++ {
+			key := reflect.New(t.Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			if i > 0 && !lessInt(last, key) {
+				return errors.New("map keys are not in increasing order")
+			}
+			elem := reflect.New(t.Elem()).Elem()
+			if err := d.decode(elem); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, elem)
+			last = key
+		}
+		v.Set(m)
+
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if err := d.decode(v.Field(i)); err != nil {
+				return errors.New(v.Type().Field(i).Name + ": " + err.Error())
+			}
+		}
+
+	default:
+		return errors.New("unsupported type " + v.Type().String())
+	}
+	return nil
+}
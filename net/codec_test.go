@@ -0,0 +1,184 @@
+package net
+
+import (
+	"bytes"
+	"github.com/dedis/crypto/abstract"
+	"github.com/mahdiz/daga/config"
+	"reflect"
+	"testing"
+)
+
+// Message using every kind of field the codec supports, except points and scalars
+type testMessage struct {
+	Flag    bool
+	Small   uint8
+	Short   uint16
+	Word    uint32
+	Signed  int32
+	Long    uint64
+	Int     int
+	Text    string
+	Data    []byte
+	Strings []string
+	ById    map[int]string
+	Nested  testNested
+	List    []testNested
+}
+
+type testNested struct {
+	Id   int32
+	Data []byte
+}
+
+const testMessageType = 0x01ff
+
+func init() {
+	RegisterMessage(PROTOCOL_TYPE_NET, testMessageType, (*testMessage)(nil))
+}
+
+func newTestMessage() *testMessage {
+	return &testMessage{
+		Flag:    true,
+		Small:   0xab,
+		Short:   0xbeef,
+		Word:    0xdeadbeef,
+		Signed:  -42,
+		Long:    1 << 60,
+		Int:     -1,
+		Text:    "daga",
+		Data:    []byte{0, 1, 2, 3},
+		Strings: []string{"a", "", "bc"},
+		ById:    map[int]string{3: "three", -1: "minus one", 0: ""},
+		Nested:  testNested{Id: 7, Data: []byte("nested")},
+		List:    []testNested{{Id: 1}, {Id: 2, Data: []byte{9}}},
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	env := &Envelope{ContextId: 12, Sender: SENDER_ANONYMOUS, Message: newTestMessage()}
+	data, err := Encode(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Protocol != PROTOCOL_TYPE_NET || env.Type != testMessageType {
+		t.Fatalf("Encode set protocol %d and type %#x", env.Protocol, env.Type)
+	}
+
+	decoded, err := Decode(nil, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ContextId != 12 || decoded.Sender != SENDER_ANONYMOUS || decoded.Type != testMessageType {
+		t.Fatalf("Decoded header %+v", decoded)
+	}
+	if !reflect.DeepEqual(decoded.Message, env.Message) {
+		t.Fatalf("Decoded %+v, want %+v", decoded.Message, env.Message)
+	}
+
+	// Maps are encoded by increasing key, so the encoding does not depend on iteration order
+	again, err := Encode(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, data) {
+		t.Fatal("Encoding is not deterministic")
+	}
+}
+
+func TestBodyRoundTrip(t *testing.T) {
+	msg := newTestMessage()
+	body, err := EncodeBody(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded testMessage
+	if err := DecodeBody(nil, body, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, msg) {
+		t.Fatalf("Decoded %+v, want %+v", decoded, msg)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	data, err := Encode(&Envelope{Message: newTestMessage()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every truncation fails, as does any trailing byte
+	for n := 0; n < len(data); n++ {
+		if _, err := Decode(nil, data[:n]); err == nil {
+			t.Fatalf("Decoded an envelope truncated to %d of %d bytes", n, len(data))
+		}
+	}
+	if _, err := Decode(nil, append(append([]byte(nil), data...), 0)); err == nil {
+		t.Fatal("Decoded an envelope with a trailing byte")
+	}
+
+	// Unknown type
+	unknown := append([]byte(nil), data...)
+	unknown[1], unknown[2] = 0x01, 0xfe
+	if _, err := Decode(nil, unknown); err == nil {
+		t.Fatal("Decoded an envelope of an unknown type")
+	}
+
+	// A length larger than the input must not allocate it
+	huge := append([]byte(nil), data[:ENVELOPE_HEADER_SIZE]...)
+	huge = append(huge, make([]byte, 1+1+2+4+4+8+8)...)
+	huge = append(huge, 0xff, 0xff, 0xff, 0xff)
+	if _, err := Decode(nil, huge); err == nil {
+		t.Fatal("Decoded a string longer than the message")
+	}
+}
+
+func TestEncodeUnregistered(t *testing.T) {
+	if _, err := Encode(&Envelope{Message: &testNested{}}); err == nil {
+		t.Fatal("Encoded an unregistered message")
+	}
+}
+
+func TestByteArraysRoundTrip(t *testing.T) {
+	arrs := [][]byte{{}, {1}, bytes.Repeat([]byte{2}, 300)}
+	data := MarshalByteArrays(arrs...)
+	decoded, err := UnmarshalByteArrays(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(arrs) {
+		t.Fatalf("Decoded %d arrays, want %d", len(decoded), len(arrs))
+	}
+	for i := range arrs {
+		if !bytes.Equal(decoded[i], arrs[i]) {
+			t.Fatalf("Array %d decoded as %x", i, decoded[i])
+		}
+	}
+	if _, err := UnmarshalByteArrays(data[:len(data)-1]); err == nil {
+		t.Fatal("Unmarshaled a truncated byte array")
+	}
+	if _, err := UnmarshalByteArrays([]byte{0x80, 0x00}); err == nil {
+		t.Fatal("Unmarshaled a length that is not minimally encoded")
+	}
+}
+
+// Points are marshaled with the suite, and nil points travel as empty values
+func TestPointsRoundTrip(t *testing.T) {
+	suite := config.CryptoSuite
+	point := suite.Point().Mul(nil, suite.Scalar().Pick(suite.Cipher(nil)))
+	msg := &PublicKeys{Keys: []abstract.Point{point, nil, suite.Point().Base()}}
+	data, err := Encode(&Envelope{Message: msg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := Decode(suite, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := env.Message.(*PublicKeys).Keys
+	if len(keys) != 3 || !keys[0].Equal(point) || keys[1] != nil || !keys[2].Equal(suite.Point().Base()) {
+		t.Fatal("Points did not round trip")
+	}
+	if _, err := Decode(nil, data); err == nil {
+		t.Fatal("Decoded points without a suite")
+	}
+}
@@ -0,0 +1,119 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Context-aware variants of ReadMessage, WriteMessage and ReadDatagram.
+// They rely on the connection's deadlines instead of extra reading goroutines: the context's
+// deadline becomes the connection's, and cancelling the context moves the deadline to the past,
+// which unblocks the pending read or write.
+// The calls own the connection's deadline: one set beforehand with SetDeadline is replaced, and
+// cleared rather than restored when the call returns, since a net.Conn does not report its
+// deadlines. Callers wanting a deadline put it in the context instead (see context.WithDeadline).
+// A message cut short by a deadline leaves the stream out of sync, so the connection
+// should be closed after such an error.
+
+// Reads a message, giving up when the context is done
+func ReadMessageContext(ctx context.Context, conn net.Conn) ([]byte, error) {
+	var msg []byte
+	err := withDeadline(ctx, conn.SetReadDeadline, func() error {
+		var err error
+		msg, err = ReadMessage(conn)
+		return err
+	})
+	return msg, err
+}
+
+// Writes a message, giving up when the context is done
+func WriteMessageContext(ctx context.Context, conn net.Conn, message []byte) error {
+	return withDeadline(ctx, conn.SetWriteDeadline, func() error {
+		return WriteMessage(conn, message)
+	})
+}
+
+// Reads a datagram, giving up when the context is done
+func ReadDatagramContext(ctx context.Context, conn net.Conn, expectedSize int) ([]byte, error) {
+	var msg []byte
+	err := withDeadline(ctx, conn.SetReadDeadline, func() error {
+		var err error
+		msg, err = ReadDatagram(conn, expectedSize)
+		return err
+	})
+	return msg, err
+}
+
+// Runs reads and writes on a connection under the context's deadline and cancellation,
+// e.g. a handshake made of several messages
+func RunWithContext(ctx context.Context, conn net.Conn, op func() error) error {
+	return withDeadline(ctx, conn.SetDeadline, op)
+}
+
+// Runs an operation on a connection under the context's deadline and cancellation, then clears
+// the deadline set with setDeadline. A deadline set before the call does not apply to it.
+// The context's error is returned if the operation failed because the context is done.
+func withDeadline(ctx context.Context, setDeadline func(time.Time) error, op func() error) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := setDeadline(deadline); err != nil {
+		return err
+	}
+
+	// Unblock the operation if the context is cancelled. The watcher exits as soon as the
+	// operation returns, and is waited for before the deadline is cleared.
+	stop := make(chan struct{})
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		select {
+		case <-ctx.Done():
+			setDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	err := op()
+	close(stop)
+	<-watcherDone
+	setDeadline(time.Time{})
+
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// The connection's deadline may expire just before the context's timer fires
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
+// Writes the whole buffer, retrying after partial writes.
+// Fails with the number of bytes written if the connection stops accepting data.
+func writeFull(conn net.Conn, buffer []byte) error {
+	written := 0
+	for written < len(buffer) {
+		n, err := conn.Write(buffer[written:])
+		written += n
+		if err != nil {
+			if written == len(buffer) {
+				return nil
+			}
+			return errors.New("Couldn't write the full " + strconv.Itoa(len(buffer)) + " bytes, only wrote " +
+				strconv.Itoa(written) + ". " + err.Error())
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package net
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadMessageContextCancel(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := ReadMessageContext(ctx, b); err != context.Canceled {
+		t.Fatalf("Read returned %v, want %v", err, context.Canceled)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := ReadMessageContext(ctx, b); err != context.DeadlineExceeded {
+		t.Fatalf("Read returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// A deadline set before the call is replaced by the context's, and cleared when the call returns
+func TestReadMessageContextReplacesDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		WriteMessage(a, []byte("first"))
+	}()
+	if msg, err := ReadMessageContext(context.Background(), b); err != nil || string(msg) != "first" {
+		t.Fatalf("Read %q, %v", msg, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	go WriteMessage(a, []byte("second"))
+	if msg, err := ReadMessage(b); err != nil || string(msg) != "second" {
+		t.Fatalf("Read %q, %v", msg, err)
+	}
+}
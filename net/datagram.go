@@ -0,0 +1,632 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reliable datagram transport over a connected UDP socket.
+//
+// Messages are numbered and split in fragments, each sent in one datagram (see WriteDatagram)
+// whose body starts with a header:
+//
+//	kind (1) | sequence number (8) | fragment index (2) | fragment count (2) | payload
+//
+// The receiver reassembles messages and delivers them in order. Every NackInterval, it asks the
+// sender for the messages and fragments it is missing, which it learns of from gaps in the
+// sequence numbers. A sender that stopped sending announces its next sequence number for a few
+// intervals, so that losing the last messages of a burst is noticed too. The sender keeps its
+// last messages for retransmission; messages requested after they left that window are
+// reported as lost by Receive rather than silently skipped.
+//
+// Partially received messages take at most MaxBuffered bytes: the messages furthest from delivery
+// are dropped to make room, and asked for again.
+//
+// Broadcast connections carry messages from one sender to many receivers (see DialBroadcast
+// and ListenBroadcast). Nothing is retransmitted: the sender's announcements tell receivers
+// which messages they lost. Since anyone may send to a broadcast address, receivers drop
+// everything until the application tells them where the stream is, from an authenticated
+// source (see Sync), and ignore announcements that would skip more than a window of messages.
+
+// Kinds of datagrams
+const (
+	DATAGRAM_KIND_DATA = iota // Fragment of a message
+	DATAGRAM_KIND_NACK        // Receiver's DatagramNack
+	DATAGRAM_KIND_SYNC        // Sender's DatagramSync
+)
+
+// Size of the header of a datagram's body
+const DATAGRAM_HEADER_SIZE = 13
+
+// Fits in one Ethernet frame along with the IP, UDP and datagram headers
+const DATAGRAM_FRAGMENT_SIZE = 1200
+
+// Messages kept for retransmission by senders, and reassembled ahead by receivers
+const DATAGRAM_WINDOW = 256
+
+const DATAGRAM_NACK_INTERVAL = 100 * time.Millisecond
+
+// Number of intervals an idle sender announces its next sequence number for
+const DATAGRAM_SYNC_REPEAT = 3
+
+// Bytes of partially received messages a receiver keeps, and so the largest message sent
+const DATAGRAM_MAX_BUFFERED = 16 << 20
+
+// Parameters of a datagram connection. Both sides must use the same fragment size, buffer size
+// and first sequence number.
+type DatagramConfig struct {
+	FragmentSize  int           // Payload bytes per datagram (0 means DATAGRAM_FRAGMENT_SIZE)
+	Window        int           // 0 means DATAGRAM_WINDOW
+	NackInterval  time.Duration // 0 means DATAGRAM_NACK_INTERVAL
+	MaxBuffered   int           // 0 means DATAGRAM_MAX_BUFFERED
+	FirstSequence uint64        // Sequence number of the first message, e.g. to follow the application's numbering
+	Broadcast     bool          // One sender and many receivers, without retransmissions
+}
+
+// Messages that were lost for good, returned by Receive
+type DatagramLossError struct {
+	Count uint64
+}
+
+func (e *DatagramLossError) Error() string {
+	return "Lost " + strconv.FormatUint(e.Count, 10) + " messages that the peer can no longer retransmit"
+}
+
+// Messages and fragments a receiver is missing
+type DatagramNack struct {
+	Missing []DatagramMissing
+}
+
+// Missing message. All of its fragments are missing if Fragments is empty.
+type DatagramMissing struct {
+	Sequence  uint64
+	Fragments []uint16
+}
+
+// Sender's next sequence number, and the oldest message it can still retransmit
+type DatagramSync struct {
+	Next   uint64
+	Oldest uint64
+}
+
+// Connection carrying whole messages over datagrams, with retransmission of lost datagrams
+type DatagramConn struct {
+	conn   net.Conn
+	config DatagramConfig
+
+	lock sync.Mutex
+
+	// Sender
+	nextSeq   uint64
+	oldest    uint64              // Oldest message kept for retransmission
+	sent      map[uint64][][]byte // Datagrams of the kept messages
+	idleTicks int
+
+	// Receiver
+	synced      bool // Whether a broadcast receiver was told where the stream is (see Sync)
+	nextDeliver uint64
+	known       uint64 // Every message below was sent
+	partial     map[uint64]*partialMessage
+	buffered    int   // Payload bytes of the partial messages
+	err         error // Error that stopped the reader
+
+	ready      chan datagramResult
+	done       chan struct{}
+	readerDone chan struct{}
+	closeOnce  sync.Once
+	wg         sync.WaitGroup
+}
+
+type partialMessage struct {
+	fragments [][]byte
+	received  int
+	size      int
+}
+
+// Message delivered by Receive, or the loss of messages
+type datagramResult struct {
+	data []byte
+	err  error
+}
+
+// Runs the datagram transport over a connected UDP socket (see net.DialUDP), or any connection
+// preserving datagram boundaries. c may be nil for the defaults.
+func NewDatagramConn(conn net.Conn, c *DatagramConfig) *DatagramConn {
+	d := newDatagramConn(conn, c)
+	d.wg.Add(2)
+	go d.readLoop()
+	go d.tickLoop()
+	return d
+}
+
+func newDatagramConn(conn net.Conn, c *DatagramConfig) *DatagramConn {
+	d := &DatagramConn{
+		conn:       conn,
+		sent:       make(map[uint64][][]byte),
+		partial:    make(map[uint64]*partialMessage),
+		done:       make(chan struct{}),
+		readerDone: make(chan struct{}),
+	}
+	if c != nil {
+		d.config = *c
+	}
+	if d.config.FragmentSize <= 0 {
+		d.config.FragmentSize = DATAGRAM_FRAGMENT_SIZE
+	}
+	if d.config.Window <= 0 {
+		d.config.Window = DATAGRAM_WINDOW
+	}
+	if d.config.NackInterval <= 0 {
+		d.config.NackInterval = DATAGRAM_NACK_INTERVAL
+	}
+	if d.config.MaxBuffered <= 0 {
+		d.config.MaxBuffered = DATAGRAM_MAX_BUFFERED
+	}
+	d.nextSeq, d.oldest = d.config.FirstSequence, d.config.FirstSequence
+	d.nextDeliver, d.known = d.config.FirstSequence, d.config.FirstSequence
+	d.ready = make(chan datagramResult, d.config.Window)
+	return d
+}
+
+// Sends a message, split in as many datagrams as needed
+func (d *DatagramConn) Send(message []byte) error {
+
+	fragSize := d.config.FragmentSize
+	count := (len(message) + fragSize - 1) / fragSize
+	if count == 0 {
+		count = 1
+	}
+	if count > 0xffff || int64(len(message)) > d.maxMessageSize() {
+		return errors.New("Message of " + strconv.Itoa(len(message)) + " bytes is too large for a datagram connection")
+	}
+	select {
+	case <-d.done:
+		return errors.New("Datagram connection is closed")
+	default:
+	}
+
+	d.lock.Lock()
+	seq := d.nextSeq
+	d.nextSeq++
+	d.idleTicks = 0
+
+	packets := make([][]byte, count)
+	for i := range packets {
+		start := i * fragSize
+		end := start + fragSize
+		if end > len(message) {
+			end = len(message)
+		}
+		packets[i] = datagramPacket(DATAGRAM_KIND_DATA, seq, uint16(i), uint16(count), message[start:end])
+	}
+	if d.config.Broadcast {
+		d.oldest = d.nextSeq
+	} else {
+		d.sent[seq] = packets
+	}
+	for d.nextSeq-d.oldest > uint64(d.config.Window) {
+		delete(d.sent, d.oldest)
+		d.oldest++
+	}
+	d.lock.Unlock()
+
+	// Datagrams lost here are retransmitted when the receiver asks for them
+	for _, packet := range packets {
+		if err := WriteDatagram(d.conn, packet); err != nil && !transientDatagramError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the next message, in the order they were sent. Fails with a *DatagramLossError,
+// without closing the connection, if messages were lost for good; the following call
+// returns the next message received.
+func (d *DatagramConn) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case r := <-d.ready:
+		return r.data, r.err
+	default:
+	}
+	select {
+	case r := <-d.ready:
+		return r.data, r.err
+	case <-d.readerDone:
+		select {
+		case r := <-d.ready:
+			return r.data, r.err
+		default:
+		}
+		d.lock.Lock()
+		err := d.err
+		d.lock.Unlock()
+		if err == nil {
+			err = errors.New("Datagram connection is closed")
+		}
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Returns the sequence number of the next message sent
+func (d *DatagramConn) NextSequence() uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.nextSeq
+}
+
+// Makes a broadcast receiver deliver the messages from the given sequence number on, dropping
+// those before it, whether it was receiving or not. The number must come from an authenticated
+// source, e.g. the sender's signed messages, since anyone may send to a broadcast address.
+// Messages already returned by Receive are not taken back.
+func (d *DatagramConn) Sync(next uint64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.synced = true
+	d.nextDeliver, d.known = next, next
+	for seq := range d.partial {
+		if seq < next || seq-next >= uint64(d.config.Window) {
+			d.dropPartial(seq)
+		}
+	}
+}
+
+// Closes the connection and waits for its goroutines to exit
+func (d *DatagramConn) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.done)
+		err = d.conn.Close()
+	})
+	d.wg.Wait()
+	return err
+}
+
+func (d *DatagramConn) LocalAddr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+func (d *DatagramConn) RemoteAddr() net.Addr {
+	return d.conn.RemoteAddr()
+}
+
+func (d *DatagramConn) readLoop() {
+	defer d.wg.Done()
+	defer close(d.readerDone)
+
+	for {
+		body, err := ReadDatagram(d.conn, d.config.FragmentSize+DATAGRAM_HEADER_SIZE)
+		if err != nil {
+			select {
+			case <-d.done:
+				return
+			default:
+			}
+			if transientDatagramError(err) {
+				continue
+			}
+			d.lock.Lock()
+			d.err = err
+			d.lock.Unlock()
+			return
+		}
+		for _, r := range d.handlePacket(body) {
+			select {
+			case d.ready <- r:
+			case <-d.done:
+				return
+			}
+		}
+	}
+}
+
+func (d *DatagramConn) tickLoop() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.config.NackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.tick()
+		}
+	}
+}
+
+// Asks for what is missing, and announces our next sequence number if we just stopped sending
+func (d *DatagramConn) tick() {
+	var packets [][]byte
+
+	d.lock.Lock()
+	if d.config.Broadcast {
+		// Receivers cannot reach the sender, which keeps nothing to retransmit
+	} else if nack := d.missing(); len(nack.Missing) > 0 {
+		packets = appendControl(packets, DATAGRAM_KIND_NACK, nack)
+	}
+	if d.nextSeq > d.config.FirstSequence && d.idleTicks < DATAGRAM_SYNC_REPEAT {
+		d.idleTicks++
+		packets = appendControl(packets, DATAGRAM_KIND_SYNC, &DatagramSync{Next: d.nextSeq, Oldest: d.oldest})
+	}
+	d.lock.Unlock()
+
+	d.writePackets(packets)
+}
+
+// Handles a received datagram, and returns the messages it completes.
+// Datagrams it sends in response are written once the connection's state is unlocked.
+func (d *DatagramConn) handlePacket(body []byte) []datagramResult {
+
+	if len(body) < DATAGRAM_HEADER_SIZE {
+		return nil
+	}
+	kind := body[0]
+	seq := binary.BigEndian.Uint64(body[1:9])
+	index := binary.BigEndian.Uint16(body[9:11])
+	count := binary.BigEndian.Uint16(body[11:13])
+	payload := body[DATAGRAM_HEADER_SIZE:]
+
+	var results []datagramResult
+	var packets [][]byte
+
+	d.lock.Lock()
+	switch kind {
+	case DATAGRAM_KIND_DATA:
+		results = d.receiveFragment(seq, index, count, payload)
+
+	case DATAGRAM_KIND_NACK:
+		nack := &DatagramNack{}
+		if DecodeBody(nil, payload, nack) == nil {
+			packets = d.retransmit(nack)
+		}
+
+	case DATAGRAM_KIND_SYNC:
+		sync := &DatagramSync{}
+		if DecodeBody(nil, payload, sync) == nil && sync.Oldest <= sync.Next {
+			results = d.receiveSync(sync)
+		}
+	}
+	d.lock.Unlock()
+
+	d.writePackets(packets)
+	return results
+}
+
+func (d *DatagramConn) receiveFragment(seq uint64, index uint16, count uint16, payload []byte) []datagramResult {
+
+	fragSize := d.config.FragmentSize
+	if d.config.Broadcast && !d.synced {
+		return nil
+	}
+	if seq < d.nextDeliver || seq-d.nextDeliver >= uint64(d.config.Window) {
+		return nil
+	}
+	if count == 0 || index >= count || len(payload) > fragSize || int64(count-1)*int64(fragSize) >= d.maxMessageSize() {
+		return nil
+	}
+
+	p := d.partial[seq]
+	if p != nil && len(p.fragments) != int(count) {
+		return nil
+	}
+	if p != nil && p.fragments[index] != nil {
+		return nil
+	}
+	if !d.makeRoom(seq, len(payload)) {
+		return nil
+	}
+	if p == nil {
+		p = &partialMessage{fragments: make([][]byte, count)}
+		d.partial[seq] = p
+	}
+	p.fragments[index] = payload
+	p.received++
+	p.size += len(payload)
+	d.buffered += len(payload)
+	if seq >= d.known {
+		d.known = seq + 1
+	}
+	return d.collect()
+}
+
+// Learns of the messages the sender sent, and of those it can no longer retransmit.
+// Messages below the sender's oldest one that were fully received are still delivered.
+func (d *DatagramConn) receiveSync(sync *DatagramSync) []datagramResult {
+
+	if d.config.Broadcast && (!d.synced || sync.Oldest > d.nextDeliver+uint64(d.config.Window)) {
+		return nil
+	}
+	if sync.Next > d.known {
+		d.known = sync.Next
+		if d.known-d.nextDeliver > uint64(d.config.Window) {
+			d.known = d.nextDeliver + uint64(d.config.Window)
+		}
+	}
+	if sync.Oldest <= d.nextDeliver {
+		return d.collect()
+	}
+
+	var complete []uint64
+	for seq, p := range d.partial {
+		if seq < sync.Oldest {
+			if p.received == len(p.fragments) {
+				complete = append(complete, seq)
+			} else {
+				d.dropPartial(seq)
+			}
+		}
+	}
+	sort.Slice(complete, func(i, j int) bool { return complete[i] < complete[j] })
+
+	var results []datagramResult
+	if lost := sync.Oldest - d.nextDeliver - uint64(len(complete)); lost > 0 {
+		results = append(results, datagramResult{err: &DatagramLossError{Count: lost}})
+	}
+	for _, seq := range complete {
+		results = append(results, datagramResult{data: bytes.Join(d.partial[seq].fragments, nil)})
+		d.dropPartial(seq)
+	}
+	d.nextDeliver = sync.Oldest
+	if d.known < d.nextDeliver {
+		d.known = d.nextDeliver
+	}
+	return append(results, d.collect()...)
+}
+
+// Removes the messages that can be delivered in order
+func (d *DatagramConn) collect() []datagramResult {
+	var results []datagramResult
+	for {
+		p := d.partial[d.nextDeliver]
+		if p == nil || p.received < len(p.fragments) {
+			return results
+		}
+		results = append(results, datagramResult{data: bytes.Join(p.fragments, nil)})
+		d.dropPartial(d.nextDeliver)
+		d.nextDeliver++
+	}
+}
+
+// Makes room for size more bytes of message seq by dropping the partial messages after it,
+// latest first. Fails if there is not enough room even then.
+func (d *DatagramConn) makeRoom(seq uint64, size int) bool {
+	if d.buffered+size <= d.config.MaxBuffered {
+		return true
+	}
+	var later []uint64
+	for s := range d.partial {
+		if s > seq {
+			later = append(later, s)
+		}
+	}
+	sort.Slice(later, func(i, j int) bool { return later[i] > later[j] })
+	for _, s := range later {
+		d.dropPartial(s)
+		if d.buffered+size <= d.config.MaxBuffered {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DatagramConn) dropPartial(seq uint64) {
+	if p := d.partial[seq]; p != nil {
+		d.buffered -= p.size
+		delete(d.partial, seq)
+	}
+}
+
+// Returns the size of the largest message, which must fit in the receiver's buffer
+func (d *DatagramConn) maxMessageSize() int64 {
+	if int64(d.config.MaxBuffered) < maxMessageSize {
+		return int64(d.config.MaxBuffered)
+	}
+	return maxMessageSize
+}
+
+// Lists the messages and fragments we are missing, as many as fit in one datagram
+func (d *DatagramConn) missing() *DatagramNack {
+
+	nack := &DatagramNack{}
+	size := 4
+	for seq := d.nextDeliver; seq < d.known; seq++ {
+		entry := DatagramMissing{Sequence: seq}
+		if p := d.partial[seq]; p != nil {
+			if p.received == len(p.fragments) {
+				continue
+			}
+			for i, f := range p.fragments {
+				if f == nil {
+					entry.Fragments = append(entry.Fragments, uint16(i))
+				}
+			}
+		}
+
+		maxFragments := (d.config.FragmentSize - size - 12) / 2
+		if maxFragments <= 0 {
+			break
+		}
+		if len(entry.Fragments) > maxFragments {
+			entry.Fragments = entry.Fragments[:maxFragments]
+		}
+		nack.Missing = append(nack.Missing, entry)
+		size += 12 + 2*len(entry.Fragments)
+	}
+	return nack
+}
+
+// Returns the datagrams the receiver is missing, and tells it which messages are gone
+func (d *DatagramConn) retransmit(nack *DatagramNack) [][]byte {
+
+	var packets [][]byte
+	gone := false
+	for _, m := range nack.Missing {
+		if m.Sequence < d.oldest {
+			gone = true
+			continue
+		}
+		sent := d.sent[m.Sequence]
+		if len(m.Fragments) == 0 {
+			packets = append(packets, sent...)
+		}
+		for _, i := range m.Fragments {
+			if int(i) < len(sent) {
+				packets = append(packets, sent[i])
+			}
+		}
+	}
+	if gone {
+		packets = appendControl(packets, DATAGRAM_KIND_SYNC, &DatagramSync{Next: d.nextSeq, Oldest: d.oldest})
+	}
+	return packets
+}
+
+// Writes datagrams, without holding the connection's state locked. Lost ones are sent again
+// when asked for.
+func (d *DatagramConn) writePackets(packets [][]byte) {
+	for _, packet := range packets {
+		WriteDatagram(d.conn, packet)
+	}
+}
+
+func appendControl(packets [][]byte, kind uint8, msg interface{}) [][]byte {
+	body, err := EncodeBody(msg)
+	if err != nil {
+		return packets
+	}
+	return append(packets, datagramPacket(kind, 0, 0, 0, body))
+}
+
+func datagramPacket(kind uint8, seq uint64, index uint16, count uint16, payload []byte) []byte {
+	packet := make([]byte, DATAGRAM_HEADER_SIZE+len(payload))
+	packet[0] = kind
+	binary.BigEndian.PutUint64(packet[1:9], seq)
+	binary.BigEndian.PutUint16(packet[9:11], index)
+	binary.BigEndian.PutUint16(packet[11:13], count)
+	copy(packet[DATAGRAM_HEADER_SIZE:], payload)
+	return packet
+}
+
+// Returns whether reading or writing may go on after an error: malformed datagrams are skipped,
+// and so are the errors UDP sockets report while the peer is not listening
+func transientDatagramError(err error) bool {
+	if err == io.EOF || err == io.ErrClosedPipe {
+		return false
+	}
+	if _, ok := err.(net.Error); !ok {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,270 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Connection dropping the first transmission of some of the datagrams written to it
+type lossyConn struct {
+	net.Conn
+	lock    sync.Mutex
+	writes  int
+	dropped map[string]bool
+	drop    func(n int) bool
+}
+
+func (c *lossyConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	c.writes++
+	key := string(p)
+	drop := !c.dropped[key] && c.drop(c.writes)
+	if drop {
+		c.dropped[key] = true
+	}
+	c.lock.Unlock()
+	if drop {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+// Returns two datagram connections over loopback UDP sockets
+func newUDPPair(t *testing.T, wrap func(net.Conn) net.Conn, c *DatagramConfig) (*DatagramConn, *DatagramConn) {
+	a, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("No loopback UDP: ", err)
+	}
+	b, err := net.DialUDP("udp", nil, a.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		a.Close()
+		t.Fatal(err)
+	}
+	a.Close()
+	a, err = net.DialUDP("udp", a.LocalAddr().(*net.UDPAddr), b.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Close()
+		t.Fatal(err)
+	}
+	var sender net.Conn = a
+	if wrap != nil {
+		sender = wrap(a)
+	}
+	return NewDatagramConn(sender, c), NewDatagramConn(b, c)
+}
+
+func testMessages(n int) [][]byte {
+	messages := make([][]byte, n)
+	for i := range messages {
+		// Sizes span zero, one and several fragments
+		messages[i] = bytes.Repeat([]byte{byte(i)}, (i*137)%(3*64+10))
+	}
+	return messages
+}
+
+func receiveAll(t *testing.T, d *DatagramConn, want [][]byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i, msg := range want {
+		got, err := d.Receive(ctx)
+		if err != nil {
+			t.Fatalf("Message %d: %v", i, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("Message %d has %d bytes, want %d", i, len(got), len(msg))
+		}
+	}
+}
+
+func TestDatagramInOrder(t *testing.T) {
+	c := &DatagramConfig{FragmentSize: 64, NackInterval: 10 * time.Millisecond}
+	sender, receiver := newUDPPair(t, nil, c)
+	defer sender.Close()
+	defer receiver.Close()
+
+	messages := testMessages(50)
+	for _, msg := range messages {
+		if err := sender.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receiveAll(t, receiver, messages)
+}
+
+// Dropped datagrams, including the last ones of the burst, are asked for and sent again
+func TestDatagramRetransmission(t *testing.T) {
+	c := &DatagramConfig{FragmentSize: 64, NackInterval: 10 * time.Millisecond}
+	wrap := func(conn net.Conn) net.Conn {
+		return &lossyConn{Conn: conn, dropped: make(map[string]bool), drop: func(n int) bool { return n%3 == 0 || n > 100 }}
+	}
+	sender, receiver := newUDPPair(t, wrap, c)
+	defer sender.Close()
+	defer receiver.Close()
+
+	messages := testMessages(50)
+	for _, msg := range messages {
+		if err := sender.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receiveAll(t, receiver, messages)
+}
+
+func TestDatagramTooLarge(t *testing.T) {
+	d := newDatagramConn(nil, &DatagramConfig{FragmentSize: 1})
+	if err := d.Send(make([]byte, 0x10000)); err == nil {
+		t.Fatal("Sent a message of more than 0xffff fragments")
+	}
+}
+
+// Fragments are reassembled in any order, and messages delivered in sequence
+func TestDatagramReassembly(t *testing.T) {
+	d := newDatagramConn(nil, &DatagramConfig{FragmentSize: 4})
+
+	var delivered [][]byte
+	handle := func(packet []byte) {
+		for _, r := range d.handlePacket(packet) {
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			delivered = append(delivered, r.data)
+		}
+	}
+	handle(datagramPacket(DATAGRAM_KIND_DATA, 1, 0, 1, []byte("next")))
+	handle(datagramPacket(DATAGRAM_KIND_DATA, 0, 2, 3, []byte("!")))
+	handle(datagramPacket(DATAGRAM_KIND_DATA, 0, 0, 3, []byte("hell")))
+	if len(delivered) != 0 {
+		t.Fatal("Delivered an incomplete message")
+	}
+
+	// Duplicates and fragments that do not match the message are ignored
+	handle(datagramPacket(DATAGRAM_KIND_DATA, 0, 0, 3, []byte("HELL")))
+	handle(datagramPacket(DATAGRAM_KIND_DATA, 0, 1, 2, []byte("o, w")))
+	handle(datagramPacket(DATAGRAM_KIND_DATA, 0, 3, 3, []byte("xxxx")))
+	handle(datagramPacket(DATAGRAM_KIND_DATA, 0, 1, 3, []byte("too long")))
+	handle([]byte{DATAGRAM_KIND_DATA, 0})
+
+	handle(datagramPacket(DATAGRAM_KIND_DATA, 0, 1, 3, []byte("o, w")))
+	if len(delivered) != 2 || string(delivered[0]) != "hello, w!" || string(delivered[1]) != "next" {
+		t.Fatalf("Delivered %q", delivered)
+	}
+
+	// Delivered messages are not delivered again
+	handle(datagramPacket(DATAGRAM_KIND_DATA, 1, 0, 1, []byte("next")))
+	if len(delivered) != 2 {
+		t.Fatalf("Delivered %q", delivered)
+	}
+}
+
+// Messages the sender can no longer retransmit are reported as lost, and complete ones delivered
+func TestDatagramLoss(t *testing.T) {
+	d := newDatagramConn(nil, &DatagramConfig{FragmentSize: 4})
+
+	d.handlePacket(datagramPacket(DATAGRAM_KIND_DATA, 2, 0, 1, []byte("two")))
+	d.handlePacket(datagramPacket(DATAGRAM_KIND_DATA, 3, 0, 2, []byte("thre")))
+	body, err := EncodeBody(&DatagramSync{Next: 5, Oldest: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := d.handlePacket(datagramPacket(DATAGRAM_KIND_SYNC, 0, 0, 0, body))
+
+	// Messages 0, 1 and the incomplete 3 are lost, 2 is delivered
+	if len(results) != 2 {
+		t.Fatalf("Got %d results", len(results))
+	}
+	loss, ok := results[0].err.(*DatagramLossError)
+	if !ok || loss.Count != 3 {
+		t.Fatalf("Got %v, want the loss of 3 messages", results[0].err)
+	}
+	if string(results[1].data) != "two" {
+		t.Fatalf("Delivered %q", results[1].data)
+	}
+	if d.nextDeliver != 4 || d.known != 5 {
+		t.Fatalf("Next delivery %d, known %d", d.nextDeliver, d.known)
+	}
+}
+
+// Broadcast receivers ignore datagrams until they are told where the stream is
+func TestDatagramBroadcastSync(t *testing.T) {
+	d := newDatagramConn(nil, &DatagramConfig{FragmentSize: 4, Window: 8, Broadcast: true})
+	sync := func(next uint64, oldest uint64) []datagramResult {
+		body, err := EncodeBody(&DatagramSync{Next: next, Oldest: oldest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.handlePacket(datagramPacket(DATAGRAM_KIND_SYNC, 0, 0, 0, body))
+	}
+
+	// A forged message or announcement does not move the receiver
+	if r := d.handlePacket(datagramPacket(DATAGRAM_KIND_DATA, 1000, 0, 1, []byte("fake"))); len(r) != 0 {
+		t.Fatalf("Unsynced receiver delivered %v", r)
+	}
+	if r := sync(2000, 2000); len(r) != 0 || d.nextDeliver != 0 {
+		t.Fatalf("Unsynced receiver followed an announcement to %d", d.nextDeliver)
+	}
+
+	d.Sync(100)
+	r := d.handlePacket(datagramPacket(DATAGRAM_KIND_DATA, 100, 0, 1, []byte("real")))
+	if len(r) != 1 || string(r[0].data) != "real" {
+		t.Fatalf("Delivered %v", r)
+	}
+
+	// Announcements skipping more than a window are ignored, others report the loss
+	if r := sync(2000, 2000); len(r) != 0 || d.nextDeliver != 101 {
+		t.Fatalf("Receiver followed an announcement to %d", d.nextDeliver)
+	}
+	r = sync(104, 104)
+	if len(r) != 1 || r[0].err.(*DatagramLossError).Count != 3 {
+		t.Fatalf("Got %v, want the loss of 3 messages", r)
+	}
+
+	// Syncing again, e.g. after catching up over another channel, can go back
+	d.handlePacket(datagramPacket(DATAGRAM_KIND_DATA, 105, 0, 2, []byte("part")))
+	d.Sync(102)
+	if d.nextDeliver != 102 || len(d.partial) != 1 {
+		t.Fatalf("Next delivery %d, %d partial messages", d.nextDeliver, len(d.partial))
+	}
+	d.Sync(200)
+	if len(d.partial) != 0 || d.buffered != 0 {
+		t.Fatalf("%d partial messages of %d bytes kept", len(d.partial), d.buffered)
+	}
+}
+
+// Partial messages furthest from delivery make room for the others
+func TestDatagramBufferLimit(t *testing.T) {
+	d := newDatagramConn(nil, &DatagramConfig{FragmentSize: 4, MaxBuffered: 10})
+
+	if err := d.Send(make([]byte, 11)); err == nil {
+		t.Fatal("Sent a message larger than the receiver's buffer")
+	}
+
+	d.handlePacket(datagramPacket(DATAGRAM_KIND_DATA, 2, 0, 2, []byte("2222")))
+	d.handlePacket(datagramPacket(DATAGRAM_KIND_DATA, 1, 0, 2, []byte("1111")))
+	d.handlePacket(datagramPacket(DATAGRAM_KIND_DATA, 3, 0, 2, []byte("3333")))
+	if d.partial[3] != nil || d.buffered != 8 {
+		t.Fatalf("Kept message 3 with %d bytes buffered", d.buffered)
+	}
+
+	// Message 0 evicts the latest messages until it fits
+	d.handlePacket(datagramPacket(DATAGRAM_KIND_DATA, 0, 0, 3, []byte("0000")))
+	if d.partial[2] != nil || d.partial[1] == nil || d.buffered != 8 {
+		t.Fatalf("Partial messages %v, %d bytes buffered", d.partial, d.buffered)
+	}
+	d.handlePacket(datagramPacket(DATAGRAM_KIND_DATA, 0, 1, 3, []byte("0000")))
+	if d.partial[1] != nil || d.buffered != 8 {
+		t.Fatalf("Partial messages %v, %d bytes buffered", d.partial, d.buffered)
+	}
+	r := d.handlePacket(datagramPacket(DATAGRAM_KIND_DATA, 0, 2, 3, []byte("0")))
+	if len(r) != 1 || len(r[0].data) != 9 || d.buffered != 0 {
+		t.Fatalf("Delivered %v, %d bytes buffered", r, d.buffered)
+	}
+
+	// Evicted messages are still known to be missing, and asked for again
+	if d.nextDeliver != 1 || d.known != 3 {
+		t.Fatalf("Next delivery %d, known %d", d.nextDeliver, d.known)
+	}
+}
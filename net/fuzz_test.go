@@ -0,0 +1,138 @@
+package net
+
+import (
+	"bytes"
+	"github.com/mahdiz/daga/config"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// Fuzz targets feeding peer-controlled input to the parsers, which must return an error instead
+// of panicking. Run one with e.g.
+//
+//	go test -fuzz FuzzDecode ./net
+
+// Decodes an envelope; a decoded message must encode and decode again
+func FuzzDecode(f *testing.F) {
+	for _, msg := range []interface{}{
+		newTestMessage(),
+		&StreamOpen{ConnectionId: 1, Window: MUX_STREAM_WINDOW},
+		&DataWithConnectionId{ConnectionId: 3, Data: []byte("data")},
+		&NegotiateHello{Versions: []uint16{1, 2}, Suites: []string{"suite"}, Framings: []string{FRAMING_LLD}},
+	} {
+		data, err := Encode(&Envelope{Sender: SENDER_ANONYMOUS, Message: msg})
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		env, err := Decode(config.CryptoSuite, data)
+		if err != nil {
+			return
+		}
+		out, err := Encode(env)
+		if err != nil {
+			t.Fatal("Decoded message does not encode: " + err.Error())
+		}
+		if _, err := Decode(config.CryptoSuite, out); err != nil {
+			t.Fatal("Encoded message does not decode: " + err.Error())
+		}
+	})
+}
+
+// Unmarshals byte arrays; unmarshaled arrays must marshal back to the input
+func FuzzUnmarshalByteArrays(f *testing.F) {
+	f.Add(MarshalByteArrays([]byte{}, []byte("a"), bytes.Repeat([]byte{1}, 200)))
+	f.Add([]byte{0x80, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		arrs, err := UnmarshalByteArrays(data)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(MarshalByteArrays(arrs...), data) {
+			t.Fatal("Byte arrays do not marshal back to their input")
+		}
+	})
+}
+
+// Parses a message with the Parse* function chosen by the first byte
+func FuzzParse(f *testing.F) {
+	for i := byte(0); i < 6; i++ {
+		f.Add([]byte{i})
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < 1 {
+			return
+		}
+		conn := fuzzConn(data[1:])
+		defer conn.Close()
+
+		switch data[0] % 6 {
+		case 0:
+			ParseTranscript(conn, 4, 4)
+		case 1:
+			ParsePublicKeyFromConn(conn)
+		case 2:
+			ParseBaseAndPublicKeysFromConn(conn)
+		case 3:
+			ParseBasePublicKeysAndProofFromConn(conn)
+		case 4:
+			ParseBasePublicKeysAndTrusteeSignaturesFromConn(conn)
+		case 5:
+			UnMarshalPublicKeyArrayFromByteArray(data[1:], config.CryptoSuite)
+		}
+	})
+}
+
+// Reads a datagram holding the input as is, header included
+func FuzzReadDatagram(f *testing.F) {
+	f.Add([]byte{0, 1, 0, 0, 0, 2, 'h', 'i'})
+	f.Add([]byte{0, 1, 0, 0, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		client, server := net.Pipe()
+		defer server.Close()
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+		ReadDatagram(server, UDP_DATAGRAM_READING_MESSAGE_BUFFER_SIZE)
+	})
+}
+
+// Handles the input as a datagram received by a datagram connection (see DatagramConn)
+func FuzzDatagramPacket(f *testing.F) {
+	f.Add(datagramPacket(DATAGRAM_KIND_DATA, 0, 0, 1, []byte("message")))
+	f.Add(datagramPacket(DATAGRAM_KIND_DATA, 5, 1, 3, []byte("fragment")))
+	for kind, msg := range map[uint8]interface{}{
+		DATAGRAM_KIND_NACK: &DatagramNack{Missing: []DatagramMissing{{Sequence: 0}, {Sequence: 2, Fragments: []uint16{1}}}},
+		DATAGRAM_KIND_SYNC: &DatagramSync{Next: 10, Oldest: 2},
+	} {
+		body, err := EncodeBody(msg)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(datagramPacket(kind, 0, 0, 0, body))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go io.Copy(ioutil.Discard, server)
+		d := newDatagramConn(client, nil)
+		d.handlePacket(data)
+		d.tick()
+	})
+}
+
+// Returns a connection from which the input can be read as one message (see WriteMessage).
+// Closing it releases the writer.
+func fuzzConn(data []byte) net.Conn {
+	client, server := net.Pipe()
+	go func() {
+		WriteMessage(client, data)
+		client.Close()
+	}()
+	return server
+}
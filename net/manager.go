@@ -0,0 +1,443 @@
+package net
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/mahdiz/daga/config"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Connection manager keeping connections to a set of peers open.
+// Each peer is dialed with exponential backoff and jitter until it answers. Once connected,
+// keepalives are written to it every KeepaliveInterval, and any read or write error on its
+// connection (see PeerConn) closes it and starts reconnecting. So does a read that waits
+// KeepaliveMissed intervals without data, which needs the accepting end to write keepalives
+// too (see KeepAlive). OnUp and OnDown let the relay and trustees act when a peer comes and goes.
+//
+// Keepalives are frame headers with the FRAME_LENGTH_KEEPALIVE length and no body, which
+// ReadMessage skips on negotiated connections.
+
+// Health of a managed peer
+type PeerState int
+
+const (
+	PEER_STATE_CONNECTING PeerState = iota // Being dialed, fewer than config.NUM_RETRY_CONNECT retries failed
+	PEER_STATE_UP                          // Connected
+	PEER_STATE_DOWN                        // Every retry failed; still dialed, at the largest backoff
+)
+
+var peerStateNames = map[PeerState]string{
+	PEER_STATE_CONNECTING: "connecting",
+	PEER_STATE_UP:         "up",
+	PEER_STATE_DOWN:       "down",
+}
+
+func (s PeerState) String() string {
+	return peerStateNames[s]
+}
+
+const DEFAULT_BACKOFF_BASE = 200 * time.Millisecond
+const DEFAULT_BACKOFF_MAX = 30 * time.Second
+const DEFAULT_KEEPALIVE_INTERVAL = 10 * time.Second
+const DEFAULT_KEEPALIVE_MISSED = 3
+
+// Body length announcing a keepalive, which has no body
+const FRAME_LENGTH_KEEPALIVE = 0xfffffffe
+
+// Dials a peer and runs the connection's handshakes, e.g. the negotiation and secure channel
+type PeerDialer func(ctx context.Context, node NodeRepresentation) (net.Conn, error)
+
+// Parameters of a connection manager. Zero values mean the defaults.
+type ManagerConfig struct {
+	BackoffBase       time.Duration // Delay before the first retry, doubled after each failure
+	BackoffMax        time.Duration
+	KeepaliveInterval time.Duration
+	KeepaliveMissed   int                                      // Intervals a read may wait without data before the connection is lost
+	DialTimeout       time.Duration                            // Limit of each dial and handshake (default: KeepaliveInterval)
+	OnUp              func(node NodeRepresentation)            // Called with the peer's new connection
+	OnDown            func(node NodeRepresentation, err error) // Called with the peer's lost connection, and a nil error if the peer was removed
+}
+
+// Keeps connections to a set of peers open
+type ConnManager struct {
+	dial   PeerDialer
+	config ManagerConfig
+	lock   sync.Mutex
+	peers  map[int]*managedPeer
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type managedPeer struct {
+	node     NodeRepresentation // Conn and Connected follow the current connection
+	state    PeerState
+	failures int
+	conn     *PeerConn
+	removed  chan struct{}
+}
+
+// Connection to a managed peer. The first read or write error other than a timeout
+// closes it, and its manager reconnects the peer.
+type PeerConn struct {
+	net.Conn
+	frameLock sync.Mutex // Keeps frames whole when keepalives are written
+	failOnce  sync.Once
+	failed    chan error
+	closeOnce sync.Once
+	closed    chan struct{}
+	readLock  sync.Mutex
+	reading   int       // Reads in progress
+	lastRead  time.Time // When data was last read, or a read started with none in progress
+}
+
+func NewConnManager(dial PeerDialer, c *ManagerConfig) *ConnManager {
+	m := &ConnManager{dial: dial, peers: make(map[int]*managedPeer)}
+	if c != nil {
+		m.config = *c
+	}
+	if m.config.BackoffBase <= 0 {
+		m.config.BackoffBase = DEFAULT_BACKOFF_BASE
+	}
+	if m.config.BackoffMax <= 0 {
+		m.config.BackoffMax = DEFAULT_BACKOFF_MAX
+	}
+	if m.config.KeepaliveInterval <= 0 {
+		m.config.KeepaliveInterval = DEFAULT_KEEPALIVE_INTERVAL
+	}
+	if m.config.KeepaliveMissed <= 0 {
+		m.config.KeepaliveMissed = DEFAULT_KEEPALIVE_MISSED
+	}
+	if m.config.DialTimeout <= 0 {
+		m.config.DialTimeout = m.config.KeepaliveInterval
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	return m
+}
+
+// Starts connecting to a peer. Adding a peer twice replaces it.
+func (m *ConnManager) Add(node NodeRepresentation) {
+	m.Remove(node.Id)
+
+	node.Conn, node.Connected = nil, false
+	p := &managedPeer{node: node, removed: make(chan struct{})}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.ctx.Err() != nil {
+		return
+	}
+	m.peers[node.Id] = p
+	m.wg.Add(1)
+	go m.run(p)
+}
+
+// Disconnects a peer and stops reconnecting it
+func (m *ConnManager) Remove(id int) {
+	m.lock.Lock()
+	p, ok := m.peers[id]
+	delete(m.peers, id)
+	m.lock.Unlock()
+	if ok {
+		close(p.removed)
+	}
+}
+
+// Returns a peer along with its current connection
+func (m *ConnManager) Node(id int) (NodeRepresentation, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	p, ok := m.peers[id]
+	if !ok {
+		return NodeRepresentation{}, false
+	}
+	return p.node, true
+}
+
+// Returns every peer along with its current connection, by increasing id
+func (m *ConnManager) Nodes() []NodeRepresentation {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	nodes := make([]NodeRepresentation, 0, len(m.peers))
+	for _, p := range m.peers {
+		nodes = append(nodes, p.node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Id < nodes[j].Id })
+	return nodes
+}
+
+// Returns the health of a peer
+func (m *ConnManager) State(id int) (PeerState, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	p, ok := m.peers[id]
+	if !ok {
+		return 0, errors.New("Node " + strconv.Itoa(id) + " is not managed")
+	}
+	return p.state, nil
+}
+
+// Writes a message to every connected peer. Peers that cannot be written to are reconnected.
+func (m *ConnManager) NUnicastMessage(message []byte) {
+	NUnicastMessageToNodes(m.Nodes(), message)
+}
+
+// Disconnects every peer and waits for the manager's goroutines to exit
+func (m *ConnManager) Close() {
+	m.lock.Lock()
+	m.cancel()
+	m.peers = make(map[int]*managedPeer)
+	m.lock.Unlock()
+	m.wg.Wait()
+}
+
+// Connects a peer, watches its connection and reconnects it, until it is removed
+func (m *ConnManager) run(p *managedPeer) {
+	defer m.wg.Done()
+
+	for {
+		conn := m.connect(p)
+		if conn == nil {
+			return
+		}
+		err := m.watch(p, conn)
+		conn.Close()
+
+		m.lock.Lock()
+		node := p.node
+		p.node.Conn, p.node.Connected, p.conn = nil, false, nil
+		p.state, p.failures = PEER_STATE_CONNECTING, 0
+		m.lock.Unlock()
+
+		// The lost connection tells it apart from the one of a peer added again meanwhile
+		if m.config.OnDown != nil {
+			node.Connected = false
+			m.config.OnDown(node, err)
+		}
+		if err == nil {
+			return
+		}
+	}
+}
+
+// Dials a peer until it answers. Returns nil if the peer is removed meanwhile.
+func (m *ConnManager) connect(p *managedPeer) *PeerConn {
+	for {
+		ctx, cancel := context.WithTimeout(m.ctx, m.config.DialTimeout)
+		conn, err := m.dial(ctx, p.node)
+		cancel()
+
+		if err == nil {
+			pc := newPeerConn(conn)
+			m.lock.Lock()
+			p.node.Conn, p.node.Connected, p.conn = pc, true, pc
+			p.state, p.failures = PEER_STATE_UP, 0
+			node := p.node
+			m.lock.Unlock()
+
+			if m.config.OnUp != nil {
+				m.config.OnUp(node)
+			}
+			return pc
+		}
+
+		m.lock.Lock()
+		p.failures++
+		if p.failures > config.NUM_RETRY_CONNECT {
+			p.state = PEER_STATE_DOWN
+		}
+		delay := backoff(m.config.BackoffBase, m.config.BackoffMax, p.failures)
+		m.lock.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-p.removed:
+			return nil
+		case <-m.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Writes keepalives until the connection fails, a read waits too long for data, or the peer
+// is removed (nil error)
+func (m *ConnManager) watch(p *managedPeer, conn *PeerConn) error {
+	ticker := time.NewTicker(m.config.KeepaliveInterval)
+	defer ticker.Stop()
+
+	limit := m.config.KeepaliveInterval * time.Duration(m.config.KeepaliveMissed)
+	for {
+		select {
+		case err := <-conn.failed:
+			return err
+		case <-ticker.C:
+			if conn.waiting() > limit {
+				return errors.New("Node " + strconv.Itoa(p.node.Id) + " sent nothing for " + limit.String())
+			}
+			conn.keepalive()
+		case <-p.removed:
+			return nil
+		case <-m.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Returns the delay before retry number n (from 1): BackoffBase * 2^(n-1), at most max,
+// of which a random half is taken off so that peers do not retry in step
+func backoff(base time.Duration, max time.Duration, n int) time.Duration {
+	d := base
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Dials an address, retrying config.NUM_RETRY_CONNECT times with exponential backoff and jitter.
+// Gives up when ctx is done.
+func DialWithRetry(ctx context.Context, network string, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	for attempt := 0; ; attempt++ {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if attempt == config.NUM_RETRY_CONNECT || ctx.Err() != nil {
+			return nil, err
+		}
+		select {
+		case <-time.After(backoff(DEFAULT_BACKOFF_BASE, DEFAULT_BACKOFF_MAX, attempt+1)):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// Keeps a connection accepted from a peer that runs a ConnManager alive: keepalives are written
+// to it every interval until it fails or is closed, so that the peer's reads see data.
+// Every write must go through the returned connection.
+func KeepAlive(conn net.Conn, interval time.Duration) *PeerConn {
+	pc := newPeerConn(conn)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pc.failed:
+				return
+			case <-pc.closed:
+				return
+			case <-ticker.C:
+				pc.keepalive()
+			}
+		}
+	}()
+	return pc
+}
+
+func newPeerConn(conn net.Conn) *PeerConn {
+	return &PeerConn{Conn: conn, failed: make(chan error, 1), closed: make(chan struct{})}
+}
+
+func (c *PeerConn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	if c.reading == 0 {
+		c.lastRead = time.Now()
+	}
+	c.reading++
+	c.readLock.Unlock()
+
+	n, err := c.Conn.Read(p)
+
+	c.readLock.Lock()
+	c.reading--
+	if n > 0 {
+		c.lastRead = time.Now()
+	}
+	c.readLock.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+	return n, err
+}
+
+func (c *PeerConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		c.fail(err)
+	}
+	return n, err
+}
+
+func (c *PeerConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+// Returns how long a read has been waiting for data, or zero if no read is in progress
+func (c *PeerConn) waiting() time.Duration {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	if c.reading == 0 {
+		return 0
+	}
+	return time.Since(c.lastRead)
+}
+
+// Returns what was agreed on the underlying connection, if it was negotiated (see NegotiateClient)
+func (c *PeerConn) Agreed() (Agreement, bool) {
+	return agreement(c.Conn)
+}
+
+// Reports the connection as broken, unless the error is a timeout, e.g. a context's deadline
+func (c *PeerConn) fail(err error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return
+	}
+	c.failOnce.Do(func() {
+		c.failed <- err
+	})
+}
+
+// Writes a keepalive, which peers skip, if the connection was negotiated
+func (c *PeerConn) keepalive() {
+	if _, ok := agreement(c); ok {
+		c.lockFrames()
+		defer c.unlockFrames()
+		header := make([]byte, 6)
+		binary.BigEndian.PutUint16(header[0:2], uint16(FrameVersion(c)))
+		binary.BigEndian.PutUint32(header[2:6], FRAME_LENGTH_KEEPALIVE)
+		writeFull(c, header)
+	}
+}
+
+func (c *PeerConn) lockFrames() {
+	c.frameLock.Lock()
+}
+
+func (c *PeerConn) unlockFrames() {
+	c.frameLock.Unlock()
+}
+
+// Holds a connection's frame lock, if it has one, while a frame is written
+func lockFrames(conn net.Conn) func() {
+	if l, ok := conn.(interface {
+		lockFrames()
+		unlockFrames()
+	}); ok {
+		l.lockFrames()
+		return l.unlockFrames
+	}
+	return func() {}
+}
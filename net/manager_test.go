@@ -0,0 +1,75 @@
+package net
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// Keepalives are skipped, while empty messages are read like any other
+func TestKeepalive(t *testing.T) {
+	client, server := negotiatedPair(t, "suite", "suite")
+	defer client.Close()
+	defer server.Close()
+
+	peer := newPeerConn(client)
+	go func() {
+		peer.keepalive()
+		WriteMessage(peer, nil)
+		peer.keepalive()
+		WriteMessage(peer, []byte("next"))
+	}()
+	if msg, err := ReadMessage(server); err != nil || len(msg) != 0 {
+		t.Fatalf("Read %q, %v", msg, err)
+	}
+	if msg, err := ReadMessage(server); err != nil || string(msg) != "next" {
+		t.Fatalf("Read %q, %v", msg, err)
+	}
+}
+
+// A peer whose reads wait too long for data is reconnected, and kept up by keepalives
+func TestManagerLiveness(t *testing.T) {
+	for _, alive := range []bool{false, true} {
+		dial := func(ctx context.Context, node NodeRepresentation) (net.Conn, error) {
+			client, server := negotiatedPair(t, "suite", "suite")
+			if alive {
+				go io.Copy(ioutil.Discard, KeepAlive(server, 10*time.Millisecond))
+			} else {
+				go io.Copy(ioutil.Discard, server)
+			}
+			return client, nil
+		}
+		down := make(chan error, 1)
+		m := NewConnManager(dial, &ManagerConfig{
+			KeepaliveInterval: 10 * time.Millisecond,
+			OnUp: func(node NodeRepresentation) {
+				go ReadMessage(node.Conn)
+			},
+			OnDown: func(node NodeRepresentation, err error) {
+				if node.Conn == nil || node.Id != 1 {
+					t.Errorf("Lost %+v", node)
+				}
+				select {
+				case down <- err:
+				default:
+				}
+			},
+		})
+		m.Add(NodeRepresentation{Id: 1})
+
+		select {
+		case err := <-down:
+			if alive || err == nil {
+				t.Fatalf("Lost the peer (alive %v): %v", alive, err)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if !alive {
+				t.Fatal("Silent peer is still up")
+			}
+		}
+		m.Close()
+	}
+}
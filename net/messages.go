@@ -0,0 +1,83 @@
+package net
+
+import (
+	"github.com/dedis/crypto/abstract"
+)
+
+// Data sent along with a request to resynchronize the connection
+type DataAndResync struct {
+	ConnectionId int
+	Data         []byte
+}
+
+// Notice that the last upload could not be processed
+type LastUploadFailed struct {
+	ConnectionId int
+}
+
+// Array of public keys
+type PublicKeys struct {
+	Keys []abstract.Point
+}
+
+// Base point of a shuffle along with the public keys it applies to
+type BaseAndPublicKeys struct {
+	Base abstract.Point
+	Keys []abstract.Point
+}
+
+// Shuffled base and public keys, along with the shuffle's proof
+type BasePublicKeysAndProof struct {
+	Base  abstract.Point
+	Keys  []abstract.Point
+	Proof []byte
+}
+
+// Final base and public keys of a shuffle, along with the trustees' signatures of them
+type BasePublicKeysAndSignatures struct {
+	Base       abstract.Point
+	Keys       []abstract.Point
+	Signatures [][]byte
+}
+
+// Transcript of a shuffle: each trustee's base, ephemeral public keys and proof
+type Transcript struct {
+	Bases               []abstract.Point
+	EphemeralPublicKeys [][]abstract.Point
+	Proofs              [][]byte
+}
+
+// First message of the secure channel handshake (see SecureClient).
+// Keys are kept as marshaled bytes since the transcript hash covers them.
+type SecureHello struct {
+	Label        string
+	EphemeralKey []byte
+}
+
+// Responder's part of the secure channel handshake
+type SecureReply struct {
+	EphemeralKey []byte
+	PublicKey    []byte
+	Signature    []byte
+}
+
+// Initiator's authentication, sent encrypted. Both fields are empty for anonymous initiators.
+type SecureAuth struct {
+	PublicKey []byte
+	Signature []byte
+}
+
+// DataWithConnectionId (types.go) is the message of MESSAGE_TYPE_DATA
+func init() {
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_DATA, (*DataWithConnectionId)(nil))
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_DATA_AND_RESYNC, (*DataAndResync)(nil))
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_PUBLICKEYS, (*PublicKeys)(nil))
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_LAST_UPLOAD_FAILED, (*LastUploadFailed)(nil))
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_BASE_AND_PUBLICKEYS, (*BaseAndPublicKeys)(nil))
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_BASE_PUBLICKEYS_AND_PROOF, (*BasePublicKeysAndProof)(nil))
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_BASE_PUBLICKEYS_AND_SIGNATURES, (*BasePublicKeysAndSignatures)(nil))
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_TRANSCRIPT, (*Transcript)(nil))
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_SECURE_HELLO, (*SecureHello)(nil))
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_SECURE_REPLY, (*SecureReply)(nil))
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_SECURE_AUTH, (*SecureAuth)(nil))
+}
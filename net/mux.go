@@ -0,0 +1,640 @@
+package net
+
+import (
+	"bytes"
+	"errors"
+	"github.com/mahdiz/daga/config"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Stream multiplexing over one connection, typically a SecureConn between the relay and a trustee.
+// Each side opens streams, which carry the messages of one client authentication or data session
+// as a net.Conn of their own. The mux sends envelopes on the connection:
+//
+//	StreamOpen              opens a stream, announcing how many bytes the opener accepts on it
+//	DataWithConnectionId    data of a stream
+//	StreamWindow            lets the peer send more bytes on a stream, first when it is accepted
+//	StreamClose             closes or refuses a stream
+//
+// Streams are identified by ConnectionId. The side created with NewMuxClient opens odd ids and the
+// side created with NewMuxServer even ids, SOCKS_CONNECTION_ID_EMPTY is never used.
+// A stream's sender never has more bytes in flight than the receiver granted, so one slow stream
+// does not hold up the others, and a peer overrunning a window breaks the whole mux. So does a
+// peer holding more than MaxStreams streams, counting those only one side closed or refused.
+// The reading goroutine never writes, so that two muxes never wait on each other's reads.
+//
+// The mux owns the connection: nothing else may read or write it.
+
+// Bytes a stream accepts before its reader catches up
+const MUX_STREAM_WINDOW = 256 * 1024
+
+// Largest data message written on a stream
+const MUX_MAX_DATA = 16 * 1024
+
+// Streams opened by the peer and not yet accepted
+const MUX_ACCEPT_BACKLOG = 64
+
+// Streams known to a mux, until both sides closed them
+const MUX_MAX_STREAMS = 1024
+
+// Parameters of a mux. Zero values mean the defaults.
+type MuxConfig struct {
+	Window     uint32 // Bytes each stream accepts before its reader catches up
+	Backlog    int    // Streams opened by the peer and not yet accepted; others are refused
+	MaxStreams int    // Streams known to the mux until both sides closed them
+}
+
+// Streams multiplexed over one connection. A Mux is a net.Listener of the peer's streams.
+type Mux struct {
+	conn        net.Conn
+	config      MuxConfig
+	writeLock   sync.Mutex
+	lock        sync.Mutex
+	streams     map[int]*Stream
+	nextId      int // Next id we open
+	peerFirstId int // First id the peer opens, giving the parity of its ids
+	accept      chan *Stream
+	refused     []int         // Streams refused by the reading goroutine, to be closed by the refusing one
+	refuse      chan struct{} // Signals refused streams
+	err         error         // Why the mux stopped, once it did
+	closed      chan struct{} // Closed once the mux stopped
+	wg          sync.WaitGroup
+}
+
+// One stream of a mux
+type Stream struct {
+	mux           *Mux
+	id            int
+	lock          sync.Mutex
+	writeLock     sync.Mutex    // Keeps each Write's bytes together
+	changed       chan struct{} // Closed and replaced whenever the stream's state changes
+	readBuffer    bytes.Buffer
+	recvWindow    uint32 // Bytes the peer may still send
+	consumed      uint32 // Bytes read since the last window update
+	sendWindow    uint32 // Bytes we may still send
+	localClosed   bool
+	remoteClosed  bool
+	err           error
+	readDeadline  muxDeadline
+	writeDeadline muxDeadline
+}
+
+var errStreamClosed = errors.New("Stream is closed")
+
+func init() {
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_STREAM_OPEN, (*StreamOpen)(nil))
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_STREAM_WINDOW, (*StreamWindow)(nil))
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_STREAM_CLOSE, (*StreamClose)(nil))
+}
+
+// Opens a stream. Window is the number of bytes the opener accepts on it.
+type StreamOpen struct {
+	ConnectionId int
+	Window       uint32
+}
+
+// Lets the peer send Increment more bytes on a stream
+type StreamWindow struct {
+	ConnectionId int
+	Increment    uint32
+}
+
+// Closes a stream, or refuses it. The sender neither writes nor reads the stream anymore.
+type StreamClose struct {
+	ConnectionId int
+}
+
+// Starts multiplexing streams over a connection the node dialed
+func NewMuxClient(conn net.Conn, c *MuxConfig) *Mux {
+	return newMux(conn, c, 1)
+}
+
+// Starts multiplexing streams over a connection the node accepted
+func NewMuxServer(conn net.Conn, c *MuxConfig) *Mux {
+	return newMux(conn, c, 2)
+}
+
+func newMux(conn net.Conn, c *MuxConfig, firstId int) *Mux {
+	m := &Mux{
+		conn:        conn,
+		streams:     make(map[int]*Stream),
+		nextId:      firstId,
+		peerFirstId: firstId%2 + 1,
+		refuse:      make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+	if c != nil {
+		m.config = *c
+	}
+	if m.config.Window == 0 {
+		m.config.Window = MUX_STREAM_WINDOW
+	}
+	if m.config.Backlog <= 0 {
+		m.config.Backlog = MUX_ACCEPT_BACKLOG
+	}
+	if m.config.MaxStreams <= 0 {
+		m.config.MaxStreams = MUX_MAX_STREAMS
+	}
+	m.accept = make(chan *Stream, m.config.Backlog)
+	m.wg.Add(2)
+	go m.readLoop()
+	go m.refuseLoop()
+	return m
+}
+
+// Opens a stream to the peer, which receives it from Accept
+func (m *Mux) OpenStream() (*Stream, error) {
+	m.lock.Lock()
+	if m.err != nil {
+		m.lock.Unlock()
+		return nil, m.err
+	}
+	if len(m.streams) >= m.config.MaxStreams {
+		m.lock.Unlock()
+		return nil, errors.New("Mux already holds " + strconv.Itoa(len(m.streams)) + " streams")
+	}
+	s := m.newStream(m.nextId, 0, m.config.Window)
+	m.nextId += 2
+	m.streams[s.id] = s
+	m.lock.Unlock()
+
+	if err := m.write(&StreamOpen{ConnectionId: s.id, Window: m.config.Window}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Returns the next stream the peer opened. The peer only sends on the stream once it was accepted.
+func (m *Mux) Accept() (net.Conn, error) {
+	select {
+	case s := <-m.accept:
+		s.update(func() {
+			s.recvWindow = m.config.Window
+		})
+		if err := m.write(&StreamWindow{ConnectionId: s.id, Increment: m.config.Window}); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case <-m.closed:
+		return nil, m.err
+	}
+}
+
+// Returns the connection's local address
+func (m *Mux) Addr() net.Addr {
+	return m.conn.LocalAddr()
+}
+
+// Returns the connection streams are multiplexed over
+func (m *Mux) Conn() net.Conn {
+	return m.conn
+}
+
+// Closes the connection along with every stream, and waits for the mux's goroutines to exit
+func (m *Mux) Close() error {
+	m.fail(errors.New("Mux is closed"))
+	m.wg.Wait()
+	return nil
+}
+
+// Returns a channel closed once the mux stopped, e.g. because the connection broke
+func (m *Mux) Done() <-chan struct{} {
+	return m.closed
+}
+
+func (m *Mux) newStream(id int, sendWindow uint32, recvWindow uint32) *Stream {
+	return &Stream{
+		mux:           m,
+		id:            id,
+		changed:       make(chan struct{}),
+		recvWindow:    recvWindow,
+		sendWindow:    sendWindow,
+		readDeadline:  newMuxDeadline(),
+		writeDeadline: newMuxDeadline(),
+	}
+}
+
+// Writes one message on the connection
+func (m *Mux) write(msg interface{}) error {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+
+	select {
+	case <-m.closed:
+		return m.err
+	default:
+	}
+	if err := WriteEnvelope(m.conn, &Envelope{Sender: SENDER_ANONYMOUS, Message: msg}); err != nil {
+		m.fail(errors.New("Cannot write to the mux connection. " + err.Error()))
+		return err
+	}
+	return nil
+}
+
+// Stops the mux, failing every stream with the error. Only the first error is kept.
+func (m *Mux) fail(err error) {
+	m.lock.Lock()
+	if m.err != nil {
+		m.lock.Unlock()
+		return
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = make(map[int]*Stream)
+	close(m.closed)
+	m.lock.Unlock()
+
+	m.conn.Close()
+	for _, s := range streams {
+		s.update(func() {
+			s.err = err
+		})
+	}
+}
+
+// Reads the peer's messages until the connection breaks
+func (m *Mux) readLoop() {
+	defer m.wg.Done()
+
+	for {
+		env, err := ReadEnvelope(m.conn, config.CryptoSuite)
+		if err == nil {
+			err = m.handle(env.Message)
+		}
+		if err != nil {
+			m.fail(err)
+			return
+		}
+	}
+}
+
+// Closes the streams the reading goroutine refused, until the mux stops
+func (m *Mux) refuseLoop() {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case <-m.refuse:
+		case <-m.closed:
+			return
+		}
+		m.lock.Lock()
+		refused := m.refused
+		m.refused = nil
+		m.lock.Unlock()
+
+		for _, id := range refused {
+			// A failure breaks the mux, which stops the loop
+			m.write(&StreamClose{ConnectionId: id})
+		}
+	}
+}
+
+func (m *Mux) handle(msg interface{}) error {
+	switch msg := msg.(type) {
+
+	case *StreamOpen:
+		if msg.ConnectionId <= SOCKS_CONNECTION_ID_EMPTY || msg.ConnectionId%2 != m.peerFirstId%2 {
+			return errors.New("Peer opened stream " + strconv.Itoa(msg.ConnectionId) + ", which is not one of its ids")
+		}
+		m.lock.Lock()
+		if _, ok := m.streams[msg.ConnectionId]; ok {
+			m.lock.Unlock()
+			return errors.New("Peer opened stream " + strconv.Itoa(msg.ConnectionId) + " twice")
+		}
+		if open := len(m.streams) + len(m.refused); open >= m.config.MaxStreams {
+			m.lock.Unlock()
+			return errors.New("Peer opened stream " + strconv.Itoa(msg.ConnectionId) + " while " +
+				strconv.Itoa(open) + " streams are not closed by both sides")
+		}
+		s := m.newStream(msg.ConnectionId, msg.Window, 0)
+		m.streams[s.id] = s
+		m.lock.Unlock()
+
+		select {
+		case m.accept <- s:
+		default:
+			// Refuse streams nobody accepts. The refusal is written by another goroutine.
+			s.update(func() {
+				s.localClosed = true
+			})
+			m.lock.Lock()
+			m.refused = append(m.refused, s.id)
+			m.lock.Unlock()
+			select {
+			case m.refuse <- struct{}{}:
+			default:
+			}
+		}
+
+	case *DataWithConnectionId:
+		s := m.stream(msg.ConnectionId)
+		if s == nil {
+			return nil
+		}
+		var err error
+		s.update(func() {
+			if uint32(len(msg.Data)) > s.recvWindow || len(msg.Data) > MUX_MAX_DATA {
+				err = errors.New("Peer overran the window of stream " + strconv.Itoa(s.id))
+				return
+			}
+			s.recvWindow -= uint32(len(msg.Data))
+			if !s.localClosed {
+				s.readBuffer.Write(msg.Data)
+			}
+		})
+		return err
+
+	case *StreamWindow:
+		s := m.stream(msg.ConnectionId)
+		if s == nil {
+			return nil
+		}
+		var err error
+		s.update(func() {
+			if s.sendWindow+msg.Increment < s.sendWindow {
+				err = errors.New("Peer overflowed the window of stream " + strconv.Itoa(s.id))
+				return
+			}
+			s.sendWindow += msg.Increment
+		})
+		return err
+
+	case *StreamClose:
+		s := m.stream(msg.ConnectionId)
+		if s == nil {
+			return nil
+		}
+		s.update(func() {
+			s.remoteClosed = true
+		})
+		s.release()
+
+	default:
+		msgType, _ := MessageType(msg)
+		return errors.New("Unexpected message of type " + strconv.Itoa(int(msgType)) + " on the mux connection")
+	}
+	return nil
+}
+
+// Returns an open stream, or nil if it is unknown, e.g. because both sides closed it
+func (m *Mux) stream(id int) *Stream {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.streams[id]
+}
+
+// Forgets a stream once both sides closed it
+func (s *Stream) release() {
+	s.lock.Lock()
+	done := s.localClosed && s.remoteClosed
+	s.lock.Unlock()
+	if done {
+		s.mux.lock.Lock()
+		if s.mux.streams[s.id] == s {
+			delete(s.mux.streams, s.id)
+		}
+		s.mux.lock.Unlock()
+	}
+}
+
+// Changes the stream's state and wakes up its pending reads and writes
+func (s *Stream) update(change func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	change()
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Returns the stream's id, its ConnectionId on the wire
+func (s *Stream) Id() int {
+	return s.id
+}
+
+// Reads the stream's data. Returns io.EOF once the peer closed the stream and its data was read.
+func (s *Stream) Read(p []byte) (int, error) {
+	for {
+		s.lock.Lock()
+		expired := s.readDeadline.wait()
+		select {
+		case <-expired:
+			s.lock.Unlock()
+			return 0, muxTimeoutError{}
+		default:
+		}
+
+		if s.localClosed {
+			s.lock.Unlock()
+			return 0, errStreamClosed
+		}
+		if s.readBuffer.Len() > 0 {
+			n, _ := s.readBuffer.Read(p)
+			s.consumed += uint32(n)
+			increment := uint32(0)
+			if s.consumed >= s.mux.config.Window/2 && !s.remoteClosed {
+				increment, s.consumed = s.consumed, 0
+				s.recvWindow += increment
+			}
+			s.lock.Unlock()
+
+			if increment > 0 {
+				// A failure breaks the mux, which the next read reports
+				s.mux.write(&StreamWindow{ConnectionId: s.id, Increment: increment})
+			}
+			return n, nil
+		}
+		if s.remoteClosed {
+			s.lock.Unlock()
+			return 0, io.EOF
+		}
+		if s.err != nil {
+			s.lock.Unlock()
+			return 0, s.err
+		}
+		changed := s.changed
+		s.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-expired:
+		}
+	}
+}
+
+// Writes data on the stream, waiting while the peer's window is full
+func (s *Stream) Write(p []byte) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	total := 0
+	for total < len(p) {
+		s.lock.Lock()
+		expired := s.writeDeadline.wait()
+		select {
+		case <-expired:
+			s.lock.Unlock()
+			return total, muxTimeoutError{}
+		default:
+		}
+
+		if s.localClosed {
+			s.lock.Unlock()
+			return total, errStreamClosed
+		}
+		if s.err != nil {
+			s.lock.Unlock()
+			return total, s.err
+		}
+		if s.remoteClosed {
+			s.lock.Unlock()
+			return total, errors.New("Stream " + strconv.Itoa(s.id) + " was closed by the peer")
+		}
+		if s.sendWindow == 0 {
+			changed := s.changed
+			s.lock.Unlock()
+			select {
+			case <-changed:
+			case <-expired:
+			}
+			continue
+		}
+
+		n := len(p) - total
+		if n > MUX_MAX_DATA {
+			n = MUX_MAX_DATA
+		}
+		if uint32(n) > s.sendWindow {
+			n = int(s.sendWindow)
+		}
+		s.sendWindow -= uint32(n)
+		s.lock.Unlock()
+
+		if err := s.mux.write(&DataWithConnectionId{ConnectionId: s.id, Data: p[total : total+n]}); err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Closes the stream. Data the peer sends afterwards is dropped, and its reads return io.EOF.
+func (s *Stream) Close() error {
+	s.lock.Lock()
+	if s.localClosed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.lock.Unlock()
+
+	s.update(func() {
+		s.localClosed = true
+		s.readBuffer.Reset()
+	})
+	s.release()
+	if err := s.mux.write(&StreamClose{ConnectionId: s.id}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Returns the mux the stream belongs to
+func (s *Stream) Mux() *Mux {
+	return s.mux
+}
+
+// Returns what was agreed on the mux's connection, if it was negotiated (see NegotiateClient)
+func (s *Stream) Agreed() (Agreement, bool) {
+	return agreement(s.mux.conn)
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.mux.conn.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.mux.conn.RemoteAddr()
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+// Sets the deadline of writes waiting for the peer's window. Writes to the connection itself
+// follow the connection's deadline.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// Deadline of a stream's reads or writes: a channel closed once the deadline passed
+type muxDeadline struct {
+	lock    sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newMuxDeadline() muxDeadline {
+	return muxDeadline{expired: make(chan struct{})}
+}
+
+func (d *muxDeadline) set(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.expired // Wait for the timer to close it
+	}
+	d.timer = nil
+
+	passed := false
+	select {
+	case <-d.expired:
+		passed = true
+	default:
+	}
+
+	if t.IsZero() {
+		if passed {
+			d.expired = make(chan struct{})
+		}
+		return
+	}
+	if wait := t.Sub(time.Now()); wait > 0 {
+		if passed {
+			d.expired = make(chan struct{})
+		}
+		expired := d.expired
+		d.timer = time.AfterFunc(wait, func() {
+			close(expired)
+		})
+		return
+	}
+	if !passed {
+		close(d.expired)
+	}
+}
+
+func (d *muxDeadline) wait() chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.expired
+}
+
+// Error of a stream's read or write past its deadline
+type muxTimeoutError struct{}
+
+func (muxTimeoutError) Error() string   { return "Stream deadline exceeded" }
+func (muxTimeoutError) Timeout() bool   { return true }
+func (muxTimeoutError) Temporary() bool { return true }
@@ -0,0 +1,262 @@
+package net
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newMuxPair(c *MuxConfig) (*Mux, *Mux) {
+	a, b := net.Pipe()
+	return NewMuxClient(a, c), NewMuxServer(b, c)
+}
+
+// Returns a mux server along with the raw connection of its peer
+func newRawMuxPeer(c *MuxConfig) (*Mux, net.Conn) {
+	a, b := net.Pipe()
+	go io.Copy(ioutil.Discard, a)
+	return NewMuxServer(b, c), a
+}
+
+func waitDone(t *testing.T, m *Mux) {
+	select {
+	case <-m.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Mux did not stop")
+	}
+}
+
+// Streams carry messages larger than their window both ways, concurrently
+func TestMuxStreams(t *testing.T) {
+	client, server := newMuxPair(&MuxConfig{Window: 4096})
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			s, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func(s net.Conn) {
+				defer s.Close()
+				data, err := ReadMessage(s)
+				if err != nil {
+					return
+				}
+				WriteMessage(s, data)
+			}(s)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := client.OpenStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer s.Close()
+			msg := bytes.Repeat([]byte{byte(i)}, 5*4096+i)
+			if err := WriteMessage(s, msg); err != nil {
+				errs <- err
+				return
+			}
+			reply, err := ReadMessage(s)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(reply, msg) {
+				t.Errorf("Stream %d echoed %d bytes, want %d", s.Id(), len(reply), len(msg))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// A stream whose reader does not read does not hold up the others
+func TestMuxStalledStream(t *testing.T) {
+	client, server := newMuxPair(&MuxConfig{Window: 1024})
+	defer client.Close()
+	defer server.Close()
+
+	stalled, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go stalled.Write(make([]byte, 1<<20))
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Write([]byte("hello"))
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("Read %q, %v", buf, err)
+	}
+}
+
+// Closing a stream ends the peer's reads once it read the data, and fails its writes
+func TestMuxClose(t *testing.T) {
+	client, server := newMuxPair(nil)
+	defer client.Close()
+	defer server.Close()
+
+	s, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	data, err := ioutil.ReadAll(accepted)
+	if err != nil || string(data) != "bye" {
+		t.Fatalf("Read %q, %v", data, err)
+	}
+	if _, err := accepted.Write([]byte("x")); err == nil {
+		t.Fatal("Wrote to a stream the peer closed")
+	}
+	if _, err := s.Read(make([]byte, 1)); err != errStreamClosed {
+		t.Fatalf("Read on a closed stream returned %v", err)
+	}
+}
+
+// Streams beyond the backlog are refused
+func TestMuxBacklog(t *testing.T) {
+	client, server := newMuxPair(&MuxConfig{Backlog: 1})
+	defer client.Close()
+	defer server.Close()
+
+	first, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := refused.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read on a refused stream returned %v", err)
+	}
+
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted.(*Stream).Id() != first.Id() {
+		t.Fatalf("Accepted stream %d, want %d", accepted.(*Stream).Id(), first.Id())
+	}
+}
+
+func TestMuxDeadline(t *testing.T) {
+	client, server := newMuxPair(&MuxConfig{Window: 16})
+	defer client.Close()
+	defer server.Close()
+
+	s, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := s.Read(make([]byte, 1)); err == nil || !err.(net.Error).Timeout() {
+		t.Fatalf("Read returned %v, want a timeout", err)
+	}
+	s.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := s.Write(make([]byte, 100))
+	if err == nil || !err.(net.Error).Timeout() || n != 16 {
+		t.Fatalf("Write returned %d, %v, want 16 bytes and a timeout", n, err)
+	}
+
+	// The deadline can be lifted
+	s.SetDeadline(time.Time{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.Close()
+	}()
+	_, err = s.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+		t.Fatalf("Read returned %v, want the mux's error", err)
+	}
+}
+
+// A peer misusing stream ids or windows breaks the mux, failing its streams
+func TestMuxProtocolErrors(t *testing.T) {
+	cases := map[string][]interface{}{
+		"even id":  {&StreamOpen{ConnectionId: 2, Window: 16}},
+		"empty id": {&StreamOpen{ConnectionId: SOCKS_CONNECTION_ID_EMPTY, Window: 16}},
+		"open twice": {
+			&StreamOpen{ConnectionId: 1, Window: 16},
+			&StreamOpen{ConnectionId: 1, Window: 16},
+		},
+		"window overrun": {
+			&StreamOpen{ConnectionId: 1, Window: 16},
+			&DataWithConnectionId{ConnectionId: 1, Data: make([]byte, 17)},
+		},
+		"window overflow": {
+			&StreamOpen{ConnectionId: 1, Window: 0xffffffff},
+			&StreamWindow{ConnectionId: 1, Increment: 1},
+		},
+		"unexpected message": {&StreamOpen{ConnectionId: 1}, &NegotiateReject{}},
+	}
+	for name, msgs := range cases {
+		m, peer := newRawMuxPeer(nil)
+		for _, msg := range msgs {
+			if err := WriteEnvelope(peer, &Envelope{Sender: SENDER_ANONYMOUS, Message: msg}); err != nil {
+				break
+			}
+		}
+		waitDone(t, m)
+		if _, err := m.OpenStream(); err == nil {
+			t.Errorf("%s: opened a stream on a broken mux", name)
+		}
+		m.Close()
+	}
+}
+
+// Refused streams count against the limit until the peer closes them, and refusing them
+// does not stop the mux from reading a peer that does not read
+func TestMuxStreamLimit(t *testing.T) {
+	a, b := net.Pipe()
+	m := NewMuxServer(b, &MuxConfig{Backlog: 1, MaxStreams: 2})
+	defer m.Close()
+
+	for _, id := range []int{1, 3, 5} {
+		if err := WriteEnvelope(a, &Envelope{Sender: SENDER_ANONYMOUS, Message: &StreamOpen{ConnectionId: id, Window: 16}}); err != nil {
+			break
+		}
+	}
+	waitDone(t, m)
+}
@@ -0,0 +1,313 @@
+package net
+
+import (
+	"errors"
+	"github.com/mahdiz/daga/config"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Negotiation of the protocol version and features of a connection, run when it is opened:
+//
+//	initiator -> responder: versions, suites, auth methods and framings it speaks, and its maximum frame size
+//	responder -> initiator: the chosen version, suite, auth method, framing and maximum frame size, or a rejection
+//
+// The highest version both sides speak is chosen. Suites, auth methods and framings are listed
+// by preference, and the responder chooses the initiator's first one it also speaks.
+// The smaller maximum frame size applies in both directions.
+// Negotiation frames carry config.MIN_PROTOCOL_VERSION, which every version reads. Later frames
+// carry the chosen version (see NegotiatedConn).
+// The negotiation itself is not authenticated: the secure channel handshake run over the connection
+// covers both messages, so that a peer in the middle cannot downgrade what was agreed (see SecureClient).
+
+// Frames made of a 6-byte header (version and body length) and the body, see WriteMessage
+const FRAMING_LLD = "lld"
+
+// lld frames, along with messages sent in chunks (see WriteStream)
+const FRAMING_CHUNKED = "lld-chunked"
+
+// Features a node speaks
+type Features struct {
+	Versions     []int
+	Suites       []string // By preference
+	AuthMethods  []int    // By preference
+	Framings     []string // By preference
+	MaxFrameSize int
+}
+
+// Features both sides of a connection agreed on
+type Agreement struct {
+	Version      int
+	Suite        string
+	AuthMethod   int
+	Framing      string
+	MaxFrameSize int
+}
+
+// Connection whose protocol version and features were negotiated.
+// WriteMessage and ReadMessage use the agreed version, framing and frame size on it.
+type NegotiatedConn struct {
+	net.Conn
+	Agreement
+	transcript []byte // Hello and accept messages, as sent
+}
+
+type NegotiateHello struct {
+	Versions     []uint16
+	Suites       []string
+	AuthMethods  []int
+	Framings     []string
+	MaxFrameSize uint32
+}
+
+type NegotiateAccept struct {
+	Version      uint16
+	Suite        string
+	AuthMethod   int
+	Framing      string
+	MaxFrameSize uint32
+}
+
+// Rejection of a connection, listing the versions the responder speaks
+type NegotiateReject struct {
+	Reason   string
+	Versions []uint16
+}
+
+func init() {
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_NEGOTIATE_HELLO, (*NegotiateHello)(nil))
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_NEGOTIATE_ACCEPT, (*NegotiateAccept)(nil))
+	RegisterMessage(PROTOCOL_TYPE_NET, MESSAGE_TYPE_NEGOTIATE_REJECT, (*NegotiateReject)(nil))
+}
+
+// Returns the features of a node using the given suite and auth method:
+// every protocol version this software speaks, both framings, and the maximum frame size (see SetFrameLimits)
+func DefaultFeatures(suite string, authMethod int) *Features {
+	f := &Features{
+		Suites:       []string{suite},
+		AuthMethods:  []int{authMethod},
+		Framings:     []string{FRAMING_CHUNKED, FRAMING_LLD},
+		MaxFrameSize: maxFrameSize,
+	}
+	for v := config.MIN_PROTOCOL_VERSION; v <= config.LLD_PROTOCOL_VERSION; v++ {
+		f.Versions = append(f.Versions, v)
+	}
+	return f
+}
+
+// Returns the protocol version of a connection's frames: the negotiated version,
+// or config.LLD_PROTOCOL_VERSION on connections that were not negotiated
+func FrameVersion(conn net.Conn) int {
+	if a, ok := agreement(conn); ok {
+		return a.Version
+	}
+	return config.LLD_PROTOCOL_VERSION
+}
+
+// Returns what was agreed on a connection, if it was negotiated
+func agreement(conn net.Conn) (Agreement, bool) {
+	if nc, ok := conn.(interface {
+		Agreed() (Agreement, bool)
+	}); ok {
+		return nc.Agreed()
+	}
+	return Agreement{}, false
+}
+
+func (c *NegotiatedConn) Agreed() (Agreement, bool) {
+	return c.Agreement, true
+}
+
+// Returns the negotiation messages exchanged on a connection, or nil if it was not negotiated
+func negotiationTranscript(conn net.Conn) []byte {
+	if nc, ok := conn.(*NegotiatedConn); ok {
+		return nc.transcript
+	}
+	return nil
+}
+
+// Runs the negotiation as the initiator, usually the side that dialed the connection
+func NegotiateClient(conn net.Conn, local *Features) (*NegotiatedConn, error) {
+
+	hello := &NegotiateHello{
+		Versions:     toUint16s(local.Versions),
+		Suites:       local.Suites,
+		AuthMethods:  local.AuthMethods,
+		Framings:     local.Framings,
+		MaxFrameSize: uint32(local.MaxFrameSize),
+	}
+	helloBytes, err := writeNegotiationMessage(conn, hello)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := readFrame(conn, config.MIN_PROTOCOL_VERSION)
+	if err != nil {
+		return nil, err
+	}
+	env, err := Decode(nil, data)
+	if err != nil {
+		return nil, err
+	}
+	switch msg := env.Message.(type) {
+	case *NegotiateReject:
+		return nil, errors.New("Peer rejected the connection: " + msg.Reason +
+			" (we speak versions " + versionsString(hello.Versions) + ", peer speaks " + versionsString(msg.Versions) + ")")
+
+	case *NegotiateAccept:
+		a := Agreement{Version: int(msg.Version), Suite: msg.Suite, AuthMethod: msg.AuthMethod, Framing: msg.Framing, MaxFrameSize: int(msg.MaxFrameSize)}
+		if !containsInt(local.Versions, a.Version) {
+			return nil, errors.New("Peer chose protocol version " + strconv.Itoa(a.Version) + ", but we speak versions " + versionsString(hello.Versions))
+		}
+		if !containsString(local.Suites, a.Suite) || !containsInt(local.AuthMethods, a.AuthMethod) || !containsString(local.Framings, a.Framing) {
+			return nil, errors.New("Peer chose features we did not offer")
+		}
+		if a.MaxFrameSize < config.MIN_FRAME_SIZE || a.MaxFrameSize > local.MaxFrameSize {
+			return nil, errors.New("Peer chose an invalid maximum frame size of " + strconv.Itoa(a.MaxFrameSize) + " bytes")
+		}
+		return &NegotiatedConn{Conn: conn, Agreement: a, transcript: MarshalByteArrays(helloBytes, data)}, nil
+	}
+	return nil, errors.New("Unexpected message type " + strconv.Itoa(int(env.Type)) + " during negotiation")
+}
+
+// Runs the negotiation as the responder, usually the side that accepted the connection.
+// Peers with no version or feature in common are sent a rejection before the error is returned.
+func NegotiateServer(conn net.Conn, local *Features) (*NegotiatedConn, error) {
+
+	data, err := readFrame(conn, config.MIN_PROTOCOL_VERSION)
+	if err != nil {
+		return nil, err
+	}
+	env, err := Decode(nil, data)
+	if err != nil {
+		return nil, err
+	}
+	hello, ok := env.Message.(*NegotiateHello)
+	if !ok {
+		return nil, errors.New("Peer did not start with a negotiation")
+	}
+
+	a, err := agree(local, hello)
+	if err != nil {
+		localVersions := toUint16s(local.Versions)
+		writeNegotiationMessage(conn, &NegotiateReject{Reason: err.Error(), Versions: localVersions})
+		return nil, errors.New(err.Error() + " (we speak versions " + versionsString(localVersions) +
+			", peer speaks " + versionsString(hello.Versions) + ")")
+	}
+
+	accept := &NegotiateAccept{Version: uint16(a.Version), Suite: a.Suite, AuthMethod: a.AuthMethod, Framing: a.Framing,
+		MaxFrameSize: uint32(a.MaxFrameSize)}
+	acceptBytes, err := writeNegotiationMessage(conn, accept)
+	if err != nil {
+		return nil, err
+	}
+	return &NegotiatedConn{Conn: conn, Agreement: *a, transcript: MarshalByteArrays(data, acceptBytes)}, nil
+}
+
+// Chooses the highest common version, and the initiator's preferred suite, auth method and framing
+// among those we speak
+func agree(local *Features, hello *NegotiateHello) (*Agreement, error) {
+
+	a := &Agreement{Version: -1}
+	for _, v := range hello.Versions {
+		if int(v) > a.Version && containsInt(local.Versions, int(v)) {
+			a.Version = int(v)
+		}
+	}
+	if a.Version < 0 {
+		return nil, errors.New("No common protocol version")
+	}
+
+	found := false
+	for _, s := range hello.Suites {
+		if containsString(local.Suites, s) {
+			a.Suite, found = s, true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.New("No common ciphersuite, peer offered " + strings.Join(hello.Suites, ", "))
+	}
+
+	found = false
+	for _, m := range hello.AuthMethods {
+		if containsInt(local.AuthMethods, m) {
+			a.AuthMethod, found = m, true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.New("No common authentication method")
+	}
+
+	found = false
+	for _, f := range hello.Framings {
+		if containsString(local.Framings, f) {
+			a.Framing, found = f, true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.New("No common framing, peer offered " + strings.Join(hello.Framings, ", "))
+	}
+
+	a.MaxFrameSize = local.MaxFrameSize
+	if int64(hello.MaxFrameSize) < int64(a.MaxFrameSize) {
+		a.MaxFrameSize = int(hello.MaxFrameSize)
+	}
+	if a.MaxFrameSize < config.MIN_FRAME_SIZE {
+		return nil, errors.New("Peer's maximum frame size of " + strconv.Itoa(a.MaxFrameSize) + " bytes is too small")
+	}
+	return a, nil
+}
+
+// Writes a negotiation message, and returns its encoding
+func writeNegotiationMessage(conn net.Conn, msg interface{}) ([]byte, error) {
+	data, err := Encode(&Envelope{Sender: SENDER_ANONYMOUS, Message: msg})
+	if err != nil {
+		return nil, err
+	}
+	return data, writeFrame(conn, config.MIN_PROTOCOL_VERSION, data)
+}
+
+func toUint16s(versions []int) []uint16 {
+	res := make([]uint16, len(versions))
+	for i, v := range versions {
+		res[i] = uint16(v)
+	}
+	return res
+}
+
+// Lists versions in increasing order, e.g. "3, 4"
+func versionsString(versions []uint16) string {
+	if len(versions) == 0 {
+		return "none"
+	}
+	sorted := append([]uint16(nil), versions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	strs := make([]string, len(sorted))
+	for i, v := range sorted {
+		strs[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(strs, ", ")
+}
+
+func containsInt(list []int, x int) bool {
+	for _, y := range list {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, x string) bool {
+	for _, y := range list {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package net
+
+import (
+	"bytes"
+	"github.com/mahdiz/daga/config"
+	"net"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	client, server := negotiatedPair(t, "suite", "suite")
+	defer client.Close()
+	defer server.Close()
+
+	if client.Agreement != server.Agreement {
+		t.Fatalf("Client agreed on %+v, server on %+v", client.Agreement, server.Agreement)
+	}
+	if client.Version != config.LLD_PROTOCOL_VERSION || client.Framing != FRAMING_CHUNKED {
+		t.Fatalf("Agreed on %+v", client.Agreement)
+	}
+
+	// Both sides see the same negotiation, which the secure channel handshake covers
+	if len(client.transcript) == 0 || !bytes.Equal(client.transcript, server.transcript) {
+		t.Fatal("Peers have different negotiation transcripts")
+	}
+}
+
+func TestNegotiateReject(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := NegotiateServer(b, DefaultFeatures("suite", 0))
+		done <- err
+	}()
+	if _, err := NegotiateClient(a, DefaultFeatures("other suite", 0)); err == nil {
+		t.Fatal("Client negotiated without a common suite")
+	}
+	if err := <-done; err == nil {
+		t.Fatal("Server negotiated without a common suite")
+	}
+}
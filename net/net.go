@@ -1,8 +1,9 @@
 package net
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/dedis/crypto/abstract"
@@ -13,67 +14,134 @@ import (
 	"time"
 )
 
+// Writes a message in one frame, with the connection's protocol version (see FrameVersion).
+// Messages larger than the connection's maximum frame size are sent in chunks (see WriteStream),
+// if the peer accepts them.
 func WriteMessage(conn net.Conn, message []byte) error {
+	return writeFrame(conn, FrameVersion(conn), message)
+}
+
+// Reads a message written by WriteMessage. The frame must carry the connection's protocol version,
+// and fit in the connection's maximum frame size.
+func ReadMessage(conn net.Conn) ([]byte, error) {
+	return readFrame(conn, FrameVersion(conn))
+}
+
+func writeFrame(conn net.Conn, version int, message []byte) error {
+
+	unlock := lockFrames(conn)
+	defer unlock()
 
 	length := len(message)
+	if limit := frameLimit(conn); length > limit {
+		if !chunkingAgreed(conn) {
+			return errors.New("Message of " + strconv.Itoa(length) + " bytes exceeds the maximum frame size of " +
+				strconv.Itoa(limit) + " bytes, and the peer does not accept chunks")
+		}
+		_, err := writeChunked(conn, version, bytes.NewReader(message))
+		return err
+	}
 
 	//compose new message
 	buffer := make([]byte, length+6)
-	binary.BigEndian.PutUint16(buffer[0:2], uint16(config.LLD_PROTOCOL_VERSION))
+	binary.BigEndian.PutUint16(buffer[0:2], uint16(version))
 	binary.BigEndian.PutUint32(buffer[2:6], uint32(length))
 	copy(buffer[6:], message)
 
-	n, err := conn.Write(buffer)
+	return writeFull(conn, buffer)
+}
 
-	if n < length+6 {
-		return errors.New("Couldn't write the full" + strconv.Itoa(length+6) + " bytes, only wrote " + strconv.Itoa(n))
-	}
+func readFrame(conn net.Conn, expectedVersion int) ([]byte, error) {
+
+	emptyMessage := make([]byte, 0)
 
+	bodySize, err := readFrameHeader(conn, expectedVersion)
 	if err != nil {
-		return err
+		return emptyMessage, err
+	}
+	if bodySize == FRAME_LENGTH_CHUNKED {
+		return readChunkedMessage(conn)
 	}
 
-	return nil
+	//read body
+	body := make([]byte, bodySize)
+	n2, err2 := io.ReadFull(conn, body)
+
+	if err2 != nil {
+		return emptyMessage, err2
+	}
+
+	if int64(n2) != bodySize {
+		return emptyMessage, errors.New("Couldn't read the full" + strconv.FormatInt(bodySize, 10) + " body bytes, only read " + strconv.Itoa(n2))
+	}
+
+	return body, nil
 }
 
-func ReadMessage(conn net.Conn) ([]byte, error) {
+// Reads a frame's header and returns its body size, which is checked against the connection's
+// maximum frame size before anything is allocated. FRAME_LENGTH_CHUNKED is returned
+// if the message follows in chunks, which the connection must have negotiated.
+// Keepalives on negotiated connections (see ConnManager) are skipped.
+func readFrameHeader(conn net.Conn, expectedVersion int) (int64, error) {
+
+	for {
+		bodySize, err := readOneFrameHeader(conn, expectedVersion)
+		if err != nil || bodySize != FRAME_LENGTH_KEEPALIVE {
+			return bodySize, err
+		}
+	}
+}
+
+func readOneFrameHeader(conn net.Conn, expectedVersion int) (int64, error) {
 
 	header := make([]byte, 6)
-	emptyMessage := make([]byte, 0)
 
 	//read header
 	n, err := io.ReadFull(conn, header)
 
 	if err != nil {
-		return emptyMessage, err
+		return 0, err
 	}
 
 	if n != 6 {
-		return emptyMessage, errors.New("Couldn't read the full 6 header bytes, only read " + strconv.Itoa(n))
+		return 0, errors.New("Couldn't read the full 6 header bytes, only read " + strconv.Itoa(n))
 	}
 
 	//parse header
 	version := int(binary.BigEndian.Uint16(header[0:2]))
-	bodySize := int(binary.BigEndian.Uint32(header[2:6]))
+	bodySize := int64(binary.BigEndian.Uint32(header[2:6]))
 
-	if version != config.LLD_PROTOCOL_VERSION {
+	if version != expectedVersion {
 
-		return emptyMessage, errors.New("Read a message with protocol " + strconv.Itoa(version) + " bytes, but our version is " + strconv.Itoa(config.LLD_PROTOCOL_VERSION) + ".")
+		return 0, errors.New("Read a message with protocol version " + strconv.Itoa(version) + ", but the connection's version is " + strconv.Itoa(expectedVersion) + ".")
 	}
 
-	//read body
-	body := make([]byte, bodySize)
-	n2, err2 := io.ReadFull(conn, body)
-
-	if err2 != nil {
-		return emptyMessage, err2
+	if bodySize == FRAME_LENGTH_CHUNKED && chunkingAgreed(conn) {
+		return bodySize, nil
 	}
-
-	if n2 != bodySize {
-		return emptyMessage, errors.New("Couldn't read the full" + strconv.Itoa(bodySize) + " body bytes, only read " + strconv.Itoa(n2))
+	if _, negotiated := agreement(conn); negotiated && bodySize == FRAME_LENGTH_KEEPALIVE {
+		return bodySize, nil
+	}
+	if limit := frameLimit(conn); bodySize > int64(limit) {
+		return 0, errors.New("Frame of " + strconv.FormatInt(bodySize, 10) + " bytes exceeds the maximum frame size of " + strconv.Itoa(limit) + " bytes.")
 	}
+	return bodySize, nil
+}
 
-	return body, nil
+// Writes a body in one datagram, behind the same 6-byte header as WriteMessage.
+// The body must fit in one datagram, see DatagramConn for larger messages.
+func WriteDatagram(conn net.Conn, body []byte) error {
+
+	buffer := make([]byte, len(body)+6)
+	binary.BigEndian.PutUint16(buffer[0:2], uint16(config.LLD_PROTOCOL_VERSION))
+	binary.BigEndian.PutUint32(buffer[2:6], uint32(len(body)))
+	copy(buffer[6:], body)
+
+	n, err := conn.Write(buffer)
+	if err == nil && n != len(buffer) {
+		return io.ErrShortWrite
+	}
+	return err
 }
 
 //tips : expectedSize could be UDP_DATAGRAM_READING_MESSAGE_BUFFER_SIZE
@@ -89,300 +157,102 @@ func ReadDatagram(conn net.Conn, expectedSize int) ([]byte, error) {
 		return emptyMessage, err
 	}
 
+	if n < 6 {
+		return emptyMessage, errors.New("Read a datagram of " + strconv.Itoa(n) + " bytes, shorter than its 6 header bytes.")
+	}
+
 	//parse header
 	version := int(binary.BigEndian.Uint16(buffer[0:2]))
-	bodySize := int(binary.BigEndian.Uint32(buffer[2:6]))
+	bodySize := int64(binary.BigEndian.Uint32(buffer[2:6]))
 
 	if version != config.LLD_PROTOCOL_VERSION {
-		return emptyMessage, errors.New("Read a datagram with protocol " + strconv.Itoa(version) + " bytes, but our version is " + strconv.Itoa(config.LLD_PROTOCOL_VERSION) + ".")
+		return emptyMessage, errors.New("Read a datagram with protocol version " + strconv.Itoa(version) + ", but our version is " + strconv.Itoa(config.LLD_PROTOCOL_VERSION) + ".")
 	}
 
-	//read body
-	body := make([]byte, bodySize) //here we should take N into account, and keep reading if it is smaller
-	copy(body, buffer[6:])
-
-	if n < bodySize+6 {
-		return body, errors.New("Read a truncated datagram of " + strconv.Itoa(n-6) + " bytes, expected " + strconv.Itoa(bodySize) + ".")
+	//read body, which must fit in what was read
+	if bodySize > int64(n-6) {
+		body := make([]byte, n-6)
+		copy(body, buffer[6:n])
+		return body, errors.New("Read a truncated datagram of " + strconv.Itoa(n-6) + " bytes, expected " + strconv.FormatInt(bodySize, 10) + ".")
 	}
+	body := make([]byte, bodySize)
+	copy(body, buffer[6:6+bodySize])
 
 	return body, nil
 }
 
+// Reads a message within the timeout. On failure, the node's id is sent to chanForTimeoutNode
+// if the timeout expired, or to chanForDisconnectedNode otherwise.
 // return data, error
 func ReadMessageWithTimeOut(nodeId int, conn net.Conn, timeout time.Duration, chanForTimeoutNode chan int, chanForDisconnectedNode chan int) ([]byte, bool) {
 
-	//read with timeout
-	timeoutChan := make(chan bool, 1)
-	errorChan := make(chan bool, 1)
-	dataChan := make(chan []byte)
-
-	go func() {
-		time.Sleep(timeout)
-		timeoutChan <- true
-	}()
-
-	go func() {
-		dataHolder, err := ReadMessage(conn)
-
-		if err != nil {
-			errorChan <- true
-		} else {
-			dataChan <- dataHolder
-		}
-	}()
-
-	var data []byte
-	errorDuringRead := false
-	select {
-	case data = <-dataChan:
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	case <-timeoutChan:
-		errorDuringRead = true
+	data, err := ReadMessageContext(ctx, conn)
+	if err == context.DeadlineExceeded {
 		chanForTimeoutNode <- nodeId
-
-	case <-errorChan:
-		errorDuringRead = true
+		return nil, true
+	}
+	if err != nil {
 		chanForDisconnectedNode <- nodeId
+		return nil, true
 	}
-
-	return data, errorDuringRead
+	return data, false
 }
 
 // return data, error
 func ReadDatagramWithTimeOut(conn net.Conn, expectedSize int, timeout time.Duration) ([]byte, error) {
 
-	//read with timeout
-	timeoutChan := make(chan bool, 1)
-	errorChan := make(chan error, 1)
-	dataChan := make(chan []byte)
-
-	go func() {
-		time.Sleep(timeout)
-		timeoutChan <- true
-	}()
-
-	go func() {
-		dataHolder, err := ReadDatagram(conn, expectedSize)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-		if err != nil {
-			errorChan <- err
-		} else {
-			dataChan <- dataHolder
-		}
-	}()
-
-	var data []byte
-	var err error
-	select {
-	case err2 := <-errorChan:
-		err = err2
-
-	case data = <-dataChan:
-
-	case <-timeoutChan:
-		err = errors.New("ReadDatagramWithTimeOut - timeout")
+	data, err := ReadDatagramContext(ctx, conn, expectedSize)
+	if err == context.DeadlineExceeded {
+		return nil, errors.New("ReadDatagramWithTimeOut - timeout")
 	}
-
 	return data, err
 }
 
 func ParseTranscript(conn net.Conn, nClients int, nTrustees int) ([]abstract.Point, [][]abstract.Point, [][]byte, error) {
-	buffer, err := ReadMessage(conn)
+	env, err := ExpectEnvelope(conn, config.CryptoSuite, MESSAGE_TYPE_TRANSCRIPT)
 	if err != nil {
-		fmt.Println("couldn't read transcript from relay " + err.Error())
-		return nil, nil, nil, err
-	}
-
-	G_s := make([]abstract.Point, nTrustees)
-	ephPublicKeys_s := make([][]abstract.Point, nTrustees)
-	proof_s := make([][]byte, nTrustees)
-
-	//read the G_s
-	currentByte := 0
-	i := 0
-	for {
-		if currentByte+4 > len(buffer) {
-			break //we reached the end of the array
-		}
-
-		length := int(binary.BigEndian.Uint32(buffer[currentByte : currentByte+4]))
-
-		if length == 0 {
-			break //we reached the end of the array
-		}
-
-		G_S_i_Bytes := buffer[currentByte+4 : currentByte+4+length]
-
-		fmt.Println("G_S_", i)
-		fmt.Println(hex.Dump(G_S_i_Bytes))
-
-		base := config.CryptoSuite.Point()
-		err2 := base.UnmarshalBinary(G_S_i_Bytes)
-		if err2 != nil {
-			fmt.Println(">>>>can't unmarshal base n°" + strconv.Itoa(i) + " ! " + err2.Error())
-			return nil, nil, nil, err
-		}
-
-		G_s[i] = base
-		fmt.Println("Read G_S[", i, "]")
-
-		currentByte += 4 + length
-		i += 1
-
-		if i == nTrustees {
-			break
-		}
+		return nil, nil, nil, errors.New("Cannot read transcript. " + err.Error())
 	}
+	t := env.Message.(*Transcript)
 
-	//read the ephemeral public keys
-	i = 0
-	for {
-		if currentByte+4 > len(buffer) {
-			break //we reached the end of the array
-		}
-
-		length := int(binary.BigEndian.Uint32(buffer[currentByte : currentByte+4]))
-
-		if length == 0 {
-			break //we reached the end of the array
-		}
-
-		ephPublicKeysBytes := buffer[currentByte+4 : currentByte+4+length]
-
-		ephPublicKeys := make([]abstract.Point, 0)
-
-		fmt.Println("Ephemeral_PKS_", i)
-		fmt.Println(hex.Dump(ephPublicKeysBytes))
-
-		currentByte2 := 0
-		j := 0
-		for {
-			if currentByte2+4 > len(ephPublicKeysBytes) {
-				break //we reached the end of the array
-			}
-
-			length := int(binary.BigEndian.Uint32(ephPublicKeysBytes[currentByte2 : currentByte2+4]))
-
-			if length == 0 {
-				break //we reached the end of the array
-			}
-
-			ephPublicKeyIJBytes := ephPublicKeysBytes[currentByte2+4 : currentByte2+4+length]
-			ephPublicKey := config.CryptoSuite.Point()
-			err2 := ephPublicKey.UnmarshalBinary(ephPublicKeyIJBytes)
-			if err2 != nil {
-				fmt.Println(">>>>can't unmarshal public key n°" + strconv.Itoa(i) + "," + strconv.Itoa(j) + " ! " + err2.Error())
-				return nil, nil, nil, err
-			}
-
-			ephPublicKeys = append(ephPublicKeys, ephPublicKey)
-			fmt.Println("Read EphemeralPublicKey[", i, "][", j, "]")
-
-			currentByte2 += 4 + length
-			j += 1
-
-			if j == nClients {
-				break
-			}
-		}
-
-		fmt.Println("Read EphemeralPublicKey[", i, "]")
-		ephPublicKeys_s[i] = ephPublicKeys
-
-		currentByte += 4 + length
-		i += 1
-
-		if i == nTrustees {
-			break
-		}
+	if len(t.Bases) != nTrustees || len(t.EphemeralPublicKeys) != nTrustees || len(t.Proofs) != nTrustees {
+		return nil, nil, nil, errors.New("Transcript does not hold the shuffles of " + strconv.Itoa(nTrustees) + " trustees")
 	}
-
-	//read the Proofs
-	i = 0
-	for {
-		if currentByte+4 > len(buffer) {
-			break //we reached the end of the array
-		}
-
-		length := int(binary.BigEndian.Uint32(buffer[currentByte : currentByte+4]))
-
-		if length == 0 {
-			break //we reached the end of the array
-		}
-
-		proofBytes := buffer[currentByte+4 : currentByte+4+length]
-		fmt.Println("Read Proof[", i, "]")
-
-		proof_s[i] = proofBytes
-
-		currentByte += 4 + length
-		i += 1
-
-		if i == nTrustees {
-			break
+	for i, keys := range t.EphemeralPublicKeys {
+		if len(keys) > nClients {
+			return nil, nil, nil, errors.New("Transcript of trustee " + strconv.Itoa(i) + " has more than " + strconv.Itoa(nClients) + " keys")
 		}
 	}
-
-	return G_s, ephPublicKeys_s, proof_s, nil
+	return t.Bases, t.EphemeralPublicKeys, t.Proofs, nil
 }
 
 func ParsePublicKeyFromConn(conn net.Conn) (abstract.Point, error) {
-	buffer, err := ReadMessage(conn)
-
-	fmt.Print("Trying to ParsePublicKeyFromConn")
-	fmt.Println(hex.Dump(buffer))
-
+	publicKeys, err := UnMarshalPublicKeyArrayFromConnection(conn, config.CryptoSuite)
 	if err != nil {
-		fmt.Println("ParsePublicKeyFromConn : Read error:" + err.Error())
 		return nil, err
 	}
-
-	msgType := int(binary.BigEndian.Uint16(buffer[0:2]))
-
-	if msgType != MESSAGE_TYPE_PUBLICKEYS {
-		s := "ParsePublicKeyFromConn : Read error, type supposed to be " + strconv.Itoa(MESSAGE_TYPE_PUBLICKEYS) + " but is " + strconv.Itoa(msgType)
-		fmt.Println(s)
-		return nil, errors.New(s)
-	}
-
-	publicKey := config.CryptoSuite.Point()
-	err2 := publicKey.UnmarshalBinary(buffer[2:])
-
-	if err2 != nil {
-		fmt.Println("ParsePublicKeyFromConn : can't unmarshal ephemeral client key ! " + err2.Error())
-		return nil, err
+	if len(publicKeys) != 1 || publicKeys[0] == nil {
+		return nil, errors.New("Expected one public key, got " + strconv.Itoa(len(publicKeys)))
 	}
-
-	return publicKey, nil
+	return publicKeys[0], nil
 }
 
 func ParseBaseAndPublicKeysFromConn(conn net.Conn) (abstract.Point, []abstract.Point, error) {
-	buffer, err := ReadMessage(conn)
-
+	env, err := ExpectEnvelope(conn, config.CryptoSuite, MESSAGE_TYPE_BASE_AND_PUBLICKEYS)
 	if err != nil {
-		fmt.Println("ParseBaseAndPublicKeysFromConn, couldn't read. " + err.Error())
-		return nil, nil, err
-	}
-
-	baseSize := int(binary.BigEndian.Uint32(buffer[0:4]))
-	keysSize := int(binary.BigEndian.Uint32(buffer[4+baseSize : 8+baseSize]))
-
-	baseBytes := buffer[4 : 4+baseSize]
-	keysBytes := buffer[8+baseSize : 8+baseSize+keysSize]
-
-	base := config.CryptoSuite.Point()
-	err2 := base.UnmarshalBinary(baseBytes)
-	if err2 != nil {
-		fmt.Println("ParseBaseAndPublicKeysFromConn : can't unmarshal client key ! " + err2.Error())
-		return nil, nil, err2
+		return nil, nil, errors.New("Cannot read base and public keys. " + err.Error())
 	}
-
-	publicKeys, err := UnMarshalPublicKeyArrayFromByteArray(keysBytes, config.CryptoSuite)
-	if err != nil {
-		return nil, nil, err
+	msg := env.Message.(*BaseAndPublicKeys)
+	if msg.Base == nil {
+		return nil, nil, errors.New("Missing base")
 	}
-
-	return base, publicKeys, nil
+	return msg.Base, msg.Keys, nil
 }
 
 func IntToBA(x int) []byte {
@@ -392,175 +262,51 @@ func IntToBA(x int) []byte {
 }
 
 func ParseBasePublicKeysAndProofFromConn(conn net.Conn) (abstract.Point, []abstract.Point, []byte, error) {
-	buffer, err := ReadMessage(conn)
+	env, err := ExpectEnvelope(conn, config.CryptoSuite, MESSAGE_TYPE_BASE_PUBLICKEYS_AND_PROOF)
 	if err != nil {
-		fmt.Println("ParseBaseAndPublicKeysFromConn, couldn't read. " + err.Error())
-		return nil, nil, nil, err
+		return nil, nil, nil, errors.New("Cannot read base, public keys and proof. " + err.Error())
 	}
-
-	baseSize := int(binary.BigEndian.Uint32(buffer[0:4]))
-	keysSize := int(binary.BigEndian.Uint32(buffer[4+baseSize : 8+baseSize]))
-	proofSize := int(binary.BigEndian.Uint32(buffer[8+baseSize+keysSize : 12+baseSize+keysSize]))
-
-	baseBytes := buffer[4 : 4+baseSize]
-	keysBytes := buffer[8+baseSize : 8+baseSize+keysSize]
-	proof := buffer[12+baseSize+keysSize : 12+baseSize+keysSize+proofSize]
-
-	base := config.CryptoSuite.Point()
-	err2 := base.UnmarshalBinary(baseBytes)
-	if err2 != nil {
-		fmt.Println("ParseBasePublicKeysAndProofFromConn : can't unmarshal client key ! " + err2.Error())
-		return nil, nil, nil, err2
+	msg := env.Message.(*BasePublicKeysAndProof)
+	if msg.Base == nil {
+		return nil, nil, nil, errors.New("Missing base")
 	}
-
-	publicKeys, err := UnMarshalPublicKeyArrayFromByteArray(keysBytes, config.CryptoSuite)
-	if err != nil {
-		return nil, nil, nil, err
-	}
-	return base, publicKeys, proof, nil
+	return msg.Base, msg.Keys, msg.Proof, nil
 }
 
 func ParseBasePublicKeysAndTrusteeSignaturesFromConn(conn net.Conn) (abstract.Point, []abstract.Point, [][]byte, error) {
-	buffer, err := ReadMessage(conn)
+	env, err := ExpectEnvelope(conn, config.CryptoSuite, MESSAGE_TYPE_BASE_PUBLICKEYS_AND_SIGNATURES)
 	if err != nil {
-		fmt.Println("ParseBasePublicKeysAndTrusteeProofFromConn, couldn't read. " + err.Error())
-		return nil, nil, nil, err
+		return nil, nil, nil, errors.New("Cannot read base, public keys and signatures. " + err.Error())
 	}
-
-	baseSize := int(binary.BigEndian.Uint32(buffer[0:4]))
-	keysSize := int(binary.BigEndian.Uint32(buffer[4+baseSize : 8+baseSize]))
-	signaturesSize := int(binary.BigEndian.Uint32(buffer[8+baseSize+keysSize : 12+baseSize+keysSize]))
-
-	fmt.Println("Signature size", signaturesSize)
-
-	baseBytes := buffer[4 : 4+baseSize]
-	keysBytes := buffer[8+baseSize : 8+baseSize+keysSize]
-	signaturesBytes := buffer[12+baseSize+keysSize : 12+baseSize+keysSize+signaturesSize]
-
-	base := config.CryptoSuite.Point()
-	err2 := base.UnmarshalBinary(baseBytes)
-	if err2 != nil {
-		fmt.Println("ParseBasePublicKeysAndProofFromConn : can't unmarshal client key ! " + err2.Error())
-		return nil, nil, nil, err2
-	}
-
-	publicKeys, err := UnMarshalPublicKeyArrayFromByteArray(keysBytes, config.CryptoSuite)
-
-	if err != nil {
-		return nil, nil, nil, err
-	}
-
-	//now read the signatures
-	currentByte := 0
-	signatures := make([][]byte, 0)
-	i := 0
-	for {
-		if currentByte+4 > len(signaturesBytes) {
-			break //we reached the end of the array
-		}
-
-		length := int(binary.BigEndian.Uint32(signaturesBytes[currentByte : currentByte+4]))
-
-		if length == 0 {
-			break //we reached the end of the array
-		}
-
-		thisSig := signaturesBytes[currentByte+4 : currentByte+4+length]
-
-		fmt.Println("thisSig_", i)
-		fmt.Println(hex.Dump(thisSig))
-
-		signatures = append(signatures, thisSig)
-
-		currentByte += 4 + length
-		i += 1
+	msg := env.Message.(*BasePublicKeysAndSignatures)
+	if msg.Base == nil {
+		return nil, nil, nil, errors.New("Missing base")
 	}
-
-	return base, publicKeys, signatures, nil
+	return msg.Base, msg.Keys, msg.Signatures, nil
 }
 
 func WriteBaseAndPublicKeyToConn(conn net.Conn, base abstract.Point, keys []abstract.Point) error {
-
-	baseBytes, err := base.MarshalBinary()
-
-	if err != nil {
-		fmt.Println("Marshall error:" + err.Error())
-		return err
-	}
-
-	publicKeysBytes, err := MarshalPublicKeyArrayToByteArray(keys)
-
-	if err != nil {
-		return err
-	}
-
-	message := make([]byte, 8+len(baseBytes)+len(publicKeysBytes))
-
-	binary.BigEndian.PutUint32(message[0:4], uint32(len(baseBytes)))
-	copy(message[4:4+len(baseBytes)], baseBytes)
-	binary.BigEndian.PutUint32(message[4+len(baseBytes):8+len(baseBytes)], uint32(len(publicKeysBytes)))
-	copy(message[8+len(baseBytes):], publicKeysBytes)
-
-	err2 := WriteMessage(conn, message)
-	if err2 != nil {
-		fmt.Println("Write error:" + err.Error())
-		return err2
-	}
-
-	return nil
+	return writeTyped(conn, &BaseAndPublicKeys{Base: base, Keys: keys})
 }
 
 func WriteBasePublicKeysAndProofToConn(conn net.Conn, base abstract.Point, keys []abstract.Point, proof []byte) error {
-	baseBytes, err := base.MarshalBinary()
-	keysBytes, err := MarshalPublicKeyArrayToByteArray(keys)
-	if err != nil {
-		fmt.Println("Marshall error:" + err.Error())
-		return err
-	}
-
-	//compose the message
-	totalMessageLength := 12 + len(baseBytes) + len(keysBytes) + len(proof)
-	message := make([]byte, totalMessageLength)
-
-	binary.BigEndian.PutUint32(message[0:4], uint32(len(baseBytes)))
-	binary.BigEndian.PutUint32(message[4+len(baseBytes):8+len(baseBytes)], uint32(len(keysBytes)))
-	binary.BigEndian.PutUint32(message[8+len(baseBytes)+len(keysBytes):12+len(baseBytes)+len(keysBytes)], uint32(len(proof)))
-
-	copy(message[4:4+len(baseBytes)], baseBytes)
-	copy(message[8+len(baseBytes):8+len(baseBytes)+len(keysBytes)], keysBytes)
-	copy(message[12+len(baseBytes)+len(keysBytes):12+len(baseBytes)+len(keysBytes)+len(proof)], proof)
+	return writeTyped(conn, &BasePublicKeysAndProof{Base: base, Keys: keys, Proof: proof})
+}
 
-	err2 := WriteMessage(conn, message)
-	if err2 != nil {
-		fmt.Println("Write error:" + err2.Error())
-		return err2
-	}
+func WriteBasePublicKeysAndTrusteeSignaturesToConn(conn net.Conn, base abstract.Point, keys []abstract.Point, signatures [][]byte) error {
+	return writeTyped(conn, &BasePublicKeysAndSignatures{Base: base, Keys: keys, Signatures: signatures})
+}
 
-	return nil
+func WriteTranscriptToConn(conn net.Conn, bases []abstract.Point, ephPublicKeys [][]abstract.Point, proofs [][]byte) error {
+	return writeTyped(conn, &Transcript{Bases: bases, EphemeralPublicKeys: ephPublicKeys, Proofs: proofs})
 }
 
 func MarshalNodeRepresentations(nodes []NodeRepresentation) ([]byte, error) {
-	var byteArray []byte
-
-	msgType := make([]byte, 2)
-	binary.BigEndian.PutUint16(msgType, uint16(MESSAGE_TYPE_PUBLICKEYS))
-	byteArray = append(byteArray, msgType...)
-
-	for i := 0; i < len(nodes); i++ {
-		publicKeysBytes, err := nodes[i].PublicKey.MarshalBinary()
-		publicKeyLength := make([]byte, 4)
-		binary.BigEndian.PutUint32(publicKeyLength, uint32(len(publicKeysBytes)))
-
-		byteArray = append(byteArray, publicKeyLength...)
-		byteArray = append(byteArray, publicKeysBytes...)
-
-		if err != nil {
-			fmt.Println("can't marshal client public key n°" + strconv.Itoa(i))
-			return nil, errors.New("Can't unmarshall")
-		}
+	publicKeys := make([]abstract.Point, len(nodes))
+	for i := range nodes {
+		publicKeys[i] = nodes[i].PublicKey
 	}
-
-	return byteArray, nil
+	return MarshalPublicKeyArrayToByteArray(publicKeys)
 }
 
 func NUnicastMessageToNodes(nodes []NodeRepresentation, message []byte) {
@@ -569,6 +315,7 @@ func NUnicastMessageToNodes(nodes []NodeRepresentation, message []byte) {
 		if nodes[i].Connected {
 			err := WriteMessage(nodes[i].Conn, message)
 
+			// On a PeerConn, the failed write also has its ConnManager reconnect the node
 			if err != nil {
 				fmt.Println("Could not n*unicast to conn", i, "gonna set it to disconnected.")
 				nodes[i].Connected = false
@@ -592,134 +339,72 @@ func NUnicastMessage(conns []net.Conn, message []byte) error {
 }
 
 func TellPublicKey(conn net.Conn, publicKey abstract.Point) error {
-	publicKeyBytes, _ := publicKey.MarshalBinary()
-
-	err := WriteMessage(conn, publicKeyBytes)
-
-	if err != nil {
-		fmt.Println("Error writing to socket:" + err.Error())
-		return err
-	}
-
-	return nil
+	return writeTyped(conn, &PublicKeys{Keys: []abstract.Point{publicKey}})
 }
 
 func MarshalPublicKeyArrayToByteArray(publicKeys []abstract.Point) ([]byte, error) {
-	var byteArray []byte
-
-	msgType := make([]byte, 2)
-	binary.BigEndian.PutUint16(msgType, uint16(MESSAGE_TYPE_PUBLICKEYS))
-	byteArray = append(byteArray, msgType...)
-
-	for i := 0; i < len(publicKeys); i++ {
-		publicKeysBytes, err := publicKeys[i].MarshalBinary()
-		publicKeyLength := make([]byte, 4)
-		binary.BigEndian.PutUint32(publicKeyLength, uint32(len(publicKeysBytes)))
-
-		byteArray = append(byteArray, publicKeyLength...)
-		byteArray = append(byteArray, publicKeysBytes...)
-
-		//fmt.Println(hex.Dump(publicKeysBytes))
-		if err != nil {
-			fmt.Println("can't marshal client public key n°" + strconv.Itoa(i))
-			return nil, err
-		}
-	}
-
-	return byteArray, nil
+	return Encode(&Envelope{Sender: SENDER_ANONYMOUS, Message: &PublicKeys{Keys: publicKeys}})
 }
 
 func UnMarshalPublicKeyArrayFromConnection(conn net.Conn, cryptoSuite abstract.Suite) ([]abstract.Point, error) {
-	//collect the public keys from the trustees
 	buffer, err := ReadMessage(conn)
 	if err != nil {
-		fmt.Println("Read error:" + err.Error())
 		return nil, err
 	}
-
-	pks, err := UnMarshalPublicKeyArrayFromByteArray(buffer, cryptoSuite)
-	if err != nil {
-		return nil, err
-	}
-	return pks, nil
+	return UnMarshalPublicKeyArrayFromByteArray(buffer, cryptoSuite)
 }
 
 func UnMarshalPublicKeyArrayFromByteArray(buffer []byte, cryptoSuite abstract.Suite) ([]abstract.Point, error) {
-
-	//will hold the public keys
-	var publicKeys []abstract.Point
-
-	//safety check
-	messageType := int(binary.BigEndian.Uint16(buffer[0:2]))
-	if messageType != MESSAGE_TYPE_PUBLICKEYS {
-		fmt.Println("Trying to unmarshall an array, but does not start by 2")
-		return nil, errors.New("Wrong message type")
+	env, err := Decode(cryptoSuite, buffer)
+	if err != nil {
+		return nil, err
 	}
-
-	//parse message
-	currentByte := 2
-	currentPkId := 0
-	for {
-		if currentByte+4 > len(buffer) {
-			break //we reached the end of the array
-		}
-
-		keyLength := int(binary.BigEndian.Uint32(buffer[currentByte : currentByte+4]))
-
-		if keyLength == 0 {
-			break //we reached the end of the array
-		}
-
-		keyBytes := buffer[currentByte+4 : currentByte+4+keyLength]
-
-		publicKey := cryptoSuite.Point()
-		err2 := publicKey.UnmarshalBinary(keyBytes)
-		if err2 != nil {
-			fmt.Println(">>>>can't unmarshal key n°" + strconv.Itoa(currentPkId) + " ! " + err2.Error())
-			return nil, err2
-		}
-
-		publicKeys = append(publicKeys, publicKey)
-
-		currentByte += 4 + keyLength
-		currentPkId += 1
+	msg, ok := env.Message.(*PublicKeys)
+	if !ok {
+		return nil, errors.New("Expected public keys, got message type " + strconv.Itoa(int(env.Type)))
 	}
-
-	return publicKeys, nil
+	return msg.Keys, nil
 }
 
-// Marshals a sequence of byte arrays
-// Each input array MUST have less than 65K bytes
+// Marshals a sequence of byte arrays of any size, each prefixed with its length as a uvarint
 func MarshalByteArrays(arrs ...[]byte) []byte {
 	size := 0
 	for _, arr := range arrs {
-		size += len(arr) + 2
+		size += len(arr) + binary.MaxVarintLen64
 	}
 
-	i := 0
-	res := make([]byte, size)
+	res := make([]byte, 0, size)
+	lenBuf := make([]byte, binary.MaxVarintLen64)
 	for _, arr := range arrs {
-		arrlen := len(arr)
-		if arrlen > 65535 {
-			panic("Cannot marshal arrays with more than 65K bytes!")
-		}
-		binary.BigEndian.PutUint16(res[i:i+2], uint16(arrlen))
-		copy(res[i+2:i+arrlen+2], arr)
-		i += arrlen + 2
+		n := binary.PutUvarint(lenBuf, uint64(len(arr)))
+		res = append(res, lenBuf[:n]...)
+		res = append(res, arr...)
 	}
 	return res
 }
 
-// Unmarshals a sequence of byte arrays
-func UnmarshalByteArrays(input []byte) [][]byte {
+// Unmarshals a sequence of byte arrays produced by MarshalByteArrays.
+// Fails instead of panicking on truncated input, and rejects lengths that are not minimally encoded.
+func UnmarshalByteArrays(input []byte) ([][]byte, error) {
 	var arrs [][]byte
 
+	lenBuf := make([]byte, binary.MaxVarintLen64)
 	for i := 0; i < len(input); {
-		len := int(binary.BigEndian.Uint16(input[i : i+2]))
-		arr := make([]byte, len)
-		copy(arr, input[i+2:i+2+len])
+		arrlen, n := binary.Uvarint(input[i:])
+		if n == 0 {
+			return nil, errors.New("Byte array " + strconv.Itoa(len(arrs)) + " has a truncated length")
+		}
+		if n < 0 || n != binary.PutUvarint(lenBuf, arrlen) {
+			return nil, errors.New("Byte array " + strconv.Itoa(len(arrs)) + " has an invalid length")
+		}
+		i += n
+		if uint64(len(input)-i) < arrlen {
+			return nil, errors.New("Byte array " + strconv.Itoa(len(arrs)) + " is truncated")
+		}
+		arr := make([]byte, arrlen)
+		copy(arr, input[i:i+int(arrlen)])
 		arrs = append(arrs, arr)
-		i += len + 2
+		i += int(arrlen)
 	}
-	return arrs
+	return arrs, nil
 }
@@ -0,0 +1,410 @@
+package net
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/random"
+	"github.com/mahdiz/daga/config"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"net"
+	"sync"
+)
+
+// Authenticated, encrypted channel over a connection, in the style of a SIGMA / TLS 1.3 handshake:
+//
+//	initiator -> responder: label, X = g^x
+//	responder -> initiator: Y = g^y, responder's long-term key R, Sign_R("responder" | H(N, X, Y, R))
+//	initiator -> responder: [initiator's long-term key I, Sign_I("initiator" | H(N, X, Y, R) | I)], encrypted
+//
+// N holds the negotiation messages exchanged on the connection, if it was negotiated, so that the
+// responder's signature covers what was agreed; the negotiated suite must be the channel's suite.
+// Both sides derive AES-256-GCM keys from g^xy with HKDF, salted with the transcript hash.
+// The responder always authenticates. The initiator either authenticates too (relay and trustees)
+// or stays anonymous (clients), which the responder may refuse.
+// Since SecureConn is a net.Conn, WriteMessage and ReadMessage work over it unchanged, with the
+// protocol version negotiated on the underlying connection, if any (see NegotiateClient).
+
+const SECURE_HANDSHAKE_LABEL = "DAGA-SECURE-1"
+
+// Prefixes of the handshake transcripts the responder and the initiator sign
+const (
+	SECURE_RESPONDER_PREFIX = "responder"
+	SECURE_INITIATOR_PREFIX = "initiator"
+)
+
+// Largest plaintext carried by one encrypted record
+const SECURE_MAX_RECORD_SIZE = 16384
+
+// Signs handshake transcripts with a node's long-term key (see daga.KeyStore)
+type Signer interface {
+	PublicKey() abstract.Point
+	Sign(message []byte) ([]byte, error)
+}
+
+// Parameters of one side of a secure channel
+type SecureConfig struct {
+	Suite           abstract.Suite
+	Signer          Signer                               // Our long-term key, or nil to stay anonymous (initiator only)
+	VerifyPeer      func(publicKey abstract.Point) error // Accepts or rejects the peer's long-term key
+	RequirePeerAuth bool                                 // Responder only: refuse anonymous initiators
+}
+
+// Connection whose traffic is encrypted and authenticated with keys from the handshake
+type SecureConn struct {
+	net.Conn
+	peerKey   abstract.Point
+	sendAEAD  cipher.AEAD
+	recvAEAD  cipher.AEAD
+	sendSeq   uint64
+	recvSeq   uint64
+	readBuf   []byte
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+}
+
+// Returns a VerifyPeer function accepting the given keys only
+func AcceptKeys(keys ...abstract.Point) func(abstract.Point) error {
+	return func(publicKey abstract.Point) error {
+		for _, key := range keys {
+			if key != nil && key.Equal(publicKey) {
+				return nil
+			}
+		}
+		return errors.New("Peer's key is not one of the expected keys")
+	}
+}
+
+// Returns a VerifyPeer function accepting the keys with the given identifiers (see config.PublicKeyId)
+func AcceptPubIds(suite abstract.Suite, pubIds ...string) func(abstract.Point) error {
+	return func(publicKey abstract.Point) error {
+		pubId := config.PublicKeyId(suite, publicKey)
+		for _, id := range pubIds {
+			if id == pubId {
+				return nil
+			}
+		}
+		return errors.New("Peer's key " + pubId + " is not one of the expected keys")
+	}
+}
+
+// Runs the handshake as the initiator, usually the side that dialed the connection.
+// VerifyPeer must be set, since the responder always authenticates.
+func SecureClient(conn net.Conn, cfg *SecureConfig) (*SecureConn, error) {
+
+	if cfg.VerifyPeer == nil {
+		return nil, errors.New("Secure channel initiator needs a way to verify the responder's key")
+	}
+	suite := cfg.Suite
+	if err := checkAgreedSuite(conn, suite); err != nil {
+		return nil, err
+	}
+	x := suite.Scalar().Pick(random.Stream)
+	X := suite.Point().Mul(nil, x)
+	Xb, err := X.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTyped(conn, &SecureHello{Label: SECURE_HANDSHAKE_LABEL, EphemeralKey: Xb}); err != nil {
+		return nil, err
+	}
+
+	// Check the responder's key and signature
+	env, err := ExpectEnvelope(conn, suite, MESSAGE_TYPE_SECURE_REPLY)
+	if err != nil {
+		return nil, err
+	}
+	reply := env.Message.(*SecureReply)
+	Y, R := suite.Point(), suite.Point()
+	if err := Y.UnmarshalBinary(reply.EphemeralKey); err != nil {
+		return nil, errors.New("Invalid handshake key. " + err.Error())
+	}
+	if err := R.UnmarshalBinary(reply.PublicKey); err != nil {
+		return nil, errors.New("Invalid responder key. " + err.Error())
+	}
+	if err := cfg.VerifyPeer(R); err != nil {
+		return nil, err
+	}
+	th := handshakeTranscript(negotiationTranscript(conn), Xb, reply.EphemeralKey, reply.PublicKey)
+	if err := config.SchnorrVerify(suite, append([]byte(SECURE_RESPONDER_PREFIX), th...), R, reply.Signature); err != nil {
+		return nil, errors.New("Invalid responder handshake signature. " + err.Error())
+	}
+
+	c, err := newSecureConn(conn, suite.Point().Mul(Y, x), th, true)
+	if err != nil {
+		return nil, err
+	}
+	c.peerKey = R
+
+	// Authenticate ourselves, or send an empty authentication to stay anonymous
+	auth := &SecureAuth{}
+	if cfg.Signer != nil {
+		Ib, err := cfg.Signer.PublicKey().MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		sig, err := cfg.Signer.Sign(initiatorSignedBytes(th, Ib))
+		if err != nil {
+			return nil, err
+		}
+		auth.PublicKey, auth.Signature = Ib, sig
+	}
+	authBytes, err := Encode(&Envelope{Sender: SENDER_ANONYMOUS, Message: auth})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.writeRecord(authBytes); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Runs the handshake as the responder, usually the side that accepted the connection.
+// Signer must be set. VerifyPeer is applied to initiators that authenticate.
+func SecureServer(conn net.Conn, cfg *SecureConfig) (*SecureConn, error) {
+
+	if cfg.Signer == nil {
+		return nil, errors.New("Secure channel responder needs a long-term key")
+	}
+	suite := cfg.Suite
+	if err := checkAgreedSuite(conn, suite); err != nil {
+		return nil, err
+	}
+
+	env, err := ExpectEnvelope(conn, suite, MESSAGE_TYPE_SECURE_HELLO)
+	if err != nil {
+		return nil, err
+	}
+	hello := env.Message.(*SecureHello)
+	if hello.Label != SECURE_HANDSHAKE_LABEL {
+		return nil, errors.New("Peer does not speak " + SECURE_HANDSHAKE_LABEL)
+	}
+	X := suite.Point()
+	if err := X.UnmarshalBinary(hello.EphemeralKey); err != nil {
+		return nil, errors.New("Invalid handshake key. " + err.Error())
+	}
+
+	// Send our ephemeral key, long-term key and signature
+	y := suite.Scalar().Pick(random.Stream)
+	Yb, err := suite.Point().Mul(nil, y).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	Rb, err := cfg.Signer.PublicKey().MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	th := handshakeTranscript(negotiationTranscript(conn), hello.EphemeralKey, Yb, Rb)
+	sig, err := cfg.Signer.Sign(append([]byte(SECURE_RESPONDER_PREFIX), th...))
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTyped(conn, &SecureReply{EphemeralKey: Yb, PublicKey: Rb, Signature: sig}); err != nil {
+		return nil, err
+	}
+
+	c, err := newSecureConn(conn, suite.Point().Mul(X, y), th, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the initiator's authentication, if any
+	auth, err := c.readRecord()
+	if err != nil {
+		return nil, err
+	}
+	authEnv, err := Decode(suite, auth)
+	if err != nil {
+		return nil, errors.New("Malformed secure channel authentication. " + err.Error())
+	}
+	peerAuth, ok := authEnv.Message.(*SecureAuth)
+	if !ok {
+		return nil, errors.New("Malformed secure channel authentication")
+	}
+	if len(peerAuth.PublicKey) == 0 {
+		if cfg.RequirePeerAuth {
+			return nil, errors.New("Peer did not authenticate")
+		}
+		return c, nil
+	}
+	I := suite.Point()
+	if err := I.UnmarshalBinary(peerAuth.PublicKey); err != nil {
+		return nil, errors.New("Invalid initiator key. " + err.Error())
+	}
+	if cfg.VerifyPeer != nil {
+		if err := cfg.VerifyPeer(I); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.SchnorrVerify(suite, initiatorSignedBytes(th, peerAuth.PublicKey), I, peerAuth.Signature); err != nil {
+		return nil, errors.New("Invalid initiator handshake signature. " + err.Error())
+	}
+	c.peerKey = I
+	return c, nil
+}
+
+// Returns what was agreed on the underlying connection, if it was negotiated (see NegotiateClient)
+func (c *SecureConn) Agreed() (Agreement, bool) {
+	return agreement(c.Conn)
+}
+
+// Returns the peer's authenticated long-term key, or nil if the peer is anonymous
+func (c *SecureConn) PeerPublicKey() abstract.Point {
+	return c.peerKey
+}
+
+func (c *SecureConn) Read(p []byte) (int, error) {
+
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	for len(c.readBuf) == 0 {
+		record, err := c.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		c.readBuf = record
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *SecureConn) Write(p []byte) (int, error) {
+
+	written := 0
+	for written < len(p) {
+		n := len(p) - written
+		if n > SECURE_MAX_RECORD_SIZE {
+			n = SECURE_MAX_RECORD_SIZE
+		}
+		if err := c.writeRecord(p[written : written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Derives the keys of both directions from the shared secret and the transcript hash
+func newSecureConn(conn net.Conn, shared abstract.Point, th []byte, initiator bool) (*SecureConn, error) {
+
+	sharedBytes, err := shared.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sharedBytes, th, []byte("daga secure channel keys")), keys); err != nil {
+		return nil, err
+	}
+
+	initiatorAEAD, err := newRecordAEAD(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	responderAEAD, err := newRecordAEAD(keys[32:])
+	if err != nil {
+		return nil, err
+	}
+
+	c := &SecureConn{Conn: conn}
+	if initiator {
+		c.sendAEAD, c.recvAEAD = initiatorAEAD, responderAEAD
+	} else {
+		c.sendAEAD, c.recvAEAD = responderAEAD, initiatorAEAD
+	}
+	return c, nil
+}
+
+func newRecordAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Writes one record: its 4-byte length, then the plaintext sealed under the next sequence number
+func (c *SecureConn) writeRecord(plaintext []byte) error {
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(plaintext)+c.sendAEAD.Overhead()))
+	record := c.sendAEAD.Seal(header, recordNonce(c.sendSeq), plaintext, header)
+	c.sendSeq++
+
+	_, err := c.Conn.Write(record)
+	return err
+}
+
+// Reads and opens one record. Records that were changed, replayed or reordered fail to open.
+func (c *SecureConn) readRecord() ([]byte, error) {
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint32(header))
+	if length < c.recvAEAD.Overhead() || length > SECURE_MAX_RECORD_SIZE+c.recvAEAD.Overhead() {
+		return nil, errors.New("Invalid secure record length")
+	}
+	ciphertext := make([]byte, length)
+	if _, err := io.ReadFull(c.Conn, ciphertext); err != nil {
+		return nil, err
+	}
+
+	plaintext, err := c.recvAEAD.Open(ciphertext[:0], recordNonce(c.recvSeq), ciphertext, header)
+	if err != nil {
+		return nil, errors.New("Secure record failed authentication")
+	}
+	c.recvSeq++
+	return plaintext, nil
+}
+
+func recordNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// Hashes the negotiation and the handshake's public values, each prefixed by its length
+func handshakeTranscript(negotiation []byte, Xb []byte, Yb []byte, Rb []byte) []byte {
+	h := sha256.Sum256(MarshalByteArrays([]byte(SECURE_HANDSHAKE_LABEL), negotiation, Xb, Yb, Rb))
+	return h[:]
+}
+
+// Checks that the suite negotiated on a connection, if any, is the secure channel's suite
+func checkAgreedSuite(conn net.Conn, suite abstract.Suite) error {
+	if a, ok := agreement(conn); ok && a.Suite != suite.String() {
+		return errors.New("Negotiated ciphersuite " + a.Suite + ", but the secure channel uses " + suite.String())
+	}
+	return nil
+}
+
+func initiatorSignedBytes(th []byte, Ib []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(SECURE_INITIATOR_PREFIX)
+	buf.Write(th)
+	buf.Write(Ib)
+	return buf.Bytes()
+}
+
+// Checks that a message is a handshake transcript as the responder or initiator signs it,
+// for signers that refuse to sign anything else (see daga.ServeKeyStore)
+func CheckHandshakeSignedBytes(message []byte) error {
+	responder, initiator := len(SECURE_RESPONDER_PREFIX), len(SECURE_INITIATOR_PREFIX)
+	switch {
+	case len(message) == responder+sha256.Size && string(message[:responder]) == SECURE_RESPONDER_PREFIX:
+		return nil
+	case len(message) > initiator+sha256.Size && string(message[:initiator]) == SECURE_INITIATOR_PREFIX:
+		return nil
+	}
+	return errors.New("Not a secure channel handshake transcript")
+}
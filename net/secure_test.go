@@ -0,0 +1,246 @@
+package net
+
+import (
+	"bytes"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/random"
+	"github.com/mahdiz/daga/config"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+type testSigner struct {
+	private abstract.Scalar
+	public  abstract.Point
+}
+
+func newTestSigner() *testSigner {
+	suite := config.CryptoSuite
+	private := suite.Scalar().Pick(random.Stream)
+	return &testSigner{private: private, public: suite.Point().Mul(nil, private)}
+}
+
+func (s *testSigner) PublicKey() abstract.Point {
+	return s.public
+}
+
+func (s *testSigner) Sign(message []byte) ([]byte, error) {
+	return config.SchnorrSign(config.CryptoSuite, random.Stream, message, s.private)
+}
+
+// Connection remembering the last bytes written to it
+type recordingConn struct {
+	net.Conn
+	lock sync.Mutex
+	last []byte
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	c.last = append([]byte(nil), p...)
+	c.lock.Unlock()
+	return c.Conn.Write(p)
+}
+
+// Runs a handshake over a pipe, returning both ends or the error of either side
+func secureHandshake(clientCfg *SecureConfig, serverCfg *SecureConfig) (*SecureConn, *SecureConn, *recordingConn, error) {
+	a, b := net.Pipe()
+	recorder := &recordingConn{Conn: a}
+	client, server, err := secureHandshakeOver(recorder, b, clientCfg, serverCfg)
+	return client, server, recorder, err
+}
+
+func secureHandshakeOver(a net.Conn, b net.Conn, clientCfg *SecureConfig, serverCfg *SecureConfig) (*SecureConn, *SecureConn, error) {
+	type result struct {
+		conn *SecureConn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		s, err := SecureServer(b, serverCfg)
+		if err != nil {
+			b.Close()
+		}
+		done <- result{s, err}
+	}()
+	c, err := SecureClient(a, clientCfg)
+	if err != nil {
+		a.Close()
+	}
+	r := <-done
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		a.Close()
+		b.Close()
+		return nil, nil, err
+	}
+	return c, r.conn, nil
+}
+
+// Negotiates over a pipe with the given suites
+func negotiatedPair(t *testing.T, clientSuite string, serverSuite string) (*NegotiatedConn, *NegotiatedConn) {
+	a, b := net.Pipe()
+	done := make(chan *NegotiatedConn, 1)
+	go func() {
+		nc, err := NegotiateServer(b, DefaultFeatures(serverSuite, 0))
+		if err != nil {
+			t.Error(err)
+		}
+		done <- nc
+	}()
+	client, err := NegotiateClient(a, DefaultFeatures(clientSuite, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-done
+	if server == nil {
+		t.FailNow()
+	}
+	return client, server
+}
+
+func TestSecureChannel(t *testing.T) {
+	clientKey, serverKey := newTestSigner(), newTestSigner()
+	client, server, _, err := secureHandshake(
+		&SecureConfig{Suite: config.CryptoSuite, Signer: clientKey, VerifyPeer: AcceptKeys(serverKey.public)},
+		&SecureConfig{Suite: config.CryptoSuite, Signer: serverKey, VerifyPeer: AcceptKeys(clientKey.public), RequirePeerAuth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	if !client.PeerPublicKey().Equal(serverKey.public) || !server.PeerPublicKey().Equal(clientKey.public) {
+		t.Fatal("Peers are not authenticated with their keys")
+	}
+
+	// Messages larger than a record come through whole, both ways
+	msg := bytes.Repeat([]byte("daga"), SECURE_MAX_RECORD_SIZE)
+	go WriteMessage(client, msg)
+	got, err := ReadMessage(server)
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("Server read %d bytes, %v", len(got), err)
+	}
+	go WriteMessage(server, []byte("reply"))
+	got, err = ReadMessage(client)
+	if err != nil || string(got) != "reply" {
+		t.Fatalf("Client read %q, %v", got, err)
+	}
+}
+
+func TestSecureChannelAnonymous(t *testing.T) {
+	serverKey := newTestSigner()
+	clientCfg := &SecureConfig{Suite: config.CryptoSuite, VerifyPeer: AcceptKeys(serverKey.public)}
+
+	client, server, _, err := secureHandshake(clientCfg, &SecureConfig{Suite: config.CryptoSuite, Signer: serverKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.PeerPublicKey() != nil {
+		t.Fatal("Anonymous client has a key")
+	}
+	client.Close()
+	server.Close()
+
+	if _, _, _, err := secureHandshake(clientCfg, &SecureConfig{Suite: config.CryptoSuite, Signer: serverKey, RequirePeerAuth: true}); err == nil {
+		t.Fatal("Server accepted an anonymous client it requires to authenticate")
+	}
+}
+
+func TestSecureChannelRejectsKeys(t *testing.T) {
+	clientKey, serverKey, otherKey := newTestSigner(), newTestSigner(), newTestSigner()
+
+	// The client expects another responder
+	if _, _, _, err := secureHandshake(
+		&SecureConfig{Suite: config.CryptoSuite, VerifyPeer: AcceptKeys(otherKey.public)},
+		&SecureConfig{Suite: config.CryptoSuite, Signer: serverKey}); err == nil {
+		t.Fatal("Client accepted an unexpected responder")
+	}
+
+	// The server expects another initiator
+	if _, _, _, err := secureHandshake(
+		&SecureConfig{Suite: config.CryptoSuite, Signer: clientKey, VerifyPeer: AcceptKeys(serverKey.public)},
+		&SecureConfig{Suite: config.CryptoSuite, Signer: serverKey, VerifyPeer: AcceptKeys(otherKey.public)}); err == nil {
+		t.Fatal("Server accepted an unexpected initiator")
+	}
+
+	// The responder's key does not match its signature
+	if _, _, _, err := secureHandshake(
+		&SecureConfig{Suite: config.CryptoSuite, VerifyPeer: AcceptKeys(otherKey.public)},
+		&SecureConfig{Suite: config.CryptoSuite, Signer: &testSigner{private: serverKey.private, public: otherKey.public}}); err == nil {
+		t.Fatal("Client accepted a responder signing with another key")
+	}
+
+	if _, err := SecureClient(nil, &SecureConfig{Suite: config.CryptoSuite}); err == nil {
+		t.Fatal("Client ran a handshake without verifying the responder")
+	}
+	if _, err := SecureServer(nil, &SecureConfig{Suite: config.CryptoSuite}); err == nil {
+		t.Fatal("Server ran a handshake without a key")
+	}
+}
+
+// Records that are changed or replayed fail, and break the connection
+func TestSecureChannelTampering(t *testing.T) {
+	serverKey := newTestSigner()
+	for _, replay := range []bool{false, true} {
+		client, server, raw, err := secureHandshake(
+			&SecureConfig{Suite: config.CryptoSuite, VerifyPeer: AcceptKeys(serverKey.public)},
+			&SecureConfig{Suite: config.CryptoSuite, Signer: serverKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go client.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("Read %q, %v", buf, err)
+		}
+
+		record := raw.last
+		if !replay {
+			record[len(record)-1] ^= 1
+		}
+		go raw.Conn.Write(record)
+		if _, err := server.Read(buf); err == nil {
+			t.Fatalf("Read a record that was tampered with (replay %v)", replay)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// The handshake covers the negotiation, and runs with the negotiated suite only
+func TestSecureChannelNegotiation(t *testing.T) {
+	serverKey := newTestSigner()
+	clientCfg := &SecureConfig{Suite: config.CryptoSuite, VerifyPeer: AcceptKeys(serverKey.public)}
+	serverCfg := &SecureConfig{Suite: config.CryptoSuite, Signer: serverKey}
+	suite := config.CryptoSuite.String()
+
+	a, b := negotiatedPair(t, suite, suite)
+	client, server, err := secureHandshakeOver(a, b, clientCfg, serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agreed, ok := client.Agreed(); !ok || agreed.Suite != suite {
+		t.Fatalf("Secure channel reports agreement %+v, %v", agreed, ok)
+	}
+	client.Close()
+	server.Close()
+
+	// The peers saw different negotiations, e.g. because one was changed on the way
+	a, b = negotiatedPair(t, suite, suite)
+	b.transcript = append([]byte(nil), b.transcript...)
+	b.transcript[len(b.transcript)-1] ^= 1
+	if _, _, err := secureHandshakeOver(a, b, clientCfg, serverCfg); err == nil {
+		t.Fatal("Handshake succeeded over different negotiations")
+	}
+
+	a, b = negotiatedPair(t, "other suite", "other suite")
+	if _, _, err := secureHandshakeOver(a, b, clientCfg, serverCfg); err == nil {
+		t.Fatal("Handshake used another suite than the negotiated one")
+	}
+}
@@ -0,0 +1,190 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/mahdiz/daga/config"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Messages larger than a connection's maximum frame size, such as big rosters and shuffle
+// transcripts, are sent in chunks when both sides negotiated FRAMING_CHUNKED:
+//
+//	header (version, FRAME_LENGTH_CHUNKED) | uvarint(n1) chunk1 | uvarint(n2) chunk2 | ... | uvarint(0)
+//
+// Each chunk holds at most the maximum frame size, and the reassembled message at most
+// the maximum message size (see SetFrameLimits). WriteMessage and ReadMessage chunk
+// transparently, and WriteStream and ReadStream send and receive without holding the whole message.
+
+// Body length announcing a message sent in chunks
+const FRAME_LENGTH_CHUNKED = 0xffffffff
+
+// Largest chunk written, unless the connection's maximum frame size is smaller
+const STREAM_CHUNK_SIZE = 65536
+
+var (
+	maxFrameSize   = config.DEFAULT_MAX_FRAME_SIZE
+	maxMessageSize = int64(config.DEFAULT_MAX_MESSAGE_SIZE)
+)
+
+// Sets the largest frame accepted from peers, and the largest message reassembled from chunks.
+// Zero means the default (config.DEFAULT_MAX_FRAME_SIZE and config.DEFAULT_MAX_MESSAGE_SIZE).
+// Call it before opening connections.
+func SetFrameLimits(frameSize int, messageSize int) error {
+	if frameSize == 0 {
+		frameSize = config.DEFAULT_MAX_FRAME_SIZE
+	}
+	if messageSize == 0 {
+		messageSize = config.DEFAULT_MAX_MESSAGE_SIZE
+	}
+	if frameSize < config.MIN_FRAME_SIZE || int64(frameSize) >= FRAME_LENGTH_CHUNKED {
+		return errors.New("Invalid maximum frame size of " + strconv.Itoa(frameSize) + " bytes")
+	}
+	if messageSize < frameSize {
+		return errors.New("The maximum message size must be at least the maximum frame size")
+	}
+	maxFrameSize, maxMessageSize = frameSize, int64(messageSize)
+	return nil
+}
+
+// Writes the reader's content as one message sent in chunks, which ReadMessage and ReadStream read.
+// The peer must have negotiated FRAMING_CHUNKED. Returns the number of bytes sent.
+func WriteStream(conn net.Conn, r io.Reader) (int64, error) {
+	if !chunkingAgreed(conn) {
+		return 0, errors.New("Cannot stream on a connection that did not negotiate chunks")
+	}
+	unlock := lockFrames(conn)
+	defer unlock()
+	return writeChunked(conn, FrameVersion(conn), r)
+}
+
+// Reads one message, sent in one frame or in chunks, into the writer.
+// Fails once more than maxSize bytes were read. Returns the number of bytes read.
+func ReadStream(conn net.Conn, w io.Writer, maxSize int64) (int64, error) {
+
+	bodySize, err := readFrameHeader(conn, FrameVersion(conn))
+	if err != nil {
+		return 0, err
+	}
+	if bodySize == FRAME_LENGTH_CHUNKED {
+		return readChunks(conn, w, frameLimit(conn), maxSize)
+	}
+	if bodySize > maxSize {
+		return 0, errors.New("Message of " + strconv.FormatInt(bodySize, 10) + " bytes exceeds the maximum of " +
+			strconv.FormatInt(maxSize, 10) + " bytes")
+	}
+	return io.CopyN(w, conn, bodySize)
+}
+
+// Returns the largest frame a connection carries: the negotiated one, or ours
+func frameLimit(conn net.Conn) int {
+	if a, ok := agreement(conn); ok && a.MaxFrameSize > 0 {
+		return a.MaxFrameSize
+	}
+	return maxFrameSize
+}
+
+// Returns whether both sides of a connection accept messages sent in chunks
+func chunkingAgreed(conn net.Conn) bool {
+	a, ok := agreement(conn)
+	return ok && a.Framing == FRAMING_CHUNKED
+}
+
+// Writes the header of a chunked message, then the reader's content in chunks
+func writeChunked(conn net.Conn, version int, r io.Reader) (int64, error) {
+
+	chunkSize := frameLimit(conn)
+	if chunkSize > STREAM_CHUNK_SIZE {
+		chunkSize = STREAM_CHUNK_SIZE
+	}
+
+	header := make([]byte, 6)
+	binary.BigEndian.PutUint16(header[0:2], uint16(version))
+	binary.BigEndian.PutUint32(header[2:6], FRAME_LENGTH_CHUNKED)
+	if err := writeFull(conn, header); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	buffer := make([]byte, binary.MaxVarintLen64+chunkSize)
+	for {
+		n, err := io.ReadFull(r, buffer[binary.MaxVarintLen64:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return total, errors.New("Cannot read the message to send. " + err.Error())
+		}
+
+		// Put the chunk's length right before it, so that both are written at once
+		lenBuf := make([]byte, binary.MaxVarintLen64)
+		lenSize := binary.PutUvarint(lenBuf, uint64(n))
+		start := binary.MaxVarintLen64 - lenSize
+		copy(buffer[start:], lenBuf[:lenSize])
+		if werr := writeFull(conn, buffer[start:binary.MaxVarintLen64+n]); werr != nil {
+			return total, werr
+		}
+		total += int64(n)
+
+		if n == 0 {
+			return total, nil
+		}
+		if err != nil {
+			// The reader is exhausted, close the message with an empty chunk
+			return total, writeFull(conn, []byte{0})
+		}
+	}
+}
+
+// Reads the chunks of a message into the writer, up to the empty chunk ending it
+func readChunks(conn net.Conn, w io.Writer, chunkLimit int, maxSize int64) (int64, error) {
+
+	var total int64
+	r := byteReader{conn}
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return total, errors.New("Cannot read chunk length. " + err.Error())
+		}
+		if n == 0 {
+			return total, nil
+		}
+		if n > uint64(chunkLimit) {
+			return total, errors.New("Chunk of " + strconv.FormatUint(n, 10) + " bytes exceeds the maximum frame size of " +
+				strconv.Itoa(chunkLimit) + " bytes")
+		}
+		if total+int64(n) > maxSize {
+			return total, errors.New("Message exceeds the maximum of " + strconv.FormatInt(maxSize, 10) + " bytes")
+		}
+		copied, err := io.CopyN(w, conn, int64(n))
+		total += copied
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Reads a whole chunked message into memory
+func readChunkedMessage(conn net.Conn) ([]byte, error) {
+	var buffer bytes.Buffer
+	if _, err := readChunks(conn, &buffer, frameLimit(conn), maxMessageSize); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Reads one byte at a time, so that nothing past the chunk lengths is consumed
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r.Reader, b); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
@@ -32,9 +32,26 @@ const SOCKS_CONNECTION_ID_EMPTY = 0
 const IPV4_BROADCAST_ADDR = "255.255.255.255"
 const UDP_DATAGRAM_READING_MESSAGE_BUFFER_SIZE = 1024 //UDP max size is 65535. Should be BIGGER than the sent datagram (or data will be lost)
 
+// Protocol of the net package's messages (see RegisterMessage)
+const PROTOCOL_TYPE_NET = 1
+
+// Type codes of the net package's messages (see messages.go)
 const (
-	MESSAGE_TYPE_DATA = iota
+	MESSAGE_TYPE_DATA = 0x0100 + iota
 	MESSAGE_TYPE_DATA_AND_RESYNC
 	MESSAGE_TYPE_PUBLICKEYS
 	MESSAGE_TYPE_LAST_UPLOAD_FAILED
+	MESSAGE_TYPE_BASE_AND_PUBLICKEYS
+	MESSAGE_TYPE_BASE_PUBLICKEYS_AND_PROOF
+	MESSAGE_TYPE_BASE_PUBLICKEYS_AND_SIGNATURES
+	MESSAGE_TYPE_TRANSCRIPT
+	MESSAGE_TYPE_SECURE_HELLO
+	MESSAGE_TYPE_SECURE_REPLY
+	MESSAGE_TYPE_SECURE_AUTH
+	MESSAGE_TYPE_NEGOTIATE_HELLO
+	MESSAGE_TYPE_NEGOTIATE_ACCEPT
+	MESSAGE_TYPE_NEGOTIATE_REJECT
+	MESSAGE_TYPE_STREAM_OPEN
+	MESSAGE_TYPE_STREAM_WINDOW
+	MESSAGE_TYPE_STREAM_CLOSE
 )
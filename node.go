@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mahdiz/daga/config"
+	"github.com/mahdiz/daga/daga"
+	daganet "github.com/mahdiz/daga/net"
+	"net"
+	"os"
+	"time"
+)
+
+// Time the relay waits for the trustees to finish a setup
+const SETUP_TIMEOUT = 30 * time.Second
+
+// Starts the relay or trustee of a profile, and runs it until the process is stopped.
+// The private key is decrypted with the passphrase read from passphraseFile or from the
+// environment, unless the profile delegates it to a signer process (see daga keyd).
+func runNode(name string, passphraseFile string) error {
+
+	c, err := loadNodeConfig(name, passphraseFile)
+	if err != nil {
+		return err
+	}
+	keys, err := daga.OpenKeyStore(c)
+	if err != nil {
+		return err
+	}
+	if len(c.ListenAddrs) == 0 {
+		return errors.New("Profile " + name + " has no address to listen on")
+	}
+
+	switch c.Type {
+	case config.NODE_TYPE_RELAY:
+		return runRelay(c, keys)
+	case config.NODE_TYPE_TRUSTEE:
+		return runTrustee(c, keys)
+	}
+	return errors.New("Profile " + name + " is a " + c.Type + ", only relays and trustees can be started")
+}
+
+// Runs a relay: connects to the trustees listed in its config, runs the setup with them
+// every time one of them (re)connects, and serves clients. Clients are sent the
+// authentication context of every setup and roster update over the config's AnnounceAddr,
+// or over their connection to the relay.
+func runRelay(c *config.NodeConfig, keys daga.KeyStore) error {
+
+	relay := daga.NewRelayProtocol(c, keys)
+	announcer, err := daga.NewAnnouncer(c, keys)
+	if err != nil {
+		return errors.New("Cannot set up announcements. " + err.Error())
+	}
+	defer announcer.Close()
+	relay.Announcer = announcer
+
+	// A pending signal is enough for the loop to look at all trustees again,
+	// so the connection manager never waits for a setup to finish
+	up := make(chan struct{}, 1)
+	relay.ConnectTrustees(c, keys, &daganet.ManagerConfig{
+		OnUp: func(daganet.NodeRepresentation) {
+			select {
+			case up <- struct{}{}:
+			default:
+			}
+		},
+	})
+	defer relay.TrusteeConns.Close()
+
+	serve := func(conn *daganet.SecureConn) {
+		relay.ServeConn(context.Background(), conn)
+	}
+	failed := make(chan error, len(c.ListenAddrs))
+	for _, addr := range c.ListenAddrs {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		go func() { failed <- daga.ServeSecure(listener, c, keys, serve) }()
+	}
+
+	// A failed setup is tried again after SETUP_TIMEOUT
+	var retry <-chan time.Time
+	for {
+		select {
+		case err := <-failed:
+			return err
+		case <-up:
+		case <-retry:
+		}
+		retry = nil
+		if !allConnected(relay.TrusteeConns) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), SETUP_TIMEOUT)
+		err := relay.Start(ctx)
+		cancel()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Setup failed.", err)
+			retry = time.After(SETUP_TIMEOUT)
+			continue
+		}
+		fmt.Fprintln(os.Stderr, "Relay", c.Name, "set up with", len(relay.TrusteeConns.Nodes()), "trustees")
+	}
+}
+
+// Runs a trustee: connects to the other trustees, and serves the relay, the other trustees
+// and clients that connect to it
+func runTrustee(c *config.NodeConfig, keys daga.KeyStore) error {
+
+	relays := c.Peers(config.NODE_TYPE_RELAY)
+	if len(relays) == 0 {
+		return errors.New("Trustee " + c.Name + " has no relay in its config")
+	}
+	var trustees []daganet.NodeRepresentation
+	for _, info := range c.Peers(config.NODE_TYPE_TRUSTEE) {
+		node := daganet.NodeRepresentation{Id: info.Id}
+		if c.Roster != nil {
+			node.PublicKey = c.Roster.Trustees[info.Id]
+		}
+		trustees = append(trustees, node)
+	}
+	trustee := daga.NewTrusteeProtocol(c.Id, daganet.NodeRepresentation{Id: relays[0].Id}, trustees, c.AdminPublicKey, keys)
+
+	peers := trustee.ConnectTrustees(c, keys, nil)
+	defer peers.Close()
+
+	serve := func(conn *daganet.SecureConn) {
+		trustee.ServeConn(context.Background(), conn, c)
+	}
+	failed := make(chan error, len(c.ListenAddrs))
+	for _, addr := range c.ListenAddrs {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		go func() { failed <- daga.ServeSecure(listener, c, keys, serve) }()
+	}
+	fmt.Fprintln(os.Stderr, "Trustee", c.Name, "listening on", c.ListenAddrs)
+	return <-failed
+}
+
+func allConnected(m *daganet.ConnManager) bool {
+	for _, node := range m.Nodes() {
+		if !node.Connected {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dedis/crypto/random"
+	"github.com/dedis/crypto/suites"
+	"github.com/mahdiz/daga/config"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// daga roster export|import|from-keys|from-ssh|apply-handover|apply
+func rosterCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: daga roster export|import|from-keys|from-ssh|apply-handover|apply [flags]")
+	}
+	switch args[0] {
+	case "export":
+		return rosterExport(args[1:])
+	case "import":
+		return rosterImport(args[1:])
+	case "from-keys":
+		return rosterFromKeys(args[1:])
+	case "from-ssh":
+		return rosterFromSSH(args[1:])
+	case "apply-handover":
+		return rosterApplyHandover(args[1:])
+	case "apply":
+		return rosterApply(args[1:])
+	}
+	return errors.New("Unknown roster command '" + args[0] + "'")
+}
+
+// Exports a node's signed roster into a human-readable file
+func rosterExport(args []string) error {
+
+	fs := flag.NewFlagSet("roster export", flag.ExitOnError)
+	node := fs.String("node", config.DEFAULT_ADMIN_NAME, "Name of the node whose roster is exported")
+	out := fs.String("out", "", "Output file (default: standard output)")
+	format := fs.String("format", "", "Output format, toml or json (default: from the output file's extension)")
+	passphraseFile := fs.String("passphrase-file", "", "File containing the node's key passphrase (default: $"+config.PASSPHRASE_ENV+")")
+	fs.Parse(args)
+
+	c, err := loadNodeConfig(*node, *passphraseFile)
+	if err != nil {
+		return err
+	}
+	if c.Roster == nil {
+		return errors.New("Node " + *node + " has no roster")
+	}
+
+	f, err := config.ExportRoster(suites.All()[c.Suite], c.Roster, c.NodesInfo)
+	if err != nil {
+		return err
+	}
+	return writeRosterFile(f, *out, *format)
+}
+
+// Imports a human-readable roster, signs it with the administrator's key and
+// saves it into the administrator's config folder
+func rosterImport(args []string) error {
+
+	fs := flag.NewFlagSet("roster import", flag.ExitOnError)
+	in := fs.String("in", "", "Human-readable roster file to import")
+	format := fs.String("format", "", "Input format, toml or json (default: from the input file's extension)")
+	admin := fs.String("admin", config.DEFAULT_ADMIN_NAME, "Name of the administrator's config")
+	rosterOut := fs.String("roster-out", "", "Also write the signed binary roster to this file, to distribute to the nodes")
+	passphraseFile := fs.String("passphrase-file", "", "File containing the administrator's key passphrase (default: $"+config.PASSPHRASE_ENV+")")
+	fs.Parse(args)
+
+	if *in == "" {
+		return errors.New("Missing -in")
+	}
+	if *format == "" {
+		*format = config.RosterFormatFromFilename(*in)
+	}
+
+	file, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	f, err := config.ReadRosterFile(file, *format)
+	if err != nil {
+		return errors.New("Cannot read " + *in + ". " + err.Error())
+	}
+	roster, err := f.Roster()
+	if err != nil {
+		return err
+	}
+
+	adminConfig, err := loadNodeConfig(*admin, *passphraseFile)
+	if err != nil {
+		return err
+	}
+	if adminConfig.Roster != nil && roster.Version <= adminConfig.Roster.Version {
+		return errors.New("Roster version must be greater than the current version " + strconv.Itoa(adminConfig.Roster.Version))
+	}
+
+	if rosterSuite, _ := f.Suite(); rosterSuite != "" && rosterSuite != adminConfig.Suite {
+		return errors.New("The roster uses suite " + rosterSuite + ", but the administrator uses " + adminConfig.Suite)
+	}
+
+	suite := suites.All()[adminConfig.Suite]
+	if err := roster.Sign(suite, random.Stream, adminConfig.PrivateKey); err != nil {
+		return err
+	}
+
+	// Keep the nodes' names and types for later exports. Nodes already known keep their
+	// addresses, and their names unless the file gives one; nodes outside the roster are kept.
+	known := make(map[int]config.NodeInfo, len(adminConfig.NodesInfo))
+	var nodesInfo []config.NodeInfo
+	for _, info := range adminConfig.NodesInfo {
+		if info.Type == config.NODE_TYPE_CLIENT || info.Type == config.NODE_TYPE_TRUSTEE {
+			known[info.Id] = info
+		} else {
+			nodesInfo = append(nodesInfo, info)
+		}
+	}
+	for _, group := range []struct {
+		entries  []config.RosterEntry
+		nodeType string
+	}{
+		{f.Trustees, config.NODE_TYPE_TRUSTEE},
+		{f.Members, config.NODE_TYPE_CLIENT},
+	} {
+		for _, entry := range group.entries {
+			pub, _ := entry.PublicKey()
+			info := known[entry.Id]
+			info.Id, info.Type, info.Suite = entry.Id, group.nodeType, entry.Suite
+			info.PubId = config.PublicKeyId(suites.All()[entry.Suite], pub)
+			if entry.Name != "" {
+				info.Name = entry.Name
+			} else if info.Name == "" {
+				info.Name = strings.ToLower(group.nodeType) + "-" + strconv.Itoa(entry.Id)
+			}
+			nodesInfo = append(nodesInfo, info)
+		}
+	}
+	adminConfig.NodesInfo = nodesInfo
+	adminConfig.Roster = roster
+	if err := adminConfig.Save(*admin); err != nil {
+		return err
+	}
+
+	if err := writeBinaryRoster(roster, *rosterOut); err != nil {
+		return err
+	}
+
+	fmt.Println("Signed roster version", roster.Version, "with", len(roster.Clients), "members and", len(roster.Trustees), "trustees")
+	return nil
+}
+
+// Applies a node's key handover to the roster: the node keeps its id with its new key.
+// The next roster version is signed with the administrator's key and saved into the
+// administrator's config folder. Every node then installs it with daga roster apply.
+func rosterApplyHandover(args []string) error {
+
+	fs := flag.NewFlagSet("roster apply-handover", flag.ExitOnError)
+	in := fs.String("in", "", "Handover statement written by daga key rotate")
+	admin := fs.String("admin", config.DEFAULT_ADMIN_NAME, "Name of the administrator's config")
+	rosterOut := fs.String("roster-out", "", "Also write the signed binary roster to this file, to distribute to the nodes")
+	passphraseFile := fs.String("passphrase-file", "", "File containing the administrator's key passphrase (default: $"+config.PASSPHRASE_ENV+")")
+	fs.Parse(args)
+
+	if *in == "" {
+		return errors.New("Missing -in")
+	}
+	data, err := ioutil.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+	handover, err := config.UnmarshalKeyHandoverPEM(data)
+	if err != nil {
+		return errors.New("Cannot read " + *in + ". " + err.Error())
+	}
+
+	adminConfig, err := loadNodeConfig(*admin, *passphraseFile)
+	if err != nil {
+		return err
+	}
+	if adminConfig.Roster == nil {
+		return errors.New("Administrator " + *admin + " has no roster")
+	}
+	roster, err := adminConfig.Roster.ApplyHandover(handover)
+	if err != nil {
+		return err
+	}
+
+	suite := suites.All()[adminConfig.Suite]
+	if err := roster.Sign(suite, random.Stream, adminConfig.PrivateKey); err != nil {
+		return err
+	}
+	if err := adminConfig.ApplyRoster(roster); err != nil {
+		return err
+	}
+	if err := adminConfig.Save(*admin); err != nil {
+		return err
+	}
+	if err := writeBinaryRoster(roster, *rosterOut); err != nil {
+		return err
+	}
+
+	fmt.Println("Signed roster version", roster.Version, "with the new key", handover.NewPubId(), "of", handover.Type, handover.Id)
+	return nil
+}
+
+// Installs a new signed roster, such as one written by apply-handover, into a node's config.
+// The node's own roster may already disagree with its key, if the key was just rotated.
+func rosterApply(args []string) error {
+
+	fs := flag.NewFlagSet("roster apply", flag.ExitOnError)
+	node := fs.String("node", "", "Name of the node that installs the roster")
+	in := fs.String("in", "", "Signed binary roster, written with -roster-out")
+	passphraseFile := fs.String("passphrase-file", "", "File containing the node's key passphrase (default: $"+config.PASSPHRASE_ENV+")")
+	fs.Parse(args)
+
+	if *node == "" || *in == "" {
+		return errors.New("Usage: daga roster apply -node <name> -in <roster>")
+	}
+	passphrase, err := config.ReadPassphrase(*passphraseFile)
+	if err != nil {
+		return errors.New("Cannot read passphrase. " + err.Error())
+	}
+	c := &config.NodeConfig{}
+	c.SetPassphrase(passphrase)
+	if err := c.Load(*node); err != nil {
+		errs, ok := err.(config.ConfigErrors)
+		if !ok {
+			return err
+		}
+		for _, e := range errs {
+			if e.Kind != config.CONFIG_ERROR_ROSTER {
+				return err
+			}
+		}
+	}
+
+	rosterBytes, err := ioutil.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+	roster, err := config.UnmarshalRoster(suites.All()[c.Suite], rosterBytes)
+	if err != nil {
+		return errors.New("Cannot read " + *in + ". " + err.Error())
+	}
+	if err := c.ApplyRoster(roster); err != nil {
+		return err
+	}
+	if err := c.Save(*node); err != nil {
+		return err
+	}
+
+	fmt.Println("Installed roster version", roster.Version, "into", *node)
+	return nil
+}
+
+// Builds a human-readable roster from a folder of per-node public key files
+func rosterFromKeys(args []string) error {
+
+	fs := flag.NewFlagSet("roster from-keys", flag.ExitOnError)
+	dir := fs.String("dir", ".", "Folder containing the nodes' .pub files")
+	out := fs.String("out", "", "Output file (default: standard output)")
+	format := fs.String("format", "", "Output format, toml or json (default: from the output file's extension)")
+	fs.Parse(args)
+
+	f, err := config.RosterFromKeyDir(*dir)
+	if err != nil {
+		return err
+	}
+	return writeRosterFile(f, *out, *format)
+}
+
+// Adds members with existing OpenSSH Ed25519 public keys to a human-readable roster.
+// The roster must then be signed with daga roster import.
+func rosterFromSSH(args []string) error {
+
+	fs := flag.NewFlagSet("roster from-ssh", flag.ExitOnError)
+	in := fs.String("in", "", "File of OpenSSH public keys, one per line as in authorized_keys")
+	base := fs.String("roster", "", "Human-readable roster to add the members to (default: a new roster)")
+	nodeType := fs.String("type", config.NODE_TYPE_CLIENT, "Type of the added nodes, Client or Trustee")
+	firstId := fs.Int("first-id", 0, "Id of the first added node (default: after the roster's largest id)")
+	out := fs.String("out", "", "Output file (default: standard output)")
+	format := fs.String("format", "", "Output format, toml or json (default: from the output file's extension)")
+	fs.Parse(args)
+
+	if *in == "" {
+		return errors.New("Missing -in")
+	}
+	if *nodeType != config.NODE_TYPE_CLIENT && *nodeType != config.NODE_TYPE_TRUSTEE {
+		return errors.New("Node type must be " + config.NODE_TYPE_CLIENT + " or " + config.NODE_TYPE_TRUSTEE)
+	}
+
+	f := &config.RosterFile{Version: 1}
+	if *base != "" {
+		file, err := os.Open(*base)
+		if err != nil {
+			return err
+		}
+		f, err = config.ReadRosterFile(file, config.RosterFormatFromFilename(*base))
+		file.Close()
+		if err != nil {
+			return errors.New("Cannot read " + *base + ". " + err.Error())
+		}
+	}
+
+	// Imported keys are on the Ed25519 suite, and a roster has a single suite
+	if suite, err := f.Suite(); err != nil {
+		return err
+	} else if suite != "" && suite != config.ED25519_SUITE {
+		return errors.New("The roster uses suite " + suite + ", SSH keys can only be added to " + config.ED25519_SUITE + " rosters")
+	}
+
+	if *firstId == 0 {
+		*firstId = 1
+		for _, entry := range append(append([]config.RosterEntry{}, f.Members...), f.Trustees...) {
+			if entry.Id >= *firstId {
+				*firstId = entry.Id + 1
+			}
+		}
+	}
+
+	data, err := ioutil.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+	entries, err := config.RosterEntriesFromSSH(data, *firstId, *nodeType)
+	if err != nil {
+		return errors.New(*in + ": " + err.Error())
+	}
+	if *nodeType == config.NODE_TYPE_CLIENT {
+		f.Members = append(f.Members, entries...)
+	} else {
+		f.Trustees = append(f.Trustees, entries...)
+	}
+
+	// Check the result, e.g. for keys that are already in the roster
+	if _, err := f.Roster(); err != nil {
+		return err
+	}
+	return writeRosterFile(f, *out, *format)
+}
+
+// Writes a human-readable roster to a file, or to the standard output if no file is given
+func writeRosterFile(f *config.RosterFile, out string, format string) error {
+
+	if format == "" {
+		format = config.RosterFormatFromFilename(out)
+	}
+	if out == "" {
+		return config.WriteRosterFile(os.Stdout, f, format)
+	}
+
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return config.WriteRosterFile(file, f, format)
+}
+
+// Writes a signed roster in binary form, if a file is given
+func writeBinaryRoster(roster *config.Roster, out string) error {
+	if out == "" {
+		return nil
+	}
+	rosterBytes, err := roster.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(out, rosterBytes, 0644)
+}